@@ -0,0 +1,468 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:        "anomalies",
+		Usage:       "anomalies [HOURS]",
+		Description: "Detect anomalies in the last HOURS complete hours (default 24), store and print them.",
+		Run:         runAnomaliesCommand,
+	})
+}
+
+type AnomalyScope string
+
+// The attacks are counted per hour for all sources together, per source and per sensor.
+// Sensors are the destination IPs of the attacks, like in the liveness monitoring.
+const (
+	AnomalyScopeTotal  AnomalyScope = "total"
+	AnomalyScopeSource AnomalyScope = "source"
+	AnomalyScopeSensor AnomalyScope = "sensor"
+)
+
+const (
+	// minAnomalyWeeks is the number of weeks with attacks a baseline needs at least.
+	minAnomalyWeeks = 2
+	// anomalyCatchUpHours is how many past hours are checked on startup.
+	anomalyCatchUpHours = 24
+	// anomalyDelay is how long the detection waits after the end of an hour, so late attacks are counted.
+	anomalyDelay = 5 * time.Minute
+)
+
+// Anomaly is an hour in which the attacks deviated from the baseline of the same hour of the week.
+type Anomaly struct {
+	ID    int64        `json:"id"`
+	Scope AnomalyScope `json:"scope"`
+	// Key is the source or destination IP, empty for the total.
+	Key     string    `json:"key"`
+	Hour    time.Time `json:"hour"`
+	Attacks int       `json:"attacks"`
+	// Baseline is the median of the attacks in the same hour of the week in the weeks before.
+	Baseline float64 `json:"baseline"`
+	// MAD is the median absolute deviation of those weeks from the baseline.
+	MAD float64 `json:"mad"`
+	// Score is the deviation from the baseline in robust standard deviations, negative for drops.
+	Score    float64   `json:"score"`
+	Weeks    int       `json:"weeks"`
+	Detected time.Time `json:"detected"`
+}
+
+// Text describes the anomaly for alerts.
+func (a Anomaly) Text() string {
+	var subject string
+	switch a.Scope {
+	case AnomalyScopeSource:
+		subject = fmt.Sprintf("Source %s made", a.Key)
+	case AnomalyScopeSensor:
+		subject = fmt.Sprintf("Sensor %s received", a.Key)
+	default:
+		subject = "All sources made"
+	}
+	direction := "above"
+	if a.Score < 0 {
+		direction = "below"
+	}
+	hour := a.Hour.In(reportLocation())
+	return fmt.Sprintf("%s %d attacks between %s and %s, %s the baseline of %.1f for this hour of the week (score %+.1f).",
+		subject, a.Attacks, hour.Format("2006-01-02 15:04"), hour.Add(time.Hour).Format("15:04"), direction, a.Baseline, a.Score)
+}
+
+var metricAnomalies = newCounter("netwatch_proxy_anomalies_total",
+	"Anomalies detected in the hourly attack volume.", "scope")
+
+type anomalyKey struct {
+	scope AnomalyScope
+	key   string
+}
+
+// startOfHour returns the start of the hour of t in the reporting timezone.
+// Timezones whose offset is not a whole hour start their hours in the middle of a UTC hour.
+func startOfHour(t time.Time) time.Time {
+	t = t.In(reportLocation())
+	return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+}
+
+// hourlyCounts counts the attacks between from and to in every scope.
+// The total is always counted, sources and sensors only if they attacked or were attacked.
+func hourlyCounts(db *sql.DB, from, to time.Time) (map[anomalyKey]int, error) {
+	rows, err := db.Query(`SELECT 'total', '', COUNT(*)
+		FROM "_attacks"
+		WHERE "timestamp" >= ?1 AND "timestamp" < ?2
+		UNION ALL
+		SELECT 'source', "_dict_source_ips"."value", COUNT(*)
+		FROM "_attacks"
+		JOIN "_dict_source_ips" ON "_attacks"."source_ip" = "_dict_source_ips"."id"
+		WHERE "timestamp" >= ?1 AND "timestamp" < ?2
+		GROUP BY "_attacks"."source_ip"
+		UNION ALL
+		SELECT 'sensor', "_dict_destination_ips"."value", COUNT(*)
+		FROM "_attacks"
+		JOIN "_dict_destination_ips" ON "_attacks"."destination_ip" = "_dict_destination_ips"."id"
+		WHERE "timestamp" >= ?1 AND "timestamp" < ?2
+		GROUP BY "_attacks"."destination_ip"`, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("could not count attacks: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[anomalyKey]int)
+	for rows.Next() {
+		var key anomalyKey
+		var count int
+		if err := rows.Scan(&key.scope, &key.key, &count); err != nil {
+			return nil, fmt.Errorf("could not scan attack count: %w", err)
+		}
+		counts[key] = count
+	}
+	return counts, rows.Err()
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		return sorted[middle]
+	}
+	return (sorted[middle-1] + sorted[middle]) / 2
+}
+
+// seasonalBaseline returns the median of the counts and their median absolute deviation from it.
+func seasonalBaseline(counts []float64) (baseline, mad float64) {
+	baseline = median(counts)
+	deviations := make([]float64, len(counts))
+	for i, count := range counts {
+		deviations[i] = math.Abs(count - baseline)
+	}
+	return baseline, median(deviations)
+}
+
+// anomalyScore is the modified z-score of the count, the MAD scaled to the standard deviation of a normal distribution.
+// A steady history has no deviation at all, so the scale is at least the square root of the baseline,
+// the standard deviation of attacks arriving at random, and at least one attack.
+func anomalyScore(count int, baseline, mad float64) float64 {
+	scale := max(1.4826*mad, math.Sqrt(baseline), 1)
+	return (float64(count) - baseline) / scale
+}
+
+// detectAnomalies compares the attacks of the hour against the same hour of the week in the weeks before.
+// Hours without enough history have no baseline and no anomalies.
+// A source that stops attacking is not unusual, so drops are only reported for the total and the sensors.
+func detectAnomalies(db *sql.DB, hour, now time.Time) ([]Anomaly, error) {
+	var earliest sql.NullInt64
+	if err := db.QueryRow(`SELECT MIN("timestamp") FROM "_attacks"`).Scan(&earliest); err != nil {
+		return nil, fmt.Errorf("could not find the first attack: %w", err)
+	}
+	if !earliest.Valid {
+		return nil, nil
+	}
+
+	var history []map[anomalyKey]int
+	for week := 1; week <= appConfig.AnomalyWeeks; week++ {
+		// AddDate keeps the time of day, so the hour of the week stays the same across daylight saving time.
+		from := hour.AddDate(0, 0, -7*week)
+		if from.UnixMilli() < earliest.Int64 {
+			break
+		}
+		counts, err := hourlyCounts(db, from, from.Add(time.Hour))
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, counts)
+	}
+	if len(history) < minAnomalyWeeks {
+		return nil, nil
+	}
+
+	current, err := hourlyCounts(db, hour, hour.Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[anomalyKey]bool)
+	for key := range current {
+		keys[key] = true
+	}
+	for _, counts := range history {
+		for key := range counts {
+			if key.scope != AnomalyScopeSource {
+				keys[key] = true
+			}
+		}
+	}
+
+	var anomalies []Anomaly
+	for key := range keys {
+		counts := make([]float64, len(history))
+		for i, week := range history {
+			counts[i] = float64(week[key])
+		}
+		baseline, mad := seasonalBaseline(counts)
+		attacks := current[key]
+		score := anomalyScore(attacks, baseline, mad)
+
+		spike := score >= appConfig.AnomalyThreshold && attacks >= appConfig.AnomalyMinAttacks
+		drop := score <= -appConfig.AnomalyThreshold && baseline >= float64(appConfig.AnomalyMinAttacks) && key.scope != AnomalyScopeSource
+		if !spike && !drop {
+			continue
+		}
+		anomalies = append(anomalies, Anomaly{
+			Scope:    key.scope,
+			Key:      key.key,
+			Hour:     hour,
+			Attacks:  attacks,
+			Baseline: baseline,
+			MAD:      mad,
+			Score:    score,
+			Weeks:    len(history),
+			Detected: now,
+		})
+	}
+
+	// The total first, then the sources and the sensors, each by the size of the deviation.
+	slices.SortFunc(anomalies, func(a, b Anomaly) int {
+		if a.Scope != b.Scope {
+			return strings.Compare(string(b.Scope), string(a.Scope))
+		}
+		if c := -cmpFloat(math.Abs(a.Score), math.Abs(b.Score)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return anomalies, nil
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// saveAnomalies stores the anomalies and returns the ones that were not stored before.
+func saveAnomalies(db *sql.DB, anomalies []Anomaly) ([]Anomaly, error) {
+	if len(anomalies) == 0 {
+		return nil, nil
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO "_anomalies" ("scope", "key", "hour", "attacks", "baseline", "mad", "score", "weeks", "detected")
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT ("hour", "scope", "key") DO NOTHING`)
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	var stored []Anomaly
+	for _, anomaly := range anomalies {
+		result, err := stmt.Exec(anomaly.Scope, anomaly.Key, anomaly.Hour.UnixMilli(), anomaly.Attacks,
+			anomaly.Baseline, anomaly.MAD, anomaly.Score, anomaly.Weeks, anomaly.Detected.UnixMilli())
+		if err != nil {
+			return nil, fmt.Errorf("could not insert anomaly: %w", err)
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+		if anomaly.ID, err = result.LastInsertId(); err != nil {
+			return nil, fmt.Errorf("could not get anomaly id: %w", err)
+		}
+		stored = append(stored, anomaly)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("could not commit anomalies: %w", err)
+	}
+	return stored, nil
+}
+
+// checkAnomalies detects and stores the anomalies of the hour and alerts about the new ones.
+func checkAnomalies(db *sql.DB, hour, now time.Time) error {
+	anomalies, err := detectAnomalies(db, hour, now)
+	if err != nil {
+		return err
+	}
+	stored, err := saveAnomalies(db, anomalies)
+	if err != nil {
+		return err
+	}
+	for _, anomaly := range stored {
+		metricAnomalies.Inc(string(anomaly.Scope))
+		log.Printf("[WARN] Anomaly: %s\n", logSafe(anomaly.Text()))
+		notifier.OnAnomaly(anomaly)
+	}
+	return nil
+}
+
+// runAnomalyDetection checks every hour once it is complete. On startup it catches up on the last hours,
+// the anomalies that were already stored are not reported again.
+func runAnomalyDetection(db *sql.DB) {
+	next := startOfHour(time.Now().Add(-anomalyDelay)).Add(-anomalyCatchUpHours * time.Hour)
+	for {
+		last := startOfHour(time.Now().Add(-anomalyDelay)).Add(-time.Hour)
+		for ; !next.After(last); next = next.Add(time.Hour) {
+			if err := checkAnomalies(db, next, time.Now()); err != nil {
+				log.Printf("[ERROR] Failed to detect anomalies: %v\n", err)
+			}
+		}
+		time.Sleep(time.Until(next.Add(time.Hour + anomalyDelay)))
+	}
+}
+
+// listAnomalies returns the anomalies of the hours since the given time, the newest first.
+// An empty scope returns every scope.
+func listAnomalies(db *sql.DB, scope AnomalyScope, since time.Time, limit int) ([]Anomaly, error) {
+	rows, err := db.Query(`SELECT "id", "scope", "key", "hour", "attacks", "baseline", "mad", "score", "weeks", "detected"
+		FROM "_anomalies"
+		WHERE "hour" >= ?1 AND (?2 = '' OR "scope" = ?2)
+		ORDER BY "hour" DESC, abs("score") DESC
+		LIMIT ?3`, since.UnixMilli(), scope, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not query anomalies: %w", err)
+	}
+	defer rows.Close()
+
+	anomalies := []Anomaly{}
+	for rows.Next() {
+		var anomaly Anomaly
+		var hour, detected int64
+		if err := rows.Scan(&anomaly.ID, &anomaly.Scope, &anomaly.Key, &hour, &anomaly.Attacks,
+			&anomaly.Baseline, &anomaly.MAD, &anomaly.Score, &anomaly.Weeks, &detected); err != nil {
+			return nil, fmt.Errorf("could not scan anomaly: %w", err)
+		}
+		anomaly.Hour = time.UnixMilli(hour).In(reportLocation())
+		anomaly.Detected = time.UnixMilli(detected).In(reportLocation())
+		anomalies = append(anomalies, anomaly)
+	}
+	return anomalies, rows.Err()
+}
+
+func parseAnomalyScope(s string) (AnomalyScope, error) {
+	switch scope := AnomalyScope(s); scope {
+	case "", AnomalyScopeTotal, AnomalyScopeSource, AnomalyScopeSensor:
+		return scope, nil
+	}
+	return "", fmt.Errorf("unknown scope %q, expected total, source or sensor", s)
+}
+
+// handleAnomalies returns the stored anomalies as JSON.
+// The query parameters scope, since (like 24h or 7d, default 7d) and limit (default 100) filter them.
+func handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdminToken(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	scope, err := parseAnomalyScope(query.Get("scope"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	since := 7 * 24 * time.Hour
+	if s := query.Get("since"); s != "" {
+		if since, err = parseReportDuration(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 100
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 || limit > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	anomalies, err := listAnomalies(db, scope, time.Now().Add(-since), limit)
+	if err != nil {
+		log.Printf("[ERROR] Failed to list anomalies: %v\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"threshold":   appConfig.AnomalyThreshold,
+		"weeks":       appConfig.AnomalyWeeks,
+		"min_attacks": appConfig.AnomalyMinAttacks,
+		"anomalies":   anomalies,
+	})
+}
+
+func runAnomaliesCommand(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: anomalies [HOURS]")
+	}
+	hours := anomalyCatchUpHours
+	if len(args) == 1 {
+		var err error
+		if hours, err = strconv.Atoi(args[0]); err != nil || hours <= 0 {
+			return fmt.Errorf("%q is not a positive number of hours", args[0])
+		}
+	}
+	if appConfig.AnomalyThreshold <= 0 {
+		return fmt.Errorf("anomaly detection is disabled, set NETWATCH_PROXY_ANOMALY_THRESHOLD")
+	}
+
+	if err := openDB(appConfig.DatabasePath); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	now := time.Now()
+	last := startOfHour(now).Add(-time.Hour)
+	first := last.Add(-time.Duration(hours-1) * time.Hour)
+	for hour := first; !hour.After(last); hour = hour.Add(time.Hour) {
+		anomalies, err := detectAnomalies(db, hour, now)
+		if err != nil {
+			return err
+		}
+		if _, err := saveAnomalies(db, anomalies); err != nil {
+			return err
+		}
+	}
+
+	anomalies, err := listAnomalies(db, "", first, math.MaxInt32)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOUR\tSCOPE\tKEY\tATTACKS\tBASELINE\tMAD\tSCORE")
+	for _, anomaly := range anomalies {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%.1f\t%.1f\t%+.1f\n", anomaly.Hour.Format("2006-01-02 15:04"), anomaly.Scope,
+			logSafe(anomaly.Key), anomaly.Attacks, anomaly.Baseline, anomaly.MAD, anomaly.Score)
+	}
+	w.Flush()
+	fmt.Printf("%d anomalies in the last %d hours.\n", len(anomalies), hours)
+	return nil
+}
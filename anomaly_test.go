@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSeasonalBaseline(t *testing.T) {
+	tests := []struct {
+		counts       []float64
+		baseline     float64
+		mad          float64
+		count        int
+		wantScoreMin float64
+		wantScoreMax float64
+	}{
+		{[]float64{10, 12, 11, 100}, 11.5, 1, 12, 0, 0.2},
+		{[]float64{0, 0, 0, 0}, 0, 0, 50, 50, 50},
+		{[]float64{100, 100, 100}, 100, 0, 50, -5, -5},
+		{[]float64{20, 40, 60}, 40, 20, 100, 2, 2.1},
+	}
+
+	for _, test := range tests {
+		baseline, mad := seasonalBaseline(test.counts)
+		if baseline != test.baseline || mad != test.mad {
+			t.Errorf("seasonalBaseline(%v) = %v, %v, want %v, %v", test.counts, baseline, mad, test.baseline, test.mad)
+		}
+		score := anomalyScore(test.count, baseline, mad)
+		if score < test.wantScoreMin || score > test.wantScoreMax {
+			t.Errorf("anomalyScore(%d, %v, %v) = %v, want %v to %v", test.count, baseline, mad, score, test.wantScoreMin, test.wantScoreMax)
+		}
+	}
+}
+
+func TestStartOfHour(t *testing.T) {
+	setupTest(t)
+	setReportTimezone(t, loadLocation(t, "Asia/Kolkata"))
+
+	got := startOfHour(time.Date(2025, 3, 12, 9, 10, 11, 12, time.UTC))
+	want := time.Date(2025, 3, 12, 8, 30, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// hourAttacks returns n attacks of the source on the sensor within the hour.
+func hourAttacks(hour time.Time, n int, source, sensor string) []*Attack {
+	attacks := make([]*Attack, n)
+	for i := range attacks {
+		attacks[i] = newAttack(source, "root", fmt.Sprintf("password%d", i), hour.Add(time.Duration(i)*30*time.Second))
+		attacks[i].DestinationIP = sensor
+	}
+	return attacks
+}
+
+// saveAnomalyHistory saves four weeks of steady attacks at the hour of the week and an hour that deviates from them:
+// a new source attacks the first sensor much more than usual and the second sensor receives nothing.
+func saveAnomalyHistory(t *testing.T, hour time.Time) {
+	t.Helper()
+
+	for week, counts := range [][2]int{{5, 24}, {5, 25}, {6, 26}, {5, 25}} {
+		from := hour.AddDate(0, 0, -7*(week+1))
+		saveAttacks(t, hourAttacks(from, counts[0], "198.51.100.1", "203.0.113.10"))
+		saveAttacks(t, hourAttacks(from.Add(time.Second), counts[1], "198.51.100.2", "203.0.113.11"))
+	}
+	saveAttacks(t, hourAttacks(hour, 60, "198.51.100.66", "203.0.113.10"))
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	setupTest(t)
+	hour := time.Date(2025, 3, 12, 14, 0, 0, 0, time.UTC)
+	saveAnomalyHistory(t, hour)
+	now := hour.Add(2 * time.Hour)
+
+	anomalies, err := detectAnomalies(db, hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		scope    AnomalyScope
+		key      string
+		attacks  int
+		baseline float64
+		drop     bool
+	}{
+		{AnomalyScopeTotal, "", 60, 30, false},
+		{AnomalyScopeSource, "198.51.100.66", 60, 0, false},
+		{AnomalyScopeSensor, "203.0.113.10", 60, 5, false},
+		{AnomalyScopeSensor, "203.0.113.11", 0, 25, true},
+	}
+	if len(anomalies) != len(want) {
+		t.Fatalf("got anomalies %+v, want %d", anomalies, len(want))
+	}
+	for i, want := range want {
+		got := anomalies[i]
+		if got.Scope != want.scope || got.Key != want.key || got.Attacks != want.attacks || got.Baseline != want.baseline ||
+			(got.Score < 0) != want.drop || math.Abs(got.Score) < appConfig.AnomalyThreshold || got.Weeks != 4 {
+			t.Errorf("got anomaly %+v, want %+v", got, want)
+		}
+	}
+
+	// The hours around it are as usual or have no history.
+	for _, other := range []time.Time{hour.Add(-time.Hour), hour.AddDate(0, 0, -14)} {
+		anomalies, err := detectAnomalies(db, other, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(anomalies) != 0 {
+			t.Errorf("%s: got anomalies %+v, want none", other, anomalies)
+		}
+	}
+
+	// A higher minimum ignores the small spikes.
+	appConfig.AnomalyMinAttacks = 61
+	anomalies, err = detectAnomalies(db, hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anomalies) != 0 {
+		t.Errorf("got anomalies %+v with a minimum of 61 attacks, want none", anomalies)
+	}
+}
+
+func TestCheckAnomalies(t *testing.T) {
+	setupTest(t)
+	hour := time.Date(2025, 3, 12, 14, 0, 0, 0, time.UTC)
+	saveAnomalyHistory(t, hour)
+
+	events := make(chan NotifyEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event NotifyEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events <- event
+	}))
+	t.Cleanup(hook.Close)
+
+	var err error
+	notifier, err = newNotifier(&NotifyConfig{Webhooks: []WebhookConfig{{Name: "test", URL: hook.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go notifier.deliver()
+	t.Cleanup(func() {
+		close(notifier.events)
+		notifier = nil
+	})
+
+	before := metricAnomalies.Get(string(AnomalyScopeSensor))
+	if err := checkAnomalies(db, hour, hour.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := metricAnomalies.Get(string(AnomalyScopeSensor)) - before; got != 2 {
+		t.Errorf("got %v sensor anomalies, want 2", got)
+	}
+
+	received := make(map[string]NotifyEvent)
+	for range 4 {
+		select {
+		case event := <-events:
+			received[event.Key] = event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d events, want 4", len(received))
+		}
+	}
+	key := fmt.Sprintf("sensor:203.0.113.11:%d", hour.UnixMilli())
+	if event := received[key]; event.Event != "anomaly_drop" || event.Rule != "anomaly" ||
+		event.Text != "Sensor 203.0.113.11 received 0 attacks between 2025-03-12 14:00 and 15:00, below the baseline of 25.0 for this hour of the week (score -5.0)." {
+		t.Errorf("got event %+v for %s", event, key)
+	}
+
+	// Checking the hour again finds the same anomalies, which were already reported.
+	if err := checkAnomalies(db, hour, hour.Add(3*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("got event %+v for a known anomaly", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+	compareRows(t, queryRows(t, `SELECT COUNT(1) FROM "_anomalies"`), [][]string{{"4"}})
+}
+
+func TestAnomaliesView(t *testing.T) {
+	setupTest(t)
+	setReportTimezone(t, loadLocation(t, "Asia/Kolkata"))
+	hour := time.Date(2025, 3, 12, 20, 0, 0, 0, reportLocation())
+	saveAnomalyHistory(t, hour)
+	if err := checkAnomalies(db, hour, hour.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	compareRows(t, queryRows(t, `SELECT * FROM "view_anomalies"`), [][]string{
+		{"1", "2025-03-12 20:00:00", "total", "", "60", "30", "0.5", "5.5", "4", "2025-03-12 22:00:00"},
+		{"2", "2025-03-12 20:00:00", "source", "198.51.100.66", "60", "0", "0", "60", "4", "2025-03-12 22:00:00"},
+		{"4", "2025-03-12 20:00:00", "sensor", "203.0.113.11", "0", "25", "0.5", "-5", "4", "2025-03-12 22:00:00"},
+		{"3", "2025-03-12 20:00:00", "sensor", "203.0.113.10", "60", "5", "0", "24.6", "4", "2025-03-12 22:00:00"},
+	})
+}
+
+func TestAnomaliesAPI(t *testing.T) {
+	setupTest(t)
+	hour := startOfHour(time.Now()).Add(-time.Hour)
+	saveAnomalyHistory(t, hour)
+	if err := checkAnomalies(db, hour, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		want   int
+	}{
+		{"", http.StatusOK, 4},
+		{"?scope=sensor", http.StatusOK, 2},
+		{"?scope=source&since=24h", http.StatusOK, 1},
+		{"?limit=1", http.StatusOK, 1},
+		{"?since=1m", http.StatusOK, 0},
+		{"?scope=country", http.StatusBadRequest, 0},
+		{"?since=yesterday", http.StatusBadRequest, 0},
+		{"?limit=0", http.StatusBadRequest, 0},
+	}
+	appConfig.AdminToken = "secret"
+	recorder := httptest.NewRecorder()
+	handleAnomalies(recorder, httptest.NewRequest(http.MethodGet, "/_proxy/anomalies", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d without the admin token, want 401", recorder.Code)
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/_proxy/anomalies"+test.query, nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		handleAnomalies(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.query, recorder.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		var response struct {
+			Anomalies []Anomaly `json:"anomalies"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Anomalies) != test.want {
+			t.Errorf("%s: got %d anomalies, want %d", test.query, len(response.Anomalies), test.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:        "backup",
+		Usage:       "backup [PATH]",
+		Description: "Take an online backup of the database, to PATH or rotated in the backup directory.",
+		Run:         runBackupCommand,
+	})
+}
+
+// BackupKind is the reason a backup is taken. Backups of each kind are rotated separately.
+type BackupKind string
+
+const (
+	BackupManual       BackupKind = "manual"
+	BackupScheduled    BackupKind = "scheduled"
+	BackupPreMigration BackupKind = "pre-migration"
+)
+
+// backupTimeLayout sorts the backups of a kind by their names.
+const backupTimeLayout = "20060102-150405"
+
+var (
+	metricBackups = newCounter("netwatch_proxy_backups_total",
+		"Database backups taken.", "kind", "result")
+	metricBackupLastSuccess = newGauge("netwatch_proxy_backup_last_success_timestamp_seconds",
+		"Unix time of the last successful database backup.", "kind")
+)
+
+// backupDatabase copies the database to path with VACUUM INTO, which works while other connections write.
+// The copy is written to a temporary file first, so path only ever holds a complete backup.
+func backupDatabase(db *sql.DB, path string, compress bool) error {
+	raw := path + ".tmp"
+	os.Remove(raw)
+	if _, err := db.Exec("VACUUM INTO ?;", raw); err != nil {
+		os.Remove(raw)
+		return fmt.Errorf("could not copy database: %w", err)
+	}
+
+	if compress {
+		err := compressFile(raw, path+".gz.tmp")
+		os.Remove(raw)
+		if err != nil {
+			os.Remove(path + ".gz.tmp")
+			return err
+		}
+		raw = path + ".gz.tmp"
+	}
+
+	if err := os.Rename(raw, strings.TrimSuffix(raw, ".tmp")); err != nil {
+		os.Remove(raw)
+		return fmt.Errorf("could not rename backup: %w", err)
+	}
+	return nil
+}
+
+func compressFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("could not open backup: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create compressed backup: %w", err)
+	}
+
+	zw := gzip.NewWriter(out)
+	zw.Name = strings.TrimSuffix(filepath.Base(dst), ".gz.tmp")
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return fmt.Errorf("could not compress backup: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return fmt.Errorf("could not compress backup: %w", err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return fmt.Errorf("could not write compressed backup: %w", err)
+	}
+	return out.Close()
+}
+
+// backupPrefix is the start of the names of all backups of a kind.
+func backupPrefix(kind BackupKind) string {
+	name := strings.TrimSuffix(filepath.Base(appConfig.DatabasePath), filepath.Ext(appConfig.DatabasePath))
+	return name + "-" + string(kind) + "-"
+}
+
+// createBackup backs the database up into the backup directory and removes the oldest backups of the kind.
+// The note is added to the file name.
+func createBackup(db *sql.DB, kind BackupKind, note string) (string, error) {
+	if err := os.MkdirAll(appConfig.BackupDir, 0755); err != nil {
+		metricBackups.Inc(string(kind), "error")
+		return "", fmt.Errorf("could not create backup directory: %w", err)
+	}
+
+	name := backupPrefix(kind) + time.Now().Format(backupTimeLayout)
+	if note != "" {
+		name += "-" + note
+	}
+	path := filepath.Join(appConfig.BackupDir, name+".db")
+
+	started := time.Now()
+	if err := backupDatabase(db, path, appConfig.BackupCompress); err != nil {
+		metricBackups.Inc(string(kind), "error")
+		return "", err
+	}
+	if appConfig.BackupCompress {
+		path += ".gz"
+	}
+	metricBackups.Inc(string(kind), "success")
+	metricBackupLastSuccess.Set(float64(time.Now().Unix()), string(kind))
+	log.Printf("[INFO] Backed up database to %s in %s.\n", path, time.Since(started).Round(time.Millisecond))
+
+	if err := rotateBackups(appConfig.BackupDir, backupPrefix(kind), appConfig.BackupKeep); err != nil {
+		log.Printf("[ERROR] Failed to rotate backups: %v\n", err)
+	}
+	return path, nil
+}
+
+// rotateBackups removes all but the newest keep backups whose names start with the prefix.
+func rotateBackups(dir, prefix string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not list backups: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, prefix) && !strings.HasSuffix(name, ".tmp") {
+			names = append(names, name)
+		}
+	}
+	if keep <= 0 || len(names) <= keep {
+		return nil
+	}
+
+	sort.Strings(names)
+	for _, name := range names[:len(names)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("could not remove old backup: %w", err)
+		}
+		log.Printf("[INFO] Removed old backup %s.\n", name)
+	}
+	return nil
+}
+
+// runBackupSchedule backs the database up at the interval.
+func runBackupSchedule(db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := createBackup(db, BackupScheduled, ""); err != nil {
+			log.Printf("[ERROR] Scheduled backup failed: %v\n", err)
+		}
+	}
+}
+
+func runBackupCommand(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: backup [PATH]")
+	}
+
+	initDB(appConfig.DatabasePath)
+	defer closeDB()
+
+	if len(args) == 1 {
+		path := args[0]
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists", path)
+		}
+		compress := strings.HasSuffix(path, ".gz")
+		if err := backupDatabase(db, strings.TrimSuffix(path, ".gz"), compress); err != nil {
+			return err
+		}
+		log.Printf("Backed up database to %s.", path)
+		return nil
+	}
+
+	_, err := createBackup(db, BackupManual, "")
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openBackup opens a copy of the backup, decompressing it if needed.
+func openBackup(t *testing.T, path string) *sql.DB {
+	t.Helper()
+
+	if strings.HasSuffix(path, ".gz") {
+		in, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer in.Close()
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := os.Create(filepath.Join(t.TempDir(), "backup.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(out, zr); err != nil {
+			t.Fatal(err)
+		}
+		out.Close()
+		path = out.Name()
+	}
+
+	backup, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backup.Close() })
+	return backup
+}
+
+func countAttacks(t *testing.T, database *sql.DB) int {
+	t.Helper()
+
+	var count int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM "attacks"`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestBackupDatabase(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			setupTest(t)
+			saveAttacks(t, generateAttacks(1, 50, time.Now()))
+
+			path := filepath.Join(t.TempDir(), "copy.db")
+			if err := backupDatabase(db, path, compress); err != nil {
+				t.Fatal(err)
+			}
+			if compress {
+				path += ".gz"
+			}
+
+			backup := openBackup(t, path)
+			if count := countAttacks(t, backup); count != 50 {
+				t.Errorf("backup has %d attacks, want 50", count)
+			}
+			var integrity string
+			if err := backup.QueryRow("PRAGMA integrity_check;").Scan(&integrity); err != nil || integrity != "ok" {
+				t.Errorf("integrity check of backup: %s %v", integrity, err)
+			}
+			if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.tmp")); len(matches) > 0 {
+				t.Errorf("temporary files are left: %v", matches)
+			}
+		})
+	}
+}
+
+func TestBackupBeforeMigration(t *testing.T) {
+	setupTest(t)
+	saveAttacks(t, generateAttacks(2, 30, time.Now()))
+
+	if err := migrateDown(db, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := runMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := filepath.Glob(filepath.Join(appConfig.BackupDir, "attacks-pre-migration-*-v7.db.gz"))
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("got pre-migration backups %v, want one", backups)
+	}
+	backup := openBackup(t, backups[0])
+	var version int
+	if err := backup.QueryRow("PRAGMA user_version;").Scan(&version); err != nil || version != 7 {
+		t.Errorf("backup has version %d, want 7", version)
+	}
+	if count := countAttacks(t, backup); count != 30 {
+		t.Errorf("backup has %d attacks, want 30", count)
+	}
+}
+
+func TestRotateBackups(t *testing.T) {
+	setupTest(t)
+	dir := t.TempDir()
+
+	names := []string{
+		"attacks-scheduled-20260101-000000.db.gz",
+		"attacks-scheduled-20260102-000000.db.gz",
+		"attacks-scheduled-20260103-000000.db.gz",
+		"attacks-scheduled-20260104-000000.db.gz.tmp",
+		"attacks-manual-20250101-000000.db.gz",
+		"other.db",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := rotateBackups(dir, "attacks-scheduled-", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	want := []string{
+		"attacks-manual-20250101-000000.db.gz",
+		"attacks-scheduled-20260102-000000.db.gz",
+		"attacks-scheduled-20260103-000000.db.gz",
+		"attacks-scheduled-20260104-000000.db.gz.tmp",
+		"other.db",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
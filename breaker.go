@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type CircuitState string
+
+// These are the states of a circuit breaker.
+const (
+	// CircuitClosed forwards every request to the upstream.
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen answers every request locally until the open duration is over.
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen forwards a single probe request to find out whether the upstream recovered.
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+// maxCachedResponseBytes is the largest /check_ip response that is cached as a fallback.
+const maxCachedResponseBytes = 64 * 1024
+
+var (
+	metricCircuitState = newGauge("netwatch_proxy_circuit_state",
+		"State of the upstream circuit breaker (0 closed, 1 open, 2 half open).", "upstream")
+	metricCircuitTransitions = newCounter("netwatch_proxy_circuit_transitions_total",
+		"State changes of the upstream circuit breaker.", "upstream", "from", "to")
+	metricCircuitFallbacks = newCounter("netwatch_proxy_circuit_fallbacks_total",
+		"Requests answered locally because the circuit breaker was open.", "endpoint", "result")
+)
+
+func (s CircuitState) metricValue() float64 {
+	switch s {
+	case CircuitOpen:
+		return 1
+	case CircuitHalfOpen:
+		return 2
+	}
+	return 0
+}
+
+// CircuitBreaker stops forwarding to an upstream that fails or is too slow.
+// The error rate is counted in fixed windows. A request counts as failed if it returned an error,
+// a 5xx status or took longer than the slow threshold.
+type CircuitBreaker struct {
+	upstream string
+
+	errorRate     float64
+	minRequests   int
+	slowThreshold time.Duration
+	window        time.Duration
+	openDuration  time.Duration
+
+	mu          sync.Mutex
+	state       CircuitState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+	// generation counts the state changes. Outcomes are only counted for requests allowed in the current state,
+	// so in the half open state only the probe decides, not a slow request allowed before the circuit opened.
+	generation uint64
+}
+
+var upstreamBreaker *CircuitBreaker
+
+func newCircuitBreaker(upstream string, errorRate float64, minRequests int, slowThreshold, window, openDuration time.Duration) *CircuitBreaker {
+	metricCircuitState.Set(CircuitClosed.metricValue(), upstream)
+	return &CircuitBreaker{
+		upstream:      upstream,
+		errorRate:     errorRate,
+		minRequests:   max(minRequests, 1),
+		slowThreshold: slowThreshold,
+		window:        window,
+		openDuration:  openDuration,
+		state:         CircuitClosed,
+		windowStart:   time.Now(),
+	}
+}
+
+// Allow reports whether a request may be forwarded to the upstream.
+// Every allowed request must be followed by Record or Release with the returned permit.
+func (b *CircuitBreaker) Allow() (permit uint64, allowed bool) {
+	if b == nil {
+		return 0, true
+	}
+	return b.allowAt(time.Now())
+}
+
+func (b *CircuitBreaker) allowAt(now time.Time) (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if now.Sub(b.openedAt) < b.openDuration {
+			return 0, false
+		}
+		b.transition(CircuitHalfOpen, now)
+		b.probing = true
+	case CircuitHalfOpen:
+		if b.probing {
+			return 0, false
+		}
+		b.probing = true
+	}
+	return b.generation, true
+}
+
+// Record counts the outcome of a forwarded request.
+func (b *CircuitBreaker) Record(permit uint64, failed bool, latency time.Duration) {
+	if b == nil {
+		return
+	}
+	b.recordAt(permit, failed || (b.slowThreshold > 0 && latency > b.slowThreshold), time.Now())
+}
+
+func (b *CircuitBreaker) recordAt(permit uint64, failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if permit != b.generation {
+		// A request that was allowed before the last state change.
+		return
+	}
+
+	if b.state == CircuitHalfOpen {
+		b.probing = false
+		if failed {
+			b.transition(CircuitOpen, now)
+		} else {
+			b.transition(CircuitClosed, now)
+		}
+		return
+	}
+
+	if now.Sub(b.windowStart) >= b.window {
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+
+	if b.requests >= b.minRequests && float64(b.failures)/float64(b.requests) >= b.errorRate {
+		log.Printf("[WARN] %d of %d requests to %s failed or were too slow.\n", b.failures, b.requests, b.upstream)
+		b.transition(CircuitOpen, now)
+	}
+}
+
+// Release ends an allowed request that says nothing about the upstream, e.g. because the client went away.
+func (b *CircuitBreaker) Release(permit uint64) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitHalfOpen && permit == b.generation {
+		b.probing = false
+	}
+}
+
+func (b *CircuitBreaker) transition(state CircuitState, now time.Time) {
+	from := b.state
+	b.state = state
+	b.generation++
+
+	switch state {
+	case CircuitOpen:
+		b.openedAt = now
+		log.Printf("[WARN] Circuit breaker for %s opened, answering locally for %s.\n", b.upstream, b.openDuration)
+	case CircuitHalfOpen:
+		log.Printf("[INFO] Circuit breaker for %s is half open, probing the upstream.\n", b.upstream)
+	case CircuitClosed:
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+		log.Printf("[INFO] Circuit breaker for %s closed, the upstream recovered.\n", b.upstream)
+	}
+
+	metricCircuitState.Set(state.metricValue(), b.upstream)
+	metricCircuitTransitions.Inc(b.upstream, string(from), string(state))
+}
+
+type cachedResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+}
+
+// ResponseCache keeps the last successful /check_ip responses, so they can be answered while the circuit is open.
+type ResponseCache struct {
+	mu        sync.Mutex
+	responses map[string]*cachedResponse
+	ttl       time.Duration
+}
+
+var checkIPCache = &ResponseCache{responses: make(map[string]*cachedResponse)}
+
+// responseCacheKey identifies a request. Pods may authenticate differently, so the credentials are part of the key.
+func responseCacheKey(r *http.Request) string {
+	return r.Method + " " + r.URL.RequestURI() + " " + r.Header.Get("Authorization")
+}
+
+func (c *ResponseCache) Store(r *http.Request, resp *http.Response, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, cached := range c.responses {
+		if c.ttl > 0 && now.Sub(cached.stored) > c.ttl {
+			delete(c.responses, key)
+		}
+	}
+
+	c.responses[responseCacheKey(r)] = &cachedResponse{
+		statusCode: resp.StatusCode,
+		header:     resp.Header.Clone(),
+		body:       body,
+		stored:     now,
+	}
+}
+
+func (c *ResponseCache) Load(r *http.Request) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.responses[responseCacheKey(r)]
+	if !ok || (c.ttl > 0 && time.Since(cached.stored) > c.ttl) {
+		return nil
+	}
+	return cached
+}
+
+// fallbackResponse answers a request locally while the circuit is open.
+// It returns nil if there is no local answer for the request.
+func fallbackResponse(r *http.Request) *http.Response {
+	endpoint := endpointLabel(r.URL.Path)
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == string(EndpointAddAttack):
+		metricCircuitFallbacks.Inc(endpoint, "mock")
+		return mockAddAttackResponse()
+
+	case r.URL.Path == string(EndpointCheckIP):
+		cached := checkIPCache.Load(r)
+		if cached == nil {
+			break
+		}
+		metricCircuitFallbacks.Inc(endpoint, "cache")
+
+		header := cached.header.Clone()
+		header.Set("Age", strconv.Itoa(int(time.Since(cached.stored).Seconds())))
+		return &http.Response{
+			StatusCode: cached.statusCode,
+			Header:     header,
+			Body:       io.NopCloser(bytes.NewReader(cached.body)),
+		}
+	}
+
+	metricCircuitFallbacks.Inc(endpoint, "unavailable")
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// useBreaker installs a circuit breaker for the collector and an empty /check_ip cache for the duration of the test.
+func useBreaker(t *testing.T, collectorURL string, minRequests int, openDuration time.Duration) *CircuitBreaker {
+	t.Helper()
+
+	parsed, err := url.Parse(collectorURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig.BreakerOpenDuration = openDuration
+	upstreamBreaker = newCircuitBreaker(parsed.Host, 0.5, minRequests, 0, time.Minute, openDuration)
+	cache := checkIPCache
+	checkIPCache = &ResponseCache{responses: make(map[string]*cachedResponse)}
+	t.Cleanup(func() {
+		upstreamBreaker = nil
+		checkIPCache = cache
+	})
+	return upstreamBreaker
+}
+
+func breakerState(b *CircuitBreaker) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func failingCollector(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "upstream failure", http.StatusInternalServerError)
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	setupTest(t)
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+	openDuration := 100 * time.Millisecond
+	breaker := useBreaker(t, collector.URL, 2, openDuration)
+
+	// Failures are passed through until the error rate opens the circuit.
+	collector.setHandler(failingCollector)
+	for range 2 {
+		if resp, _ := doRequest(t, http.MethodGet, proxyURL+"/check_ip", nil, nil); resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("got status %d, want the failure of the collector", resp.StatusCode)
+		}
+	}
+	if state := breakerState(breaker); state != CircuitOpen {
+		t.Fatalf("got state %s after two failures, want open", state)
+	}
+
+	// While open, nothing reaches the collector. Attacks are acknowledged and saved, /check_ip without a cached answer is unavailable.
+	resp, _ := doRequest(t, http.MethodGet, proxyURL+"/check_ip", nil, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("got status %d with Retry-After %q, want 503 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	attacks := generateAttacks(1, 1, time.Now())
+	resp, body := doRequest(t, http.MethodPost, proxyURL+"/add_attack", nil, attackJSON(t, attacks[0]))
+	if resp.StatusCode != http.StatusOK || string(body) != `{"status":"success"}` {
+		t.Errorf("got %d %s, want the mock response", resp.StatusCode, body)
+	}
+	if got := len(collector.Requests()); got != 2 {
+		t.Errorf("got %d requests at the collector, want 2", got)
+	}
+	flushIngestQueue()
+	assertStoredAttacks(t, attacks)
+
+	// After the open duration a probe is forwarded, a failed probe opens the circuit again.
+	time.Sleep(openDuration)
+	if resp, _ := doRequest(t, http.MethodGet, proxyURL+"/check_ip", nil, nil); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got status %d for the probe, want the failure of the collector", resp.StatusCode)
+	}
+	if state := breakerState(breaker); state != CircuitOpen {
+		t.Fatalf("got state %s after a failed probe, want open", state)
+	}
+	if got := len(collector.Requests()); got != 3 {
+		t.Errorf("got %d requests at the collector, want 3", got)
+	}
+
+	// A successful probe closes the circuit.
+	collector.setHandler(nil)
+	time.Sleep(openDuration)
+	if resp, _ := doRequest(t, http.MethodGet, proxyURL+"/check_ip", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d for the probe, want 200", resp.StatusCode)
+	}
+	if state := breakerState(breaker); state != CircuitClosed {
+		t.Fatalf("got state %s after a successful probe, want closed", state)
+	}
+
+	// The counts start over, a single failure does not open the circuit again.
+	collector.setHandler(failingCollector)
+	doRequest(t, http.MethodGet, proxyURL+"/check_ip", nil, nil)
+	if state := breakerState(breaker); state != CircuitClosed {
+		t.Errorf("got state %s after one failure, want closed", state)
+	}
+}
+
+func TestCircuitBreakerAllowsOneProbe(t *testing.T) {
+	setupTest(t)
+	now := time.Now()
+	breaker := newCircuitBreaker("collector.test", 0.5, 1, 0, time.Minute, time.Minute)
+
+	permit, _ := breaker.allowAt(now)
+	breaker.recordAt(permit, true, now)
+	if _, allowed := breaker.allowAt(now.Add(time.Second)); allowed {
+		t.Fatal("the open circuit allowed a request")
+	}
+
+	now = now.Add(time.Minute)
+	probe, allowed := breaker.allowAt(now)
+	if !allowed {
+		t.Fatal("the circuit did not allow a probe after the open duration")
+	}
+	if _, allowed := breaker.allowAt(now); breaker.state != CircuitHalfOpen || allowed {
+		t.Fatalf("got state %s, want half open with a single probe", breaker.state)
+	}
+
+	// A probe without an outcome, e.g. because the client went away, lets the next request probe.
+	breaker.Release(probe)
+	probe, allowed = breaker.allowAt(now)
+	if !allowed {
+		t.Fatal("the circuit did not allow a probe after the release")
+	}
+	breaker.recordAt(probe, false, now)
+	if _, allowed := breaker.allowAt(now); breaker.state != CircuitClosed || !allowed {
+		t.Errorf("got state %s, want closed", breaker.state)
+	}
+}
+
+func TestCircuitBreakerIgnoresRequestsBeforeTheProbe(t *testing.T) {
+	setupTest(t)
+	now := time.Now()
+	breaker := newCircuitBreaker("collector.test", 0.5, 2, 0, time.Minute, time.Minute)
+
+	// A slow request is allowed while the circuit is closed, then other requests open it.
+	slow, _ := breaker.allowAt(now)
+	for range 2 {
+		permit, _ := breaker.allowAt(now)
+		breaker.recordAt(permit, true, now)
+	}
+	if breaker.state != CircuitOpen {
+		t.Fatalf("got state %s, want open", breaker.state)
+	}
+
+	// The slow request ends while the probe is running, neither its success nor its release decides.
+	now = now.Add(time.Minute)
+	probe, allowed := breaker.allowAt(now)
+	if !allowed {
+		t.Fatal("the circuit did not allow a probe after the open duration")
+	}
+	breaker.recordAt(slow, false, now)
+	breaker.Release(slow)
+	if _, allowed := breaker.allowAt(now); breaker.state != CircuitHalfOpen || allowed {
+		t.Fatalf("got state %s, want half open with the probe still running", breaker.state)
+	}
+
+	breaker.recordAt(probe, true, now)
+	if breaker.state != CircuitOpen {
+		t.Errorf("got state %s after the failed probe, want open", breaker.state)
+	}
+}
+
+func TestCircuitBreakerCheckIPFallback(t *testing.T) {
+	setupTest(t)
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+	breaker := useBreaker(t, collector.URL, 2, time.Minute)
+
+	// Successful answers are cached per pod, failures are not.
+	podA := http.Header{"Authorization": {"Bearer pod-a"}}
+	podB := http.Header{"Authorization": {"Bearer pod-b"}}
+	resp, cachedBody := doRequest(t, http.MethodGet, proxyURL+"/check_ip?verbose=1", podA, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+	collector.setHandler(failingCollector)
+	doRequest(t, http.MethodGet, proxyURL+"/check_ip", podB, nil)
+	doRequest(t, http.MethodGet, proxyURL+"/check_ip", podB, nil)
+	if state := breakerState(breaker); state != CircuitOpen {
+		t.Fatalf("got state %s, want open", state)
+	}
+	requests := len(collector.Requests())
+
+	resp, body := doRequest(t, http.MethodGet, proxyURL+"/check_ip?verbose=1", podA, nil)
+	if resp.StatusCode != http.StatusOK || string(body) != string(cachedBody) {
+		t.Errorf("got %d %s, want the cached %s", resp.StatusCode, body, cachedBody)
+	}
+	if resp.Header.Get("Age") == "" || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got headers %v, want the cached headers with Age", resp.Header)
+	}
+
+	// Another pod or another query has no cached answer.
+	if resp, _ := doRequest(t, http.MethodGet, proxyURL+"/check_ip?verbose=1", podB, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for another pod, want 503", resp.StatusCode)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, proxyURL+"/check_ip", podA, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for another query, want 503", resp.StatusCode)
+	}
+
+	// Expired answers are not used.
+	checkIPCache.ttl = time.Nanosecond
+	if resp, _ := doRequest(t, http.MethodGet, proxyURL+"/check_ip?verbose=1", podA, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for an expired answer, want 503", resp.StatusCode)
+	}
+	if got := len(collector.Requests()); got != requests {
+		t.Errorf("got %d requests at the collector while open, want none", got-requests)
+	}
+}
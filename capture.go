@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CaptureRecord is one request of a pod together with the response it received.
+// Bodies longer than the capture limit are truncated, which is noted in the record.
+// The values of credential headers are redacted, see redactCaptureHeader.
+type CaptureRecord struct {
+	Time       time.Time     `json:"time"`
+	Duration   time.Duration `json:"duration"`
+	RemoteAddr string        `json:"remote_addr"`
+
+	Method                string      `json:"method"`
+	URI                   string      `json:"uri"`
+	RequestHeader         http.Header `json:"request_header"`
+	RequestBody           []byte      `json:"request_body"`
+	RequestBodyTruncated  bool        `json:"request_body_truncated,omitempty"`
+	StatusCode            int         `json:"status_code"`
+	ResponseHeader        http.Header `json:"response_header"`
+	ResponseBody          []byte      `json:"response_body"`
+	ResponseBodyTruncated bool        `json:"response_body_truncated,omitempty"`
+}
+
+// CaptureWriter appends capture records as JSON lines to a file that is rotated once it is too large.
+type CaptureWriter struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+var captureWriter *CaptureWriter
+
+func newCaptureWriter(path string, maxBytes int64, maxFiles int) (*CaptureWriter, error) {
+	c := &CaptureWriter{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CaptureWriter) open() error {
+	file, err := os.OpenFile(c.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open capture file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not stat capture file: %w", err)
+	}
+
+	c.file = file
+	c.size = info.Size()
+	return nil
+}
+
+// rotate renames the capture file to path.1, shifting older files up to path.maxFiles.
+func (c *CaptureWriter) rotate() error {
+	c.file.Close()
+	c.file = nil
+
+	os.Remove(fmt.Sprintf("%s.%d", c.path, c.maxFiles))
+	for i := c.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i+1))
+	}
+	if c.maxFiles > 0 {
+		if err := os.Rename(c.path, c.path+".1"); err != nil {
+			return fmt.Errorf("could not rotate capture file: %w", err)
+		}
+	} else if err := os.Remove(c.path); err != nil {
+		return fmt.Errorf("could not remove capture file: %w", err)
+	}
+	return c.open()
+}
+
+func (c *CaptureWriter) Write(record *CaptureRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("could not marshal capture record: %w", err)
+	}
+	data = append(data, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		if err := c.open(); err != nil {
+			return err
+		}
+	}
+	if c.maxBytes > 0 && c.size > 0 && c.size+int64(len(data)) > c.maxBytes {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := c.file.Write(data)
+	c.size += int64(n)
+	return err
+}
+
+func (c *CaptureWriter) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+// captureCredentialHeaders are headers that carry credentials by name.
+var captureCredentialHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// captureCredentialHeaderParts mark custom headers that carry credentials, like X-Api-Key or X-Auth-Token.
+var captureCredentialHeaderParts = []string{"api-key", "apikey", "auth", "token", "secret", "password", "session"}
+
+// redactCaptureHeader returns a copy of the header with the values of credential headers replaced.
+// The replay does not authenticate against the stub upstream, so it does not need them.
+func redactCaptureHeader(header http.Header) http.Header {
+	redactedHeader := header.Clone()
+	for name, values := range redactedHeader {
+		if !isCredentialHeader(name) {
+			continue
+		}
+		for i := range values {
+			values[i] = redacted
+		}
+	}
+	return redactedHeader
+}
+
+func isCredentialHeader(name string) bool {
+	if captureCredentialHeaders[http.CanonicalHeaderKey(name)] {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, part := range captureCredentialHeaderParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// captureBody copies what the handler reads from the request body.
+// The transport may still read the body while the record is written, so the copy is locked.
+type captureBody struct {
+	io.ReadCloser
+	mu  sync.Mutex
+	buf *cappedBuffer
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	b.buf.Write(p[:n])
+	b.mu.Unlock()
+	return n, err
+}
+
+// snapshot returns the captured body and whether it was truncated.
+func (b *captureBody) snapshot() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.buf.Bytes()), b.buf.total > int64(b.buf.buf.Len())
+}
+
+// captureResponseWriter copies the response written by the handler.
+type captureResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	header     http.Header
+	body       *cappedBuffer
+}
+
+func (w *captureResponseWriter) WriteHeader(statusCode int) {
+	if w.header == nil {
+		w.statusCode = statusCode
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *captureResponseWriter) Write(p []byte) (int, error) {
+	if w.header == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// captureRequests records every request and its response with the capture writer.
+func captureRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := &CaptureRecord{
+			Time:          time.Now(),
+			RemoteAddr:    r.RemoteAddr,
+			Method:        r.Method,
+			URI:           r.URL.RequestURI(),
+			RequestHeader: redactCaptureHeader(r.Header),
+		}
+
+		requestBody := &captureBody{ReadCloser: r.Body, buf: &cappedBuffer{limit: appConfig.CaptureMaxBodyBytes}}
+		r.Body = requestBody
+		capture := &captureResponseWriter{ResponseWriter: w, body: &cappedBuffer{limit: appConfig.CaptureMaxBodyBytes}}
+
+		next.ServeHTTP(capture, r)
+
+		record.Duration = time.Since(record.Time)
+		record.RequestBody, record.RequestBodyTruncated = requestBody.snapshot()
+		record.StatusCode = capture.statusCode
+		record.ResponseHeader = redactCaptureHeader(capture.header)
+		record.ResponseBody = capture.body.buf.Bytes()
+		record.ResponseBodyTruncated = capture.body.total > int64(capture.body.buf.Len())
+		if capture.header == nil {
+			record.StatusCode = http.StatusOK
+			record.ResponseHeader = redactCaptureHeader(w.Header())
+		}
+
+		if err := captureWriter.Write(record); err != nil {
+			log.Printf("[ERROR] Failed to write capture record: %v\n", err)
+		}
+	})
+}
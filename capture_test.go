@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactCaptureHeader(t *testing.T) {
+	header := http.Header{
+		"Authorization":   {"Bearer pod-secret"},
+		"Cookie":          {"session=abc"},
+		"X-Api-Key":       {"pod-key"},
+		"X-Auth-Token":    {"pod-token"},
+		"Content-Type":    {"application/json"},
+		"X-Forwarded-For": {"198.51.100.1"},
+	}
+	got := redactCaptureHeader(header)
+	for _, name := range []string{"Authorization", "Cookie", "X-Api-Key", "X-Auth-Token"} {
+		if got.Get(name) != redacted {
+			t.Errorf("got %s %q, want it redacted", name, got.Get(name))
+		}
+	}
+	for _, name := range []string{"Content-Type", "X-Forwarded-For"} {
+		if got.Get(name) != header.Get(name) {
+			t.Errorf("got %s %q, want %q", name, got.Get(name), header.Get(name))
+		}
+	}
+	if header.Get("Authorization") != "Bearer pod-secret" {
+		t.Errorf("the request header was changed")
+	}
+}
+
+func TestCaptureReplayRoundTrip(t *testing.T) {
+	setupTest(t)
+	collector := newFakeCollector(t)
+	collectorURL, err := url.Parse(collector.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig.Collector.URL = collectorURL
+
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	captureWriter, err = newCaptureWriter(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { captureWriter = nil })
+	proxy := httptest.NewServer(captureRequests(http.HandlerFunc(handleProxyRequest)))
+	t.Cleanup(proxy.Close)
+
+	header := http.Header{
+		"Authorization": {"Bearer pod-secret"},
+		"X-Api-Key":     {"pod-key"},
+		"Cookie":        {"session=abc"},
+	}
+	attacks := generateAttacks(1, 5, time.Now())
+	for _, attack := range attacks {
+		doRequest(t, http.MethodPost, proxy.URL+"/add_attack", header, attackJSON(t, attack))
+	}
+	doRequest(t, http.MethodGet, proxy.URL+"/check_ip", header, nil)
+	captureWriter.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("got capture file mode %v, want 0600", info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"pod-secret", "pod-key", "session=abc"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("the capture contains %q", secret)
+		}
+	}
+
+	records, err := loadCapture([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(attacks)+1 {
+		t.Fatalf("got %d records, want %d", len(records), len(attacks)+1)
+	}
+
+	// Replay into an empty database through a stub upstream that answers with the recorded responses.
+	flushIngestQueue()
+	closeDB()
+	initDB(filepath.Join(t.TempDir(), "replay.db"))
+
+	upstreamURL, closeUpstream, err := serveLocal(newStubUpstream(records))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeUpstream()
+	appConfig.Collector.URL = upstreamURL
+	proxyURL, closeProxy, err := serveLocal(http.HandlerFunc(handleProxyRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeProxy()
+
+	for i, record := range records {
+		diffs, err := replayRecord(http.DefaultClient, proxyURL, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diffs) > 0 {
+			t.Errorf("#%d %s %s: %v", i+1, record.Method, record.URI, diffs)
+		}
+	}
+	flushIngestQueue()
+
+	stored, err := storedAttacks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := expectedAttacks(records)
+	if len(expected) != len(attacks) || len(stored) != len(expected) {
+		t.Fatalf("got %d stored attacks, want the %d attacks of the capture", len(stored), len(expected))
+	}
+	for key := range expected {
+		if !stored[key] {
+			t.Errorf("missing attack %s", key)
+		}
+	}
+}
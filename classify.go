@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// classifierVersion is stored with every feature row, raising it classifies all values again at the next start.
+const classifierVersion = 1
+
+// Categories of usernames and passwords, a value gets the first one that applies in the order listed here.
+const (
+	CategoryEmpty        = "empty"
+	CategoryService      = "service"
+	CategoryDefault      = "default"
+	CategoryKeyboardWalk = "keyboard_walk"
+	CategoryLeaked       = "leaked"
+	CategoryNumeric      = "numeric"
+	CategoryOther        = "other"
+)
+
+// defaultUsernames are the accounts devices and cloud images ship with, compared in lower case.
+var defaultUsernames = wordSet(
+	"root", "admin", "administrator", "user", "guest", "support", "default", "test", "demo", "operator",
+	"supervisor", "manager", "super", "sysadmin", "service", "tech", "ubnt", "pi", "ubuntu", "debian",
+	"centos", "fedora", "ec2-user", "azureuser", "opc", "cloud-user", "vagrant", "alpine", "kali", "osmc",
+	"cisco", "mikrotik", "admin1", "telnet", "installer", "factory", "daemon", "mother", "vyos", "pfsense",
+)
+
+// serviceUsernames are accounts of databases, servers and other software rather than of people.
+var serviceUsernames = wordSet(
+	"postgres", "mysql", "oracle", "git", "gitlab", "gitlab-runner", "ftp", "ftpuser", "www", "www-data",
+	"nginx", "apache", "tomcat", "jenkins", "hadoop", "spark", "kafka", "zookeeper", "elastic", "elasticsearch",
+	"solr", "redis", "mongodb", "mongo", "docker", "ansible", "deploy", "deployer", "nagios", "zabbix",
+	"prometheus", "grafana", "minecraft", "steam", "teamspeak", "ts3", "sshd", "backup", "mail", "postfix",
+	"odoo", "sonar", "nexus", "svn", "mssql", "sa", "db2inst1", "weblogic", "wildfly", "jboss",
+	"rabbitmq", "couchdb", "influxdb", "ubuntu-server", "odroid", "bin", "nobody", "sync", "proxy", "node",
+)
+
+// defaultPasswords are the factory passwords of routers, cameras and other devices that botnets try.
+var defaultPasswords = wordSet(
+	"admin", "root", "password", "1234", "12345", "123456", "default", "support", "user", "guest",
+	"ubnt", "raspberry", "xc3511", "vizxv", "888888", "666666", "54321", "7ujMko0admin", "7ujMko0vizxv", "juantech",
+	"xmhdipc", "anko", "klv123", "klv1234", "Zte521", "hi3518", "jvbzd", "system", "realtek", "00000000",
+	"1111", "1111111", "smcadmin", "meinsm", "tech", "zlxx.", "dreambox", "changeme", "toor", "alpine",
+	"calvin", "admin123", "admin1234", "pass", "service", "supervisor", "ikwb", "Win1doW$", "GMB182", "oelinux123",
+	"openelec", "libreelec", "osmc", "vagrant", "ubuntu", "centos", "cisco", "synopass", "mikrotik", "uClinux",
+)
+
+// leakedPasswords are among the most common passwords of leaked password corpora.
+var leakedPasswords = wordSet(
+	"123456", "password", "123456789", "12345678", "12345", "qwerty", "abc123", "password1", "111111", "123123",
+	"1234567", "1234567890", "iloveyou", "1q2w3e4r", "000000", "qwerty123", "zaq12wsx", "dragon", "sunshine", "princess",
+	"letmein", "654321", "monkey", "27653", "1qaz2wsx", "123321", "qwertyuiop", "superman", "asdfghjkl", "football",
+	"baseball", "shadow", "master", "michael", "welcome", "login", "passw0rd", "starwars", "trustno1", "hello",
+	"freedom", "whatever", "qazwsx", "ninja", "mustang", "access", "batman", "7777777", "123qwe", "1q2w3e",
+	"p@ssw0rd", "Password", "Password1", "P@ssw0rd", "test", "test123", "root123", "123456a", "a123456", "123abc",
+	"1234qwer", "qwe123", "asdf1234", "secret", "q1w2e3r4", "abcd1234", "112233", "121212", "aa123456", "11111111",
+	"88888888", "147258369", "computer", "jordan", "hunter", "hunter2", "ashley", "charlie", "robert", "daniel",
+	"jessica", "pokemon", "killer", "soccer", "hockey", "ranger", "harley", "thomas", "tigger", "summer",
+	"buster", "pepper", "ginger", "jennifer", "iloveu", "lovely", "nicole", "159753", "987654321", "qweasdzxc",
+)
+
+func wordSet(words ...string) map[string]bool {
+	set := make(map[string]bool, len(words))
+	for _, word := range words {
+		set[word] = true
+	}
+	return set
+}
+
+// keyboardRows are the rows of a US QWERTY keyboard with the characters typed with shift,
+// each row is shifted to the right by its stagger in key widths.
+var keyboardRows = []struct {
+	keys    string
+	shifted string
+	stagger float64
+}{
+	{"1234567890-=", "!@#$%^&*()_+", 0},
+	{"qwertyuiop[]", "QWERTYUIOP{}", 0.5},
+	{"asdfghjkl;'", "ASDFGHJKL:\"", 0.75},
+	{"zxcvbnm,./", "ZXCVBNM<>?", 1.25},
+}
+
+type keyPosition struct {
+	row int
+	x   float64
+}
+
+var keyPositions = func() map[rune]keyPosition {
+	positions := make(map[rune]keyPosition)
+	for row, keys := range keyboardRows {
+		for i, key := range []rune(keys.keys) {
+			positions[key] = keyPosition{row, float64(i) + keys.stagger}
+		}
+		for i, key := range []rune(keys.shifted) {
+			positions[key] = keyPosition{row, float64(i) + keys.stagger}
+		}
+	}
+	return positions
+}()
+
+// isKeyboardWalk reports whether at least three quarters of the consecutive characters of the value
+// are different keys next to each other, like qwerty or 1qaz2wsx. Runs of digits alone are numeric.
+func isKeyboardWalk(value string) bool {
+	keys := []rune(value)
+	if len(keys) < 4 || isNumeric(value) {
+		return false
+	}
+
+	adjacent := 0
+	for i := 1; i < len(keys); i++ {
+		from, ok := keyPositions[keys[i-1]]
+		if !ok {
+			continue
+		}
+		to, ok := keyPositions[keys[i]]
+		if !ok {
+			continue
+		}
+		rows, x := to.row-from.row, math.Abs(to.x-from.x)
+		if rows >= -1 && rows <= 1 && x <= 1 && !(rows == 0 && x == 0) {
+			adjacent++
+		}
+	}
+	return adjacent*4 >= (len(keys)-1)*3
+}
+
+func isNumeric(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// entropy returns the Shannon entropy of the characters of the value times its length in bits.
+func entropy(value string) float64 {
+	counts := make(map[rune]int)
+	length := 0
+	for _, r := range value {
+		counts[r]++
+		length++
+	}
+
+	bits := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(length)
+		bits -= p * math.Log2(p)
+	}
+	return bits * float64(length)
+}
+
+// CredentialFeatures are the features common to usernames and passwords.
+type CredentialFeatures struct {
+	Length    int
+	HasLower  bool
+	HasUpper  bool
+	HasDigit  bool
+	HasSymbol bool
+	Entropy   float64
+}
+
+func credentialFeatures(value string) CredentialFeatures {
+	features := CredentialFeatures{Entropy: entropy(value)}
+	for _, r := range value {
+		features.Length++
+		switch {
+		case unicode.IsLower(r):
+			features.HasLower = true
+		case unicode.IsUpper(r):
+			features.HasUpper = true
+		case unicode.IsDigit(r):
+			features.HasDigit = true
+		default:
+			features.HasSymbol = true
+		}
+	}
+	return features
+}
+
+// UsernameFeatures are the features and the category of a username.
+type UsernameFeatures struct {
+	CredentialFeatures
+	IsDefault bool
+	IsService bool
+	Category  string
+}
+
+func classifyUsername(value string) UsernameFeatures {
+	lower := strings.ToLower(value)
+	features := UsernameFeatures{
+		CredentialFeatures: credentialFeatures(value),
+		IsDefault:          defaultUsernames[lower],
+		IsService:          serviceUsernames[lower],
+	}
+	switch {
+	case value == "":
+		features.Category = CategoryEmpty
+	case features.IsService:
+		features.Category = CategoryService
+	case features.IsDefault:
+		features.Category = CategoryDefault
+	case isNumeric(value):
+		features.Category = CategoryNumeric
+	default:
+		features.Category = CategoryOther
+	}
+	return features
+}
+
+// PasswordFeatures are the features and the category of a password.
+type PasswordFeatures struct {
+	CredentialFeatures
+	IsDefault      bool
+	IsLeaked       bool
+	IsKeyboardWalk bool
+	Category       string
+}
+
+func classifyPassword(value string) PasswordFeatures {
+	features := PasswordFeatures{
+		CredentialFeatures: credentialFeatures(value),
+		IsDefault:          defaultPasswords[value],
+		IsLeaked:           leakedPasswords[value],
+		IsKeyboardWalk:     isKeyboardWalk(value),
+	}
+	switch {
+	case value == "":
+		features.Category = CategoryEmpty
+	case features.IsDefault:
+		features.Category = CategoryDefault
+	case features.IsKeyboardWalk:
+		features.Category = CategoryKeyboardWalk
+	case features.IsLeaked:
+		features.Category = CategoryLeaked
+	case isNumeric(value):
+		features.Category = CategoryNumeric
+	default:
+		features.Category = CategoryOther
+	}
+	return features
+}
+
+// classifier stores what is derived from the values of a dictionary in a side table with a row per value.
+type classifier struct {
+	dictionary string
+	table      string
+	columns    []string
+	// version is stored with every row, rows of another version are derived again.
+	version int
+	// values returns the values of the columns for a value of the dictionary.
+	values func(value string) []any
+}
+
+var usernameClassifier = &classifier{
+	dictionary: "_dict_usernames",
+	table:      "_username_features",
+	version:    classifierVersion,
+	columns:    []string{"length", "has_lower", "has_upper", "has_digit", "has_symbol", "entropy", "is_default", "is_service", "category"},
+	values: func(value string) []any {
+		features := classifyUsername(value)
+		return append(features.CredentialFeatures.values(), features.IsDefault, features.IsService, features.Category)
+	},
+}
+
+var passwordClassifier = &classifier{
+	dictionary: "_dict_passwords",
+	table:      "_password_features",
+	version:    classifierVersion,
+	columns:    []string{"length", "has_lower", "has_upper", "has_digit", "has_symbol", "entropy", "is_default", "is_leaked", "is_keyboard_walk", "category"},
+	values: func(value string) []any {
+		features := classifyPassword(value)
+		return append(features.CredentialFeatures.values(), features.IsDefault, features.IsLeaked, features.IsKeyboardWalk, features.Category)
+	},
+}
+
+func (f CredentialFeatures) values() []any {
+	return []any{f.Length, f.HasLower, f.HasUpper, f.HasDigit, f.HasSymbol, f.Entropy}
+}
+
+// insertSQL returns the statement that stores the row of the dictionary entry with the id.
+func (c *classifier) insertSQL() string {
+	return fmt.Sprintf(`INSERT OR REPLACE INTO "%s" ("id", "%s", "version") VALUES (?%s, %d)`,
+		c.table, strings.Join(c.columns, `", "`), strings.Repeat(", ?", len(c.columns)), c.version)
+}
+
+// hook returns the function the dictionary calls for every value it inserts,
+// so that its row is stored in the same transaction as the value.
+func (c *classifier) hook(db *sql.DB) (func(tx *batchTx, id int64, value string) error, error) {
+	stmt, err := db.Prepare(c.insertSQL())
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare insert for %s: %w", c.table, err)
+	}
+	return func(tx *batchTx, id int64, value string) error {
+		if _, err := tx.stmt(stmt).Exec(append([]any{id}, c.values(value)...)...); err != nil {
+			return fmt.Errorf("could not insert into %s: %w", c.table, err)
+		}
+		return nil
+	}, nil
+}
+
+// classify stores the row of every value that has none or one of another version.
+// It returns the number of classified values.
+func (c *classifier) classify(db *sql.DB) (int, error) {
+	rows, err := db.Query(fmt.Sprintf(`SELECT "%[1]s"."id", "%[1]s"."value"
+		FROM "%[1]s"
+		LEFT JOIN "%[2]s" ON "%[1]s"."id" = "%[2]s"."id"
+		WHERE "%[2]s"."id" IS NULL OR "%[2]s"."version" <> ?`, c.dictionary, c.table), c.version)
+	if err != nil {
+		return 0, fmt.Errorf("could not query unclassified values of %s: %w", c.dictionary, err)
+	}
+	type entry struct {
+		id    int64
+		value string
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.id, &e.value); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("could not scan value of %s: %w", c.dictionary, err)
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("could not read unclassified values of %s: %w", c.dictionary, err)
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(c.insertSQL())
+	if err != nil {
+		return 0, fmt.Errorf("could not prepare insert for %s: %w", c.table, err)
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		if _, err := stmt.Exec(append([]any{e.id}, c.values(e.value)...)...); err != nil {
+			return 0, fmt.Errorf("could not insert into %s: %w", c.table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not commit %s: %w", c.table, err)
+	}
+	return len(entries), nil
+}
+
+// classifyCredentials classifies the usernames and passwords stored before the classifier or by an older version of it.
+func classifyCredentials(db *sql.DB) error {
+	usernames, err := usernameClassifier.classify(db)
+	if err != nil {
+		return err
+	}
+	passwords, err := passwordClassifier.classify(db)
+	if err != nil {
+		return err
+	}
+	if usernames > 0 || passwords > 0 {
+		log.Printf("[INFO] Classified %d usernames and %d passwords.\n", usernames, passwords)
+	}
+	return nil
+}
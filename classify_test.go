@@ -0,0 +1,180 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEntropy(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{"", 0},
+		{"aaaa", 0},
+		{"ab", 2},
+		{"abcd", 8},
+		{"aabb", 4},
+	}
+	for _, test := range tests {
+		if got := entropy(test.value); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("entropy(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestIsKeyboardWalk(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"qwerty", true},
+		{"asdfgh", true},
+		{"zxcvbnm", true},
+		{"1qaz2wsx", true},
+		{"1q2w3e4r", true},
+		{"QWERTY", true},
+		{"!QAZ@WSX", true},
+		{"qwe", false},
+		{"123456", false},
+		{"aaaaaa", false},
+		{"password", false},
+		{"raspberry", false},
+	}
+	for _, test := range tests {
+		if got := isKeyboardWalk(test.value); got != test.want {
+			t.Errorf("isKeyboardWalk(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestClassifyCredentials(t *testing.T) {
+	features := credentialFeatures("Pa55 wörd!")
+	if features != (CredentialFeatures{Length: 10, HasLower: true, HasUpper: true, HasDigit: true, HasSymbol: true, Entropy: features.Entropy}) {
+		t.Errorf("got features %+v", features)
+	}
+
+	usernames := map[string]string{
+		"":         CategoryEmpty,
+		"postgres": CategoryService,
+		"Oracle":   CategoryService,
+		"root":     CategoryDefault,
+		"EC2-User": CategoryDefault,
+		"12345":    CategoryNumeric,
+		"johndoe":  CategoryOther,
+	}
+	for value, want := range usernames {
+		if got := classifyUsername(value).Category; got != want {
+			t.Errorf("classifyUsername(%q) has category %s, want %s", value, got, want)
+		}
+	}
+
+	passwords := map[string]string{
+		"":           CategoryEmpty,
+		"xc3511":     CategoryDefault,
+		"123456":     CategoryDefault,
+		"qwerty":     CategoryKeyboardWalk,
+		"1qaz2wsx":   CategoryKeyboardWalk,
+		"iloveyou":   CategoryLeaked,
+		"Admin":      CategoryOther,
+		"20240101":   CategoryNumeric,
+		"c0rrect-h0": CategoryOther,
+	}
+	for value, want := range passwords {
+		if got := classifyPassword(value).Category; got != want {
+			t.Errorf("classifyPassword(%q) has category %s, want %s", value, got, want)
+		}
+	}
+	if got := classifyPassword("qwerty"); !got.IsLeaked || !got.IsKeyboardWalk || got.IsDefault {
+		t.Errorf("got features %+v for qwerty, want a leaked keyboard walk", got)
+	}
+}
+
+func TestClassifyOnInsert(t *testing.T) {
+	setupTest(t)
+	now := time.Now().Truncate(time.Second)
+	saveAttacks(t, []*Attack{
+		newAttack("198.51.100.1", "root", "xc3511", now),
+		newAttack("198.51.100.1", "postgres", "postgres", now.Add(time.Second)),
+		newAttack("198.51.100.1", "root", "qwerty", now.Add(2*time.Second)),
+	})
+
+	compareRows(t, queryRows(t, `SELECT "_dict_usernames"."value", "length", "has_lower", "has_digit", "is_default", "is_service", "category", "version"
+		FROM "_username_features" JOIN "_dict_usernames" ON "_username_features"."id" = "_dict_usernames"."id"
+		ORDER BY "_dict_usernames"."value"`), [][]string{
+		{"postgres", "8", "1", "0", "0", "1", "service", "1"},
+		{"root", "4", "1", "0", "1", "0", "default", "1"},
+	})
+	compareRows(t, queryRows(t, `SELECT "_dict_passwords"."value", "length", "has_digit", "is_default", "is_leaked", "is_keyboard_walk", "category"
+		FROM "_password_features" JOIN "_dict_passwords" ON "_password_features"."id" = "_dict_passwords"."id"
+		ORDER BY "_dict_passwords"."value"`), [][]string{
+		{"postgres", "8", "0", "0", "0", "0", "other"},
+		{"qwerty", "6", "0", "0", "1", "1", "keyboard_walk"},
+		{"xc3511", "6", "1", "1", "0", "0", "default"},
+	})
+}
+
+func TestClassifyBackfill(t *testing.T) {
+	setupTest(t)
+	saveAttacks(t, generateAttacks(5, 50, time.Now()))
+
+	// Values stored before the classifier or by an older version of it.
+	if _, err := db.Exec(`DELETE FROM "_username_features"`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE "_password_features" SET "version" = 0, "category" = 'stale'`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := classifyCredentials(db); err != nil {
+		t.Fatal(err)
+	}
+	compareRows(t, queryRows(t, `SELECT
+		(SELECT COUNT(1) FROM "_dict_usernames") = (SELECT COUNT(1) FROM "_username_features" WHERE "version" = 1),
+		(SELECT COUNT(1) FROM "_dict_passwords") = (SELECT COUNT(1) FROM "_password_features" WHERE "version" = 1 AND "category" <> 'stale')`),
+		[][]string{{"1", "1"}})
+
+	// Everything is classified, nothing is left to do.
+	for _, c := range []*classifier{usernameClassifier, passwordClassifier} {
+		if n, err := c.classify(db); err != nil || n != 0 {
+			t.Errorf("%s: classified %d values again, err %v", c.table, n, err)
+		}
+	}
+}
+
+func TestCredentialCategoryViews(t *testing.T) {
+	setupTest(t)
+	setReportTimezone(t, loadLocation(t, "Asia/Kolkata"))
+	day := time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), 12, 0, 0, 0, reportLocation()).AddDate(0, 0, -2)
+	saveAttacks(t, []*Attack{
+		newAttack("198.51.100.1", "root", "xc3511", day),
+		newAttack("198.51.100.1", "root", "xc3511", day.Add(time.Minute)),
+		newAttack("198.51.100.1", "root", "qwerty", day.Add(2*time.Minute)),
+		newAttack("198.51.100.1", "postgres", "postgres", day.Add(3*time.Minute)),
+		newAttack("198.51.100.1", "johndoe", "iloveyou", day.AddDate(0, 0, 1)),
+		// Too old for the report.
+		newAttack("198.51.100.1", "root", "xc3511", day.AddDate(0, 0, -40)),
+	})
+
+	compareRows(t, queryRows(t, `SELECT * FROM "view_username_categories"`), [][]string{
+		{"default", "1", "4"},
+		{"other", "1", "1"},
+		{"service", "1", "1"},
+	})
+	compareRows(t, queryRows(t, `SELECT * FROM "view_password_categories"`), [][]string{
+		{"default", "1", "3"},
+		{"keyboard_walk", "1", "1"},
+		{"leaked", "1", "1"},
+		{"other", "1", "1"},
+	})
+
+	date := day.Format(time.DateOnly)
+	next := day.AddDate(0, 0, 1).Format(time.DateOnly)
+	compareRows(t, queryRows(t, `SELECT * FROM "report_credential_categories_last_30_days"`), [][]string{
+		{date, "default", "default", "2"},
+		{date, "default", "keyboard_walk", "1"},
+		{date, "service", "username", "1"},
+		{next, "other", "leaked", "1"},
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// Command is an administrative subcommand, run as `ssh_attackpod_proxy <name> [args...]`.
+type Command struct {
+	Name        string
+	Usage       string
+	Description string
+	Run         func(args []string) error
+}
+
+var commands = map[string]*Command{}
+
+func registerCommand(command *Command) {
+	commands[command.Name] = command
+}
+
+// runCommand runs the subcommand with the given name.
+func runCommand(name string, args []string) error {
+	if name == "help" || name == "-h" || name == "--help" {
+		printCommandUsage()
+		return nil
+	}
+
+	command, ok := commands[name]
+	if !ok {
+		printCommandUsage()
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return command.Run(args)
+}
+
+func printCommandUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Usage: ssh_attackpod_proxy [command]")
+	fmt.Fprintln(os.Stderr, "Without a command the proxy server is started.")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", commands[name].Usage, commands[name].Description)
+	}
+	w.Flush()
+}
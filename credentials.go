@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:  "credentials",
+		Usage: "credentials [-rank attacks|sources] [-window DURATION] [-min-attacks N] [-min-sources N] [-limit N] [-format hydra|medusa|john] usernames|passwords|combos",
+		Description: "Export the usernames, passwords or username and password combos attackers tried as a wordlist for " +
+			"hydra, medusa or John the Ripper.",
+		Run: runCredentialsCommand,
+	})
+}
+
+// ErrCredentialExport is returned for an export with invalid options.
+var ErrCredentialExport = errors.New("invalid credential export")
+
+// CredentialKind is what a wordlist consists of.
+type CredentialKind string
+
+const (
+	CredentialUsernames CredentialKind = "usernames"
+	CredentialPasswords CredentialKind = "passwords"
+	// CredentialCombos are the username and password pairs that were tried together.
+	CredentialCombos CredentialKind = "combos"
+)
+
+// CredentialRank is what the entries of a wordlist are ordered by, the most used first.
+type CredentialRank string
+
+const (
+	// RankAttacks orders by the number of attacks that used the entry.
+	RankAttacks CredentialRank = "attacks"
+	// RankSources orders by the number of distinct source IPs that used the entry.
+	RankSources CredentialRank = "sources"
+)
+
+// WordlistFormat is the tool a wordlist is written for.
+// Usernames and passwords are written one per line for every tool, combos differ:
+// hydra -C reads username:password, medusa -C reads host:username:password with the host left empty.
+// John the Ripper only reads wordlists of candidates, it has no combo format.
+type WordlistFormat string
+
+const (
+	FormatHydra  WordlistFormat = "hydra"
+	FormatMedusa WordlistFormat = "medusa"
+	FormatJohn   WordlistFormat = "john"
+)
+
+// CredentialExport are the options of a wordlist export.
+type CredentialExport struct {
+	Kind   CredentialKind
+	Rank   CredentialRank
+	Format WordlistFormat
+	// Window only counts attacks of the recent time, zero counts all attacks.
+	Window time.Duration
+	// MinAttacks and MinSources are the support an entry needs to be exported.
+	MinAttacks int
+	MinSources int
+	// Limit is the maximum number of entries, zero exports all.
+	Limit int
+}
+
+// parseCredentialExport parses the options of the export of the kind.
+// The values are named like the query parameters of the endpoint, missing ones get their default.
+func parseCredentialExport(kind string, values map[string]string) (*CredentialExport, error) {
+	export := &CredentialExport{
+		Kind:       CredentialKind(kind),
+		Rank:       RankAttacks,
+		Format:     FormatHydra,
+		MinAttacks: 1,
+		MinSources: 1,
+	}
+	switch export.Kind {
+	case CredentialUsernames, CredentialPasswords, CredentialCombos:
+	default:
+		return nil, fmt.Errorf("%w: unknown kind %q, expected usernames, passwords or combos", ErrCredentialExport, kind)
+	}
+	if s, ok := values["rank"]; ok {
+		switch export.Rank = CredentialRank(s); export.Rank {
+		case RankAttacks, RankSources:
+		default:
+			return nil, fmt.Errorf("%w: unknown rank %q, expected attacks or sources", ErrCredentialExport, s)
+		}
+	}
+	if s, ok := values["format"]; ok {
+		switch export.Format = WordlistFormat(s); export.Format {
+		case FormatHydra, FormatMedusa, FormatJohn:
+		default:
+			return nil, fmt.Errorf("%w: unknown format %q, expected hydra, medusa or john", ErrCredentialExport, s)
+		}
+	}
+	if export.Kind == CredentialCombos && export.Format == FormatJohn {
+		return nil, fmt.Errorf("%w: John the Ripper has no combo format, export usernames or passwords", ErrCredentialExport)
+	}
+	if s, ok := values["window"]; ok {
+		window, err := parseReportDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: window: %v", ErrCredentialExport, err)
+		}
+		export.Window = window
+	}
+	for name, n := range map[string]*int{"min_attacks": &export.MinAttacks, "min_sources": &export.MinSources, "limit": &export.Limit} {
+		s, ok := values[name]
+		if !ok {
+			continue
+		}
+		value, err := strconv.Atoi(s)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("%w: %s must be a number of at least 0, not %q", ErrCredentialExport, name, s)
+		}
+		*n = value
+	}
+	return export, nil
+}
+
+// allowed returns ErrRedacted if the redaction policy withholds the credentials of the export.
+func (e *CredentialExport) allowed(policy RedactionPolicy) error {
+	switch {
+	case policy == RedactAll, policy == RedactPasswords && e.Kind == CredentialPasswords:
+		return fmt.Errorf("%s are %w %q", e.Kind, ErrRedacted, policy)
+	case policy == RedactPasswords && e.Kind == CredentialCombos:
+		return fmt.Errorf("%s contain passwords, which are %w %q", e.Kind, ErrRedacted, policy)
+	}
+	return nil
+}
+
+// CredentialEntry is an entry of a wordlist, the password is empty for usernames and the username for passwords.
+type CredentialEntry struct {
+	Username string
+	Password string
+	Attacks  int
+	Sources  int
+}
+
+// exportCredentials returns the entries of the export ordered by their rank.
+// All time counts come from the rollups, a window counts the attacks since then.
+func exportCredentials(db *sql.DB, export *CredentialExport, now time.Time) ([]CredentialEntry, error) {
+	source := `"_rollup_source_credentials"`
+	var args []any
+	if export.Window > 0 {
+		source = `(SELECT "source_ip", "username", "password", COUNT(1) AS "attacks"
+			FROM "_attacks"
+			WHERE "timestamp" >= ?
+			GROUP BY "source_ip", "username", "password")`
+		args = append(args, now.Add(-export.Window).UnixMilli())
+	}
+
+	var columns, joins, group, values string
+	switch export.Kind {
+	case CredentialUsernames:
+		columns = `"_dict_usernames"."value", ''`
+		joins = `JOIN "_dict_usernames" ON "credentials"."username" = "_dict_usernames"."id"`
+		group = `"credentials"."username"`
+		values = `"_dict_usernames"."value"`
+	case CredentialPasswords:
+		columns = `'', "_dict_passwords"."value"`
+		joins = `JOIN "_dict_passwords" ON "credentials"."password" = "_dict_passwords"."id"`
+		group = `"credentials"."password"`
+		values = `"_dict_passwords"."value"`
+	default:
+		columns = `"_dict_usernames"."value", "_dict_passwords"."value"`
+		joins = `JOIN "_dict_usernames" ON "credentials"."username" = "_dict_usernames"."id"
+			JOIN "_dict_passwords" ON "credentials"."password" = "_dict_passwords"."id"`
+		group = `"credentials"."username", "credentials"."password"`
+		values = `"_dict_usernames"."value", "_dict_passwords"."value"`
+	}
+	order := `"attacks" DESC, "sources" DESC`
+	if export.Rank == RankSources {
+		order = `"sources" DESC, "attacks" DESC`
+	}
+
+	query := fmt.Sprintf(`SELECT %s, SUM("credentials"."attacks") AS "attacks", COUNT(DISTINCT "credentials"."source_ip") AS "sources"
+		FROM %s AS "credentials"
+		%s
+		GROUP BY %s
+		HAVING SUM("credentials"."attacks") >= ? AND COUNT(DISTINCT "credentials"."source_ip") >= ?
+		ORDER BY %s, %s`, columns, source, joins, group, order, values)
+	args = append(args, export.MinAttacks, export.MinSources)
+	if export.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, export.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query %s: %w", export.Kind, err)
+	}
+	defer rows.Close()
+
+	var entries []CredentialEntry
+	for rows.Next() {
+		var entry CredentialEntry
+		if err := rows.Scan(&entry.Username, &entry.Password, &entry.Attacks, &entry.Sources); err != nil {
+			return nil, fmt.Errorf("could not scan %s: %w", export.Kind, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", export.Kind, err)
+	}
+	return entries, nil
+}
+
+// writeWordlist writes the entries in the format of the export, one per line.
+// Entries the tools cannot read back are skipped: values with line breaks or NUL characters,
+// and combos whose username contains the colon that separates it from the password.
+// It returns the number of skipped entries.
+func writeWordlist(w io.Writer, export *CredentialExport, entries []CredentialEntry) (int, error) {
+	unreadable := func(value string) bool {
+		return strings.ContainsAny(value, "\r\n\x00")
+	}
+
+	buffered := bufio.NewWriter(w)
+	skipped := 0
+	for _, entry := range entries {
+		var line string
+		switch export.Kind {
+		case CredentialUsernames:
+			if unreadable(entry.Username) {
+				skipped++
+				continue
+			}
+			line = entry.Username
+		case CredentialPasswords:
+			if unreadable(entry.Password) {
+				skipped++
+				continue
+			}
+			line = entry.Password
+		default:
+			if unreadable(entry.Username) || unreadable(entry.Password) || strings.Contains(entry.Username, ":") {
+				skipped++
+				continue
+			}
+			line = entry.Username + ":" + entry.Password
+			if export.Format == FormatMedusa {
+				line = ":" + line
+			}
+		}
+		if _, err := buffered.WriteString(line + "\n"); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, buffered.Flush()
+}
+
+// handleCredentials serves the wordlists of /_proxy/credentials/{usernames,passwords,combos}.
+func handleCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdminToken(w, r) {
+		return
+	}
+
+	values := make(map[string]string)
+	for name, value := range r.URL.Query() {
+		values[name] = value[len(value)-1]
+	}
+	export, err := parseCredentialExport(strings.TrimPrefix(r.URL.Path, "/_proxy/credentials/"), values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := export.allowed(appConfig.Redaction); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	entries, err := exportCredentials(db, export, time.Now())
+	if err != nil {
+		log.Printf("[ERROR] Failed to export %s: %v\n", export.Kind, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.txt"`, export.Kind, export.Format))
+	if _, err := writeWordlist(w, export, entries); err != nil {
+		log.Printf("[ERROR] Failed to write %s: %v\n", export.Kind, err)
+	}
+}
+
+func runCredentialsCommand(args []string) error {
+	flags := flag.NewFlagSet("credentials", flag.ExitOnError)
+	flags.String("rank", string(RankAttacks), "order by the number of attacks or of distinct source IPs")
+	flags.String("window", "0", "only count the attacks of this duration, like 24h or 30d; 0 counts all")
+	flags.String("min-attacks", "1", "attacks an entry needs")
+	flags.String("min-sources", "1", "distinct source IPs an entry needs")
+	flags.String("limit", "0", "maximum number of entries; 0 exports all")
+	flags.String("format", string(FormatHydra), "write for hydra, medusa or john")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: credentials [-rank attacks|sources] [-window DURATION] [-min-attacks N] [-min-sources N] [-limit N] [-format hydra|medusa|john] usernames|passwords|combos")
+	}
+	values := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		values[strings.ReplaceAll(f.Name, "-", "_")] = f.Value.String()
+	})
+	export, err := parseCredentialExport(flags.Arg(0), values)
+	if err != nil {
+		return err
+	}
+	if err := export.allowed(appConfig.Redaction); err != nil {
+		return err
+	}
+
+	if err := openDB(appConfig.DatabasePath); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	entries, err := exportCredentials(db, export, time.Now())
+	if err != nil {
+		return err
+	}
+	skipped, err := writeWordlist(os.Stdout, export, entries)
+	if err != nil {
+		return fmt.Errorf("could not write %s: %w", export.Kind, err)
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d of %d %s that %s cannot read.\n", skipped, len(entries), export.Kind, export.Format)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCredentialExport(t *testing.T) {
+	export, err := parseCredentialExport("combos", map[string]string{"rank": "sources", "window": "30d", "min_sources": "2", "limit": "10", "format": "medusa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CredentialExport{Kind: CredentialCombos, Rank: RankSources, Format: FormatMedusa, Window: 30 * 24 * time.Hour, MinAttacks: 1, MinSources: 2, Limit: 10}
+	if *export != want {
+		t.Errorf("got %+v, want %+v", *export, want)
+	}
+
+	for _, test := range []struct {
+		kind   string
+		values map[string]string
+	}{
+		{"logins", nil},
+		{"usernames", map[string]string{"rank": "recent"}},
+		{"usernames", map[string]string{"format": "ncrack"}},
+		{"combos", map[string]string{"format": "john"}},
+		{"passwords", map[string]string{"window": "a month"}},
+		{"passwords", map[string]string{"min_attacks": "-1"}},
+		{"passwords", map[string]string{"limit": "all"}},
+	} {
+		if _, err := parseCredentialExport(test.kind, test.values); !errors.Is(err, ErrCredentialExport) {
+			t.Errorf("%s %v: got %v, want an invalid export", test.kind, test.values, err)
+		}
+	}
+}
+
+func TestCredentialExportRedaction(t *testing.T) {
+	tests := []struct {
+		policy RedactionPolicy
+		kind   CredentialKind
+		want   bool
+	}{
+		{RedactNone, CredentialCombos, true},
+		{RedactPasswords, CredentialUsernames, true},
+		{RedactPasswords, CredentialPasswords, false},
+		{RedactPasswords, CredentialCombos, false},
+		{RedactAll, CredentialUsernames, false},
+	}
+	for _, test := range tests {
+		err := (&CredentialExport{Kind: test.kind}).allowed(test.policy)
+		if (err == nil) != test.want || (err != nil && !errors.Is(err, ErrRedacted)) {
+			t.Errorf("%s with %s: got %v", test.kind, test.policy, err)
+		}
+	}
+}
+
+// saveCredentialCorpus saves attacks where root/123456 is tried most often by a single source,
+// admin/admin by the most sources, and credentials a wordlist cannot hold before the last week.
+func saveCredentialCorpus(t *testing.T, now time.Time) {
+	t.Helper()
+
+	var attacks []*Attack
+	add := func(source, username, password string, at time.Time) {
+		attacks = append(attacks, newAttack(source, username, password, at))
+	}
+	for i := range 5 {
+		add("198.51.100.1", "root", "123456", now.Add(-time.Duration(i+1)*time.Minute))
+	}
+	for i, source := range []string{"198.51.100.2", "198.51.100.3", "198.51.100.4"} {
+		add(source, "admin", "admin", now.Add(-time.Duration(i+1)*time.Hour))
+	}
+	add("198.51.100.2", "root", "admin", now.Add(-2*time.Hour))
+	add("198.51.100.5", "old:user", "line\nbreak", now.AddDate(0, 0, -20))
+	add("198.51.100.5", "old:user", "oldpass", now.AddDate(0, 0, -20))
+	saveAttacks(t, attacks)
+}
+
+func TestExportCredentials(t *testing.T) {
+	setupTest(t)
+	now := time.Now().Truncate(time.Second)
+	saveCredentialCorpus(t, now)
+
+	tests := []struct {
+		kind   string
+		values map[string]string
+		want   string
+	}{
+		{"usernames", nil, "root\nadmin\nold:user\n"},
+		{"usernames", map[string]string{"rank": "sources"}, "admin\nroot\nold:user\n"},
+		{"passwords", map[string]string{"format": "john"}, "123456\nadmin\noldpass\n"},
+		{"passwords", map[string]string{"window": "7d", "min_attacks": "2"}, "123456\nadmin\n"},
+		{"passwords", map[string]string{"min_sources": "2"}, "admin\n"},
+		{"combos", nil, "root:123456\nadmin:admin\nroot:admin\n"},
+		{"combos", map[string]string{"rank": "sources", "limit": "2", "format": "medusa"}, ":admin:admin\n:root:123456\n"},
+	}
+	for _, test := range tests {
+		export, err := parseCredentialExport(test.kind, test.values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := exportCredentials(db, export, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got strings.Builder
+		if _, err := writeWordlist(&got, export, entries); err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != test.want {
+			t.Errorf("%s %v: got %q, want %q", test.kind, test.values, got.String(), test.want)
+		}
+	}
+}
+
+func TestWriteWordlistSkipsUnreadableEntries(t *testing.T) {
+	entries := []CredentialEntry{
+		{Username: "root", Password: "pass:word"},
+		{Username: "old:user", Password: "oldpass"},
+		{Username: "root", Password: "line\nbreak"},
+	}
+	var got strings.Builder
+	skipped, err := writeWordlist(&got, &CredentialExport{Kind: CredentialCombos, Format: FormatHydra}, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "root:pass:word\n" || skipped != 2 {
+		t.Errorf("got %q with %d skipped, want the first combo and 2 skipped", got.String(), skipped)
+	}
+}
+
+func TestCredentialsAPI(t *testing.T) {
+	setupTest(t)
+	saveCredentialCorpus(t, time.Now())
+
+	appConfig.AdminToken = "secret"
+
+	tests := []struct {
+		policy RedactionPolicy
+		path   string
+		status int
+		want   string
+	}{
+		{RedactNone, "/_proxy/credentials/combos?limit=1", http.StatusOK, "root:123456\n"},
+		{RedactNone, "/_proxy/credentials/passwords?min_sources=3", http.StatusOK, "admin\n"},
+		{RedactNone, "/_proxy/credentials/logins", http.StatusBadRequest, ""},
+		{RedactNone, "/_proxy/credentials/combos?format=john", http.StatusBadRequest, ""},
+		{RedactPasswords, "/_proxy/credentials/usernames?limit=1", http.StatusOK, "root\n"},
+		{RedactPasswords, "/_proxy/credentials/passwords", http.StatusForbidden, ""},
+		{RedactPasswords, "/_proxy/credentials/combos", http.StatusForbidden, ""},
+		{RedactAll, "/_proxy/credentials/usernames", http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		appConfig.Redaction = test.policy
+		request := httptest.NewRequest(http.MethodGet, test.path, nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		handleCredentials(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%s with %s: got status %d, want %d", test.path, test.policy, recorder.Code, test.status)
+			continue
+		}
+		if test.status == http.StatusOK && recorder.Body.String() != test.want {
+			t.Errorf("%s with %s: got %q, want %q", test.path, test.policy, recorder.Body.String(), test.want)
+		}
+	}
+}
+
+func TestCredentialsAPIRequiresAdminToken(t *testing.T) {
+	setupTest(t)
+	saveCredentialCorpus(t, time.Now())
+	appConfig.Redaction = RedactNone
+
+	tests := []struct {
+		token         string
+		authorization string
+		status        int
+	}{
+		{"", "", http.StatusForbidden},
+		{"", "Bearer ", http.StatusForbidden},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "Basic secret", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		appConfig.AdminToken = test.token
+		request := httptest.NewRequest(http.MethodGet, "/_proxy/credentials/combos", nil)
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handleCredentials(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("token %q with %q: got status %d, want %d", test.token, test.authorization, recorder.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:        "dead-letters",
+		Usage:       "dead-letters list|show|replay|delete",
+		Description: "Inspect and replay /add_attack requests that could not be parsed.",
+		Run:         runDeadLettersCommand,
+	})
+}
+
+type DeadLetter struct {
+	ID           int64
+	Received     time.Time
+	Method       string
+	Path         string
+	RemoteAddr   string
+	Headers      http.Header
+	Body         []byte
+	Error        string
+	Replayed     *time.Time
+	ReplayResult string
+}
+
+// saveDeadLetter stores a request body that could not be parsed, so it can be replayed later.
+// The replay only needs the body, the credentials of the pod are not kept.
+func saveDeadLetter(r *http.Request, body []byte, parseErr error) error {
+	headers, err := json.Marshal(redactCaptureHeader(r.Header))
+	if err != nil {
+		return fmt.Errorf("could not marshal headers: %w", err)
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	_, err = db.Exec(`INSERT INTO "_dead_letters" ("received", "method", "path", "remote_addr", "headers", "body", "error")
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		time.Now().UnixMilli(), r.Method, r.URL.Path, r.RemoteAddr, string(headers), body, parseErr.Error())
+	if err != nil {
+		return fmt.Errorf("could not insert dead letter: %w", err)
+	}
+	return nil
+}
+
+func scanDeadLetter(scanner interface{ Scan(...any) error }) (*DeadLetter, error) {
+	var letter DeadLetter
+	var received int64
+	var replayed sql.NullInt64
+	var replayResult sql.NullString
+	var headers string
+
+	err := scanner.Scan(&letter.ID, &received, &letter.Method, &letter.Path, &letter.RemoteAddr,
+		&headers, &letter.Body, &letter.Error, &replayed, &replayResult)
+	if err != nil {
+		return nil, err
+	}
+
+	letter.Received = time.UnixMilli(received)
+	if replayed.Valid {
+		t := time.UnixMilli(replayed.Int64)
+		letter.Replayed = &t
+	}
+	letter.ReplayResult = replayResult.String
+	if err := json.Unmarshal([]byte(headers), &letter.Headers); err != nil {
+		return nil, fmt.Errorf("could not parse headers of dead letter %d: %w", letter.ID, err)
+	}
+	return &letter, nil
+}
+
+const deadLetterColumns = `"id", "received", "method", "path", "remote_addr", "headers", "body", "error", "replayed", "replay_result"`
+
+// loadDeadLetters returns the dead letters, optionally including the already replayed ones.
+func loadDeadLetters(includeReplayed bool) ([]*DeadLetter, error) {
+	query := `SELECT ` + deadLetterColumns + ` FROM "_dead_letters"`
+	if !includeReplayed {
+		query += ` WHERE "replayed" IS NULL`
+	}
+	query += ` ORDER BY "id" ASC`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("could not query dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	var letters []*DeadLetter
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan dead letter: %w", err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+func loadDeadLetter(id int64) (*DeadLetter, error) {
+	row := db.QueryRow(`SELECT `+deadLetterColumns+` FROM "_dead_letters" WHERE "id" = ?`, id)
+	letter, err := scanDeadLetter(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("dead letter %d does not exist", id)
+	}
+	return letter, err
+}
+
+// replayDeadLetter parses the stored body again and saves the attack as received with the letter.
+// It returns a short description of the outcome.
+func replayDeadLetter(letter *DeadLetter) (string, error) {
+	var attack Attack
+	if err := json.Unmarshal(letter.Body, &attack); err != nil {
+		return "", fmt.Errorf("still not parsable: %w", err)
+	}
+
+	result := "saved"
+	if err := saveAttackReceivedAt(&attack, letter.Received); err != nil {
+		switch {
+		case errors.Is(err, ErrDuplicateAttack):
+			result = "duplicate"
+		case errors.Is(err, ErrQuarantined):
+			result = "quarantined: " + err.Error()
+		default:
+			return "", err
+		}
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	_, err := db.Exec(`UPDATE "_dead_letters" SET "replayed" = ?, "replay_result" = ? WHERE "id" = ?`,
+		time.Now().UnixMilli(), result, letter.ID)
+	if err != nil {
+		return "", fmt.Errorf("could not mark dead letter %d as replayed: %w", letter.ID, err)
+	}
+	return result, nil
+}
+
+func parseIDs(args []string) ([]int64, error) {
+	ids := make([]int64, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func runDeadLettersCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: dead-letters list [-all] | show ID | replay -all | replay ID... | delete ID...")
+	}
+
+	flags := flag.NewFlagSet("dead-letters "+args[0], flag.ExitOnError)
+	all := flags.Bool("all", false, "include replayed dead letters (list) or replay every pending dead letter (replay)")
+	flags.Parse(args[1:])
+
+	// Listing and showing only read, replaying and deleting need the migrated database and the attack writer.
+	if args[0] == "list" || args[0] == "show" {
+		if err := openDB(appConfig.DatabasePath); err != nil {
+			return err
+		}
+		defer db.Close()
+	} else {
+		initDB(appConfig.DatabasePath)
+		defer closeDB()
+	}
+
+	switch args[0] {
+	case "list":
+		letters, err := loadDeadLetters(*all)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tRECEIVED\tREMOTE\tBYTES\tERROR\tREPLAY")
+		for _, letter := range letters {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\n", letter.ID, letter.Received.Format("2006-01-02 15:04:05"),
+				letter.RemoteAddr, len(letter.Body), logSafe(letter.Error), letter.ReplayResult)
+		}
+		return w.Flush()
+
+	case "show":
+		ids, err := parseIDs(flags.Args())
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			letter, err := loadDeadLetter(id)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("ID:       %d\n", letter.ID)
+			fmt.Printf("Received: %s\n", letter.Received.Format(time.RFC3339))
+			fmt.Printf("Request:  %s %s from %s\n", letter.Method, letter.Path, letter.RemoteAddr)
+			fmt.Printf("Error:    %s\n", letter.Error)
+			if letter.Replayed != nil {
+				fmt.Printf("Replayed: %s (%s)\n", letter.Replayed.Format(time.RFC3339), letter.ReplayResult)
+			}
+			fmt.Println("Headers:")
+			for key, values := range letter.Headers {
+				for _, value := range values {
+					fmt.Printf("  %s: %s\n", key, logSafe(value))
+				}
+			}
+			fmt.Println("Body:")
+			fmt.Println(logSafe(string(letter.Body)))
+			fmt.Println()
+		}
+		return nil
+
+	case "replay":
+		var letters []*DeadLetter
+		if *all {
+			var err error
+			letters, err = loadDeadLetters(false)
+			if err != nil {
+				return err
+			}
+		} else {
+			ids, err := parseIDs(flags.Args())
+			if err != nil {
+				return err
+			}
+			if len(ids) == 0 {
+				return fmt.Errorf("no dead letter ids given, use -all to replay every pending dead letter")
+			}
+			for _, id := range ids {
+				letter, err := loadDeadLetter(id)
+				if err != nil {
+					return err
+				}
+				letters = append(letters, letter)
+			}
+		}
+
+		failed := 0
+		for _, letter := range letters {
+			result, err := replayDeadLetter(letter)
+			if err != nil {
+				failed++
+				fmt.Printf("%d: failed: %v\n", letter.ID, err)
+				continue
+			}
+			fmt.Printf("%d: %s\n", letter.ID, result)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d dead letters could not be replayed", failed, len(letters))
+		}
+		return nil
+
+	case "delete":
+		ids, err := parseIDs(flags.Args())
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if _, err := db.Exec(`DELETE FROM "_dead_letters" WHERE "id" = ?`, id); err != nil {
+				return fmt.Errorf("could not delete dead letter %d: %w", id, err)
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown dead-letters command %q", args[0])
+}
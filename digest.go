@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:        "digest",
+		Usage:       "digest NAME [markdown|html|send]",
+		Description: "Render the digest of the last complete period as Markdown or HTML, or deliver it now.",
+		Run:         runDigestCommand,
+	})
+}
+
+type DigestPeriod string
+
+const (
+	DigestDaily  DigestPeriod = "daily"
+	DigestWeekly DigestPeriod = "weekly"
+)
+
+// SMTPConfig is the mail server a digest is sent through. The connection is upgraded with STARTTLS when the server offers it.
+type SMTPConfig struct {
+	// Address is the host:port of the mail server.
+	Address string `json:"address"`
+	// Username and Password authenticate with PLAIN, which Go only allows over TLS or to localhost.
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// DigestConfig describes a digest and where it is delivered to. Every configured delivery is used.
+type DigestConfig struct {
+	Name   string       `json:"name"`
+	Period DigestPeriod `json:"period"`
+	// Hour is the hour of the day, in the reporting timezone, the digest is sent at.
+	Hour int `json:"hour"`
+	// Weekday is the day weekly digests are sent on. Empty means Monday.
+	Weekday string `json:"weekday"`
+	// Top is the number of rows of the top lists. Zero means 10.
+	Top int `json:"top"`
+
+	SMTP *SMTPConfig `json:"smtp"`
+	// Dir is the directory the digest is written to as Markdown and HTML.
+	Dir string `json:"dir"`
+	// Webhook receives the digest as a notification event with the Markdown as its text.
+	Webhook *WebhookConfig `json:"webhook"`
+
+	weekday time.Weekday
+	webhook *Webhook
+}
+
+type DigestsConfig struct {
+	Digests []DigestConfig `json:"digests"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+var metricDigests = newCounter("netwatch_proxy_digests_total",
+	"Digests delivered.", "digest", "delivery", "result")
+
+// loadDigestsConfig reads the digests from a JSON file and fills in the defaults.
+func loadDigestsConfig(path string) ([]*DigestConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read digest config: %w", err)
+	}
+	var config DigestsConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("could not parse digest config: %w", err)
+	}
+
+	names := make(map[string]bool)
+	var digests []*DigestConfig
+	for i := range config.Digests {
+		digest := &config.Digests[i]
+		if digest.Name == "" {
+			digest.Name = string(digest.Period)
+		}
+		if names[digest.Name] {
+			return nil, fmt.Errorf("duplicate digest name %q", digest.Name)
+		}
+		names[digest.Name] = true
+
+		switch digest.Period {
+		case DigestDaily, DigestWeekly:
+		default:
+			return nil, fmt.Errorf("digest %q has unknown period %q, expected daily or weekly", digest.Name, digest.Period)
+		}
+		if digest.Hour < 0 || digest.Hour > 23 {
+			return nil, fmt.Errorf("digest %q has hour %d, expected 0 to 23", digest.Name, digest.Hour)
+		}
+		digest.weekday = time.Monday
+		if digest.Weekday != "" {
+			weekday, ok := weekdays[strings.ToLower(digest.Weekday)]
+			if !ok {
+				return nil, fmt.Errorf("digest %q has unknown weekday %q", digest.Name, digest.Weekday)
+			}
+			digest.weekday = weekday
+		}
+		if digest.Top <= 0 {
+			digest.Top = 10
+		}
+
+		if digest.SMTP == nil && digest.Dir == "" && digest.Webhook == nil {
+			return nil, fmt.Errorf("digest %q has no smtp, dir or webhook to deliver to", digest.Name)
+		}
+		if digest.SMTP != nil && (digest.SMTP.Address == "" || digest.SMTP.From == "" || len(digest.SMTP.To) == 0) {
+			return nil, fmt.Errorf("digest %q needs an smtp address, from and to", digest.Name)
+		}
+		if digest.Webhook != nil {
+			if digest.Webhook.Name == "" {
+				digest.Webhook.Name = digest.Name
+			}
+			if digest.webhook, err = newWebhook(*digest.Webhook); err != nil {
+				return nil, err
+			}
+		}
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+// periodEnd returns the end of the last complete period at now: midnight of the day the digest is sent,
+// if its hour has passed, otherwise midnight of the send day before.
+func (c *DigestConfig) periodEnd(now time.Time) time.Time {
+	now = now.In(reportLocation())
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if now.Hour() < c.Hour {
+		day = day.AddDate(0, 0, -1)
+	}
+	if c.Period == DigestWeekly {
+		day = day.AddDate(0, 0, -((int(day.Weekday()) - int(c.weekday) + 7) % 7))
+	}
+	return day
+}
+
+// periodStart returns the start of the period that ends at end. Days are calendar days, so they have 23 or 25 hours
+// when the clocks change.
+func (c *DigestConfig) periodStart(end time.Time) time.Time {
+	if c.Period == DigestWeekly {
+		return end.AddDate(0, 0, -7)
+	}
+	return end.AddDate(0, 0, -1)
+}
+
+// nextRun returns the first time after now the digest is sent at.
+func (c *DigestConfig) nextRun(now time.Time) time.Time {
+	end := c.periodEnd(now)
+	for {
+		next := end
+		if c.Period == DigestWeekly {
+			next = end.AddDate(0, 0, 7)
+		} else {
+			next = end.AddDate(0, 0, 1)
+		}
+		run := time.Date(next.Year(), next.Month(), next.Day(), c.Hour, 0, 0, 0, next.Location())
+		if run.After(now) {
+			return run
+		}
+		end = next
+	}
+}
+
+// DigestCount is a row of a top list.
+type DigestCount struct {
+	Value string
+	Count int
+}
+
+// DigestFingerprint is a credential that was first used within the period, by a single source.
+type DigestFingerprint struct {
+	Username  string
+	Password  string
+	SourceIP  string
+	FirstSeen time.Time
+}
+
+// DigestTotal compares a number of the period with the period before.
+type DigestTotal struct {
+	Name     string
+	Current  int
+	Previous int
+}
+
+// Change is the relative change to the previous period, like +12.5%.
+func (t DigestTotal) Change() string {
+	if t.Previous == 0 {
+		if t.Current == 0 {
+			return "±0%"
+		}
+		return "new"
+	}
+	change := float64(t.Current-t.Previous) / float64(t.Previous) * 100
+	if change == 0 {
+		return "±0%"
+	}
+	return fmt.Sprintf("%+.1f%%", change)
+}
+
+// Digest is the summary of a period.
+type Digest struct {
+	Name   string
+	Period DigestPeriod
+	From   time.Time
+	To     time.Time
+
+	Totals          []DigestTotal
+	TopSources      []DigestCount
+	TopUsernames    []DigestCount
+	TopPasswords    []DigestCount
+	TopLogins       []DigestCount
+	NewFingerprints []DigestFingerprint
+}
+
+// Title is the headline and the email subject of the digest.
+func (d *Digest) Title() string {
+	last := d.To.AddDate(0, 0, -1)
+	if d.Period == DigestDaily {
+		return fmt.Sprintf("Daily attack digest for %s", d.From.Format(time.DateOnly))
+	}
+	return fmt.Sprintf("Weekly attack digest for %s to %s", d.From.Format(time.DateOnly), last.Format(time.DateOnly))
+}
+
+// PeriodName is how the digest calls its period.
+func (d *Digest) PeriodName() string {
+	if d.Period == DigestDaily {
+		return "day"
+	}
+	return "week"
+}
+
+func digestTotals(db *sql.DB, from, to time.Time) (attacks, sources, logins, fingerprints int, err error) {
+	err = db.QueryRow(`SELECT
+			COUNT(*),
+			COUNT(DISTINCT "source_ip"),
+			(SELECT COUNT(*) FROM (SELECT DISTINCT "username", "password" FROM "_attacks" WHERE "timestamp" >= ?1 AND "timestamp" < ?2)),
+			(SELECT COUNT(*) FROM "_rollup_credentials" WHERE "first_seen" >= ?1 AND "first_seen" < ?2 AND "sources" = 1)
+		FROM "_attacks"
+		WHERE "timestamp" >= ?1 AND "timestamp" < ?2`,
+		from.UnixMilli(), to.UnixMilli()).Scan(&attacks, &sources, &logins, &fingerprints)
+	if err != nil {
+		err = fmt.Errorf("could not count attacks: %w", err)
+	}
+	return
+}
+
+// digestTop returns the most frequent values of the period. The expression is evaluated on the attacks view.
+func digestTop(db *sql.DB, expression string, from, to time.Time, limit int) ([]DigestCount, error) {
+	rows, err := db.Query(fmt.Sprintf(`SELECT %s AS "value", COUNT(*) AS "count"
+		FROM "attacks"
+		WHERE "timestamp" >= ? AND "timestamp" < ?
+		GROUP BY "value"
+		ORDER BY "count" DESC, "value" ASC
+		LIMIT ?`, expression), from.UnixMilli(), to.UnixMilli(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not query top list: %w", err)
+	}
+	defer rows.Close()
+
+	var top []DigestCount
+	for rows.Next() {
+		var row DigestCount
+		if err := rows.Scan(&row.Value, &row.Count); err != nil {
+			return nil, fmt.Errorf("could not scan top list: %w", err)
+		}
+		top = append(top, row)
+	}
+	return top, rows.Err()
+}
+
+// digestFingerprints returns the newest credentials first used within the period, like report_new_credential_fingerprints_last_7_days.
+func digestFingerprints(db *sql.DB, from, to time.Time, limit int) ([]DigestFingerprint, error) {
+	rows, err := db.Query(`SELECT "_dict_usernames"."value", "_dict_passwords"."value", "_dict_source_ips"."value", "_rollup_credentials"."first_seen"
+		FROM "_rollup_credentials"
+		JOIN "_rollup_source_credentials" ON
+			"_rollup_source_credentials"."username" = "_rollup_credentials"."username" AND
+			"_rollup_source_credentials"."password" = "_rollup_credentials"."password"
+		JOIN "_dict_usernames" ON "_rollup_credentials"."username" = "_dict_usernames"."id"
+		JOIN "_dict_passwords" ON "_rollup_credentials"."password" = "_dict_passwords"."id"
+		JOIN "_dict_source_ips" ON "_rollup_source_credentials"."source_ip" = "_dict_source_ips"."id"
+		WHERE "_rollup_credentials"."first_seen" >= ? AND "_rollup_credentials"."first_seen" < ? AND "_rollup_credentials"."sources" = 1
+		ORDER BY "_rollup_credentials"."first_seen" DESC
+		LIMIT ?`, from.UnixMilli(), to.UnixMilli(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not query new fingerprints: %w", err)
+	}
+	defer rows.Close()
+
+	var fingerprints []DigestFingerprint
+	for rows.Next() {
+		var fingerprint DigestFingerprint
+		var firstSeen int64
+		if err := rows.Scan(&fingerprint.Username, &fingerprint.Password, &fingerprint.SourceIP, &firstSeen); err != nil {
+			return nil, fmt.Errorf("could not scan new fingerprint: %w", err)
+		}
+		fingerprint.FirstSeen = time.UnixMilli(firstSeen).In(reportLocation())
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	return fingerprints, rows.Err()
+}
+
+// buildDigest collects the digest of the last complete period at now.
+// There is no enrichment of the sources yet, so the digest has no ASNs or countries.
+func buildDigest(db *sql.DB, config *DigestConfig, now time.Time) (*Digest, error) {
+	digest := &Digest{Name: config.Name, Period: config.Period, To: config.periodEnd(now)}
+	digest.From = config.periodStart(digest.To)
+	previous := config.periodStart(digest.From)
+
+	attacks, sources, logins, fingerprints, err := digestTotals(db, digest.From, digest.To)
+	if err != nil {
+		return nil, err
+	}
+	previousAttacks, previousSources, previousLogins, previousFingerprints, err := digestTotals(db, previous, digest.From)
+	if err != nil {
+		return nil, err
+	}
+	digest.Totals = []DigestTotal{
+		{"Attacks", attacks, previousAttacks},
+		{"Sources", sources, previousSources},
+		{"Credentials", logins, previousLogins},
+		{"New fingerprints", fingerprints, previousFingerprints},
+	}
+
+	if digest.TopSources, err = digestTop(db, `"source_ip"`, digest.From, digest.To, config.Top); err != nil {
+		return nil, err
+	}
+	if digest.TopUsernames, err = digestTop(db, `"username"`, digest.From, digest.To, config.Top); err != nil {
+		return nil, err
+	}
+	if digest.TopPasswords, err = digestTop(db, `"password"`, digest.From, digest.To, config.Top); err != nil {
+		return nil, err
+	}
+	if digest.TopLogins, err = digestTop(db, `"username" || ' / ' || "password"`, digest.From, digest.To, config.Top); err != nil {
+		return nil, err
+	}
+	if digest.NewFingerprints, err = digestFingerprints(db, digest.From, digest.To, config.Top); err != nil {
+		return nil, err
+	}
+	digest.redact(appConfig.Redaction)
+	return digest, nil
+}
+
+// redact replaces the credentials the policy withholds. The counts stay, they tell how concentrated the attacks are.
+func (d *Digest) redact(policy RedactionPolicy) {
+	for i := range d.TopUsernames {
+		d.TopUsernames[i].Value = policy.username(d.TopUsernames[i].Value)
+	}
+	for i := range d.TopPasswords {
+		d.TopPasswords[i].Value = policy.password(d.TopPasswords[i].Value)
+	}
+	if policy.withholdsPasswords() {
+		for i := range d.TopLogins {
+			d.TopLogins[i].Value = redacted
+		}
+	}
+	for i := range d.NewFingerprints {
+		d.NewFingerprints[i].Username = policy.username(d.NewFingerprints[i].Username)
+		d.NewFingerprints[i].Password = policy.password(d.NewFingerprints[i].Password)
+	}
+}
+
+// markdownEscape makes attacker controlled text safe to use in a Markdown table cell.
+func markdownEscape(s string) string {
+	s = logSafe(s)
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune("\\`*_[]<>|~", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() == 0 {
+		return "(empty)"
+	}
+	return b.String()
+}
+
+var digestMarkdownTemplate = texttemplate.Must(texttemplate.New("markdown").Funcs(texttemplate.FuncMap{
+	"md":   markdownEscape,
+	"list": func(values ...any) []any { return values },
+	"time": func(t time.Time) string { return t.Format(time.DateTime) },
+}).Parse(`# {{ .Title }}
+
+| | This {{ .PeriodName }} | Previous {{ .PeriodName }} | Change |
+|---|---:|---:|---:|
+{{- range .Totals }}
+| {{ .Name }} | {{ .Current }} | {{ .Previous }} | {{ .Change }} |
+{{- end }}
+{{ template "top" (list "Top attackers" "Source IP" .TopSources) }}
+{{- template "top" (list "Top usernames" "Username" .TopUsernames) }}
+{{- template "top" (list "Top passwords" "Password" .TopPasswords) }}
+{{- template "top" (list "Top credentials" "Username / password" .TopLogins) }}
+## New credential fingerprints
+{{ if .NewFingerprints }}
+| Username | Password | Source IP | First seen |
+|---|---|---|---|
+{{- range .NewFingerprints }}
+| {{ md .Username }} | {{ md .Password }} | {{ md .SourceIP }} | {{ time .FirstSeen }} |
+{{- end }}
+{{ else }}
+None.
+{{ end -}}
+{{ define "top" }}
+## {{ index . 0 }}
+{{ if index . 2 }}
+| {{ index . 1 }} | Attacks |
+|---|---:|
+{{- range index . 2 }}
+| {{ md .Value }} | {{ .Count }} |
+{{- end }}
+{{ else }}
+None.
+{{ end }}
+{{- end }}`))
+
+var digestHTMLTemplate = htmltemplate.Must(htmltemplate.New("html").Funcs(htmltemplate.FuncMap{
+	"time": func(t time.Time) string { return t.Format(time.DateTime) },
+	"list": func(values ...any) []any { return values },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+td.number { text-align: right; }
+</style>
+</head>
+<body>
+<h1>{{ .Title }}</h1>
+<table>
+<tr><th></th><th>This {{ .PeriodName }}</th><th>Previous {{ .PeriodName }}</th><th>Change</th></tr>
+{{- range .Totals }}
+<tr><td>{{ .Name }}</td><td class="number">{{ .Current }}</td><td class="number">{{ .Previous }}</td><td class="number">{{ .Change }}</td></tr>
+{{- end }}
+</table>
+{{ template "top" (list "Top attackers" "Source IP" .TopSources) }}
+{{- template "top" (list "Top usernames" "Username" .TopUsernames) }}
+{{- template "top" (list "Top passwords" "Password" .TopPasswords) }}
+{{- template "top" (list "Top credentials" "Username / password" .TopLogins) }}
+<h2>New credential fingerprints</h2>
+{{- if .NewFingerprints }}
+<table>
+<tr><th>Username</th><th>Password</th><th>Source IP</th><th>First seen</th></tr>
+{{- range .NewFingerprints }}
+<tr><td>{{ .Username }}</td><td>{{ .Password }}</td><td>{{ .SourceIP }}</td><td>{{ time .FirstSeen }}</td></tr>
+{{- end }}
+</table>
+{{- else }}
+<p>None.</p>
+{{- end }}
+</body>
+</html>
+{{ define "top" }}
+<h2>{{ index . 0 }}</h2>
+{{- if index . 2 }}
+<table>
+<tr><th>{{ index . 1 }}</th><th>Attacks</th></tr>
+{{- range index . 2 }}
+<tr><td>{{ .Value }}</td><td class="number">{{ .Count }}</td></tr>
+{{- end }}
+</table>
+{{- else }}
+<p>None.</p>
+{{- end }}
+{{- end }}`))
+
+// Markdown renders the digest as Markdown.
+func (d *Digest) Markdown() (string, error) {
+	var buf bytes.Buffer
+	if err := digestMarkdownTemplate.Execute(&buf, d); err != nil {
+		return "", fmt.Errorf("could not render digest: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// HTML renders the digest as an HTML document.
+func (d *Digest) HTML() (string, error) {
+	var buf bytes.Buffer
+	if err := digestHTMLTemplate.Execute(&buf, d); err != nil {
+		return "", fmt.Errorf("could not render digest: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// digestEmail builds a multipart/alternative message with the Markdown as plain text and the HTML.
+func digestEmail(config *SMTPConfig, subject, markdown, html string, now time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", markdown},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n", parts.Boundary())
+	fmt.Fprintf(&msg, "\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+func sendDigestEmail(config *SMTPConfig, digest *Digest, markdown, html string, now time.Time) error {
+	msg, err := digestEmail(config, digest.Title(), markdown, html, now)
+	if err != nil {
+		return fmt.Errorf("could not build email: %w", err)
+	}
+
+	var auth smtp.Auth
+	if config.Username != "" {
+		host, _, _ := strings.Cut(config.Address, ":")
+		auth = smtp.PlainAuth("", config.Username, config.Password, host)
+	}
+	if err := smtp.SendMail(config.Address, auth, config.From, config.To, msg); err != nil {
+		return fmt.Errorf("could not send email: %w", err)
+	}
+	return nil
+}
+
+// writeDigestFiles writes the digest to NAME-DATE.md and NAME-DATE.html in the directory.
+func writeDigestFiles(dir string, digest *Digest, markdown, html string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create digest directory: %w", err)
+	}
+	base := filepath.Join(dir, digest.Name+"-"+digest.From.Format(time.DateOnly))
+	if err := os.WriteFile(base+".md", []byte(markdown), 0644); err != nil {
+		return fmt.Errorf("could not write digest: %w", err)
+	}
+	if err := os.WriteFile(base+".html", []byte(html), 0644); err != nil {
+		return fmt.Errorf("could not write digest: %w", err)
+	}
+	return nil
+}
+
+// deliverDigest builds the digest of the last complete period and sends it to every configured delivery.
+// A failed delivery does not stop the others, the first error is returned.
+func deliverDigest(db *sql.DB, config *DigestConfig, now time.Time) error {
+	digest, err := buildDigest(db, config, now)
+	if err != nil {
+		return err
+	}
+	markdown, err := digest.Markdown()
+	if err != nil {
+		return err
+	}
+	html, err := digest.HTML()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	deliver := func(delivery string, send func() error) {
+		if err := send(); err != nil {
+			metricDigests.Inc(config.Name, delivery, "error")
+			log.Printf("[ERROR] Failed to deliver digest %s by %s: %v\n", config.Name, delivery, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		metricDigests.Inc(config.Name, delivery, "success")
+		log.Printf("[INFO] Delivered digest %s for %s by %s.\n", config.Name, digest.From.Format(time.DateOnly), delivery)
+	}
+
+	if config.SMTP != nil {
+		deliver("smtp", func() error { return sendDigestEmail(config.SMTP, digest, markdown, html, now) })
+	}
+	if config.Dir != "" {
+		deliver("file", func() error { return writeDigestFiles(config.Dir, digest, markdown, html) })
+	}
+	if config.webhook != nil {
+		deliver("webhook", func() error {
+			return config.webhook.Send(NotifyEvent{
+				Rule:  config.Name,
+				Event: "digest",
+				Key:   config.Name + ":" + digest.From.Format(time.DateOnly),
+				Text:  markdown,
+				Time:  now,
+				Fields: map[string]any{
+					"title": digest.Title(),
+					"from":  digest.From,
+					"to":    digest.To,
+					"html":  html,
+				},
+			})
+		})
+	}
+	return firstErr
+}
+
+// runDigestSchedule delivers every digest at its hour. Digests that were due while the proxy was down are not sent.
+func runDigestSchedule(db *sql.DB, digests []*DigestConfig) {
+	for {
+		now := time.Now()
+		var next time.Time
+		for _, digest := range digests {
+			if run := digest.nextRun(now); next.IsZero() || run.Before(next) {
+				next = run
+			}
+		}
+
+		time.Sleep(time.Until(next))
+
+		for _, digest := range digests {
+			if digest.nextRun(next.Add(-time.Second)).Equal(next) {
+				deliverDigest(db, digest, next)
+			}
+		}
+	}
+}
+
+func runDigestCommand(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: digest NAME [markdown|html|send]")
+	}
+	if appConfig.DigestConfigPath == "" {
+		return fmt.Errorf("no digests are configured, set NETWATCH_PROXY_DIGEST_CONFIG")
+	}
+	digests, err := loadDigestsConfig(appConfig.DigestConfigPath)
+	if err != nil {
+		return err
+	}
+	var config *DigestConfig
+	for _, digest := range digests {
+		if digest.Name == args[0] {
+			config = digest
+		}
+	}
+	if config == nil {
+		return fmt.Errorf("unknown digest %q", args[0])
+	}
+
+	if err := openDB(appConfig.DatabasePath); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	mode := "markdown"
+	if len(args) == 2 {
+		mode = args[1]
+	}
+	switch mode {
+	case "send":
+		return deliverDigest(db, config, time.Now())
+	case "markdown", "html":
+		digest, err := buildDigest(db, config, time.Now())
+		if err != nil {
+			return err
+		}
+		render := digest.Markdown
+		if mode == "html" {
+			render = digest.HTML
+		}
+		out, err := render()
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q, expected markdown, html or send", mode)
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer accepts mail like a local test server and keeps the messages.
+type fakeSMTPServer struct {
+	net.Listener
+
+	mu       sync.Mutex
+	messages []fakeSMTPMessage
+}
+
+type fakeSMTPMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{Listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+
+	var message fakeSMTPMessage
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(command) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 localhost")
+		case "MAIL":
+			message = fakeSMTPMessage{From: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			message.To = append(message.To, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			message.Data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, message)
+			s.mu.Unlock()
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) Messages() []fakeSMTPMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeSMTPMessage(nil), s.messages...)
+}
+
+// writeDigestsConfig writes the digests to a config file and loads it.
+func writeDigestsConfig(t *testing.T, config string) []*DigestConfig {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "digests.json")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digests, err := loadDigestsConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digests
+}
+
+func TestLoadDigestsConfig(t *testing.T) {
+	digests := writeDigestsConfig(t, `{"digests": [
+		{"period": "daily", "hour": 6, "dir": "/tmp"},
+		{"name": "team", "period": "weekly", "weekday": "Friday", "top": 5, "smtp": {"address": "localhost:25", "from": "proxy@example.com", "to": ["team@example.com"]}}
+	]}`)
+	if len(digests) != 2 {
+		t.Fatalf("got %d digests, want 2", len(digests))
+	}
+	if digests[0].Name != "daily" || digests[0].Top != 10 || digests[0].weekday != time.Monday {
+		t.Errorf("got %+v, want the defaults", digests[0])
+	}
+	if digests[1].weekday != time.Friday || digests[1].Top != 5 {
+		t.Errorf("got %+v, want Friday and 5", digests[1])
+	}
+
+	for _, config := range []string{
+		`{"digests": [{"period": "monthly", "dir": "/tmp"}]}`,
+		`{"digests": [{"period": "daily", "hour": 24, "dir": "/tmp"}]}`,
+		`{"digests": [{"period": "weekly", "weekday": "someday", "dir": "/tmp"}]}`,
+		`{"digests": [{"period": "daily"}]}`,
+		`{"digests": [{"period": "daily", "smtp": {"address": "localhost:25"}}]}`,
+		`{"digests": [{"period": "daily", "dir": "/tmp"}, {"period": "daily", "dir": "/tmp"}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "digests.json")
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadDigestsConfig(path); err == nil {
+			t.Errorf("%s: expected an error", config)
+		}
+	}
+}
+
+func TestDigestPeriods(t *testing.T) {
+	setupTest(t)
+	setReportTimezone(t, loadLocation(t, "America/New_York"))
+	loc := reportLocation()
+
+	daily := &DigestConfig{Period: DigestDaily, Hour: 6}
+	weekly := &DigestConfig{Period: DigestWeekly, Hour: 6, weekday: time.Monday}
+
+	tests := []struct {
+		config    *DigestConfig
+		now       time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+		wantNext  time.Time
+	}{
+		// 2025-03-12 is a Wednesday.
+		{daily, time.Date(2025, 3, 12, 7, 0, 0, 0, loc),
+			time.Date(2025, 3, 11, 0, 0, 0, 0, loc), time.Date(2025, 3, 12, 0, 0, 0, 0, loc), time.Date(2025, 3, 13, 6, 0, 0, 0, loc)},
+		{daily, time.Date(2025, 3, 12, 5, 0, 0, 0, loc),
+			time.Date(2025, 3, 10, 0, 0, 0, 0, loc), time.Date(2025, 3, 11, 0, 0, 0, 0, loc), time.Date(2025, 3, 12, 6, 0, 0, 0, loc)},
+		// The clocks went forward on 2025-03-09, the day has 23 hours.
+		{daily, time.Date(2025, 3, 10, 6, 0, 0, 0, loc),
+			time.Date(2025, 3, 9, 0, 0, 0, 0, loc), time.Date(2025, 3, 10, 0, 0, 0, 0, loc), time.Date(2025, 3, 11, 6, 0, 0, 0, loc)},
+		{weekly, time.Date(2025, 3, 12, 7, 0, 0, 0, loc),
+			time.Date(2025, 3, 3, 0, 0, 0, 0, loc), time.Date(2025, 3, 10, 0, 0, 0, 0, loc), time.Date(2025, 3, 17, 6, 0, 0, 0, loc)},
+		{weekly, time.Date(2025, 3, 17, 5, 59, 0, 0, loc),
+			time.Date(2025, 3, 3, 0, 0, 0, 0, loc), time.Date(2025, 3, 10, 0, 0, 0, 0, loc), time.Date(2025, 3, 17, 6, 0, 0, 0, loc)},
+		{weekly, time.Date(2025, 3, 17, 6, 0, 0, 0, loc),
+			time.Date(2025, 3, 10, 0, 0, 0, 0, loc), time.Date(2025, 3, 17, 0, 0, 0, 0, loc), time.Date(2025, 3, 24, 6, 0, 0, 0, loc)},
+	}
+
+	for _, test := range tests {
+		end := test.config.periodEnd(test.now)
+		if start := test.config.periodStart(end); !start.Equal(test.wantStart) || !end.Equal(test.wantEnd) {
+			t.Errorf("%s at %s: got %s to %s, want %s to %s", test.config.Period, test.now, start, end, test.wantStart, test.wantEnd)
+		}
+		if next := test.config.nextRun(test.now); !next.Equal(test.wantNext) {
+			t.Errorf("%s at %s: next run at %s, want %s", test.config.Period, test.now, next, test.wantNext)
+		}
+	}
+}
+
+func TestDigestChange(t *testing.T) {
+	tests := []struct {
+		total DigestTotal
+		want  string
+	}{
+		{DigestTotal{Current: 150, Previous: 100}, "+50.0%"},
+		{DigestTotal{Current: 50, Previous: 200}, "-75.0%"},
+		{DigestTotal{Current: 7, Previous: 7}, "±0%"},
+		{DigestTotal{Current: 3, Previous: 0}, "new"},
+		{DigestTotal{Current: 0, Previous: 0}, "±0%"},
+	}
+	for _, test := range tests {
+		if got := test.total.Change(); got != test.want {
+			t.Errorf("%d after %d: got %q, want %q", test.total.Current, test.total.Previous, got, test.want)
+		}
+	}
+}
+
+// saveDigestAttacks saves attacks on the two days before now and returns the time the daily digest covers them at.
+func saveDigestAttacks(t *testing.T) time.Time {
+	t.Helper()
+
+	day := time.Date(2025, 3, 11, 0, 0, 0, 0, reportLocation())
+
+	// The day before: two attacks of one source.
+	saveAttacks(t, []*Attack{
+		newAttack("198.51.100.1", "root", "123456", day.Add(-12*time.Hour)),
+		newAttack("198.51.100.1", "root", "password", day.Add(-11*time.Hour)),
+	})
+	// The day of the digest: three sources, one of them trying a password nobody tried before.
+	saveAttacks(t, []*Attack{
+		newAttack("198.51.100.1", "root", "123456", day.Add(1*time.Hour)),
+		newAttack("198.51.100.1", "root", "123456", day.Add(2*time.Hour)),
+		newAttack("198.51.100.2", "admin", "123456", day.Add(3*time.Hour)),
+		newAttack("198.51.100.3", "root", "hunter2|*x*", day.Add(4*time.Hour)),
+	})
+	// After the period, not part of the digest.
+	saveAttacks(t, []*Attack{
+		newAttack("198.51.100.9", "oracle", "oracle", day.Add(25*time.Hour)),
+	})
+	return day.Add(30 * time.Hour)
+}
+
+func TestBuildDigest(t *testing.T) {
+	setupTest(t)
+	appConfig.Redaction = RedactNone
+	now := saveDigestAttacks(t)
+
+	digest, err := buildDigest(db, &DigestConfig{Name: "daily", Period: DigestDaily, Hour: 6, Top: 10}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := digest.From.Format(time.DateOnly); got != "2025-03-11" {
+		t.Errorf("got digest from %s, want 2025-03-11", got)
+	}
+	wantTotals := []DigestTotal{
+		{"Attacks", 4, 2},
+		{"Sources", 3, 1},
+		{"Credentials", 3, 2},
+		{"New fingerprints", 2, 2},
+	}
+	if len(digest.Totals) != len(wantTotals) {
+		t.Fatalf("got totals %+v, want %+v", digest.Totals, wantTotals)
+	}
+	for i, want := range wantTotals {
+		if digest.Totals[i] != want {
+			t.Errorf("got total %+v, want %+v", digest.Totals[i], want)
+		}
+	}
+
+	wantSources := []DigestCount{{"198.51.100.1", 2}, {"198.51.100.2", 1}, {"198.51.100.3", 1}}
+	if len(digest.TopSources) != len(wantSources) {
+		t.Fatalf("got top sources %+v, want %+v", digest.TopSources, wantSources)
+	}
+	for i, want := range wantSources {
+		if digest.TopSources[i] != want {
+			t.Errorf("got top source %+v, want %+v", digest.TopSources[i], want)
+		}
+	}
+	if len(digest.TopLogins) == 0 || digest.TopLogins[0] != (DigestCount{"root / 123456", 2}) {
+		t.Errorf("got top logins %+v, want root / 123456 first", digest.TopLogins)
+	}
+
+	if len(digest.NewFingerprints) != 2 {
+		t.Fatalf("got new fingerprints %+v, want 2", digest.NewFingerprints)
+	}
+	if got := digest.NewFingerprints[0]; got.Password != "hunter2|*x*" || got.SourceIP != "198.51.100.3" {
+		t.Errorf("got newest fingerprint %+v, want hunter2|*x* of 198.51.100.3", got)
+	}
+}
+
+func TestRenderDigest(t *testing.T) {
+	setupTest(t)
+	appConfig.Redaction = RedactNone
+	now := saveDigestAttacks(t)
+
+	digest, err := buildDigest(db, &DigestConfig{Name: "daily", Period: DigestDaily, Hour: 6, Top: 10}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	markdown, err := digest.Markdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# Daily attack digest for 2025-03-11\n",
+		"| Attacks | 4 | 2 | +100.0% |\n",
+		"## Top attackers\n",
+		"| 198.51.100.1 | 2 |\n",
+		"| root | hunter2\\|\\*x\\* | 198.51.100.3 | 2025-03-11 04:00:00 |\n",
+	} {
+		if !strings.Contains(markdown, want) {
+			t.Errorf("Markdown does not contain %q:\n%s", want, markdown)
+		}
+	}
+
+	html, err := digest.HTML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<title>Daily attack digest for 2025-03-11</title>",
+		"<tr><td>198.51.100.1</td><td class=\"number\">2</td></tr>",
+		"<td>hunter2|*x*</td>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML does not contain %q:\n%s", want, html)
+		}
+	}
+}
+
+func TestDigestRedaction(t *testing.T) {
+	setupTest(t)
+	now := saveDigestAttacks(t)
+
+	digest, err := buildDigest(db, &DigestConfig{Name: "daily", Period: DigestDaily, Hour: 6, Top: 10}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := digest.TopUsernames[0]; got != (DigestCount{"root", 3}) {
+		t.Errorf("got top username %+v, want root", got)
+	}
+	if got := digest.TopPasswords[0]; got != (DigestCount{redacted, 3}) {
+		t.Errorf("got top password %+v, want it redacted", got)
+	}
+	if got := digest.TopLogins[0]; got != (DigestCount{redacted, 2}) {
+		t.Errorf("got top login %+v, want it redacted", got)
+	}
+	if got := digest.NewFingerprints[0]; got.Username != "root" || got.Password != redacted {
+		t.Errorf("got newest fingerprint %+v, want its password redacted", got)
+	}
+
+	markdown, err := digest.Markdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(markdown, "123456") || strings.Contains(markdown, "hunter2") {
+		t.Errorf("Markdown contains a password:\n%s", markdown)
+	}
+}
+
+func TestMarkdownEscape(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"root", "root"},
+		{"", "(empty)"},
+		{"a|b", `a\|b`},
+		{"<script>", `\<script\>`},
+		{"[x](http://e)", `\[x\](http://e)`},
+		{"two\nlines", `two\\nlines`},
+	}
+	for _, test := range tests {
+		if got := markdownEscape(test.in); got != test.want {
+			t.Errorf("markdownEscape(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestDeliverDigest(t *testing.T) {
+	setupTest(t)
+	now := saveDigestAttacks(t)
+
+	smtpServer := newFakeSMTPServer(t)
+
+	var webhookMu sync.Mutex
+	var webhookEvents []NotifyEvent
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event NotifyEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		webhookMu.Lock()
+		webhookEvents = append(webhookEvents, event)
+		webhookMu.Unlock()
+	}))
+	t.Cleanup(hook.Close)
+
+	dir := t.TempDir()
+	digests := writeDigestsConfig(t, `{"digests": [{
+		"name": "ops",
+		"period": "daily",
+		"hour": 6,
+		"smtp": {"address": "`+smtpServer.Addr().String()+`", "from": "proxy@example.com", "to": ["ops@example.com", "oncall@example.com"]},
+		"dir": "`+dir+`",
+		"webhook": {"url": "`+hook.URL+`"}
+	}]}`)
+
+	before := metricDigests.Get("ops", "smtp", "success")
+	if err := deliverDigest(db, digests[0], now); err != nil {
+		t.Fatal(err)
+	}
+	if got := metricDigests.Get("ops", "smtp", "success") - before; got != 1 {
+		t.Errorf("got %v successful smtp deliveries, want 1", got)
+	}
+
+	t.Run("smtp", func(t *testing.T) {
+		messages := smtpServer.Messages()
+		if len(messages) != 1 {
+			t.Fatalf("got %d messages, want 1", len(messages))
+		}
+		if messages[0].From != "proxy@example.com" || strings.Join(messages[0].To, ",") != "ops@example.com,oncall@example.com" {
+			t.Errorf("got envelope from %s to %v", messages[0].From, messages[0].To)
+		}
+
+		msg, err := mail.ReadMessage(strings.NewReader(messages[0].Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := msg.Header.Get("Subject"); got != "Daily attack digest for 2025-03-11" {
+			t.Errorf("got subject %q", got)
+		}
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/alternative" {
+			t.Fatalf("got content type %q: %v", msg.Header.Get("Content-Type"), err)
+		}
+
+		parts := multipart.NewReader(msg.Body, params["boundary"])
+		var types []string
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The reader decodes quoted-printable parts.
+			body, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			types = append(types, part.Header.Get("Content-Type"))
+			if !strings.Contains(string(body), "198.51.100.3") {
+				t.Errorf("part %s does not contain the sources:\n%s", part.Header.Get("Content-Type"), body)
+			}
+		}
+		if strings.Join(types, ",") != "text/plain; charset=utf-8,text/html; charset=utf-8" {
+			t.Errorf("got parts %v", types)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		for _, name := range []string{"ops-2025-03-11.md", "ops-2025-03-11.html"} {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), "Daily attack digest for 2025-03-11") {
+				t.Errorf("%s does not contain the title:\n%s", name, data)
+			}
+		}
+	})
+
+	t.Run("webhook", func(t *testing.T) {
+		webhookMu.Lock()
+		defer webhookMu.Unlock()
+		if len(webhookEvents) != 1 {
+			t.Fatalf("got %d webhook events, want 1", len(webhookEvents))
+		}
+		event := webhookEvents[0]
+		if event.Event != "digest" || event.Key != "ops:2025-03-11" || !strings.HasPrefix(event.Text, "# Daily attack digest") {
+			t.Errorf("got event %+v", event)
+		}
+		if event.Fields["title"] != "Daily attack digest for 2025-03-11" {
+			t.Errorf("got fields %v", event.Fields)
+		}
+	})
+}
+
+func TestDeliverDigestFailure(t *testing.T) {
+	setupTest(t)
+	now := saveDigestAttacks(t)
+
+	// Nothing listens on the address once the listener is closed.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	dir := t.TempDir()
+	digests := writeDigestsConfig(t, `{"digests": [{
+		"name": "broken",
+		"period": "daily",
+		"smtp": {"address": "`+address+`", "from": "proxy@example.com", "to": ["ops@example.com"]},
+		"dir": "`+dir+`"
+	}]}`)
+
+	if err := deliverDigest(db, digests[0], now); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := metricDigests.Get("broken", "smtp", "error"); got != 1 {
+		t.Errorf("got %v failed smtp deliveries, want 1", got)
+	}
+	// The file is still written.
+	if _, err := os.Stat(filepath.Join(dir, "broken-2025-03-11.md")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// evidenceParserVersion is stored with the metadata of every evidence.
+// Raise it when a parser is added or changed, so that the stored evidences are parsed again at the next start.
+const evidenceParserVersion = 1
+
+func init() {
+	registerEvidenceParser(&EvidenceParser{Name: "ssh_banner", Parse: parseSSHBanner})
+	registerEvidenceParser(&EvidenceParser{Name: "ssh_algorithms", Parse: parseSSHAlgorithms})
+	registerEvidenceParser(&EvidenceParser{Name: "source_port", Parse: parseSourcePort})
+}
+
+// EvidenceMetadata are the structures found in the evidence of an attack, the pod sends it as free text.
+// Lists are comma separated, values that were not found are empty or zero.
+type EvidenceMetadata struct {
+	// Banner is the SSH identification string of the client, like SSH-2.0-libssh_0.9.6.
+	Banner          string
+	Protocol        string
+	Software        string
+	SoftwareVersion string
+	Comment         string
+	Kex             string
+	Ciphers         string
+	MACs            string
+	SourcePort      int
+	// Parsers are the names of the parsers that found something.
+	Parsers []string
+}
+
+// EvidenceParser extracts a known structure from the evidence into the metadata.
+type EvidenceParser struct {
+	Name string
+	// Parse fills in what it finds and reports whether it found anything.
+	Parse func(evidence string, metadata *EvidenceMetadata) bool
+}
+
+var evidenceParsers []*EvidenceParser
+
+// registerEvidenceParser adds a parser, parsers run in the order they are registered.
+func registerEvidenceParser(parser *EvidenceParser) {
+	evidenceParsers = append(evidenceParsers, parser)
+}
+
+// parseEvidence runs every parser over the evidence.
+func parseEvidence(evidence string) EvidenceMetadata {
+	var metadata EvidenceMetadata
+	for _, parser := range evidenceParsers {
+		if parser.Parse(evidence, &metadata) {
+			metadata.Parsers = append(metadata.Parsers, parser.Name)
+		}
+	}
+	return metadata
+}
+
+var (
+	// sshBannerPattern matches the identification string of RFC 4253, section 4.2, anywhere in the evidence.
+	// Clients put dashes into the software version although the RFC does not allow them.
+	sshBannerPattern = regexp.MustCompile(`SSH-(\d+\.\d+)-([^\s"',;\])}]+)(?:[ \t]+([^\r\n"']*))?`)
+	// softwareVersionPattern splits a software version like OpenSSH_8.9p1 or JSCH-0.1.54 at the first
+	// separator that is followed by a digit.
+	softwareVersionPattern = regexp.MustCompile(`^(.+?)[._-]v?(\d[0-9A-Za-z._+~-]*)$`)
+)
+
+func parseSSHBanner(evidence string, metadata *EvidenceMetadata) bool {
+	match := sshBannerPattern.FindStringSubmatch(evidence)
+	if match == nil {
+		return false
+	}
+	metadata.Protocol = match[1]
+	metadata.Software = match[2]
+	if parts := softwareVersionPattern.FindStringSubmatch(match[2]); parts != nil {
+		metadata.Software, metadata.SoftwareVersion = parts[1], parts[2]
+	}
+	metadata.Banner = "SSH-" + match[1] + "-" + match[2]
+	// The comment is the rest of the line, which is only the banner's own if the line starts with it.
+	if start := strings.Index(evidence, match[0]); start == 0 || evidence[start-1] == '\n' {
+		metadata.Comment = strings.TrimSpace(match[3])
+		if metadata.Comment != "" {
+			metadata.Banner += " " + metadata.Comment
+		}
+	}
+	return true
+}
+
+// sshAlgorithmsPattern matches a name like kex_algorithms or ciphers followed by a list of algorithm names,
+// as key=value, key: value or a JSON array with quoted names.
+var sshAlgorithmsPattern = regexp.MustCompile(`(?i)\b(kex(?:_?algorithms)?|ciphers?|encryption(?:_algorithms)?(?:_client_to_server)?|macs?|mac_algorithms(?:_client_to_server)?)["']?\s*[=:]\s*\[?\s*["']?([A-Za-z0-9@._+-]+(?:["']?\s*,\s*["']?[A-Za-z0-9@._+-]+)*)`)
+
+func parseSSHAlgorithms(evidence string, metadata *EvidenceMetadata) bool {
+	found := false
+	for _, match := range sshAlgorithmsPattern.FindAllStringSubmatch(evidence, -1) {
+		var names []string
+		for _, name := range strings.Split(match[2], ",") {
+			names = append(names, strings.Trim(name, ` "'`))
+		}
+		list := strings.Join(names, ",")
+
+		switch key := strings.ToLower(match[1]); {
+		case strings.HasPrefix(key, "kex"):
+			metadata.Kex = list
+		case strings.HasPrefix(key, "cipher"), strings.HasPrefix(key, "encryption"):
+			metadata.Ciphers = list
+		default:
+			metadata.MACs = list
+		}
+		found = true
+	}
+	return found
+}
+
+// sourcePortPatterns match a source port as a key=value pair or in a sshd log line like "from 198.51.100.1 port 51234".
+var sourcePortPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(?:src_?port|source_?port|sport)["']?\s*[=:]\s*["']?(\d{1,5})\b`),
+	regexp.MustCompile(`(?i)\bfrom\s+\S+\s+port\s+(\d{1,5})\b`),
+}
+
+func parseSourcePort(evidence string, metadata *EvidenceMetadata) bool {
+	for _, pattern := range sourcePortPatterns {
+		match := pattern.FindStringSubmatch(evidence)
+		if match == nil {
+			continue
+		}
+		if port, err := strconv.Atoi(match[1]); err == nil && port > 0 && port <= 65535 {
+			metadata.SourcePort = port
+			return true
+		}
+	}
+	return false
+}
+
+var evidenceClassifier = &classifier{
+	dictionary: "_dict_evidences",
+	table:      "_evidence_metadata",
+	version:    evidenceParserVersion,
+	columns:    []string{"banner", "protocol", "software", "software_version", "comment", "kex", "ciphers", "macs", "source_port", "parsers"},
+	values: func(value string) []any {
+		metadata := parseEvidence(value)
+		return []any{metadata.Banner, metadata.Protocol, metadata.Software, metadata.SoftwareVersion, metadata.Comment,
+			metadata.Kex, metadata.Ciphers, metadata.MACs, metadata.SourcePort, strings.Join(metadata.Parsers, ",")}
+	},
+}
+
+// parseEvidences parses the evidences stored before the parsers or by an older version of them.
+func parseEvidences(db *sql.DB) error {
+	evidences, err := evidenceClassifier.classify(db)
+	if err != nil {
+		return err
+	}
+	if evidences > 0 {
+		log.Printf("[INFO] Parsed %d evidences.\n", evidences)
+	}
+	return nil
+}
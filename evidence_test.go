@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEvidence(t *testing.T) {
+	tests := []struct {
+		evidence string
+		want     EvidenceMetadata
+	}{
+		{"SSH-2.0-Go", EvidenceMetadata{Banner: "SSH-2.0-Go", Protocol: "2.0", Software: "Go", Parsers: []string{"ssh_banner"}}},
+		{"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.6", EvidenceMetadata{Banner: "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.6", Protocol: "2.0",
+			Software: "OpenSSH", SoftwareVersion: "8.9p1", Comment: "Ubuntu-3ubuntu0.6", Parsers: []string{"ssh_banner"}}},
+		{"client: SSH-2.0-JSCH-0.1.54, kex=curve25519-sha256,diffie-hellman-group14-sha1", EvidenceMetadata{Banner: "SSH-2.0-JSCH-0.1.54",
+			Protocol: "2.0", Software: "JSCH", SoftwareVersion: "0.1.54", Kex: "curve25519-sha256,diffie-hellman-group14-sha1",
+			Parsers: []string{"ssh_banner", "ssh_algorithms"}}},
+		{`{"client_version": "SSH-2.0-paramiko_2.11.0", "kex_algorithms": ["curve25519-sha256@libssh.org", "ecdh-sha2-nistp256"], ` +
+			`"encryption_algorithms_client_to_server": ["aes128-ctr"], "mac_algorithms_client_to_server": ["hmac-sha2-256"], "src_port": 51234}`,
+			EvidenceMetadata{Banner: "SSH-2.0-paramiko_2.11.0", Protocol: "2.0", Software: "paramiko", SoftwareVersion: "2.11.0",
+				Kex: "curve25519-sha256@libssh.org,ecdh-sha2-nistp256", Ciphers: "aes128-ctr", MACs: "hmac-sha2-256", SourcePort: 51234,
+				Parsers: []string{"ssh_banner", "ssh_algorithms", "source_port"}}},
+		{"Connection from 198.51.100.7 port 40022 on 203.0.113.10 port 22", EvidenceMetadata{SourcePort: 40022, Parsers: []string{"source_port"}}},
+		{"SSH-2.0-Renci.SshNet.SshClient.0.0.1 sport=70000", EvidenceMetadata{Banner: "SSH-2.0-Renci.SshNet.SshClient.0.0.1 sport=70000", Protocol: "2.0",
+			Software: "Renci.SshNet.SshClient", SoftwareVersion: "0.0.1", Comment: "sport=70000", Parsers: []string{"ssh_banner"}}},
+		{"SSH-2.0-PuTTY_Release_0.78", EvidenceMetadata{Banner: "SSH-2.0-PuTTY_Release_0.78", Protocol: "2.0", Software: "PuTTY_Release",
+			SoftwareVersion: "0.78", Parsers: []string{"ssh_banner"}}},
+		{"login attempt", EvidenceMetadata{}},
+	}
+	for _, test := range tests {
+		if got := parseEvidence(test.evidence); fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", test.want) {
+			t.Errorf("parseEvidence(%q) = %+v, want %+v", test.evidence, got, test.want)
+		}
+	}
+}
+
+func TestRegisterEvidenceParser(t *testing.T) {
+	parsers := evidenceParsers
+	t.Cleanup(func() { evidenceParsers = parsers })
+
+	registerEvidenceParser(&EvidenceParser{Name: "hassh", Parse: func(evidence string, metadata *EvidenceMetadata) bool {
+		return strings.Contains(evidence, "hassh=")
+	}})
+	if got := parseEvidence("SSH-2.0-Go hassh=0df0d56bb50c6b2426d8d40234bf1826").Parsers; strings.Join(got, ",") != "ssh_banner,hassh" {
+		t.Errorf("got parsers %v, want ssh_banner,hassh", got)
+	}
+}
+
+// evidenceAttacks returns an attack for each evidence, a minute apart from start on.
+func evidenceAttacks(source string, evidences []string, start time.Time) []*Attack {
+	attacks := make([]*Attack, len(evidences))
+	for i, evidence := range evidences {
+		attack := newAttack(source, "root", fmt.Sprintf("password%d", i), start.Add(time.Duration(i)*time.Minute))
+		attack.Evidence = evidence
+		attacks[i] = attack
+	}
+	return attacks
+}
+
+func TestEvidenceMetadata(t *testing.T) {
+	setupTest(t)
+	saveAttacks(t, evidenceAttacks("198.51.100.1", []string{"SSH-2.0-libssh_0.9.6 sport=40001", "login attempt"}, time.Now().Add(-time.Hour)))
+
+	query := `SELECT "_dict_evidences"."value", "software", "software_version", "source_port", "parsers", "version"
+		FROM "_evidence_metadata" JOIN "_dict_evidences" ON "_evidence_metadata"."id" = "_dict_evidences"."id"
+		ORDER BY "_dict_evidences"."value"`
+	want := [][]string{
+		{"SSH-2.0-libssh_0.9.6 sport=40001", "libssh", "0.9.6", "40001", "ssh_banner,source_port", "1"},
+		{"login attempt", "", "", "0", "", "1"},
+	}
+	compareRows(t, queryRows(t, query), want)
+
+	// Evidences stored before the parsers or parsed by an older version of them are parsed at startup.
+	if _, err := db.Exec(`DELETE FROM "_evidence_metadata" WHERE "software" = ''`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE "_evidence_metadata" SET "version" = 0, "software" = 'stale'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseEvidences(db); err != nil {
+		t.Fatal(err)
+	}
+	compareRows(t, queryRows(t, query), want)
+}
+
+func TestSSHClientViews(t *testing.T) {
+	setupTest(t)
+	start := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	algorithms := " kex=curve25519-sha256,ecdh-sha2-nistp256 ciphers=aes128-ctr macs=hmac-sha2-256"
+	saveAttacks(t, evidenceAttacks("198.51.100.1", []string{
+		"SSH-2.0-libssh_0.9.6 sport=40001" + algorithms,
+		"SSH-2.0-libssh_0.9.6 sport=40002" + algorithms,
+		"SSH-2.0-Go",
+	}, start))
+	saveAttacks(t, evidenceAttacks("198.51.100.2", []string{
+		"SSH-2.0-libssh_0.9.6 sport=40003" + algorithms,
+		"SSH-2.0-libssh_0.10.4",
+		"login attempt",
+	}, start.Add(time.Hour)))
+
+	compareRows(t, queryRows(t, `SELECT * FROM "view_ssh_clients"`), [][]string{
+		{"libssh", "0.9.6", "3", "2", "3", "2025-03-10 12:00:00", "2025-03-10 13:00:00"},
+		{"", "", "1", "1", "1", "2025-03-10 13:02:00", "2025-03-10 13:02:00"},
+		{"Go", "", "1", "1", "1", "2025-03-10 12:02:00", "2025-03-10 12:02:00"},
+		{"libssh", "0.10.4", "1", "1", "1", "2025-03-10 13:01:00", "2025-03-10 13:01:00"},
+	})
+	compareRows(t, queryRows(t, `SELECT * FROM "view_ssh_client_software"`), [][]string{
+		{"libssh", "2", "4", "2"},
+		{"", "1", "1", "1"},
+		{"Go", "1", "1", "1"},
+	})
+	compareRows(t, queryRows(t, `SELECT * FROM "view_ssh_client_algorithms"`), [][]string{
+		{"curve25519-sha256,ecdh-sha2-nistp256", "aes128-ctr", "hmac-sha2-256", "libssh", "3", "2"},
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:        "explain",
+		Usage:       "explain [VIEW|QUERY...]",
+		Description: "Print the query plan of every view, or the given views and queries, and warn about full table scans.",
+		Run:         runExplainCommand,
+	})
+}
+
+// PlanStep is a row of EXPLAIN QUERY PLAN.
+type PlanStep struct {
+	ID     int
+	Parent int
+	Detail string
+}
+
+// QueryPlan is the query plan of a view or query with the tables it scans without an index.
+type QueryPlan struct {
+	Name      string
+	Steps     []PlanStep
+	FullScans []string
+}
+
+func viewNames(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT "name" FROM "sqlite_master" WHERE "type" = 'view' ORDER BY "name"`)
+	if err != nil {
+		return nil, fmt.Errorf("could not list views: %w", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("could not scan view name: %w", err)
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func tableNames(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT "name" FROM "sqlite_master" WHERE "type" = 'table'`)
+	if err != nil {
+		return nil, fmt.Errorf("could not list tables: %w", err)
+	}
+	defer rows.Close()
+
+	tables := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("could not scan table name: %w", err)
+		}
+		tables[name] = true
+	}
+	return tables, rows.Err()
+}
+
+// fullScan returns the table a plan step reads completely without an index, if any.
+// Subqueries and views that are scanned are not tables, the plan lists their own steps.
+// The rollups hold one row per group and are meant to be read as a whole.
+func fullScan(detail string, tables map[string]bool) (string, bool) {
+	if !strings.HasPrefix(detail, "SCAN ") || strings.Contains(detail, " USING ") {
+		return "", false
+	}
+	fields := strings.Fields(detail)
+	if len(fields) < 2 || !tables[fields[1]] || strings.HasPrefix(fields[1], "_rollup_") {
+		return "", false
+	}
+	return fields[1], true
+}
+
+func explainView(db *sql.DB, view string, tables map[string]bool) (*QueryPlan, error) {
+	return explainQuery(db, view, fmt.Sprintf(`SELECT * FROM "%s"`, strings.ReplaceAll(view, `"`, `""`)), tables)
+}
+
+func explainQuery(db *sql.DB, name, query string, tables map[string]bool) (*QueryPlan, error) {
+	rows, err := db.Query("EXPLAIN QUERY PLAN " + query)
+	if err != nil {
+		return nil, fmt.Errorf("could not explain %s: %w", name, err)
+	}
+	defer rows.Close()
+
+	plan := &QueryPlan{Name: name}
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var step PlanStep
+		var unused int
+		if err := rows.Scan(&step.ID, &step.Parent, &unused, &step.Detail); err != nil {
+			return nil, fmt.Errorf("could not scan plan of %s: %w", name, err)
+		}
+		plan.Steps = append(plan.Steps, step)
+
+		if table, ok := fullScan(step.Detail, tables); ok && !seen[table] {
+			seen[table] = true
+			plan.FullScans = append(plan.FullScans, table)
+		}
+	}
+	return plan, rows.Err()
+}
+
+// printPlan prints the steps indented below their parents.
+func printPlan(plan *QueryPlan) {
+	depth := map[int]int{0: 0}
+	for _, step := range plan.Steps {
+		depth[step.ID] = depth[step.Parent] + 1
+		fmt.Printf("%s%s\n", strings.Repeat("  ", depth[step.ID]), step.Detail)
+	}
+}
+
+func runExplainCommand(args []string) error {
+	// Explaining the queries must not migrate or back up the database it looks at.
+	if err := openDB(appConfig.DatabasePath); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	names := args
+	if len(names) == 0 {
+		var err error
+		if names, err = viewNames(db); err != nil {
+			return err
+		}
+	}
+	tables, err := tableNames(db)
+	if err != nil {
+		return err
+	}
+
+	scanning := 0
+	for _, name := range names {
+		// Arguments with whitespace are queries, everything else names a view.
+		var plan *QueryPlan
+		if strings.ContainsAny(name, " \t\n") {
+			plan, err = explainQuery(db, name, name, tables)
+		} else {
+			plan, err = explainView(db, name, tables)
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s:\n", plan.Name)
+		printPlan(plan)
+		for _, table := range plan.FullScans {
+			fmt.Printf("[WARN] %s scans the whole table %s without an index.\n", plan.Name, table)
+		}
+		if len(plan.FullScans) > 0 {
+			scanning++
+		}
+		fmt.Println()
+	}
+
+	fmt.Printf("%d of %d scan a table without an index.\n", scanning, len(names))
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFullScan(t *testing.T) {
+	tables := map[string]bool{"_attacks": true, "_rollup_sources": true}
+	tests := []struct {
+		detail string
+		want   string
+	}{
+		{"SCAN _attacks", "_attacks"},
+		{"SCAN a", ""},
+		{"SCAN _attacks USING COVERING INDEX idx_attacks_unique", ""},
+		{"SEARCH _attacks USING INDEX idx_attacks_source_ip (source_ip=?)", ""},
+		{"SCAN _rollup_sources", ""},
+		{"SCAN CONSTANT ROW", ""},
+		{"USE TEMP B-TREE FOR ORDER BY", ""},
+	}
+
+	for _, test := range tests {
+		table, ok := fullScan(test.detail, tables)
+		if table != test.want || ok != (test.want != "") {
+			t.Errorf("fullScan(%q) = %q, %v, want %q", test.detail, table, ok, test.want)
+		}
+	}
+}
+
+func TestExplainViews(t *testing.T) {
+	setupTest(t)
+	saveAttacks(t, generateAttacks(42, 200, time.Now()))
+
+	views, err := viewNames(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, err := tableNames(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// These list every row or a daily breakdown of every row, everything else must use an index or a rollup.
+	mayScan := map[string]bool{
+		"attacks":               true,
+		"view_daily_usernames":  true,
+		"view_daily_passwords":  true,
+		"view_daily_source_ips": true,
+		"view_quarantine":       true,
+	}
+	for _, view := range views {
+		plan, err := explainView(db, view, tables)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.Steps) == 0 {
+			t.Errorf("%s has an empty query plan", view)
+		}
+		if len(plan.FullScans) > 0 && !mayScan[view] {
+			t.Errorf("%s scans %v without an index", view, plan.FullScans)
+		}
+	}
+}
+
+func TestAttackLookupsUseIndexes(t *testing.T) {
+	setupTest(t)
+	saveAttacks(t, generateAttacks(42, 200, time.Now()))
+
+	tables, err := tableNames(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := []string{
+		`SELECT * FROM "attacks" WHERE "source_ip" = '198.51.0.1'`,
+		`SELECT * FROM "attacks" WHERE "source_ip" = '198.51.0.1' AND "timestamp" > 0`,
+		`SELECT * FROM "attacks" WHERE "username" = 'root'`,
+		`SELECT * FROM "attacks" WHERE "username" = 'root' AND "password" = 'admin'`,
+		`SELECT * FROM "attacks" WHERE "password" = 'admin'`,
+		`SELECT * FROM "attacks" WHERE "timestamp" > 0`,
+	}
+
+	for _, query := range queries {
+		plan, err := explainQuery(db, query, query, tables)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.FullScans) > 0 {
+			t.Errorf("%s scans %v without an index", query, plan.FullScans)
+		}
+	}
+}
+
+func TestExplainCommandDoesNotMigrate(t *testing.T) {
+	appConfig = loadConfig()
+	previous := db
+	t.Cleanup(func() { db = previous })
+
+	dir := t.TempDir()
+	appConfig.DatabasePath = filepath.Join(dir, "old.db")
+	appConfig.BackupDir = filepath.Join(dir, "backups")
+	old, err := sql.Open("sqlite3", appConfig.DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(`CREATE TABLE "_attacks" ("id" INTEGER PRIMARY KEY)`); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	if err := runExplainCommand([]string{`SELECT * FROM "_attacks" WHERE "id" = 1`}); err != nil {
+		t.Fatal(err)
+	}
+	old, err = sql.Open("sqlite3", appConfig.DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if version, err := userVersion(old); err != nil || version != 0 {
+		t.Errorf("got version %d, %v, want the database left at 0", version, err)
+	}
+	if _, err := os.Stat(appConfig.BackupDir); err == nil {
+		t.Error("the database was backed up")
+	}
+
+	// A missing database is not created.
+	appConfig.DatabasePath = filepath.Join(dir, "missing.db")
+	if err := runExplainCommand(nil); err == nil {
+		t.Error("got no error for a missing database")
+	}
+	if _, err := os.Stat(appConfig.DatabasePath); err == nil {
+		t.Error("the missing database was created")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collectedRequest is a request as the fake collector received it.
+type collectedRequest struct {
+	Method string
+	URI    string
+	Host   string
+	Header http.Header
+	Body   []byte
+}
+
+// fakeCollector is an in-process stand-in for the NetWatch collector.
+// It records every request and answers like the collector unless handler is set.
+type fakeCollector struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []collectedRequest
+	handler  http.HandlerFunc
+}
+
+func newFakeCollector(t *testing.T) *fakeCollector {
+	t.Helper()
+
+	c := &fakeCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.serve))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *fakeCollector) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	c.requests = append(c.requests, collectedRequest{
+		Method: r.Method,
+		URI:    r.URL.RequestURI(),
+		Host:   r.Host,
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	handler := c.handler
+	c.mu.Unlock()
+
+	if handler != nil {
+		handler(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch KnownEndpoints(r.URL.Path) {
+	case EndpointAddAttack:
+		w.Write([]byte(`{"status":"success"}`))
+	case EndpointCheckIP:
+		json.NewEncoder(w).Encode(map[string]string{"status": "success", "ip": clientIP(r)})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"status":"error","message":"unknown endpoint"}`))
+	}
+}
+
+func (c *fakeCollector) setHandler(handler http.HandlerFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handler = handler
+}
+
+// Requests returns the requests received so far.
+func (c *fakeCollector) Requests() []collectedRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]collectedRequest(nil), c.requests...)
+}
+
+// setupTest configures the proxy with its defaults and a fresh database in a temporary directory.
+// Log output is discarded for the duration of the test.
+func setupTest(t *testing.T) {
+	t.Helper()
+
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	appConfig = loadConfig()
+	appConfig.DatabasePath = filepath.Join(t.TempDir(), "attacks.db")
+	appConfig.IngestSpillPath = ""
+	appConfig.BackupDir = filepath.Join(t.TempDir(), "backups")
+	// The generated attacks go back further than the default maximum age.
+	appConfig.MaxAttackAge = 0
+
+	initDB(appConfig.DatabasePath)
+	ingestQueue = newIngestQueue(64, 2, OverflowBlock, "")
+	t.Cleanup(func() {
+		ingestQueue.Close()
+		ingestQueue = nil
+		closeDB()
+	})
+}
+
+// assertDoesNotMigrate runs a command on the test database, made to look like one the last migration
+// did not run on yet, and fails the test if the command migrated or backed up the database.
+func assertDoesNotMigrate(t *testing.T, name string, run func() error) {
+	t.Helper()
+
+	version := migrations[len(migrations)-1].Version - 1
+	if _, err := db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version)); err != nil {
+		t.Fatal(err)
+	}
+	// The command opens and closes a database of its own.
+	migrated := db
+	err := run()
+	db = migrated
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+
+	got, err := userVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != version {
+		t.Errorf("%s: got version %d, want the database left at %d", name, got, version)
+	}
+	if _, err := os.Stat(appConfig.BackupDir); err == nil {
+		t.Errorf("%s backed up the database", name)
+	}
+	if _, err := db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// flushIngestQueue waits until every queued attack is saved.
+func flushIngestQueue() {
+	ingestQueue.Close()
+	ingestQueue = newIngestQueue(64, 2, OverflowBlock, "")
+}
+
+// startProxy forwards to the collector and returns the URL of a proxy server.
+func startProxy(t *testing.T, collector *fakeCollector) string {
+	t.Helper()
+
+	collectorURL, err := url.Parse(collector.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig.Collector.URL = collectorURL
+
+	proxy := httptest.NewServer(http.HandlerFunc(handleProxyRequest))
+	t.Cleanup(proxy.Close)
+	return proxy.URL
+}
+
+// generateAttacks generates n attacks of a few hundred sources trying credentials from shared lists.
+// The timestamps are unique and spread over the last 120 days, but keep a margin around
+// the boundaries of the reports (1, 7 and 90 days), so the tests do not depend on the exact time.
+func generateAttacks(seed int64, n int, now time.Time) []*Attack {
+	rng := rand.New(rand.NewSource(seed))
+
+	usernames := []string{"root", "admin", "ubuntu", "test", "oracle", "pi", "git", "user"}
+	passwords := []string{"123456", "password", "admin", "root", "qwerty", "letmein", "raspberry", "P@ssw0rd", ""}
+	destinations := []string{"203.0.113.10", "203.0.113.11", "2001:db8::10"}
+	evidences := []string{"SSH-2.0-libssh_0.9.6", "SSH-2.0-Go", "SSH-2.0-PUTTY", "SSH-2.0-OpenSSH_8.9p1"}
+
+	attacks := make([]*Attack, 0, n)
+	used := make(map[int64]bool)
+	for len(attacks) < n {
+		age := time.Duration(rng.Int63n(int64(120 * 24 * time.Hour)))
+		if nearBoundary(age) {
+			continue
+		}
+		timestamp := now.Add(-age).Truncate(time.Millisecond)
+		if used[timestamp.UnixMilli()] {
+			continue
+		}
+		used[timestamp.UnixMilli()] = true
+
+		source := rng.Intn(300)
+		attacks = append(attacks, &Attack{
+			SourceIP:        fmt.Sprintf("198.51.%d.%d", source/256, source%256),
+			DestinationIP:   destinations[rng.Intn(len(destinations))],
+			Username:        usernames[rng.Intn(len(usernames))],
+			Password:        passwords[rng.Intn(len(passwords))],
+			AttackTimestamp: FlexibleTime(timestamp),
+			Evidence:        evidences[rng.Intn(len(evidences))],
+			AttackType:      "SSH_BRUTEFORCE",
+		})
+	}
+	return attacks
+}
+
+// newAttack returns a brute force attack of the source on the first test sensor.
+func newAttack(source, username, password string, at time.Time) *Attack {
+	return &Attack{
+		SourceIP:        source,
+		DestinationIP:   "203.0.113.10",
+		Username:        username,
+		Password:        password,
+		AttackTimestamp: FlexibleTime(at),
+		Evidence:        "SSH-2.0-Go",
+		AttackType:      "SSH_BRUTEFORCE",
+	}
+}
+
+func nearBoundary(age time.Duration) bool {
+	day := 24 * time.Hour
+	for _, boundary := range []time.Duration{day, 7 * day} {
+		if age > boundary-2*time.Hour && age < boundary+2*time.Hour {
+			return true
+		}
+	}
+	return age > 88*day && age < 92*day
+}
+
+// saveAttacks saves the attacks and fails the test on any error.
+func saveAttacks(t *testing.T, attacks []*Attack) {
+	t.Helper()
+
+	for _, attack := range attacks {
+		stored := *attack
+		if err := saveAttackToDB(&stored); err != nil {
+			t.Fatalf("could not save attack %+v: %v", attack, err)
+		}
+	}
+}
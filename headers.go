@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+type HeaderMode string
+
+// These are the ways the forwarder treats the headers of requests and responses.
+const (
+	// HeaderModeStandard removes hop-by-hop headers in both directions as required by RFC 7230.
+	HeaderModeStandard HeaderMode = "standard"
+	// HeaderModeMinimal copies all headers verbatim, only the http package itself manages the connection headers.
+	HeaderModeMinimal HeaderMode = "minimal"
+)
+
+type ForwardedHeader string
+
+// Upstream is a server the proxy forwards to. The forwarded headers are set per upstream,
+// because only an upstream that trusts the proxy should be told the address of the client.
+type Upstream struct {
+	URL *url.URL
+	// ForwardedHeaders are added to the requests forwarded to the upstream to tell it which client sent them.
+	ForwardedHeaders []ForwardedHeader
+}
+
+// These are the headers the forwarder can add to tell the collector where a request came from.
+const (
+	ForwardedHeaderFor   ForwardedHeader = "x-forwarded-for"
+	ForwardedHeaderProto ForwardedHeader = "x-forwarded-proto"
+	ForwardedHeaderHost  ForwardedHeader = "x-forwarded-host"
+	// ForwardedHeaderForwarded is the standardized Forwarded header of RFC 7239.
+	ForwardedHeaderForwarded ForwardedHeader = "forwarded"
+)
+
+// hopByHopHeaders apply to a single connection and must not be forwarded (RFC 7230, section 6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func parseHeaderMode(s string) (HeaderMode, error) {
+	switch mode := HeaderMode(s); mode {
+	case HeaderModeStandard, HeaderModeMinimal:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown header mode %q, expected standard or minimal", s)
+}
+
+// parseForwardedHeaders parses a comma separated list of forwarded headers.
+func parseForwardedHeaders(s string) ([]ForwardedHeader, error) {
+	var headers []ForwardedHeader
+	for _, field := range strings.Split(s, ",") {
+		header := ForwardedHeader(strings.ToLower(strings.TrimSpace(field)))
+		switch header {
+		case "":
+			continue
+		case ForwardedHeaderFor, ForwardedHeaderProto, ForwardedHeaderHost, ForwardedHeaderForwarded:
+			headers = append(headers, header)
+		default:
+			return nil, fmt.Errorf("unknown forwarded header %q", field)
+		}
+	}
+	return headers, nil
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers and every header listed in Connection.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// proxyRequestHeader returns the headers of the request forwarded to the upstream.
+// host is the Host of the incoming request, before it was rewritten to the upstream.
+func proxyRequestHeader(r *http.Request, host string, upstream *Upstream) http.Header {
+	header := r.Header.Clone()
+	if appConfig.HeaderMode == HeaderModeStandard {
+		removeHopByHopHeaders(header)
+
+		// Trailers are end-to-end, so announcing support for them is still allowed.
+		for _, value := range r.Header.Values("Te") {
+			if strings.EqualFold(textproto.TrimString(value), "trailers") {
+				header.Set("Te", "trailers")
+			}
+		}
+	}
+
+	addForwardedHeaders(header, r, host, upstream.ForwardedHeaders)
+	return header
+}
+
+// proxyResponseHeader returns the headers of the collector response that are passed on to the client.
+func proxyResponseHeader(resp *http.Response) http.Header {
+	if appConfig.HeaderMode == HeaderModeMinimal {
+		return resp.Header
+	}
+
+	header := resp.Header.Clone()
+	removeHopByHopHeaders(header)
+	return header
+}
+
+// addForwardedHeaders adds the forwarded headers of the upstream, keeping the values of earlier proxies.
+func addForwardedHeaders(header http.Header, r *http.Request, host string, forwardedHeaders []ForwardedHeader) {
+	ip := clientIP(r)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	for _, forwarded := range forwardedHeaders {
+		switch forwarded {
+		case ForwardedHeaderFor:
+			value := ip
+			if prior := header.Values("X-Forwarded-For"); len(prior) > 0 {
+				value = strings.Join(prior, ", ") + ", " + value
+			}
+			header.Set("X-Forwarded-For", value)
+		case ForwardedHeaderProto:
+			header.Set("X-Forwarded-Proto", proto)
+		case ForwardedHeaderHost:
+			header.Set("X-Forwarded-Host", host)
+		case ForwardedHeaderForwarded:
+			node := ip
+			if strings.Contains(node, ":") {
+				node = `"[` + node + `]"`
+			} else if net.ParseIP(node) == nil {
+				node = "unknown"
+			}
+
+			element := fmt.Sprintf("for=%s;proto=%s", node, proto)
+			if host != "" {
+				element += fmt.Sprintf(";host=%q", host)
+			}
+			if prior := header.Values("Forwarded"); len(prior) > 0 {
+				element = strings.Join(prior, ", ") + ", " + element
+			}
+			header.Set("Forwarded", element)
+		}
+	}
+}
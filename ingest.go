@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type OverflowPolicy string
+
+// These are the policies for attacks that arrive while the ingestion queue is full.
+const (
+	// OverflowBlock makes the request handler wait until the queue has room again.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDrop drops the newest attack.
+	OverflowDrop OverflowPolicy = "drop"
+	// OverflowSpill appends the attack to a spill file, which is ingested once the queue has room again.
+	OverflowSpill OverflowPolicy = "spill"
+)
+
+// spillReplayInterval is how often the spill file is checked for attacks to ingest.
+const spillReplayInterval = 5 * time.Second
+
+var (
+	metricIngestEnqueued = newCounter("netwatch_proxy_ingest_enqueued_total",
+		"Attacks added to the ingestion queue.")
+	metricIngestDropped = newCounter("netwatch_proxy_ingest_dropped_total",
+		"Attacks dropped before they reached the database.", "reason")
+	metricIngestSpilled = newCounter("netwatch_proxy_ingest_spilled_total",
+		"Attacks written to the spill file because the ingestion queue was full.")
+	metricIngestQueueLength = newGaugeFunc("netwatch_proxy_ingest_queue_length",
+		"Attacks waiting in the ingestion queue.", func() float64 {
+			if ingestQueue == nil {
+				return 0
+			}
+			return float64(len(ingestQueue.queue))
+		})
+)
+
+// queuedAttack is an attack waiting to be saved together with the time the proxy received it.
+// The timestamp of the attack is checked against that time, not against the time it is saved at.
+type queuedAttack struct {
+	Received time.Time `json:"received"`
+	Attack   *Attack   `json:"attack"`
+}
+
+// IngestQueue decouples saving attacks from the request handler,
+// so a slow database never delays the forwarding of a request.
+type IngestQueue struct {
+	queue     chan queuedAttack
+	policy    OverflowPolicy
+	spillPath string
+
+	workers sync.WaitGroup
+	replay  sync.WaitGroup
+	stop    chan struct{}
+
+	// closeMu guards closed, so that no attack is sent to the closed queue.
+	closeMu sync.RWMutex
+	closed  bool
+
+	spillMu   sync.Mutex
+	spillFile *os.File
+
+	dropped        atomic.Int64
+	dropLogLimiter *tokenBucket
+}
+
+var ingestQueue *IngestQueue
+
+func parseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(s); policy {
+	case OverflowBlock, OverflowDrop, OverflowSpill:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q, expected block, drop or spill", s)
+}
+
+func newIngestQueue(size, workers int, policy OverflowPolicy, spillPath string) *IngestQueue {
+	q := &IngestQueue{
+		queue:          make(chan queuedAttack, size),
+		policy:         policy,
+		spillPath:      spillPath,
+		stop:           make(chan struct{}),
+		dropLogLimiter: newTokenBucket(0.1, 1),
+	}
+
+	for range max(workers, 1) {
+		q.workers.Add(1)
+		go q.work()
+	}
+
+	q.replay.Add(1)
+	go q.replaySpill()
+
+	return q
+}
+
+// Enqueue queues the attack for saving. What happens if the queue is full depends on the overflow policy.
+func (q *IngestQueue) Enqueue(attack *Attack) {
+	queued := queuedAttack{Received: time.Now(), Attack: attack}
+
+	q.closeMu.RLock()
+	defer q.closeMu.RUnlock()
+
+	if q.closed {
+		q.overflow(queued, "closed")
+		return
+	}
+
+	if q.policy == OverflowBlock {
+		q.queue <- queued
+		metricIngestEnqueued.Inc()
+		return
+	}
+
+	select {
+	case q.queue <- queued:
+		metricIngestEnqueued.Inc()
+	default:
+		q.overflow(queued, "queue_full")
+	}
+}
+
+// overflow spills or drops an attack that did not fit into the queue.
+func (q *IngestQueue) overflow(queued queuedAttack, reason string) {
+	if q.policy == OverflowSpill {
+		err := q.spill(queued)
+		if err == nil {
+			metricIngestSpilled.Inc()
+			return
+		}
+		log.Printf("[ERROR] Failed to spill attack to %s: %v\n", q.spillPath, err)
+		reason = "spill_failed"
+	}
+
+	metricIngestDropped.Inc(reason)
+	dropped := q.dropped.Add(1)
+	if q.dropLogLimiter.Allow() {
+		log.Printf("[WARN] Dropping attack from %s (%s), %d dropped in total.\n",
+			logSafe(queued.Attack.SourceIP), reason, dropped)
+	}
+}
+
+// spill appends the attack with the time it was received as a JSON line to the spill file.
+func (q *IngestQueue) spill(queued queuedAttack) error {
+	data, err := json.Marshal(queued)
+	if err != nil {
+		return fmt.Errorf("could not marshal attack: %w", err)
+	}
+
+	q.spillMu.Lock()
+	defer q.spillMu.Unlock()
+
+	if q.spillFile == nil {
+		q.spillFile, err = os.OpenFile(q.spillPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("could not open spill file: %w", err)
+		}
+	}
+
+	_, err = q.spillFile.Write(append(data, '\n'))
+	return err
+}
+
+// rotateSpill moves the current spill file aside for replay.
+// It returns false if there is nothing to replay.
+func (q *IngestQueue) rotateSpill(replayPath string) (bool, error) {
+	q.spillMu.Lock()
+	defer q.spillMu.Unlock()
+
+	info, err := os.Stat(q.spillPath)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && info.Size() == 0) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if q.spillFile != nil {
+		q.spillFile.Close()
+		q.spillFile = nil
+	}
+	return true, os.Rename(q.spillPath, replayPath)
+}
+
+// replaySpill feeds spilled attacks back into the queue once it has room again.
+// A replay file that was not finished before a shutdown is replayed after the next start;
+// attacks that were already saved are skipped as duplicates.
+func (q *IngestQueue) replaySpill() {
+	defer q.replay.Done()
+
+	if q.spillPath == "" {
+		return
+	}
+	replayPath := q.spillPath + ".replaying"
+
+	ticker := time.NewTicker(spillReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(replayPath); err == nil {
+			if !q.replayFile(replayPath) {
+				return
+			}
+		} else if len(q.queue) < cap(q.queue)/2 {
+			rotated, err := q.rotateSpill(replayPath)
+			if err != nil {
+				log.Printf("[ERROR] Failed to rotate spill file: %v\n", err)
+			} else if rotated {
+				continue
+			}
+		}
+
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// replayFile enqueues every attack of the file and removes it afterwards.
+// It returns false if the queue is shutting down.
+func (q *IngestQueue) replayFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("[ERROR] Failed to open spill file %s: %v\n", path, err)
+		return true
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	replayed := 0
+	for scanner.Scan() {
+		queued, err := parseSpillLine(scanner.Bytes())
+		if err != nil {
+			log.Printf("[ERROR] Skipping invalid line in spill file %s: %v\n", path, err)
+			continue
+		}
+
+		select {
+		case q.queue <- queued:
+			replayed++
+		case <-q.stop:
+			log.Printf("[INFO] Interrupted replay of %s after %d attacks, it will be resumed after the next start.\n", path, replayed)
+			return false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("[ERROR] Failed to read spill file %s: %v\n", path, err)
+		return true
+	}
+
+	log.Printf("[INFO] Replayed %d spilled attacks.\n", replayed)
+	if err := os.Remove(path); err != nil {
+		log.Printf("[ERROR] Failed to remove spill file %s: %v\n", path, err)
+	}
+	return true
+}
+
+// parseSpillLine reads a line of the spill file.
+// Files spilled before the received time was kept hold the bare attack, it counts as received now.
+func parseSpillLine(line []byte) (queuedAttack, error) {
+	var queued queuedAttack
+	if err := json.Unmarshal(line, &queued); err != nil {
+		return queuedAttack{}, err
+	}
+	if queued.Attack != nil {
+		return queued, nil
+	}
+
+	var attack Attack
+	if err := json.Unmarshal(line, &attack); err != nil {
+		return queuedAttack{}, err
+	}
+	return queuedAttack{Received: time.Now(), Attack: &attack}, nil
+}
+
+func (q *IngestQueue) work() {
+	defer q.workers.Done()
+
+	for queued := range q.queue {
+		ingestAttack(queued.Attack, queued.Received)
+	}
+}
+
+// Close stops accepting attacks and waits until every queued attack is saved.
+func (q *IngestQueue) Close() {
+	close(q.stop)
+	q.replay.Wait()
+
+	q.closeMu.Lock()
+	q.closed = true
+	close(q.queue)
+	q.closeMu.Unlock()
+
+	log.Printf("Draining %d queued attacks...", len(q.queue))
+	q.workers.Wait()
+
+	q.spillMu.Lock()
+	if q.spillFile != nil {
+		q.spillFile.Close()
+		q.spillFile = nil
+	}
+	q.spillMu.Unlock()
+}
+
+// ingestAttack saves the attack the proxy received at the given time and logs the outcome.
+func ingestAttack(attack *Attack, received time.Time) {
+	err := saveAttackReceivedAt(attack, received)
+	switch {
+	case err == nil:
+		timestamp := attack.AttackTimestamp.ToTime().Format("02.01. 15:04:05")
+		log.Printf("%s | From: %-15s | User: %-22s | Pass: %s\n",
+			timestamp, attack.SourceIP, logSafe(attack.Username), logSafe(attack.Password))
+
+		notifier.OnAttack(attack)
+	case errors.Is(err, ErrDuplicateAttack):
+		if appConfig.DebugLog {
+			log.Printf("[DEBUG] Skipping duplicate attack entry from %s", attack.SourceIP)
+		}
+	case errors.Is(err, ErrQuarantined):
+		log.Printf("[WARN] Quarantined attack from %s: %v\n", logSafe(attack.SourceIP), err)
+	default:
+		log.Printf("[ERROR] Failed to save attack to DB: %v\n", err)
+	}
+}
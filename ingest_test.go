@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stallDatabase keeps the attack writer from committing until the returned function is called.
+func stallDatabase(t *testing.T) func() {
+	t.Helper()
+
+	dbMutex.Lock()
+	stalled := true
+	release := func() {
+		if stalled {
+			stalled = false
+			dbMutex.Unlock()
+		}
+	}
+	t.Cleanup(release)
+	return release
+}
+
+// readSpill returns the attacks of a spill file.
+func readSpill(t *testing.T, path string) []queuedAttack {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var attacks []queuedAttack
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		queued, err := parseSpillLine(scanner.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		attacks = append(attacks, queued)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return attacks
+}
+
+// writeSpill writes the attacks as a spill file, received at the given time.
+func writeSpill(t *testing.T, path string, attacks []*Attack, received time.Time) {
+	t.Helper()
+
+	var data []byte
+	for _, attack := range attacks {
+		line, err := json.Marshal(queuedAttack{Received: received, Attack: attack})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForReplay waits until the queue replayed and removed the spill files.
+func waitForReplay(t *testing.T, spillPath string) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		_, errSpill := os.Stat(spillPath)
+		_, errReplay := os.Stat(spillPath + ".replaying")
+		if errors.Is(errSpill, os.ErrNotExist) && errors.Is(errReplay, os.ErrNotExist) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the spill files of %s were not replayed", spillPath)
+}
+
+func TestIngestQueueDropsOverflow(t *testing.T) {
+	setupTest(t)
+	attacks := generateAttacks(1, 10, time.Now())
+
+	// With the database stalled, one worker holds one attack and the queue two, the others are dropped.
+	release := stallDatabase(t)
+	queue := newIngestQueue(2, 1, OverflowDrop, "")
+	for _, attack := range attacks {
+		queue.Enqueue(attack)
+	}
+	dropped := queue.dropped.Load()
+	if dropped < 7 || dropped > 8 {
+		t.Errorf("got %d dropped attacks, want 7 or 8", dropped)
+	}
+	release()
+	queue.Close()
+
+	if saved := countAttacks(t, db); int64(saved)+dropped != int64(len(attacks)) {
+		t.Errorf("got %d saved and %d dropped attacks, want %d in total", saved, dropped, len(attacks))
+	}
+
+	// A closed queue drops what it is given.
+	queue.Enqueue(generateAttacks(2, 1, time.Now())[0])
+	if queue.dropped.Load() != dropped+1 {
+		t.Errorf("the attack enqueued after Close was not dropped")
+	}
+}
+
+func TestIngestQueueSpillsOverflow(t *testing.T) {
+	setupTest(t)
+	spillPath := filepath.Join(t.TempDir(), "spill.jsonl")
+	attacks := generateAttacks(1, 10, time.Now())
+
+	release := stallDatabase(t)
+	queue := newIngestQueue(2, 1, OverflowSpill, spillPath)
+	for _, attack := range attacks {
+		queue.Enqueue(attack)
+	}
+	spilled := readSpill(t, spillPath)
+	if len(spilled) < 7 || len(spilled) > 8 || queue.dropped.Load() != 0 {
+		t.Errorf("got %d spilled and %d dropped attacks, want 7 or 8 spilled", len(spilled), queue.dropped.Load())
+	}
+
+	// The spill file survives the shutdown, the next start replays it.
+	release()
+	queue.Close()
+	if saved := countAttacks(t, db); saved+len(spilled) != len(attacks) {
+		t.Fatalf("got %d saved and %d spilled attacks, want %d in total", saved, len(spilled), len(attacks))
+	}
+
+	queue = newIngestQueue(2, 1, OverflowSpill, spillPath)
+	waitForReplay(t, spillPath)
+	queue.Close()
+	assertStoredAttacks(t, attacks)
+}
+
+func TestIngestQueueRotatesSpill(t *testing.T) {
+	setupTest(t)
+	spillPath := filepath.Join(t.TempDir(), "spill.jsonl")
+	replayPath := spillPath + ".replaying"
+	queue := &IngestQueue{spillPath: spillPath}
+
+	if rotated, err := queue.rotateSpill(replayPath); rotated || err != nil {
+		t.Fatalf("got %v, %v for a missing spill file, want nothing to rotate", rotated, err)
+	}
+
+	attacks := generateAttacks(1, 3, time.Now())
+	for _, attack := range attacks[:2] {
+		if err := queue.spill(queuedAttack{Received: time.Now(), Attack: attack}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rotated, err := queue.rotateSpill(replayPath); !rotated || err != nil {
+		t.Fatalf("got %v, %v, want the spill file rotated", rotated, err)
+	}
+	if got := readSpill(t, replayPath); len(got) != 2 {
+		t.Errorf("got %d attacks to replay, want 2", len(got))
+	}
+
+	// The next spill starts a new file instead of writing to the rotated one.
+	if err := queue.spill(queuedAttack{Received: time.Now(), Attack: attacks[2]}); err != nil {
+		t.Fatal(err)
+	}
+	queue.spillFile.Close()
+	if got := readSpill(t, spillPath); len(got) != 1 || string(attackJSON(t, got[0].Attack)) != string(attackJSON(t, attacks[2])) {
+		t.Errorf("got %d attacks in the new spill file, want the last attack", len(got))
+	}
+	if got := readSpill(t, replayPath); len(got) != 2 {
+		t.Errorf("got %d attacks to replay after the next spill, want 2", len(got))
+	}
+}
+
+func TestIngestQueueReplaysSpillAtStartup(t *testing.T) {
+	setupTest(t)
+	spillPath := filepath.Join(t.TempDir(), "spill.jsonl")
+	attacks := generateAttacks(1, 20, time.Now())
+
+	// An interrupted replay and a spill file left by the last run, the replay already saved its first attacks.
+	// Invalid lines are skipped, bare attacks of older spill files are replayed.
+	saveAttacks(t, attacks[:3])
+	writeSpill(t, spillPath+".replaying", attacks[:10], time.Now())
+	writeSpill(t, spillPath, attacks[10:19], time.Now())
+	file, err := os.OpenFile(spillPath+".replaying", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("not json\n")
+	file.Write(append(attackJSON(t, attacks[19]), '\n'))
+	file.Close()
+
+	queue := newIngestQueue(64, 2, OverflowSpill, spillPath)
+	waitForReplay(t, spillPath)
+	queue.Close()
+
+	assertStoredAttacks(t, attacks)
+}
+
+func TestIngestQueueReplaysSpillWithReceivedTime(t *testing.T) {
+	setupTest(t)
+	appConfig.MaxAttackAge = time.Hour
+	spillPath := filepath.Join(t.TempDir(), "spill.jsonl")
+
+	// The attack was an hour old only by the time it was replayed.
+	now := time.Now()
+	attack := newAttack("198.51.100.1", "root", "123456", now.Add(-90*time.Minute))
+	writeSpill(t, spillPath, []*Attack{attack}, now.Add(-80*time.Minute))
+
+	queue := newIngestQueue(64, 1, OverflowSpill, spillPath)
+	waitForReplay(t, spillPath)
+	queue.Close()
+
+	assertStoredAttacks(t, []*Attack{attack})
+}
+
+func TestIngestQueueCloseDrainsQueue(t *testing.T) {
+	setupTest(t)
+	attacks := generateAttacks(1, 50, time.Now())
+
+	release := stallDatabase(t)
+	queue := newIngestQueue(len(attacks), 1, OverflowBlock, "")
+	for _, attack := range attacks {
+		queue.Enqueue(attack)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		queue.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the queued attacks were saved")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	<-closed
+	assertStoredAttacks(t, attacks)
+}
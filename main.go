@@ -1,18 +1,22 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -21,6 +25,8 @@ import (
 type Migration struct {
 	Version int
 	SQL     string
+	// Down reverts the migration. It is optional, migrations that transform data usually cannot be reverted.
+	Down string
 }
 
 // migrations is a list of database migrations. The version number should be incremental.
@@ -859,6 +865,1579 @@ var migrations = []Migration{
 			DROP TABLE "_sentence_words";
 			DROP TABLE "_sentences";
 		`,
+		Down: `
+			CREATE TABLE "_sentence_words" (
+				"id" INTEGER NOT NULL UNIQUE,
+				"word" TEXT NOT NULL UNIQUE,
+				PRIMARY KEY("id" AUTOINCREMENT)
+			);
+			CREATE TABLE "_sentences" (
+				"id" INTEGER NOT NULL,
+				"index" INTEGER NOT NULL,
+				"word_id" INTEGER NOT NULL,
+				FOREIGN KEY("word_id") REFERENCES "_sentence_words"("id"),
+				PRIMARY KEY("id", "index")
+			);
+		`,
+	},
+	{
+		Version: 8,
+		SQL: `
+			-- Last seen times of the sensors (proxy clients and destination IPs) for liveness monitoring.
+			CREATE TABLE "_sensors" (
+				"kind"	TEXT NOT NULL,
+				"name"	TEXT NOT NULL,
+				"first_seen"	INTEGER NOT NULL,
+				"last_seen"	INTEGER NOT NULL,
+				"silent"	INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY("kind", "name")
+			);
+
+			CREATE VIEW "view_sensors" AS
+				SELECT
+					"kind",
+					"name",
+					strftime('%F %T', "first_seen" / 1000, 'unixepoch', 'localtime') AS "first_seen",
+					strftime('%F %T', "last_seen" / 1000, 'unixepoch', 'localtime') AS "last_seen",
+					"silent"
+				FROM "_sensors"
+				ORDER BY
+					"kind" ASC,
+					"name" ASC;
+		`,
+		Down: `
+			DROP VIEW "view_sensors";
+			DROP TABLE "_sensors";
+		`,
+	},
+	{
+		Version: 9,
+		SQL: `
+			-- Attacks that failed validation, stored as received together with the reason.
+			CREATE TABLE "_quarantine" (
+				"id"	INTEGER NOT NULL UNIQUE,
+				"received"	INTEGER NOT NULL,
+				"reason"	TEXT NOT NULL,
+				"source_ip"	TEXT,
+				"data"	TEXT NOT NULL,
+				PRIMARY KEY("id" AUTOINCREMENT)
+			);
+
+			CREATE VIEW "view_quarantine" AS
+				SELECT
+					"id",
+					strftime('%F %T', "received" / 1000, 'unixepoch', 'localtime') AS "received",
+					"reason",
+					"source_ip",
+					"data"
+				FROM "_quarantine"
+				ORDER BY "id" DESC;
+		`,
+		Down: `
+			DROP VIEW "view_quarantine";
+			DROP TABLE "_quarantine";
+		`,
+	},
+	{
+		Version: 10,
+		SQL: `
+			-- Raw /add_attack requests that could not be parsed, kept for inspection and replay.
+			CREATE TABLE "_dead_letters" (
+				"id"	INTEGER NOT NULL UNIQUE,
+				"received"	INTEGER NOT NULL,
+				"method"	TEXT NOT NULL,
+				"path"	TEXT NOT NULL,
+				"remote_addr"	TEXT NOT NULL,
+				"headers"	TEXT NOT NULL,
+				"body"	BLOB NOT NULL,
+				"error"	TEXT NOT NULL,
+				"replayed"	INTEGER,
+				"replay_result"	TEXT,
+				PRIMARY KEY("id" AUTOINCREMENT)
+			);
+		`,
+		Down: `
+			DROP TABLE "_dead_letters";
+		`,
+	},
+	{
+		Version: 11,
+		SQL: `
+			-- Rollups of the attacks, so the heavy views do not scan and join every attack.
+			-- They are maintained by a trigger on every inserted attack and backfilled from the existing attacks.
+			CREATE TABLE "_rollup_sources" (
+				"source_ip"	INTEGER NOT NULL,
+				"attacks"	INTEGER NOT NULL,
+				"first_seen"	INTEGER NOT NULL,
+				"last_seen"	INTEGER NOT NULL,
+				FOREIGN KEY("source_ip") REFERENCES "_dict_source_ips"("id"),
+				PRIMARY KEY("source_ip")
+			);
+
+			-- "sources" is the number of distinct source IPs that used the credential pair.
+			CREATE TABLE "_rollup_credentials" (
+				"username"	INTEGER NOT NULL,
+				"password"	INTEGER NOT NULL,
+				"attacks"	INTEGER NOT NULL,
+				"sources"	INTEGER NOT NULL,
+				"first_seen"	INTEGER NOT NULL,
+				"last_seen"	INTEGER NOT NULL,
+				FOREIGN KEY("username") REFERENCES "_dict_usernames"("id"),
+				FOREIGN KEY("password") REFERENCES "_dict_passwords"("id"),
+				PRIMARY KEY("username", "password")
+			);
+
+			CREATE TABLE "_rollup_source_credentials" (
+				"source_ip"	INTEGER NOT NULL,
+				"username"	INTEGER NOT NULL,
+				"password"	INTEGER NOT NULL,
+				"attacks"	INTEGER NOT NULL,
+				"first_seen"	INTEGER NOT NULL,
+				"last_seen"	INTEGER NOT NULL,
+				FOREIGN KEY("source_ip") REFERENCES "_dict_source_ips"("id"),
+				FOREIGN KEY("username") REFERENCES "_dict_usernames"("id"),
+				FOREIGN KEY("password") REFERENCES "_dict_passwords"("id"),
+				PRIMARY KEY("source_ip", "username", "password")
+			);
+			CREATE INDEX "idx_rollup_source_credentials_credential" ON "_rollup_source_credentials" (
+				"username",
+				"password"
+			);
+
+			-- Attacks per UTC minute, in unix seconds. Local hours and days are summed from the minutes,
+			-- which keeps them right for time zones whose offset is not a whole hour.
+			CREATE TABLE "_rollup_minutes" (
+				"minute"	INTEGER NOT NULL,
+				"attacks"	INTEGER NOT NULL,
+				PRIMARY KEY("minute")
+			);
+
+			INSERT INTO "_rollup_sources" ("source_ip", "attacks", "first_seen", "last_seen")
+			SELECT "source_ip", COUNT(1), MIN("timestamp"), MAX("timestamp")
+			FROM "_attacks"
+			GROUP BY "source_ip";
+
+			INSERT INTO "_rollup_credentials" ("username", "password", "attacks", "sources", "first_seen", "last_seen")
+			SELECT "username", "password", COUNT(1), COUNT(DISTINCT "source_ip"), MIN("timestamp"), MAX("timestamp")
+			FROM "_attacks"
+			GROUP BY "username", "password";
+
+			INSERT INTO "_rollup_source_credentials" ("source_ip", "username", "password", "attacks", "first_seen", "last_seen")
+			SELECT "source_ip", "username", "password", COUNT(1), MIN("timestamp"), MAX("timestamp")
+			FROM "_attacks"
+			GROUP BY "source_ip", "username", "password";
+
+			INSERT INTO "_rollup_minutes" ("minute", "attacks")
+			SELECT "timestamp" / 60000 * 60, COUNT(1)
+			FROM "_attacks"
+			GROUP BY "timestamp" / 60000;
+
+			-- Duplicates are ignored by the insert and never reach the trigger.
+			-- The credential rollup runs first, as it counts a new source by the missing source credential row.
+			CREATE TRIGGER "trg_attacks_rollup" AFTER INSERT ON "_attacks"
+			BEGIN
+				INSERT INTO "_rollup_sources" ("source_ip", "attacks", "first_seen", "last_seen")
+				VALUES (NEW."source_ip", 1, NEW."timestamp", NEW."timestamp")
+				ON CONFLICT ("source_ip") DO UPDATE SET
+					"attacks" = "attacks" + 1,
+					"first_seen" = MIN("first_seen", excluded."first_seen"),
+					"last_seen" = MAX("last_seen", excluded."last_seen");
+
+				INSERT INTO "_rollup_credentials" ("username", "password", "attacks", "sources", "first_seen", "last_seen")
+				VALUES (NEW."username", NEW."password", 1, 1, NEW."timestamp", NEW."timestamp")
+				ON CONFLICT ("username", "password") DO UPDATE SET
+					"attacks" = "attacks" + 1,
+					"sources" = "sources" + NOT EXISTS (
+						SELECT 1 FROM "_rollup_source_credentials"
+						WHERE
+							"source_ip" = NEW."source_ip" AND
+							"username" = NEW."username" AND
+							"password" = NEW."password"
+					),
+					"first_seen" = MIN("first_seen", excluded."first_seen"),
+					"last_seen" = MAX("last_seen", excluded."last_seen");
+
+				INSERT INTO "_rollup_source_credentials" ("source_ip", "username", "password", "attacks", "first_seen", "last_seen")
+				VALUES (NEW."source_ip", NEW."username", NEW."password", 1, NEW."timestamp", NEW."timestamp")
+				ON CONFLICT ("source_ip", "username", "password") DO UPDATE SET
+					"attacks" = "attacks" + 1,
+					"first_seen" = MIN("first_seen", excluded."first_seen"),
+					"last_seen" = MAX("last_seen", excluded."last_seen");
+
+				INSERT INTO "_rollup_minutes" ("minute", "attacks")
+				VALUES (NEW."timestamp" / 60000 * 60, 1)
+				ON CONFLICT ("minute") DO UPDATE SET
+					"attacks" = "attacks" + 1;
+			END;
+
+			-- Rebuild the views on top of the rollups, with the same columns and rows.
+			DROP VIEW "view_usernames";
+			DROP VIEW "view_passwords";
+			DROP VIEW "view_source_ips";
+			DROP VIEW "view_logins";
+			DROP VIEW "view_daily_attacks";
+			DROP VIEW "view_attacks_by_time";
+			DROP VIEW "view_attack_patterns_by_source";
+			DROP VIEW "view_credential_fingerprints";
+			DROP VIEW "view_attack_spread_by_username";
+
+			CREATE VIEW "view_usernames" AS
+				SELECT
+					"_dict_usernames"."value" AS "username",
+					SUM("_rollup_credentials"."attacks") AS "count"
+				FROM "_rollup_credentials"
+				JOIN "_dict_usernames" ON "_rollup_credentials"."username" = "_dict_usernames"."id"
+				GROUP BY "_rollup_credentials"."username"
+				ORDER BY
+					"count" DESC,
+					"username" ASC;
+
+			CREATE VIEW "view_passwords" AS
+				SELECT
+					"_dict_passwords"."value" AS "password",
+					SUM("_rollup_credentials"."attacks") AS "count"
+				FROM "_rollup_credentials"
+				JOIN "_dict_passwords" ON "_rollup_credentials"."password" = "_dict_passwords"."id"
+				GROUP BY "_rollup_credentials"."password"
+				ORDER BY
+					"count" DESC,
+					"password" ASC;
+
+			CREATE VIEW "view_source_ips" AS
+				SELECT
+					"_dict_source_ips"."value" AS "source_ip",
+					"_rollup_sources"."attacks" AS "count"
+				FROM "_rollup_sources"
+				JOIN "_dict_source_ips" ON "_rollup_sources"."source_ip" = "_dict_source_ips"."id"
+				ORDER BY
+					"count" DESC,
+					"source_ip" ASC;
+
+			CREATE VIEW "view_logins" AS
+				SELECT
+					"_dict_usernames"."value" AS "username",
+					"_dict_passwords"."value" AS "password",
+					"_rollup_credentials"."attacks" AS "count"
+				FROM "_rollup_credentials"
+				JOIN "_dict_usernames" ON "_rollup_credentials"."username" = "_dict_usernames"."id"
+				JOIN "_dict_passwords" ON "_rollup_credentials"."password" = "_dict_passwords"."id"
+				ORDER BY
+					"count" DESC,
+					"username" ASC,
+					"password" ASC;
+
+			CREATE VIEW "view_daily_attacks" AS
+				SELECT
+					strftime('%F', "minute", 'unixepoch', 'localtime') AS "date",
+					SUM("attacks") AS "count"
+				FROM "_rollup_minutes"
+				GROUP BY "date"
+				ORDER BY "date" DESC;
+
+			CREATE VIEW "view_attacks_by_time" AS
+				SELECT
+					strftime('%Y-%m-%d', "minute", 'unixepoch', 'localtime') AS "date",
+					strftime('%m', "minute", 'unixepoch', 'localtime') AS "month",
+					strftime('%W', "minute", 'unixepoch', 'localtime') AS "week_of_year",
+					strftime('%w', "minute", 'unixepoch', 'localtime') AS "weekday",
+					strftime('%d', "minute", 'unixepoch', 'localtime') AS "day_of_month",
+					strftime('%H', "minute", 'unixepoch', 'localtime') AS "hour_of_day",
+					strftime('%M', "minute", 'unixepoch', 'localtime') AS "minute_of_hour",
+					SUM("attacks") AS "count"
+				FROM "_rollup_minutes"
+				GROUP BY
+					"date",
+					"hour_of_day",
+					"minute_of_hour"
+				ORDER BY
+					"date" ASC,
+					"hour_of_day" ASC,
+					"minute_of_hour" ASC;
+
+			CREATE VIEW "view_attack_patterns_by_source" AS
+				SELECT
+					"_dict_source_ips"."value" AS "source_ip",
+					"_rollup_sources"."attacks" AS "total_attacks",
+					"credentials"."unique_usernames",
+					"credentials"."unique_passwords",
+					"credentials"."unique_logins",
+					strftime('%Y-%m-%d %H:%M:%S', "_rollup_sources"."first_seen" / 1000, 'unixepoch', 'localtime') AS "first_seen",
+					strftime('%Y-%m-%d %H:%M:%S', "_rollup_sources"."last_seen" / 1000, 'unixepoch', 'localtime') AS "last_seen"
+				FROM "_rollup_sources"
+				JOIN "_dict_source_ips" ON "_rollup_sources"."source_ip" = "_dict_source_ips"."id"
+				JOIN (
+					SELECT
+						"source_ip",
+						COUNT(DISTINCT "username") AS "unique_usernames",
+						COUNT(DISTINCT "password") AS "unique_passwords",
+						COUNT(1) AS "unique_logins"
+					FROM "_rollup_source_credentials"
+					GROUP BY "source_ip"
+				) AS "credentials" ON "_rollup_sources"."source_ip" = "credentials"."source_ip"
+				ORDER BY
+					"total_attacks" DESC,
+					"source_ip" ASC;
+
+			CREATE VIEW "view_credential_fingerprints" AS
+				SELECT
+					"_dict_usernames"."value" AS "username",
+					"_dict_passwords"."value" AS "password",
+					"_rollup_credentials"."attacks" AS "total_uses",
+					"_rollup_credentials"."sources" AS "distinct_source_ips",
+					strftime('%Y-%m-%d %H:%M:%S', "_rollup_credentials"."first_seen" / 1000, 'unixepoch', 'localtime') AS "first_seen",
+					strftime('%Y-%m-%d %H:%M:%S', "_rollup_credentials"."last_seen" / 1000, 'unixepoch', 'localtime') AS "last_seen",
+					(
+						SELECT GROUP_CONCAT("_dict_source_ips"."value")
+						FROM "_rollup_source_credentials"
+						JOIN "_dict_source_ips" ON "_rollup_source_credentials"."source_ip" = "_dict_source_ips"."id"
+						WHERE
+							"_rollup_source_credentials"."username" = "_rollup_credentials"."username" AND
+							"_rollup_source_credentials"."password" = "_rollup_credentials"."password"
+					) AS "source_ips"
+				FROM "_rollup_credentials"
+				JOIN "_dict_usernames" ON "_rollup_credentials"."username" = "_dict_usernames"."id"
+				JOIN "_dict_passwords" ON "_rollup_credentials"."password" = "_dict_passwords"."id"
+				ORDER BY
+					"distinct_source_ips" ASC,
+					"total_uses" DESC,
+					"last_seen" DESC,
+					"username" ASC,
+					"password" ASC;
+
+			CREATE VIEW "view_attack_spread_by_username" AS
+				SELECT
+					"_dict_usernames"."value" AS "username",
+					SUM("_rollup_source_credentials"."attacks") AS "total_attempts",
+					COUNT(DISTINCT "_rollup_source_credentials"."source_ip") AS "distinct_attackers"
+				FROM "_rollup_source_credentials"
+				JOIN "_dict_usernames" ON "_rollup_source_credentials"."username" = "_dict_usernames"."id"
+				GROUP BY "_rollup_source_credentials"."username"
+				ORDER BY
+					"total_attempts" DESC,
+					"distinct_attackers" DESC,
+					"username" ASC;
+		`,
+		Down: `
+			DROP TRIGGER "trg_attacks_rollup";
+
+			DROP VIEW "view_usernames";
+			DROP VIEW "view_passwords";
+			DROP VIEW "view_source_ips";
+			DROP VIEW "view_logins";
+			DROP VIEW "view_daily_attacks";
+			DROP VIEW "view_attacks_by_time";
+			DROP VIEW "view_attack_patterns_by_source";
+			DROP VIEW "view_credential_fingerprints";
+			DROP VIEW "view_attack_spread_by_username";
+
+			DROP TABLE "_rollup_sources";
+			DROP TABLE "_rollup_credentials";
+			DROP TABLE "_rollup_source_credentials";
+			DROP TABLE "_rollup_minutes";
+
+			CREATE VIEW "view_usernames" AS
+				SELECT
+					"username",
+					COUNT(1) AS "count"
+				FROM "attacks"
+				GROUP BY "username"
+				ORDER BY
+					"count" DESC,
+					"username" ASC;
+
+			CREATE VIEW "view_passwords" AS
+				SELECT
+					"password",
+					COUNT(1) AS "count"
+				FROM "attacks"
+				GROUP BY "password"
+				ORDER BY
+					"count" DESC,
+					"password" ASC;
+
+			CREATE VIEW "view_source_ips" AS
+				SELECT
+					"source_ip",
+					COUNT(1) AS "count"
+				FROM "attacks"
+				GROUP BY "source_ip"
+				ORDER BY
+					"count" DESC,
+					"source_ip" ASC;
+
+			CREATE VIEW "view_logins" AS
+				SELECT
+					"username",
+					"password",
+					COUNT(1) AS "count"
+				FROM "attacks"
+				GROUP BY
+					"username",
+					"password"
+				ORDER BY
+					"count" DESC,
+					"username" ASC,
+					"password" ASC;
+
+			CREATE VIEW "view_daily_attacks" AS
+				SELECT
+					strftime('%F', strftime('%F %T', "timestamp" / 1000, 'unixepoch'), 'localtime') AS "date",
+					COUNT(*) AS "count"
+				FROM "attacks"
+				GROUP BY "date"
+				ORDER BY "date" DESC;
+
+			CREATE VIEW "view_attacks_by_time" AS
+				SELECT
+					strftime('%Y-%m-%d', "timestamp" / 1000, 'unixepoch', 'localtime') AS "date",
+					strftime('%m', "timestamp" / 1000, 'unixepoch', 'localtime') AS "month",
+					strftime('%W', "timestamp" / 1000, 'unixepoch', 'localtime') AS "week_of_year",
+					strftime('%w', "timestamp" / 1000, 'unixepoch', 'localtime') AS "weekday",
+					strftime('%d', "timestamp" / 1000, 'unixepoch', 'localtime') AS "day_of_month",
+					strftime('%H', "timestamp" / 1000, 'unixepoch', 'localtime') AS "hour_of_day",
+					strftime('%M', "timestamp" / 1000, 'unixepoch', 'localtime') AS "minute_of_hour",
+					COUNT(1) AS "count"
+				FROM "attacks"
+				GROUP BY
+					"date",
+					"hour_of_day",
+					"minute_of_hour"
+				ORDER BY
+					"date" ASC,
+					"hour_of_day" ASC,
+					"minute_of_hour" ASC;
+
+			CREATE VIEW "view_attack_patterns_by_source" AS
+				SELECT
+					"source_ip",
+					COUNT(1) AS "total_attacks",
+					COUNT(DISTINCT "username") AS "unique_usernames",
+					COUNT(DISTINCT "password") AS "unique_passwords",
+					COUNT(DISTINCT ("username" || ' <-| username @ password |-> ' || "password")) AS "unique_logins",
+					MIN(strftime('%Y-%m-%d %H:%M:%S', "timestamp" / 1000, 'unixepoch', 'localtime')) AS "first_seen",
+					MAX(strftime('%Y-%m-%d %H:%M:%S', "timestamp" / 1000, 'unixepoch', 'localtime')) AS "last_seen"
+				FROM "attacks"
+				GROUP BY
+					"source_ip"
+				ORDER BY
+					"total_attacks" DESC,
+					"source_ip" ASC;
+
+			CREATE VIEW "view_credential_fingerprints" AS
+				SELECT
+					"username",
+					"password",
+					COUNT(1) AS "total_uses",
+					COUNT(DISTINCT "source_ip") AS "distinct_source_ips",
+					MIN(strftime('%Y-%m-%d %H:%M:%S', "timestamp" / 1000, 'unixepoch', 'localtime')) AS "first_seen",
+					MAX(strftime('%Y-%m-%d %H:%M:%S', "timestamp" / 1000, 'unixepoch', 'localtime')) AS "last_seen",
+					GROUP_CONCAT(DISTINCT "source_ip") AS "source_ips"
+				FROM "attacks"
+				GROUP BY
+					"username",
+					"password"
+				ORDER BY
+					"distinct_source_ips" ASC,
+					"total_uses" DESC,
+					"last_seen" DESC,
+					"username" ASC,
+					"password" ASC;
+
+			CREATE VIEW "view_attack_spread_by_username" AS
+				SELECT
+					"username",
+					COUNT(1) AS "total_attempts",
+					COUNT(DISTINCT "source_ip") AS "distinct_attackers"
+				FROM "attacks"
+				GROUP BY
+					"username"
+				ORDER BY
+					"total_attempts" DESC,
+					"distinct_attackers" DESC,
+					"username" ASC;
+		`,
+	},
+	{
+		Version: 12,
+		SQL: `
+			-- idx_attacks_unique leads with the timestamp, which only serves time ranges.
+			-- These serve lookups of the attacks of a source or a credential, optionally limited to a time range.
+			CREATE INDEX "idx_attacks_source_ip" ON "_attacks" (
+				"source_ip",
+				"timestamp"
+			);
+			CREATE INDEX "idx_attacks_credential" ON "_attacks" (
+				"username",
+				"password",
+				"timestamp"
+			);
+			CREATE INDEX "idx_attacks_password" ON "_attacks" (
+				"password",
+				"timestamp"
+			);
+
+			-- Statistics let the query planner choose between the indexes.
+			ANALYZE;
+		`,
+		Down: `
+			DROP INDEX "idx_attacks_source_ip";
+			DROP INDEX "idx_attacks_credential";
+			DROP INDEX "idx_attacks_password";
+		`,
+	},
+	{
+		Version: 13,
+		SQL: `
+			-- The offsets of the reporting timezone to UTC, filled from the timezone database on startup.
+			-- "since" is the Unix time in milliseconds the offset starts at, the first row starts at the smallest integer.
+			-- The offset of a timestamp is the one of the last row that started before it.
+			CREATE TABLE "_report_timezone" (
+				"since" INTEGER NOT NULL,
+				"offset" INTEGER NOT NULL,
+				"utc_offset" TEXT NOT NULL,
+				"abbreviation" TEXT NOT NULL,
+				"zone" TEXT NOT NULL,
+				PRIMARY KEY("since")
+			);
+			INSERT INTO "_report_timezone" ("since", "offset", "utc_offset", "abbreviation", "zone")
+			VALUES (-9223372036854775808, 0, '+00:00', 'UTC', 'UTC');
+
+			-- Convert with the reporting timezone instead of the timezone of whichever process reads the views.
+			DROP VIEW "report_new_credential_fingerprints_last_7_days";
+			DROP VIEW "report_hourly_attacks_last_7_days";
+			DROP VIEW "report_daily_attacks_last_90_days";
+			DROP VIEW "view_log";
+			DROP VIEW "view_daily_usernames";
+			DROP VIEW "view_daily_passwords";
+			DROP VIEW "view_daily_source_ips";
+			DROP VIEW "view_sensors";
+			DROP VIEW "view_quarantine";
+			DROP VIEW "view_daily_attacks";
+			DROP VIEW "view_attacks_by_time";
+			DROP VIEW "view_attack_patterns_by_source";
+			DROP VIEW "view_credential_fingerprints";
+
+			CREATE VIEW "view_log" AS
+				SELECT
+					strftime('%F %T', "timestamp" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "attacks"."timestamp" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "time",
+					"source_ip" AS "source",
+					"username",
+					"password"
+				FROM "attacks"
+				ORDER BY "timestamp" DESC;
+
+			CREATE VIEW "view_daily_usernames" AS
+				SELECT
+					strftime('%F', "timestamp" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "attacks"."timestamp" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "date",
+					"username",
+					COUNT(*) AS "count"
+				FROM "attacks"
+				GROUP BY
+					"date",
+					"username"
+				ORDER BY
+					"date" DESC,
+					"count" DESC,
+					"username" ASC;
+
+			CREATE VIEW "view_daily_passwords" AS
+				SELECT
+					strftime('%F', "timestamp" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "attacks"."timestamp" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "date",
+					"password",
+					COUNT(*) AS "count"
+				FROM "attacks"
+				GROUP BY
+					"date",
+					"password"
+				ORDER BY
+					"date" DESC,
+					"count" DESC,
+					"password" ASC;
+
+			CREATE VIEW "view_daily_source_ips" AS
+				SELECT
+					strftime('%F', "timestamp" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "attacks"."timestamp" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "date",
+					"source_ip",
+					COUNT(*) AS "count"
+				FROM "attacks"
+				GROUP BY
+					"date",
+					"source_ip"
+				ORDER BY
+					"date" DESC,
+					"count" DESC,
+					"source_ip" ASC;
+
+			CREATE VIEW "view_sensors" AS
+				SELECT
+					"kind",
+					"name",
+					strftime('%F %T', "first_seen" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_sensors"."first_seen" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "first_seen",
+					strftime('%F %T', "last_seen" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_sensors"."last_seen" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "last_seen",
+					"silent"
+				FROM "_sensors"
+				ORDER BY
+					"kind" ASC,
+					"name" ASC;
+
+			CREATE VIEW "view_quarantine" AS
+				SELECT
+					"id",
+					strftime('%F %T', "received" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_quarantine"."received" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "received",
+					"reason",
+					"source_ip",
+					"data"
+				FROM "_quarantine"
+				ORDER BY "id" DESC;
+
+			CREATE VIEW "view_daily_attacks" AS
+				SELECT
+					strftime('%F', "minute" + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_rollup_minutes"."minute" * 1000 ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "date",
+					SUM("attacks") AS "count"
+				FROM "_rollup_minutes"
+				GROUP BY "date"
+				ORDER BY "date" DESC;
+
+			-- When the clocks go back, an hour repeats with another offset.
+			-- Both are kept apart by the offset and ordered by the time they happened.
+			CREATE VIEW "view_attacks_by_time" AS
+				SELECT
+					strftime('%Y-%m-%d', "local", 'unixepoch') AS "date",
+					strftime('%m', "local", 'unixepoch') AS "month",
+					strftime('%W', "local", 'unixepoch') AS "week_of_year",
+					strftime('%w', "local", 'unixepoch') AS "weekday",
+					strftime('%d', "local", 'unixepoch') AS "day_of_month",
+					strftime('%H', "local", 'unixepoch') AS "hour_of_day",
+					strftime('%M', "local", 'unixepoch') AS "minute_of_hour",
+					SUM("attacks") AS "count",
+					"utc_offset"
+				FROM (
+					SELECT
+						"_rollup_minutes"."minute",
+						"_rollup_minutes"."minute" + "_report_timezone"."offset" AS "local",
+						"_report_timezone"."utc_offset",
+						"_rollup_minutes"."attacks"
+					FROM "_rollup_minutes"
+					JOIN "_report_timezone" ON "_report_timezone"."since" = (
+						SELECT "since" FROM "_report_timezone" WHERE "since" <= "_rollup_minutes"."minute" * 1000 ORDER BY "since" DESC LIMIT 1
+					)
+				)
+				GROUP BY
+					"date",
+					"hour_of_day",
+					"minute_of_hour",
+					"utc_offset"
+				ORDER BY MIN("minute") ASC;
+
+			CREATE VIEW "view_attack_patterns_by_source" AS
+				SELECT
+					"_dict_source_ips"."value" AS "source_ip",
+					"_rollup_sources"."attacks" AS "total_attacks",
+					"credentials"."unique_usernames",
+					"credentials"."unique_passwords",
+					"credentials"."unique_logins",
+					strftime('%Y-%m-%d %H:%M:%S', "_rollup_sources"."first_seen" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_rollup_sources"."first_seen" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "first_seen",
+					strftime('%Y-%m-%d %H:%M:%S', "_rollup_sources"."last_seen" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_rollup_sources"."last_seen" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "last_seen"
+				FROM "_rollup_sources"
+				JOIN "_dict_source_ips" ON "_rollup_sources"."source_ip" = "_dict_source_ips"."id"
+				JOIN (
+					SELECT
+						"source_ip",
+						COUNT(DISTINCT "username") AS "unique_usernames",
+						COUNT(DISTINCT "password") AS "unique_passwords",
+						COUNT(1) AS "unique_logins"
+					FROM "_rollup_source_credentials"
+					GROUP BY "source_ip"
+				) AS "credentials" ON "_rollup_sources"."source_ip" = "credentials"."source_ip"
+				ORDER BY
+					"total_attacks" DESC,
+					"source_ip" ASC;
+
+			CREATE VIEW "view_credential_fingerprints" AS
+				SELECT
+					"_dict_usernames"."value" AS "username",
+					"_dict_passwords"."value" AS "password",
+					"_rollup_credentials"."attacks" AS "total_uses",
+					"_rollup_credentials"."sources" AS "distinct_source_ips",
+					strftime('%Y-%m-%d %H:%M:%S', "_rollup_credentials"."first_seen" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_rollup_credentials"."first_seen" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "first_seen",
+					strftime('%Y-%m-%d %H:%M:%S', "_rollup_credentials"."last_seen" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_rollup_credentials"."last_seen" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "last_seen",
+					(
+						SELECT GROUP_CONCAT("_dict_source_ips"."value")
+						FROM "_rollup_source_credentials"
+						JOIN "_dict_source_ips" ON "_rollup_source_credentials"."source_ip" = "_dict_source_ips"."id"
+						WHERE
+							"_rollup_source_credentials"."username" = "_rollup_credentials"."username" AND
+							"_rollup_source_credentials"."password" = "_rollup_credentials"."password"
+					) AS "source_ips"
+				FROM "_rollup_credentials"
+				JOIN "_dict_usernames" ON "_rollup_credentials"."username" = "_dict_usernames"."id"
+				JOIN "_dict_passwords" ON "_rollup_credentials"."password" = "_dict_passwords"."id"
+				ORDER BY
+					"distinct_source_ips" ASC,
+					"total_uses" DESC,
+					"last_seen" DESC,
+					"username" ASC,
+					"password" ASC;
+
+			CREATE VIEW "report_new_credential_fingerprints_last_7_days" AS
+				SELECT
+					*
+				FROM "view_credential_fingerprints"
+				WHERE
+					"distinct_source_ips" = 1 AND
+					"first_seen" >= strftime('%Y-%m-%d %H:%M:%S', unixepoch('now', '-7 days') + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= unixepoch('now', '-7 days') * 1000 ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch');
+
+			CREATE VIEW "report_hourly_attacks_last_7_days" AS
+				SELECT
+					"time" as "from_time",
+					strftime('%F %T', "time", '+1 hour') AS "to_time",
+					"total_attacks",
+					"utc_offset"
+				FROM (
+					SELECT
+						"date" || ' ' || "hour_of_day" || ':00:00' AS "time",
+						"utc_offset",
+						SUM("count") AS "total_attacks"
+					FROM "view_attacks_by_time"
+					WHERE
+						"time" >= strftime('%F %H:00:00', unixepoch('now', '-7 days') + (
+							SELECT "offset" FROM "_report_timezone" WHERE "since" <= unixepoch('now', '-7 days') * 1000 ORDER BY "since" DESC LIMIT 1
+						), 'unixepoch')
+					GROUP BY
+						"date",
+						"hour_of_day",
+						"utc_offset"
+					ORDER BY
+						strftime('%F %T', "time" || "utc_offset") ASC
+				) AS hourly_data;
+
+			CREATE VIEW "report_daily_attacks_last_90_days" AS
+				SELECT
+					"time" as "from_time",
+					strftime('%F %T', "time", '+1 day') AS "to_time",
+					"total_attacks"
+				FROM (
+					SELECT
+						"date" || ' 00:00:00' AS "time",
+						SUM("count") AS "total_attacks"
+					FROM "view_attacks_by_time"
+					WHERE
+						"time" >= strftime('%F 00:00:00', unixepoch('now', '-90 days') + (
+							SELECT "offset" FROM "_report_timezone" WHERE "since" <= unixepoch('now', '-90 days') * 1000 ORDER BY "since" DESC LIMIT 1
+						), 'unixepoch')
+					GROUP BY
+						"date"
+					ORDER BY
+						"time" ASC
+				) AS daily_data;
+		`,
+		Down: `
+			DROP VIEW "report_new_credential_fingerprints_last_7_days";
+			DROP VIEW "report_hourly_attacks_last_7_days";
+			DROP VIEW "report_daily_attacks_last_90_days";
+			DROP VIEW "view_log";
+			DROP VIEW "view_daily_usernames";
+			DROP VIEW "view_daily_passwords";
+			DROP VIEW "view_daily_source_ips";
+			DROP VIEW "view_sensors";
+			DROP VIEW "view_quarantine";
+			DROP VIEW "view_daily_attacks";
+			DROP VIEW "view_attacks_by_time";
+			DROP VIEW "view_attack_patterns_by_source";
+			DROP VIEW "view_credential_fingerprints";
+
+			DROP TABLE "_report_timezone";
+
+			CREATE VIEW "view_log" AS
+				SELECT
+					strftime('%F %T', strftime('%F %T', "timestamp" / 1000, 'unixepoch'), 'localtime') AS "time",
+					"source_ip" AS "source",
+					"username",
+					"password"
+				FROM "attacks"
+				ORDER BY "timestamp" DESC;
+
+			CREATE VIEW "view_daily_usernames" AS
+				SELECT
+					strftime('%F', strftime('%F %T', "timestamp" / 1000, 'unixepoch'), 'localtime') AS "date",
+					"username",
+					COUNT(*) AS "count"
+				FROM "attacks"
+				GROUP BY 
+					"date",
+					"username"
+				ORDER BY 
+					"date" DESC,
+					"count" DESC,
+					"username" ASC;
+
+			CREATE VIEW "view_daily_passwords" AS
+				SELECT
+					strftime('%F', strftime('%F %T', "timestamp" / 1000, 'unixepoch'), 'localtime') AS "date",
+					"password",
+					COUNT(*) AS "count"
+				FROM "attacks"
+				GROUP BY 
+					"date",
+					"password"
+				ORDER BY 
+					"date" DESC,
+					"count" DESC,
+					"password" ASC;
+
+			CREATE VIEW "view_daily_source_ips" AS
+				SELECT
+					strftime('%F', strftime('%F %T', "timestamp" / 1000, 'unixepoch'), 'localtime') AS "date",
+					"source_ip",
+					COUNT(*) AS "count"
+				FROM "attacks"
+				GROUP BY 
+					"date",
+					"source_ip"
+				ORDER BY 
+					"date" DESC,
+					"count" DESC,
+					"source_ip" ASC;
+
+			CREATE VIEW "view_sensors" AS
+				SELECT
+					"kind",
+					"name",
+					strftime('%F %T', "first_seen" / 1000, 'unixepoch', 'localtime') AS "first_seen",
+					strftime('%F %T', "last_seen" / 1000, 'unixepoch', 'localtime') AS "last_seen",
+					"silent"
+				FROM "_sensors"
+				ORDER BY
+					"kind" ASC,
+					"name" ASC;
+
+			CREATE VIEW "view_quarantine" AS
+				SELECT
+					"id",
+					strftime('%F %T', "received" / 1000, 'unixepoch', 'localtime') AS "received",
+					"reason",
+					"source_ip",
+					"data"
+				FROM "_quarantine"
+				ORDER BY "id" DESC;
+
+			CREATE VIEW "view_daily_attacks" AS
+				SELECT
+					strftime('%F', "minute", 'unixepoch', 'localtime') AS "date",
+					SUM("attacks") AS "count"
+				FROM "_rollup_minutes"
+				GROUP BY "date"
+				ORDER BY "date" DESC;
+
+			CREATE VIEW "view_attacks_by_time" AS
+				SELECT
+					strftime('%Y-%m-%d', "minute", 'unixepoch', 'localtime') AS "date",
+					strftime('%m', "minute", 'unixepoch', 'localtime') AS "month",
+					strftime('%W', "minute", 'unixepoch', 'localtime') AS "week_of_year",
+					strftime('%w', "minute", 'unixepoch', 'localtime') AS "weekday",
+					strftime('%d', "minute", 'unixepoch', 'localtime') AS "day_of_month",
+					strftime('%H', "minute", 'unixepoch', 'localtime') AS "hour_of_day",
+					strftime('%M', "minute", 'unixepoch', 'localtime') AS "minute_of_hour",
+					SUM("attacks") AS "count"
+				FROM "_rollup_minutes"
+				GROUP BY
+					"date",
+					"hour_of_day",
+					"minute_of_hour"
+				ORDER BY
+					"date" ASC,
+					"hour_of_day" ASC,
+					"minute_of_hour" ASC;
+
+			CREATE VIEW "view_attack_patterns_by_source" AS
+				SELECT
+					"_dict_source_ips"."value" AS "source_ip",
+					"_rollup_sources"."attacks" AS "total_attacks",
+					"credentials"."unique_usernames",
+					"credentials"."unique_passwords",
+					"credentials"."unique_logins",
+					strftime('%Y-%m-%d %H:%M:%S', "_rollup_sources"."first_seen" / 1000, 'unixepoch', 'localtime') AS "first_seen",
+					strftime('%Y-%m-%d %H:%M:%S', "_rollup_sources"."last_seen" / 1000, 'unixepoch', 'localtime') AS "last_seen"
+				FROM "_rollup_sources"
+				JOIN "_dict_source_ips" ON "_rollup_sources"."source_ip" = "_dict_source_ips"."id"
+				JOIN (
+					SELECT
+						"source_ip",
+						COUNT(DISTINCT "username") AS "unique_usernames",
+						COUNT(DISTINCT "password") AS "unique_passwords",
+						COUNT(1) AS "unique_logins"
+					FROM "_rollup_source_credentials"
+					GROUP BY "source_ip"
+				) AS "credentials" ON "_rollup_sources"."source_ip" = "credentials"."source_ip"
+				ORDER BY
+					"total_attacks" DESC,
+					"source_ip" ASC;
+
+			CREATE VIEW "view_credential_fingerprints" AS
+				SELECT
+					"_dict_usernames"."value" AS "username",
+					"_dict_passwords"."value" AS "password",
+					"_rollup_credentials"."attacks" AS "total_uses",
+					"_rollup_credentials"."sources" AS "distinct_source_ips",
+					strftime('%Y-%m-%d %H:%M:%S', "_rollup_credentials"."first_seen" / 1000, 'unixepoch', 'localtime') AS "first_seen",
+					strftime('%Y-%m-%d %H:%M:%S', "_rollup_credentials"."last_seen" / 1000, 'unixepoch', 'localtime') AS "last_seen",
+					(
+						SELECT GROUP_CONCAT("_dict_source_ips"."value")
+						FROM "_rollup_source_credentials"
+						JOIN "_dict_source_ips" ON "_rollup_source_credentials"."source_ip" = "_dict_source_ips"."id"
+						WHERE
+							"_rollup_source_credentials"."username" = "_rollup_credentials"."username" AND
+							"_rollup_source_credentials"."password" = "_rollup_credentials"."password"
+					) AS "source_ips"
+				FROM "_rollup_credentials"
+				JOIN "_dict_usernames" ON "_rollup_credentials"."username" = "_dict_usernames"."id"
+				JOIN "_dict_passwords" ON "_rollup_credentials"."password" = "_dict_passwords"."id"
+				ORDER BY
+					"distinct_source_ips" ASC,
+					"total_uses" DESC,
+					"last_seen" DESC,
+					"username" ASC,
+					"password" ASC;
+
+			CREATE VIEW "report_new_credential_fingerprints_last_7_days" AS
+				SELECT
+					*
+				FROM "view_credential_fingerprints"
+				WHERE 
+					"distinct_source_ips" = 1 AND
+					"first_seen" >= strftime('%Y-%m-%d %H:%M:%S', 'now', '-7 days', 'localtime');
+
+			CREATE VIEW "report_hourly_attacks_last_7_days" AS
+				SELECT
+					"time" as "from_time",
+					strftime('%F %T', "time", '+1 hour') AS "to_time",
+					"total_attacks"
+				FROM (
+					SELECT
+						"date" || ' ' || "hour_of_day" || ':00:00' AS "time",
+						SUM("count") AS "total_attacks"
+					FROM "view_attacks_by_time"
+					WHERE 
+						"time" >= strftime('%F %H:00:00', 'now', '-7 days', 'localtime')
+					GROUP BY
+						"date",
+						"hour_of_day"
+					ORDER BY
+						"time" ASC
+				) AS hourly_data;
+
+			CREATE VIEW "report_daily_attacks_last_90_days" AS
+				SELECT
+					"time" as "from_time",
+					strftime('%F %T', "time", '+1 day') AS "to_time",
+					"total_attacks"
+				FROM (
+					SELECT
+						"date" || ' 00:00:00' AS "time",
+						SUM("count") AS "total_attacks"
+					FROM "view_attacks_by_time"
+					WHERE
+						"time" >= strftime('%F 00:00:00', 'now', '-90 days', 'localtime')
+					GROUP BY
+						"date"
+					ORDER BY
+						"time" ASC
+				) AS daily_data;
+		`,
+	},
+	{
+		Version: 14,
+		SQL: `
+			-- Hours in which the attacks of all sources, a single source or a sensor deviated from their baseline.
+			-- "scope" is total, source or sensor, "key" is the source or destination IP and empty for the total.
+			-- "hour" is the Unix time in milliseconds the hour in the reporting timezone starts at.
+			-- The baseline is the median of the same hour of the week in the "weeks" weeks before, "mad" the median
+			-- absolute deviation from it. "score" is the deviation in robust standard deviations, negative for drops.
+			CREATE TABLE "_anomalies" (
+				"id"	INTEGER NOT NULL UNIQUE,
+				"scope"	TEXT NOT NULL,
+				"key"	TEXT NOT NULL,
+				"hour"	INTEGER NOT NULL,
+				"attacks"	INTEGER NOT NULL,
+				"baseline"	REAL NOT NULL,
+				"mad"	REAL NOT NULL,
+				"score"	REAL NOT NULL,
+				"weeks"	INTEGER NOT NULL,
+				"detected"	INTEGER NOT NULL,
+				PRIMARY KEY("id" AUTOINCREMENT)
+			);
+			CREATE UNIQUE INDEX "idx_anomalies_hour" ON "_anomalies" (
+				"hour",
+				"scope",
+				"key"
+			);
+
+			CREATE VIEW "view_anomalies" AS
+				SELECT
+					"id",
+					strftime('%F %T', "hour" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_anomalies"."hour" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "hour",
+					"scope",
+					"key",
+					"attacks",
+					round("baseline", 1) AS "baseline",
+					round("mad", 1) AS "mad",
+					round("score", 1) AS "score",
+					"weeks",
+					strftime('%F %T', "detected" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_anomalies"."detected" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "detected"
+				FROM "_anomalies"
+				ORDER BY
+					"_anomalies"."hour" DESC,
+					"_anomalies"."scope" DESC,
+					"_anomalies"."key" DESC;
+		`,
+		Down: `
+			DROP VIEW "view_anomalies";
+			DROP TABLE "_anomalies";
+		`,
+	},
+	{
+		Version: 15,
+		SQL: `
+			-- Families of sources that try credentials from the same wordlist, rebuilt periodically from the rollups.
+			-- A family keeps its id across rebuilds while it shares sources with the family of the previous build,
+			-- so a botnet can be followed while it rotates through IP addresses.
+			-- "similarity" is the average Jaccard similarity of the credential sets of the linked sources.
+			CREATE TABLE "_wordlist_families" (
+				"id"	INTEGER NOT NULL UNIQUE,
+				"sources"	INTEGER NOT NULL,
+				"credentials"	INTEGER NOT NULL,
+				"attacks"	INTEGER NOT NULL,
+				"similarity"	REAL NOT NULL,
+				"first_seen"	INTEGER NOT NULL,
+				"last_seen"	INTEGER NOT NULL,
+				"updated"	INTEGER NOT NULL,
+				PRIMARY KEY("id" AUTOINCREMENT)
+			);
+			CREATE INDEX "idx_wordlist_families_last_seen" ON "_wordlist_families" (
+				"last_seen"
+			);
+
+			-- A source belongs to at most one family.
+			CREATE TABLE "_wordlist_family_sources" (
+				"family"	INTEGER NOT NULL,
+				"source_ip"	INTEGER NOT NULL,
+				"credentials"	INTEGER NOT NULL,
+				"attacks"	INTEGER NOT NULL,
+				"first_seen"	INTEGER NOT NULL,
+				"last_seen"	INTEGER NOT NULL,
+				FOREIGN KEY("family") REFERENCES "_wordlist_families"("id"),
+				FOREIGN KEY("source_ip") REFERENCES "_dict_source_ips"("id"),
+				PRIMARY KEY("source_ip")
+			);
+			CREATE INDEX "idx_wordlist_family_sources_family" ON "_wordlist_family_sources" (
+				"family"
+			);
+
+			-- The credentials used by most sources of a family, "sources" is the number of them that used it.
+			CREATE TABLE "_wordlist_family_credentials" (
+				"family"	INTEGER NOT NULL,
+				"rank"	INTEGER NOT NULL,
+				"username"	INTEGER NOT NULL,
+				"password"	INTEGER NOT NULL,
+				"sources"	INTEGER NOT NULL,
+				FOREIGN KEY("family") REFERENCES "_wordlist_families"("id"),
+				FOREIGN KEY("username") REFERENCES "_dict_usernames"("id"),
+				FOREIGN KEY("password") REFERENCES "_dict_passwords"("id"),
+				PRIMARY KEY("family", "rank")
+			);
+
+			CREATE VIEW "view_wordlist_families" AS
+				SELECT
+					"id",
+					"sources",
+					"credentials",
+					"attacks",
+					round("similarity", 2) AS "similarity",
+					strftime('%F %T', "first_seen" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_wordlist_families"."first_seen" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "first_seen",
+					strftime('%F %T', "last_seen" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_wordlist_families"."last_seen" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "last_seen",
+					(
+						SELECT group_concat("_dict_usernames"."value" || ' / ' || "_dict_passwords"."value", ', ' ORDER BY "_wordlist_family_credentials"."rank")
+						FROM "_wordlist_family_credentials"
+						JOIN "_dict_usernames" ON "_wordlist_family_credentials"."username" = "_dict_usernames"."id"
+						JOIN "_dict_passwords" ON "_wordlist_family_credentials"."password" = "_dict_passwords"."id"
+						WHERE "_wordlist_family_credentials"."family" = "_wordlist_families"."id" AND "_wordlist_family_credentials"."rank" <= 5
+					) AS "top_credentials"
+				FROM "_wordlist_families"
+				ORDER BY
+					"_wordlist_families"."last_seen" DESC;
+
+			CREATE VIEW "view_wordlist_family_sources" AS
+				SELECT
+					"_wordlist_family_sources"."family",
+					"_dict_source_ips"."value" AS "source_ip",
+					"_wordlist_family_sources"."credentials",
+					"_wordlist_family_sources"."attacks",
+					strftime('%F %T', "_wordlist_family_sources"."first_seen" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_wordlist_family_sources"."first_seen" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "first_seen",
+					strftime('%F %T', "_wordlist_family_sources"."last_seen" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_wordlist_family_sources"."last_seen" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "last_seen"
+				FROM "_wordlist_family_sources"
+				JOIN "_dict_source_ips" ON "_wordlist_family_sources"."source_ip" = "_dict_source_ips"."id"
+				ORDER BY
+					"_wordlist_family_sources"."family" ASC,
+					"_wordlist_family_sources"."first_seen" ASC;
+
+			CREATE VIEW "view_wordlist_family_credentials" AS
+				SELECT
+					"_wordlist_family_credentials"."family",
+					"_wordlist_family_credentials"."rank",
+					"_dict_usernames"."value" AS "username",
+					"_dict_passwords"."value" AS "password",
+					"_wordlist_family_credentials"."sources"
+				FROM "_wordlist_family_credentials"
+				JOIN "_dict_usernames" ON "_wordlist_family_credentials"."username" = "_dict_usernames"."id"
+				JOIN "_dict_passwords" ON "_wordlist_family_credentials"."password" = "_dict_passwords"."id"
+				ORDER BY
+					"_wordlist_family_credentials"."family" ASC,
+					"_wordlist_family_credentials"."rank" ASC;
+		`,
+		Down: `
+			DROP VIEW "view_wordlist_family_credentials";
+			DROP VIEW "view_wordlist_family_sources";
+			DROP VIEW "view_wordlist_families";
+			DROP TABLE "_wordlist_family_credentials";
+			DROP TABLE "_wordlist_family_sources";
+			DROP TABLE "_wordlist_families";
+		`,
+	},
+	{
+		Version: 16,
+		SQL: `
+			-- Features of every username and password, filled in by the classifier when a value is first stored.
+			-- "entropy" is the Shannon entropy of the characters times the length in bits, the is_* flags are 0 or 1.
+			-- "version" is the classifier version, values classified by an older one are classified again at startup.
+			CREATE TABLE "_username_features" (
+				"id"	INTEGER NOT NULL,
+				"length"	INTEGER NOT NULL,
+				"has_lower"	INTEGER NOT NULL,
+				"has_upper"	INTEGER NOT NULL,
+				"has_digit"	INTEGER NOT NULL,
+				"has_symbol"	INTEGER NOT NULL,
+				"entropy"	REAL NOT NULL,
+				"is_default"	INTEGER NOT NULL,
+				"is_service"	INTEGER NOT NULL,
+				"category"	TEXT NOT NULL,
+				"version"	INTEGER NOT NULL,
+				FOREIGN KEY("id") REFERENCES "_dict_usernames"("id"),
+				PRIMARY KEY("id")
+			);
+
+			CREATE TABLE "_password_features" (
+				"id"	INTEGER NOT NULL,
+				"length"	INTEGER NOT NULL,
+				"has_lower"	INTEGER NOT NULL,
+				"has_upper"	INTEGER NOT NULL,
+				"has_digit"	INTEGER NOT NULL,
+				"has_symbol"	INTEGER NOT NULL,
+				"entropy"	REAL NOT NULL,
+				"is_default"	INTEGER NOT NULL,
+				"is_leaked"	INTEGER NOT NULL,
+				"is_keyboard_walk"	INTEGER NOT NULL,
+				"category"	TEXT NOT NULL,
+				"version"	INTEGER NOT NULL,
+				FOREIGN KEY("id") REFERENCES "_dict_passwords"("id"),
+				PRIMARY KEY("id")
+			);
+
+			CREATE VIEW "view_username_categories" AS
+				SELECT
+					"_username_features"."category",
+					COUNT(DISTINCT "_rollup_credentials"."username") AS "usernames",
+					SUM("_rollup_credentials"."attacks") AS "attacks"
+				FROM "_rollup_credentials"
+				JOIN "_username_features" ON "_rollup_credentials"."username" = "_username_features"."id"
+				GROUP BY
+					"_username_features"."category"
+				ORDER BY
+					"attacks" DESC,
+					"category" ASC;
+
+			CREATE VIEW "view_password_categories" AS
+				SELECT
+					"_password_features"."category",
+					COUNT(DISTINCT "_rollup_credentials"."password") AS "passwords",
+					SUM("_rollup_credentials"."attacks") AS "attacks"
+				FROM "_rollup_credentials"
+				JOIN "_password_features" ON "_rollup_credentials"."password" = "_password_features"."id"
+				GROUP BY
+					"_password_features"."category"
+				ORDER BY
+					"attacks" DESC,
+					"category" ASC;
+
+			-- A password that equals its username is counted as the category username.
+			CREATE VIEW "report_credential_categories_last_30_days" AS
+				SELECT
+					strftime('%F', "_attacks"."timestamp" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_attacks"."timestamp" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "date",
+					"_username_features"."category" AS "username_category",
+					CASE
+						WHEN "_dict_usernames"."value" = "_dict_passwords"."value" THEN 'username'
+						ELSE "_password_features"."category"
+					END AS "password_category",
+					COUNT(1) AS "attacks"
+				FROM "_attacks"
+				JOIN "_dict_usernames" ON "_attacks"."username" = "_dict_usernames"."id"
+				JOIN "_dict_passwords" ON "_attacks"."password" = "_dict_passwords"."id"
+				JOIN "_username_features" ON "_attacks"."username" = "_username_features"."id"
+				JOIN "_password_features" ON "_attacks"."password" = "_password_features"."id"
+				WHERE
+					"_attacks"."timestamp" >= (unixepoch('now', '-30 days') + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= unixepoch('now', '-30 days') * 1000 ORDER BY "since" DESC LIMIT 1
+					)) / 86400 * 86400 * 1000 - (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= unixepoch('now', '-30 days') * 1000 ORDER BY "since" DESC LIMIT 1
+					) * 1000
+				GROUP BY
+					"date",
+					"username_category",
+					"password_category"
+				ORDER BY
+					"date" ASC,
+					"attacks" DESC,
+					"username_category" ASC,
+					"password_category" ASC;
+		`,
+		Down: `
+			DROP VIEW "report_credential_categories_last_30_days";
+			DROP VIEW "view_password_categories";
+			DROP VIEW "view_username_categories";
+			DROP TABLE "_password_features";
+			DROP TABLE "_username_features";
+		`,
+	},
+	{
+		Version: 17,
+		SQL: `
+			-- Structures the evidence parsers found in an evidence, filled in when the evidence is first stored.
+			-- Values that were not found are empty, a "source_port" of 0 is unknown. "kex", "ciphers" and "macs" are
+			-- comma separated in the order the client offered them, "parsers" lists the parsers that found something.
+			-- "version" is the parser version, evidences parsed by an older one are parsed again at startup.
+			CREATE TABLE "_evidence_metadata" (
+				"id"	INTEGER NOT NULL,
+				"banner"	TEXT NOT NULL,
+				"protocol"	TEXT NOT NULL,
+				"software"	TEXT NOT NULL,
+				"software_version"	TEXT NOT NULL,
+				"comment"	TEXT NOT NULL,
+				"kex"	TEXT NOT NULL,
+				"ciphers"	TEXT NOT NULL,
+				"macs"	TEXT NOT NULL,
+				"source_port"	INTEGER NOT NULL,
+				"parsers"	TEXT NOT NULL,
+				"version"	INTEGER NOT NULL,
+				FOREIGN KEY("id") REFERENCES "_dict_evidences"("id"),
+				PRIMARY KEY("id")
+			);
+
+			CREATE TABLE "_rollup_source_evidences" (
+				"source_ip"	INTEGER NOT NULL,
+				"evidence"	INTEGER NOT NULL,
+				"attacks"	INTEGER NOT NULL,
+				"first_seen"	INTEGER NOT NULL,
+				"last_seen"	INTEGER NOT NULL,
+				FOREIGN KEY("source_ip") REFERENCES "_dict_source_ips"("id"),
+				FOREIGN KEY("evidence") REFERENCES "_dict_evidences"("id"),
+				PRIMARY KEY("source_ip", "evidence")
+			);
+
+			INSERT INTO "_rollup_source_evidences" ("source_ip", "evidence", "attacks", "first_seen", "last_seen")
+			SELECT "source_ip", "evidence", COUNT(1), MIN("timestamp"), MAX("timestamp")
+			FROM "_attacks"
+			GROUP BY "source_ip", "evidence";
+
+			CREATE TRIGGER "trg_attacks_rollup_evidences" AFTER INSERT ON "_attacks"
+			BEGIN
+				INSERT INTO "_rollup_source_evidences" ("source_ip", "evidence", "attacks", "first_seen", "last_seen")
+				VALUES (NEW."source_ip", NEW."evidence", 1, NEW."timestamp", NEW."timestamp")
+				ON CONFLICT ("source_ip", "evidence") DO UPDATE SET
+					"attacks" = "attacks" + 1,
+					"first_seen" = MIN("first_seen", excluded."first_seen"),
+					"last_seen" = MAX("last_seen", excluded."last_seen");
+			END;
+
+			-- Attacks by the SSH client software and version of their banner, which are empty without a banner.
+			CREATE VIEW "view_ssh_clients" AS
+				SELECT
+					"software",
+					"software_version",
+					"attacks",
+					"sources",
+					"evidences",
+					strftime('%F %T', "first_seen" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "clients"."first_seen" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "first_seen",
+					strftime('%F %T', "last_seen" / 1000 + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "clients"."last_seen" ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "last_seen"
+				FROM (
+					SELECT
+						"_evidence_metadata"."software",
+						"_evidence_metadata"."software_version",
+						SUM("_rollup_source_evidences"."attacks") AS "attacks",
+						COUNT(DISTINCT "_rollup_source_evidences"."source_ip") AS "sources",
+						COUNT(DISTINCT "_rollup_source_evidences"."evidence") AS "evidences",
+						MIN("_rollup_source_evidences"."first_seen") AS "first_seen",
+						MAX("_rollup_source_evidences"."last_seen") AS "last_seen"
+					FROM "_rollup_source_evidences"
+					JOIN "_evidence_metadata" ON "_rollup_source_evidences"."evidence" = "_evidence_metadata"."id"
+					GROUP BY
+						"_evidence_metadata"."software",
+						"_evidence_metadata"."software_version"
+				) AS "clients"
+				ORDER BY
+					"attacks" DESC,
+					"software" ASC,
+					"software_version" ASC;
+
+			-- Attacks by the SSH client software of their banner over all versions.
+			CREATE VIEW "view_ssh_client_software" AS
+				SELECT
+					"_evidence_metadata"."software",
+					COUNT(DISTINCT "_evidence_metadata"."software_version") AS "versions",
+					SUM("_rollup_source_evidences"."attacks") AS "attacks",
+					COUNT(DISTINCT "_rollup_source_evidences"."source_ip") AS "sources"
+				FROM "_rollup_source_evidences"
+				JOIN "_evidence_metadata" ON "_rollup_source_evidences"."evidence" = "_evidence_metadata"."id"
+				GROUP BY
+					"_evidence_metadata"."software"
+				ORDER BY
+					"attacks" DESC,
+					"software" ASC;
+
+			-- Attacks by the algorithms the client offered, only for evidences with at least one algorithm list.
+			CREATE VIEW "view_ssh_client_algorithms" AS
+				SELECT
+					"_evidence_metadata"."kex",
+					"_evidence_metadata"."ciphers",
+					"_evidence_metadata"."macs",
+					group_concat(DISTINCT nullif("_evidence_metadata"."software", '')) AS "software",
+					SUM("_rollup_source_evidences"."attacks") AS "attacks",
+					COUNT(DISTINCT "_rollup_source_evidences"."source_ip") AS "sources"
+				FROM "_rollup_source_evidences"
+				JOIN "_evidence_metadata" ON "_rollup_source_evidences"."evidence" = "_evidence_metadata"."id"
+				WHERE
+					"_evidence_metadata"."kex" <> '' OR
+					"_evidence_metadata"."ciphers" <> '' OR
+					"_evidence_metadata"."macs" <> ''
+				GROUP BY
+					"_evidence_metadata"."kex",
+					"_evidence_metadata"."ciphers",
+					"_evidence_metadata"."macs"
+				ORDER BY
+					"attacks" DESC,
+					"kex" ASC,
+					"ciphers" ASC,
+					"macs" ASC;
+		`,
+		Down: `
+			DROP VIEW "view_ssh_client_algorithms";
+			DROP VIEW "view_ssh_client_software";
+			DROP VIEW "view_ssh_clients";
+			DROP TRIGGER "trg_attacks_rollup_evidences";
+			DROP TABLE "_rollup_source_evidences";
+			DROP TABLE "_evidence_metadata";
+		`,
+	},
+	{
+		Version: 18,
+		SQL: `
+			-- Attacks per hour and per day in the reporting timezone, so the hourly and daily reports
+			-- do not sum up the minutes. view_attacks_by_time has a minute column and stays on the minutes.
+			-- "hour" is the Unix time in seconds the local hour starts at, "offset" the offset it has in the reporting
+			-- timezone. Both are the key, as an hour with a half hour offset can start where another one starts.
+			-- They are maintained by a trigger on every inserted attack and rebuilt from the minutes
+			-- when the reporting timezone changes.
+			CREATE TABLE "_rollup_hours" (
+				"hour"	INTEGER NOT NULL,
+				"offset"	INTEGER NOT NULL,
+				"attacks"	INTEGER NOT NULL,
+				PRIMARY KEY("hour", "offset")
+			);
+
+			CREATE TABLE "_rollup_days" (
+				"date"	TEXT NOT NULL,
+				"attacks"	INTEGER NOT NULL,
+				PRIMARY KEY("date")
+			);
+
+			INSERT INTO "_rollup_hours" ("hour", "offset", "attacks")
+			SELECT ("minute" + "offset") / 3600 * 3600 - "offset", "offset", SUM("attacks")
+			FROM (
+				SELECT "minute", "attacks", (
+					SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_rollup_minutes"."minute" * 1000 ORDER BY "since" DESC LIMIT 1
+				) AS "offset"
+				FROM "_rollup_minutes"
+			)
+			GROUP BY 1, 2;
+
+			INSERT INTO "_rollup_days" ("date", "attacks")
+			SELECT strftime('%F', "minute" + "offset", 'unixepoch'), SUM("attacks")
+			FROM (
+				SELECT "minute", "attacks", (
+					SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_rollup_minutes"."minute" * 1000 ORDER BY "since" DESC LIMIT 1
+				) AS "offset"
+				FROM "_rollup_minutes"
+			)
+			GROUP BY 1;
+
+			-- The WHERE clauses keep SQLite from reading ON CONFLICT as a join constraint.
+			CREATE TRIGGER "trg_attacks_rollup_local" AFTER INSERT ON "_attacks"
+			BEGIN
+				INSERT INTO "_rollup_hours" ("hour", "offset", "attacks")
+				SELECT (NEW."timestamp" / 1000 + "offset") / 3600 * 3600 - "offset", "offset", 1
+				FROM "_report_timezone"
+				WHERE "since" = (SELECT MAX("since") FROM "_report_timezone" WHERE "since" <= NEW."timestamp")
+				ON CONFLICT ("hour", "offset") DO UPDATE SET
+					"attacks" = "attacks" + 1;
+
+				INSERT INTO "_rollup_days" ("date", "attacks")
+				SELECT strftime('%F', NEW."timestamp" / 1000 + "offset", 'unixepoch'), 1
+				FROM "_report_timezone"
+				WHERE "since" = (SELECT MAX("since") FROM "_report_timezone" WHERE "since" <= NEW."timestamp")
+				ON CONFLICT ("date") DO UPDATE SET
+					"attacks" = "attacks" + 1;
+			END;
+
+			DROP VIEW "view_daily_attacks";
+			DROP VIEW "report_hourly_attacks_last_7_days";
+			DROP VIEW "report_daily_attacks_last_90_days";
+
+			CREATE VIEW "view_daily_attacks" AS
+				SELECT
+					"date",
+					"attacks" AS "count"
+				FROM "_rollup_days"
+				ORDER BY "date" DESC;
+
+			CREATE VIEW "report_hourly_attacks_last_7_days" AS
+				SELECT
+					strftime('%F %T', "hour" + "offset", 'unixepoch') AS "from_time",
+					strftime('%F %T', "hour" + "offset" + 3600, 'unixepoch') AS "to_time",
+					"attacks" AS "total_attacks",
+					printf('%s%02d:%02d', iif("offset" < 0, '-', '+'), abs("offset") / 3600, abs("offset") % 3600 / 60) AS "utc_offset"
+				FROM "_rollup_hours"
+				WHERE
+					"from_time" >= strftime('%F %H:00:00', unixepoch('now', '-7 days') + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= unixepoch('now', '-7 days') * 1000 ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch')
+				ORDER BY "hour" ASC;
+
+			CREATE VIEW "report_daily_attacks_last_90_days" AS
+				SELECT
+					"date" || ' 00:00:00' AS "from_time",
+					strftime('%F %T', "date", '+1 day') AS "to_time",
+					"attacks" AS "total_attacks"
+				FROM "_rollup_days"
+				WHERE
+					"from_time" >= strftime('%F 00:00:00', unixepoch('now', '-90 days') + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= unixepoch('now', '-90 days') * 1000 ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch')
+				ORDER BY "date" ASC;
+		`,
+		Down: `
+			DROP VIEW "view_daily_attacks";
+			DROP VIEW "report_hourly_attacks_last_7_days";
+			DROP VIEW "report_daily_attacks_last_90_days";
+			DROP TRIGGER "trg_attacks_rollup_local";
+			DROP TABLE "_rollup_hours";
+			DROP TABLE "_rollup_days";
+
+			CREATE VIEW "view_daily_attacks" AS
+				SELECT
+					strftime('%F', "minute" + (
+						SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_rollup_minutes"."minute" * 1000 ORDER BY "since" DESC LIMIT 1
+					), 'unixepoch') AS "date",
+					SUM("attacks") AS "count"
+				FROM "_rollup_minutes"
+				GROUP BY "date"
+				ORDER BY "date" DESC;
+
+			CREATE VIEW "report_hourly_attacks_last_7_days" AS
+				SELECT
+					"time" as "from_time",
+					strftime('%F %T', "time", '+1 hour') AS "to_time",
+					"total_attacks",
+					"utc_offset"
+				FROM (
+					SELECT
+						"date" || ' ' || "hour_of_day" || ':00:00' AS "time",
+						"utc_offset",
+						SUM("count") AS "total_attacks"
+					FROM "view_attacks_by_time"
+					WHERE
+						"time" >= strftime('%F %H:00:00', unixepoch('now', '-7 days') + (
+							SELECT "offset" FROM "_report_timezone" WHERE "since" <= unixepoch('now', '-7 days') * 1000 ORDER BY "since" DESC LIMIT 1
+						), 'unixepoch')
+					GROUP BY
+						"date",
+						"hour_of_day",
+						"utc_offset"
+					ORDER BY
+						strftime('%F %T', "time" || "utc_offset") ASC
+				) AS hourly_data;
+
+			CREATE VIEW "report_daily_attacks_last_90_days" AS
+				SELECT
+					"time" as "from_time",
+					strftime('%F %T', "time", '+1 day') AS "to_time",
+					"total_attacks"
+				FROM (
+					SELECT
+						"date" || ' 00:00:00' AS "time",
+						SUM("count") AS "total_attacks"
+					FROM "view_attacks_by_time"
+					WHERE
+						"time" >= strftime('%F 00:00:00', unixepoch('now', '-90 days') + (
+							SELECT "offset" FROM "_report_timezone" WHERE "since" <= unixepoch('now', '-90 days') * 1000 ORDER BY "since" DESC LIMIT 1
+						), 'unixepoch')
+					GROUP BY
+						"date"
+					ORDER BY
+						"time" ASC
+				) AS daily_data;
+		`,
 	},
 }
 
@@ -880,17 +2459,31 @@ func (ft *FlexibleTime) UnmarshalJSON(b []byte) error {
 	// First, try the standard RFC3339 format.
 	t, err := time.Parse(time.RFC3339Nano, s)
 	if err != nil {
-		// If that fails, try our custom layout without timezone.
-		t, err = time.ParseInLocation(layoutWithoutTimezone, s, time.Local)
-		if err != nil {
-			return fmt.Errorf("failed to parse time %q with any known layout: %w", s, err)
+		// If that fails, try our custom layout without timezone, which is interpreted as the policy says.
+		if _, errNaive := time.Parse(layoutWithoutTimezone, s); errNaive != nil {
+			return fmt.Errorf("failed to parse time %q with any known layout: %w", s, errNaive)
 		}
+		loc, errPolicy := naiveTimestampLocation()
+		if errPolicy != nil {
+			return fmt.Errorf("failed to parse time %q: %w", s, errPolicy)
+		}
+		t, _ = time.ParseInLocation(layoutWithoutTimezone, s, loc)
 	}
 
-	*ft = FlexibleTime(t.Local())
+	*ft = FlexibleTime(t.In(reportLocation()))
 	return nil
 }
 
+// MarshalJSON implements the json.Marshaler interface.
+// A zero time is written as null.
+func (ft FlexibleTime) MarshalJSON() ([]byte, error) {
+	t := ft.ToTime()
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.Format(time.RFC3339Nano))
+}
+
 func (ft FlexibleTime) ToTime() time.Time {
 	return time.Time(ft)
 }
@@ -906,12 +2499,123 @@ const (
 )
 
 type Config struct {
-	ListenAddress      string
-	DatabasePath       string
-	ProxiedURL         *url.URL
+	ListenAddress string
+	DatabasePath  string
+	// Collector is the upstream the requests of the pods are forwarded to.
+	Collector          *Upstream
 	LogRequests        bool
 	DebugLog           bool
 	DoNotSubmitAttacks bool
+	// OfflineCollector makes the proxy answer the whole collector API itself instead of forwarding anything.
+	OfflineCollector bool
+
+	// VerifySchema makes a database schema that does not match the migrations a fatal error instead of a warning.
+	VerifySchema bool
+
+	// HeaderMode decides whether hop-by-hop headers are removed from forwarded requests and responses.
+	HeaderMode HeaderMode
+
+	// UpstreamTimeout is how long the proxy waits for the response headers of the collector.
+	UpstreamTimeout time.Duration
+	// BreakerErrorRate is the share of failed or slow requests that opens the circuit breaker. Zero disables it.
+	BreakerErrorRate float64
+	// BreakerMinRequests is the number of requests in a window before the error rate is evaluated.
+	BreakerMinRequests int
+	// BreakerSlowThreshold is the latency after which a forwarded request counts as failed.
+	BreakerSlowThreshold time.Duration
+	// BreakerWindow is the length of the windows in which the error rate is counted.
+	BreakerWindow time.Duration
+	// BreakerOpenDuration is how long the circuit stays open before a probe request is forwarded.
+	BreakerOpenDuration time.Duration
+	// CheckIPCacheTTL is how long a /check_ip response is used as fallback while the circuit is open.
+	CheckIPCacheTTL time.Duration
+
+	// CapturePath is the file every request and response is recorded to. Empty disables the recording.
+	CapturePath string
+	// CaptureMaxBytes is the size after which the capture file is rotated.
+	CaptureMaxBytes int64
+	// CaptureMaxFiles is the number of rotated capture files that are kept.
+	CaptureMaxFiles int
+	// CaptureMaxBodyBytes is the number of bytes of each body that is recorded.
+	CaptureMaxBodyBytes int
+
+	// DebugLogMaxBytes is the number of bytes of each request and response body written to the debug log.
+	DebugLogMaxBytes int
+
+	// SensorSilenceThreshold is the time after which a known sensor that sent nothing is reported as silent.
+	// Zero disables the liveness monitoring.
+	SensorSilenceThreshold time.Duration
+	// AlertWebhookURL receives a JSON notification for every alert. Empty disables the default webhook.
+	AlertWebhookURL string
+	// NotifyConfigPath is the path to a JSON file with additional webhooks and notification rules.
+	NotifyConfigPath string
+
+	// MaxBodyBytes is the maximum size of a request body. Larger requests are rejected with 413.
+	MaxBodyBytes int64
+	// RateLimit is the number of requests per second a single client may send. Zero, the default, disables the rate limit.
+	RateLimit float64
+	// RateLimitBurst is the number of requests a client may send at once.
+	RateLimitBurst int
+	// AllowedClients are the networks that may submit attacks. Empty allows every client.
+	AllowedClients []*net.IPNet
+
+	// MaxTimestampSkew is how far in the future an attack timestamp may be before the attack is quarantined.
+	MaxTimestampSkew time.Duration
+	// MaxAttackAge is how far in the past an attack timestamp may be before the attack is quarantined.
+	MaxAttackAge time.Duration
+	// MaxEvidenceBytes is the length the evidence is truncated to.
+	MaxEvidenceBytes int
+
+	// IngestQueueSize is the number of attacks that may wait for the database.
+	IngestQueueSize int
+	// IngestWorkers is the number of goroutines that save queued attacks.
+	// They all hand their attacks to the single attack writer, more than a few only wait for it.
+	IngestWorkers int
+	// IngestOverflow decides what happens to attacks that arrive while the queue is full.
+	IngestOverflow OverflowPolicy
+	// IngestSpillPath is the file attacks are spilled to with the spill overflow policy.
+	IngestSpillPath string
+
+	// BackupDir is the directory the rotated backups of the database are written to.
+	BackupDir string
+	// BackupKeep is the number of backups of each kind that are kept.
+	BackupKeep int
+	// BackupCompress writes the backups gzip compressed.
+	BackupCompress bool
+	// BackupInterval is the time between scheduled backups. Zero disables them.
+	BackupInterval time.Duration
+	// BackupBeforeMigration backs the database up before pending migrations are applied.
+	BackupBeforeMigration bool
+
+	// Timezone is the timezone the views and the API report times in, independent of the TZ of the process.
+	Timezone *time.Location
+	// NaiveTimestamps decides how attack timestamps without a timezone are interpreted.
+	NaiveTimestamps NaiveTimestampPolicy
+
+	// ReportsDir is the directory with the user-defined reports.
+	ReportsDir string
+
+	// DigestConfigPath is the path to a JSON file with the scheduled digests. Empty disables digests.
+	DigestConfigPath string
+
+	// AnomalyThreshold is the score beyond which the attacks of an hour are an anomaly. Zero disables the detection.
+	AnomalyThreshold float64
+	// AnomalyWeeks is the number of weeks the baseline of an hour of the week is computed from.
+	AnomalyWeeks int
+	// AnomalyMinAttacks is the number of attacks below which a spike, or a baseline below which a drop, is ignored.
+	AnomalyMinAttacks int
+
+	// WordlistInterval is how often the wordlist families are rebuilt. Zero disables the rebuild.
+	WordlistInterval time.Duration
+	// WordlistSimilarity is the Jaccard similarity of their credential sets above which two sources share a wordlist.
+	WordlistSimilarity float64
+	// WordlistMinCredentials is the number of distinct credentials a source needs to be compared.
+	WordlistMinCredentials int
+
+	// Redaction decides which credentials the credential export, the reports, the digests and the wordlist families hand out.
+	Redaction RedactionPolicy
+	// AdminToken is the bearer token the credential export, the reports and the anomalies require. Empty disables them over HTTP.
+	AdminToken string
 }
 
 type Attack struct {
@@ -923,6 +2627,9 @@ type Attack struct {
 	Evidence        string       `json:"evidence"`
 	AttackType      string       `json:"attack_type"`
 	TestMode        bool         `json:"test_mode"`
+
+	// firstCredentialUse is set by the attack writer when the attack is the first one with its username and password.
+	firstCredentialUse bool
 }
 
 var db *sql.DB
@@ -939,6 +2646,20 @@ func strToBool(s string) bool {
 func main() {
 	log.SetFlags(0)
 
+	appConfig = loadConfig()
+
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("[FATAL] %v", err)
+		}
+		return
+	}
+
+	serve()
+}
+
+// loadConfig reads the configuration from the environment.
+func loadConfig() *Config {
 	proxiedURLString := getEnv("NETWATCH_COLLECTOR_PROXIED_URL", "https://api.netwatch.team")
 	if proxiedURLString == "" {
 		log.Fatal("[FATAL] Environment variable NETWATCH_COLLECTOR_PROXIED_URL must be set!")
@@ -951,170 +2672,363 @@ func main() {
 	logRequests := strToBool(getEnv("NETWATCH_PROXY_LOG_REQUESTS", "false"))
 	debugLog := strToBool(getEnv("NETWATCH_PROXY_DEBUG_LOG", "false"))
 	doNotSubmitAttacks := strToBool(getEnv("NETWATCH_PROXY_DO_NOT_SUBMIT_ATTACKS", "false"))
+	offlineCollector := strToBool(getEnv("NETWATCH_PROXY_OFFLINE_COLLECTOR", "false"))
 
-	appConfig = &Config{
-		ListenAddress:      getEnv("NETWATCH_PROXY_LISTEN_ADDRESS", ":8161"),
-		DatabasePath:       getEnv("NETWATCH_PROXY_DB_PATH", "/app/data/attacks.db"),
-		ProxiedURL:         parsedURL,
-		LogRequests:        logRequests || debugLog,
-		DebugLog:           debugLog,
-		DoNotSubmitAttacks: doNotSubmitAttacks,
+	headerMode, err := parseHeaderMode(getEnv("NETWATCH_PROXY_HEADER_MODE", "standard"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_HEADER_MODE: %v", err)
+	}
+	forwardedHeaders, err := parseForwardedHeaders(getEnv("NETWATCH_PROXY_FORWARDED_HEADERS", ""))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_FORWARDED_HEADERS: %v", err)
 	}
 
-	initDB(appConfig.DatabasePath)
-	defer db.Close()
+	upstreamTimeout, err := time.ParseDuration(getEnv("NETWATCH_PROXY_UPSTREAM_TIMEOUT", "60s"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_UPSTREAM_TIMEOUT: %v", err)
+	}
+	breakerErrorRate, err := strconv.ParseFloat(getEnv("NETWATCH_PROXY_BREAKER_ERROR_RATE", "0.5"), 64)
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_BREAKER_ERROR_RATE: %v", err)
+	}
+	breakerMinRequests, err := strconv.Atoi(getEnv("NETWATCH_PROXY_BREAKER_MIN_REQUESTS", "10"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_BREAKER_MIN_REQUESTS: %v", err)
+	}
+	breakerSlowThreshold, err := time.ParseDuration(getEnv("NETWATCH_PROXY_BREAKER_SLOW_THRESHOLD", "10s"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_BREAKER_SLOW_THRESHOLD: %v", err)
+	}
+	breakerWindow, err := time.ParseDuration(getEnv("NETWATCH_PROXY_BREAKER_WINDOW", "1m"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_BREAKER_WINDOW: %v", err)
+	}
+	breakerOpenDuration, err := time.ParseDuration(getEnv("NETWATCH_PROXY_BREAKER_OPEN_DURATION", "30s"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_BREAKER_OPEN_DURATION: %v", err)
+	}
+	checkIPCacheTTL, err := time.ParseDuration(getEnv("NETWATCH_PROXY_CHECK_IP_CACHE_TTL", "24h"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_CHECK_IP_CACHE_TTL: %v", err)
+	}
 
-	// A single handler for all incoming requests.
-	http.HandleFunc("/", handleProxyRequest)
+	captureMaxBytes, err := strconv.ParseInt(getEnv("NETWATCH_PROXY_CAPTURE_MAX_BYTES", "104857600"), 10, 64)
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_CAPTURE_MAX_BYTES: %v", err)
+	}
+	captureMaxFiles, err := strconv.Atoi(getEnv("NETWATCH_PROXY_CAPTURE_MAX_FILES", "5"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_CAPTURE_MAX_FILES: %v", err)
+	}
+	captureMaxBodyBytes, err := strconv.Atoi(getEnv("NETWATCH_PROXY_CAPTURE_MAX_BODY_BYTES", "65536"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_CAPTURE_MAX_BODY_BYTES: %v", err)
+	}
 
-	log.Printf("Attack Pod Proxy started. Listening on %s. Forwarding to %s.\n", appConfig.ListenAddress, appConfig.ProxiedURL)
-	if err := http.ListenAndServe(appConfig.ListenAddress, nil); err != nil {
-		log.Fatalf("[FATAL] Failed to start server: %v", err)
+	debugLogMaxBytes, err := strconv.Atoi(getEnv("NETWATCH_PROXY_DEBUG_LOG_MAX_BYTES", "4096"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_DEBUG_LOG_MAX_BYTES: %v", err)
 	}
-}
 
-// handleProxyRequest manually forwards the request to ensure minimal header modification.
-func handleProxyRequest(w http.ResponseWriter, r *http.Request) {
-	// Read the entire body of the incoming request.
-	body, err := io.ReadAll(r.Body)
+	maxBodyBytes, err := strconv.ParseInt(getEnv("NETWATCH_PROXY_MAX_BODY_BYTES", "1048576"), 10, 64)
 	if err != nil {
-		log.Printf("[ERROR] Failed to read request body: %v\n", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_MAX_BODY_BYTES: %v", err)
+	}
+	rateLimit, err := strconv.ParseFloat(getEnv("NETWATCH_PROXY_RATE_LIMIT", "0"), 64)
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_RATE_LIMIT: %v", err)
+	}
+	rateLimitBurst, err := strconv.Atoi(getEnv("NETWATCH_PROXY_RATE_LIMIT_BURST", "200"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_RATE_LIMIT_BURST: %v", err)
+	}
+	allowedClients, err := parseCIDRs(getEnv("NETWATCH_PROXY_ALLOWED_CLIENTS", ""))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_ALLOWED_CLIENTS: %v", err)
 	}
-	r.Body.Close()
 
-	if r.Method == http.MethodPost && r.URL.Path == string(EndpointAddAttack) {
-		var attack Attack
-		err := json.Unmarshal(body, &attack)
-		if err != nil {
-			log.Printf("[ERROR] Failed to unmarshal attack data: %v\n", err)
-		} else if errDb := saveAttackToDB(&attack); errDb != nil {
-			if errDb == ErrDuplicateAttack {
-				if appConfig.DebugLog {
-					log.Printf("[DEBUG] Skipping duplicate attack entry from %s", attack.SourceIP)
-				}
-			} else {
-				log.Printf("[ERROR] Failed to save attack to DB: %v\n", errDb)
-			}
-		} else {
-			timestamp := attack.AttackTimestamp.ToTime().Format("02.01. 15:04:05")
-			log.Printf("%s | From: %-15s | User: %-22s | Pass: %s\n",
-				timestamp, attack.SourceIP, attack.Username, attack.Password)
-		}
+	maxTimestampSkew, err := time.ParseDuration(getEnv("NETWATCH_PROXY_MAX_TIMESTAMP_SKEW", "1h"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_MAX_TIMESTAMP_SKEW: %v", err)
+	}
+	maxAttackAge, err := time.ParseDuration(getEnv("NETWATCH_PROXY_MAX_ATTACK_AGE", "720h"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_MAX_ATTACK_AGE: %v", err)
+	}
+	maxEvidenceBytes, err := strconv.Atoi(getEnv("NETWATCH_PROXY_MAX_EVIDENCE_BYTES", "16384"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_MAX_EVIDENCE_BYTES: %v", err)
 	}
 
-	// Construct the full destination URL.
-	r.URL.Scheme = appConfig.ProxiedURL.Scheme
-	r.URL.Host = appConfig.ProxiedURL.Host
-	r.Host = appConfig.ProxiedURL.Host
-	targetURL := appConfig.ProxiedURL.ResolveReference(r.URL)
+	ingestQueueSize, err := strconv.Atoi(getEnv("NETWATCH_PROXY_INGEST_QUEUE_SIZE", "10000"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_INGEST_QUEUE_SIZE: %v", err)
+	}
+	ingestWorkers, err := strconv.Atoi(getEnv("NETWATCH_PROXY_INGEST_WORKERS", "2"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_INGEST_WORKERS: %v", err)
+	}
+	ingestOverflow, err := parseOverflowPolicy(getEnv("NETWATCH_PROXY_INGEST_OVERFLOW", "spill"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_INGEST_OVERFLOW: %v", err)
+	}
+	databasePath := getEnv("NETWATCH_PROXY_DB_PATH", "/app/data/attacks.db")
 
-	// Create a new request to be forwarded.
-	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL.String(), bytes.NewBuffer(body))
+	backupKeep, err := strconv.Atoi(getEnv("NETWATCH_PROXY_BACKUP_KEEP", "7"))
 	if err != nil {
-		log.Printf("[ERROR] Failed to create proxy request: %v\n", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_BACKUP_KEEP: %v", err)
+	}
+	backupInterval, err := time.ParseDuration(getEnv("NETWATCH_PROXY_BACKUP_INTERVAL", "0"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_BACKUP_INTERVAL: %v", err)
 	}
 
-	proxyReq.Header = r.Header.Clone()
-	proxyReq.Host = appConfig.ProxiedURL.Host
+	timezoneName := getEnv("NETWATCH_PROXY_TIMEZONE", "UTC")
+	if timezoneName == "Local" {
+		log.Fatal("[FATAL] NETWATCH_PROXY_TIMEZONE must name a timezone, like Europe/Berlin or UTC.")
+	}
+	timezone, err := time.LoadLocation(timezoneName)
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_TIMEZONE: %v", err)
+	}
+	naiveTimestamps, err := parseNaiveTimestampPolicy(getEnv("NETWATCH_PROXY_NAIVE_TIMESTAMPS", "utc"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_NAIVE_TIMESTAMPS: %v", err)
+	}
 
-	if appConfig.LogRequests {
-		log.Printf("[INFO] Forwarding request: %s %s to %s\n", r.Method, r.URL.Path, targetURL.String())
+	sensorSilenceThreshold, err := time.ParseDuration(getEnv("NETWATCH_PROXY_SENSOR_SILENCE_THRESHOLD", "30m"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_SENSOR_SILENCE_THRESHOLD: %v", err)
 	}
-	if appConfig.DebugLog {
-		headerCount := 0
-		for _, values := range proxyReq.Header {
-			headerCount += len(values)
-		}
 
-		log.Printf("[DEBUG] Request Headers (%d):\n", headerCount)
-		for key, values := range proxyReq.Header {
-			for _, value := range values {
-				log.Printf("[DEBUG] - %s: %s\n", key, value)
-			}
-		}
+	anomalyThreshold, err := strconv.ParseFloat(getEnv("NETWATCH_PROXY_ANOMALY_THRESHOLD", "3.5"), 64)
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_ANOMALY_THRESHOLD: %v", err)
+	}
+	anomalyWeeks, err := strconv.Atoi(getEnv("NETWATCH_PROXY_ANOMALY_WEEKS", "4"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_ANOMALY_WEEKS: %v", err)
+	}
+	if anomalyWeeks < minAnomalyWeeks {
+		log.Fatalf("[FATAL] NETWATCH_PROXY_ANOMALY_WEEKS must be at least %d", minAnomalyWeeks)
+	}
+	anomalyMinAttacks, err := strconv.Atoi(getEnv("NETWATCH_PROXY_ANOMALY_MIN_ATTACKS", "20"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_ANOMALY_MIN_ATTACKS: %v", err)
+	}
 
-		log.Printf("[DEBUG] Request Body (%d bytes):\n", len(body))
-		if len(body) > 0 {
-			log.Printf("[DEBUG] %s\n", string(body))
-		} else {
-			log.Println("[DEBUG] <empty body>")
-		}
+	wordlistInterval, err := time.ParseDuration(getEnv("NETWATCH_PROXY_WORDLIST_INTERVAL", "6h"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_WORDLIST_INTERVAL: %v", err)
+	}
+	wordlistSimilarity, err := strconv.ParseFloat(getEnv("NETWATCH_PROXY_WORDLIST_SIMILARITY", "0.5"), 64)
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_WORDLIST_SIMILARITY: %v", err)
+	}
+	wordlistMinCredentials, err := strconv.Atoi(getEnv("NETWATCH_PROXY_WORDLIST_MIN_CREDENTIALS", "5"))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_WORDLIST_MIN_CREDENTIALS: %v", err)
 	}
 
-	var resp *http.Response
-	if appConfig.DoNotSubmitAttacks && r.URL.Path == string(EndpointAddAttack) {
-		if appConfig.LogRequests {
-			log.Printf("[INFO] Skipping submission of attack data due to configuration and returning mockup response.")
-		}
+	redaction, err := parseRedactionPolicy(getEnv("NETWATCH_PROXY_REDACTION", string(RedactPasswords)))
+	if err != nil {
+		log.Fatalf("[FATAL] Could not parse NETWATCH_PROXY_REDACTION: %v", err)
+	}
+
+	return &Config{
+		ListenAddress:      getEnv("NETWATCH_PROXY_LISTEN_ADDRESS", ":8161"),
+		DatabasePath:       databasePath,
+		Collector:          &Upstream{URL: parsedURL, ForwardedHeaders: forwardedHeaders},
+		LogRequests:        logRequests || debugLog,
+		DebugLog:           debugLog,
+		DoNotSubmitAttacks: doNotSubmitAttacks,
+		OfflineCollector:   offlineCollector,
+
+		VerifySchema: strToBool(getEnv("NETWATCH_PROXY_VERIFY_SCHEMA", "true")),
+
+		HeaderMode: headerMode,
+
+		UpstreamTimeout:      upstreamTimeout,
+		BreakerErrorRate:     breakerErrorRate,
+		BreakerMinRequests:   breakerMinRequests,
+		BreakerSlowThreshold: breakerSlowThreshold,
+		BreakerWindow:        breakerWindow,
+		BreakerOpenDuration:  breakerOpenDuration,
+		CheckIPCacheTTL:      checkIPCacheTTL,
+
+		CapturePath:         getEnv("NETWATCH_PROXY_CAPTURE_PATH", ""),
+		CaptureMaxBytes:     captureMaxBytes,
+		CaptureMaxFiles:     captureMaxFiles,
+		CaptureMaxBodyBytes: captureMaxBodyBytes,
+
+		DebugLogMaxBytes: debugLogMaxBytes,
+
+		SensorSilenceThreshold: sensorSilenceThreshold,
+		AlertWebhookURL:        getEnv("NETWATCH_PROXY_ALERT_WEBHOOK_URL", ""),
+		NotifyConfigPath:       getEnv("NETWATCH_PROXY_NOTIFY_CONFIG", ""),
+
+		MaxBodyBytes:   maxBodyBytes,
+		RateLimit:      rateLimit,
+		RateLimitBurst: rateLimitBurst,
+		AllowedClients: allowedClients,
+
+		MaxTimestampSkew: maxTimestampSkew,
+		MaxAttackAge:     maxAttackAge,
+		MaxEvidenceBytes: maxEvidenceBytes,
+
+		IngestQueueSize: ingestQueueSize,
+		IngestWorkers:   ingestWorkers,
+		IngestOverflow:  ingestOverflow,
+		IngestSpillPath: getEnv("NETWATCH_PROXY_INGEST_SPILL_PATH", databasePath+".spill.jsonl"),
+
+		BackupDir:             getEnv("NETWATCH_PROXY_BACKUP_DIR", filepath.Join(filepath.Dir(databasePath), "backups")),
+		BackupKeep:            backupKeep,
+		BackupCompress:        strToBool(getEnv("NETWATCH_PROXY_BACKUP_COMPRESS", "true")),
+		BackupInterval:        backupInterval,
+		BackupBeforeMigration: strToBool(getEnv("NETWATCH_PROXY_BACKUP_BEFORE_MIGRATION", "true")),
+
+		Timezone:        timezone,
+		NaiveTimestamps: naiveTimestamps,
+
+		ReportsDir: getEnv("NETWATCH_PROXY_REPORTS_DIR", filepath.Join(filepath.Dir(databasePath), "reports")),
+
+		DigestConfigPath: getEnv("NETWATCH_PROXY_DIGEST_CONFIG", ""),
+
+		AnomalyThreshold:  anomalyThreshold,
+		AnomalyWeeks:      anomalyWeeks,
+		AnomalyMinAttacks: anomalyMinAttacks,
+
+		WordlistInterval:       wordlistInterval,
+		WordlistSimilarity:     wordlistSimilarity,
+		WordlistMinCredentials: wordlistMinCredentials,
+
+		Redaction:  redaction,
+		AdminToken: getEnv("NETWATCH_PROXY_ADMIN_TOKEN", ""),
+	}
+}
+
+// serve runs the proxy server.
+func serve() {
+	if appConfig.RateLimit > 0 {
+		clientRateLimiter = newClientRateLimiter(appConfig.RateLimit, appConfig.RateLimitBurst)
+		go clientRateLimiter.cleanup()
+	}
+
+	initDB(appConfig.DatabasePath)
+	defer closeDB()
+
+	proxyTransport.ResponseHeaderTimeout = appConfig.UpstreamTimeout
+	if appConfig.BreakerErrorRate > 0 && !appConfig.OfflineCollector {
+		upstreamBreaker = newCircuitBreaker(appConfig.Collector.URL.Host, appConfig.BreakerErrorRate, appConfig.BreakerMinRequests,
+			appConfig.BreakerSlowThreshold, appConfig.BreakerWindow, appConfig.BreakerOpenDuration)
+	}
+	checkIPCache.ttl = appConfig.CheckIPCacheTTL
+
+	ingestQueue = newIngestQueue(appConfig.IngestQueueSize, appConfig.IngestWorkers,
+		appConfig.IngestOverflow, appConfig.IngestSpillPath)
 
-		resp = &http.Response{
-			StatusCode: http.StatusOK,
-			Header: http.Header{
-				"Content-Length": []string{"20"},
-				"Server":         []string{"SSH-AttackPod-Proxy/1.0"},
-				"Date":           []string{time.Now().UTC().Format(http.TimeFormat)},
-				"Content-Type":   []string{"application/json"},
-			},
-			Body: io.NopCloser(bytes.NewBufferString(`{"status":"success"}`)),
+	var err error
+	notifyConfig := &NotifyConfig{}
+	if appConfig.NotifyConfigPath != "" {
+		notifyConfig, err = loadNotifyConfig(appConfig.NotifyConfigPath)
+		if err != nil {
+			log.Fatalf("[FATAL] %v", err)
 		}
-	} else {
-		client := &http.Client{Timeout: 60 * time.Second}
-		resp, err = client.Do(proxyReq)
+	}
+	if appConfig.AlertWebhookURL != "" {
+		notifyConfig.Webhooks = append(notifyConfig.Webhooks, WebhookConfig{
+			Name:   "default",
+			URL:    appConfig.AlertWebhookURL,
+			Format: WebhookFormatGeneric,
+		})
+	}
+	notifier, err = newNotifier(notifyConfig)
+	if err != nil {
+		log.Fatalf("[FATAL] Invalid notify config: %v", err)
+	}
+	go notifier.run(db)
+
+	if appConfig.DigestConfigPath != "" {
+		digests, err := loadDigestsConfig(appConfig.DigestConfigPath)
 		if err != nil {
-			log.Printf("[ERROR] Failed to forward request to %s: %v\n", targetURL, err)
-			http.Error(w, "Bad Gateway", http.StatusBadGateway)
-			return
+			log.Fatalf("[FATAL] %v", err)
 		}
-		defer resp.Body.Close()
+		go runDigestSchedule(db, digests)
+	}
+
+	if appConfig.AnomalyThreshold > 0 {
+		go runAnomalyDetection(db)
 	}
 
-	if appConfig.LogRequests {
-		log.Printf("[INFO] Received response: %d from %s\n", resp.StatusCode, targetURL.String())
+	if appConfig.WordlistInterval > 0 {
+		go runWordlistSchedule(db, appConfig.WordlistInterval)
 	}
-	if appConfig.DebugLog {
-		headerCount := 0
-		for _, values := range resp.Header {
-			headerCount += len(values)
+
+	if appConfig.BackupInterval > 0 {
+		go runBackupSchedule(db, appConfig.BackupInterval)
+	}
+
+	if appConfig.SensorSilenceThreshold > 0 {
+		sensorMonitor = newSensorMonitor(appConfig.SensorSilenceThreshold)
+		if err := sensorMonitor.load(db); err != nil {
+			log.Fatalf("[FATAL] Could not load sensors: %v", err)
 		}
+		go sensorMonitor.run(db)
+	}
 
-		log.Printf("[DEBUG] Response Headers (%d):\n", headerCount)
-		for key, values := range resp.Header {
-			for _, value := range values {
-				log.Printf("[DEBUG] - %s: %s\n", key, value)
-			}
+	// Endpoints served by the proxy itself.
+	http.HandleFunc("/_proxy/sensors", handleSensors)
+	http.HandleFunc("/_proxy/metrics", handleMetrics)
+	http.HandleFunc("/_proxy/reports", handleReports)
+	http.HandleFunc("/_proxy/reports/", handleReport)
+	http.HandleFunc("/_proxy/anomalies", handleAnomalies)
+	http.HandleFunc("/_proxy/credentials/", handleCredentials)
+
+	// A single handler for all other incoming requests.
+	var handler http.Handler = http.HandlerFunc(handleProxyRequest)
+	if appConfig.CapturePath != "" {
+		captureWriter, err = newCaptureWriter(appConfig.CapturePath, appConfig.CaptureMaxBytes, appConfig.CaptureMaxFiles)
+		if err != nil {
+			log.Fatalf("[FATAL] %v", err)
 		}
+		defer captureWriter.Close()
+		handler = captureRequests(handler)
+		log.Printf("[INFO] Recording requests to %s.\n", appConfig.CapturePath)
+	}
+	http.Handle("/", handler)
 
-		// Copy the response body to a buffer for logging.
-		var responseBody bytes.Buffer
-		if _, err := io.Copy(&responseBody, resp.Body); err != nil {
-			log.Printf("[ERROR] Failed to read response body: %v\n", err)
-		} else {
-			responseBytes := responseBody.Bytes()
-
-			log.Printf("[DEBUG] Response Body (%d bytes):\n", len(responseBytes))
-			if len(responseBytes) > 0 {
-				log.Printf("[DEBUG] %s\n", string(responseBytes))
-			} else {
-				log.Println("[DEBUG] <empty body>")
-			}
+	server := &http.Server{Addr: appConfig.ListenAddress}
 
-			// Reset the response body to allow further reading.
-			resp.Body = io.NopCloser(bytes.NewBuffer(responseBytes))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		log.Printf("Shutting down...")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("[ERROR] Failed to shut down server: %v", err)
 		}
+	}()
+
+	if appConfig.OfflineCollector {
+		log.Printf("Attack Pod Proxy started. Listening on %s. Answering as offline collector.\n", appConfig.ListenAddress)
+	} else {
+		log.Printf("Attack Pod Proxy started. Listening on %s. Forwarding to %s.\n", appConfig.ListenAddress, appConfig.Collector.URL)
+	}
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("[FATAL] Failed to start server: %v", err)
 	}
 
-	// --- Copy the response back to the original client ---
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
+	// Save everything that is still queued before the database is closed.
+	ingestQueue.Close()
+	if sensorMonitor != nil {
+		if err := sensorMonitor.flush(db); err != nil {
+			log.Printf("[ERROR] Failed to save sensors to DB: %v\n", err)
 		}
 	}
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	log.Printf("Shutdown complete.")
 }
 
 func getEnv(key, fallback string) string {
@@ -1124,6 +3038,10 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// dbOptions are appended to the database path when the database is opened.
+// WAL lets the reports read while the attack writer commits, the busy timeout lets concurrent writers wait.
+const dbOptions = "?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL"
+
 func initDB(dbFilepath string) {
 	dir := filepath.Dir(dbFilepath)
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
@@ -1133,7 +3051,7 @@ func initDB(dbFilepath string) {
 	}
 
 	var err error
-	db, err = sql.Open("sqlite3", dbFilepath)
+	db, err = sql.Open("sqlite3", dbFilepath+dbOptions)
 	if err != nil {
 		log.Fatalf("[FATAL] Could not open database: %v", err)
 	}
@@ -1141,41 +3059,59 @@ func initDB(dbFilepath string) {
 	if err := runMigrations(db); err != nil {
 		log.Fatalf("[FATAL] Database migration failed: %v", err)
 	}
+	if err := verifySchema(db); err != nil {
+		if appConfig.VerifySchema {
+			log.Fatalf("[FATAL] Database schema verification failed, see the migrate status command: %v", err)
+		}
+		log.Printf("[WARN] Database schema verification failed: %v\n", err)
+	}
+	if err := syncReportTimezone(db, reportLocation()); err != nil {
+		log.Fatalf("[FATAL] Could not set the reporting timezone: %v", err)
+	}
+	if err := classifyCredentials(db); err != nil {
+		log.Fatalf("[FATAL] Could not classify credentials: %v", err)
+	}
+	if err := parseEvidences(db); err != nil {
+		log.Fatalf("[FATAL] Could not parse evidences: %v", err)
+	}
+
+	attackWriter, err = newAttackWriter(db)
+	if err != nil {
+		log.Fatalf("[FATAL] Could not start attack writer: %v", err)
+	}
 }
 
 func runMigrations(db *sql.DB) error {
-	var currentVersion int
-	err := db.QueryRow("PRAGMA user_version;").Scan(&currentVersion)
+	currentVersion, err := userVersion(db)
 	if err != nil {
-		return fmt.Errorf("could not get user_version: %w", err)
+		return err
 	}
 
 	log.Printf("Current DB version: %d", currentVersion)
 
+	if err := createSchemaMigrationsTable(db); err != nil {
+		return err
+	}
+	if err := recordUntrackedMigrations(db, currentVersion); err != nil {
+		return err
+	}
+
+	// A failed migration leaves the database as it was, but a migration that succeeds with a bug does not.
+	latestVersion := migrations[len(migrations)-1].Version
+	if appConfig.BackupBeforeMigration && currentVersion > 0 && currentVersion < latestVersion {
+		note := fmt.Sprintf("v%d", currentVersion)
+		if _, err := createBackup(db, BackupPreMigration, note); err != nil {
+			return fmt.Errorf("could not back up database before migration: %w", err)
+		}
+	}
+
 	migrated := false
 
 	for _, migration := range migrations {
 		if currentVersion < migration.Version {
 			log.Printf("Migrating database to version %d...", migration.Version)
-			tx, err := db.Begin()
-			if err != nil {
-				return fmt.Errorf("could not begin transaction for migration to version %d: %w", migration.Version, err)
-			}
-
-			if _, err := tx.Exec(migration.SQL); err != nil {
-				tx.Rollback()
-				return fmt.Errorf("could not execute migration to version %d: %w", migration.Version, err)
-			}
-
-			// Update user_version
-			setUserVersionSQL := fmt.Sprintf("PRAGMA user_version = %d;", migration.Version)
-			if _, err := tx.Exec(setUserVersionSQL); err != nil {
-				tx.Rollback()
-				return fmt.Errorf("could not set user_version to %d: %w", migration.Version, err)
-			}
-
-			if err := tx.Commit(); err != nil {
-				return fmt.Errorf("could not commit transaction for migration to version %d: %w", migration.Version, err)
+			if err := applyMigration(db, migration); err != nil {
+				return err
 			}
 			log.Printf("Successfully migrated database to version %d.", migration.Version)
 			currentVersion = migration.Version
@@ -1198,88 +3134,24 @@ func runMigrations(db *sql.DB) error {
 }
 
 func saveAttackToDB(attack *Attack) error {
+	return saveAttackReceivedAt(attack, time.Now())
+}
+
+// saveAttackReceivedAt saves an attack the proxy received earlier, like a replayed dead letter.
+// Its timestamp is checked against the time it was received, so an old attack is not quarantined for its age.
+func saveAttackReceivedAt(attack *Attack, received time.Time) error {
 	if attack == nil || attack.TestMode {
 		// Skip saving if attack is nil or in test mode.
 		return nil
 	}
 
-	timestamp := attack.AttackTimestamp.ToTime().UnixMilli()
-	evidence := strings.TrimSpace(attack.Evidence)
-
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
-
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("could not begin transaction: %w", err)
-	}
-
-	// Check for duplicates first.
-	checkQuery := `SELECT COUNT(*) FROM _attacks WHERE
-					timestamp = ? AND
-					source_ip = (SELECT id FROM _dict_source_ips WHERE value = ?) AND
-					destination_ip = (SELECT id FROM _dict_destination_ips WHERE value = ?) AND
-					username = (SELECT id FROM _dict_usernames WHERE value = ?) AND
-					password = (SELECT id FROM _dict_passwords WHERE value = ?) AND
-					attack_type = (SELECT id FROM _dict_attack_types WHERE value = ?) AND
-					evidence = (SELECT id FROM _dict_evidences WHERE value = ?)
-					`
-	var count int
-	err = tx.QueryRow(checkQuery,
-		timestamp,
-		attack.SourceIP, attack.DestinationIP,
-		attack.Username, attack.Password,
-		attack.AttackType, evidence).Scan(&count)
-
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("could not check for duplicate attack: %w", err)
-	}
-
-	if count > 0 {
-		tx.Rollback()
-		return ErrDuplicateAttack
-	}
-
-	// If no duplicate is found, insert the new attack.
-	insertValuesQuery := `INSERT OR IGNORE INTO _dict_source_ips (value) VALUES (?);
-	INSERT OR IGNORE INTO _dict_destination_ips (value) VALUES (?);
-	INSERT OR IGNORE INTO _dict_usernames (value) VALUES (?);
-	INSERT OR IGNORE INTO _dict_passwords (value) VALUES (?);
-	INSERT OR IGNORE INTO _dict_attack_types (value) VALUES (?);
-	INSERT OR IGNORE INTO _dict_evidences (value) VALUES (?);`
-	_, err = tx.Exec(insertValuesQuery,
-		attack.SourceIP, attack.DestinationIP,
-		attack.Username, attack.Password,
-		attack.AttackType, evidence)
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("could not execute insert values statement: %w", err)
-	}
-
-	insertQuery := `INSERT INTO _attacks (timestamp, source_ip, destination_ip, username, password, attack_type, evidence)
-	VALUES (?,
-		(SELECT id FROM _dict_source_ips WHERE value = ?),
-		(SELECT id FROM _dict_destination_ips WHERE value = ?),
-		(SELECT id FROM _dict_usernames WHERE value = ?),
-		(SELECT id FROM _dict_passwords WHERE value = ?),
-		(SELECT id FROM _dict_attack_types WHERE value = ?),
-		(SELECT id FROM _dict_evidences WHERE value = ?))`
-	_, err = tx.Exec(insertQuery,
-		timestamp,
-		attack.SourceIP, attack.DestinationIP,
-		attack.Username, attack.Password,
-		attack.AttackType, evidence)
-
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("could not execute insert statement: %w", err)
+	original := *attack
+	if err := normalizeAttack(attack, received); err != nil {
+		if errQuarantine := quarantineAttack(&original, err.Error()); errQuarantine != nil {
+			return fmt.Errorf("could not quarantine attack (%v): %w", err, errQuarantine)
+		}
+		return err
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("could not commit transaction: %w", err)
-	}
-	return nil
+	return attackWriter.Write(attack)
 }
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlexibleTimeUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:  "RFC3339 UTC",
+			input: `"2024-05-01T12:34:56Z"`,
+			want:  time.Date(2024, 5, 1, 12, 34, 56, 0, time.UTC),
+		},
+		{
+			name:  "RFC3339 with offset and nanoseconds",
+			input: `"2024-05-01T12:34:56.123456789+02:00"`,
+			want:  time.Date(2024, 5, 1, 10, 34, 56, 123456789, time.UTC),
+		},
+		{
+			name:  "Python isoformat with microseconds",
+			input: `"2024-05-01T12:34:56.123456"`,
+			want:  time.Date(2024, 5, 1, 12, 34, 56, 123456000, time.UTC),
+		},
+		{
+			name:  "Python isoformat without fraction",
+			input: `"2024-05-01T12:34:56"`,
+			want:  time.Date(2024, 5, 1, 12, 34, 56, 0, time.UTC),
+		},
+		{
+			name:  "null",
+			input: `null`,
+		},
+		{
+			name:    "date only",
+			input:   `"2024-05-01"`,
+			wantErr: true,
+		},
+		{
+			name:    "unix timestamp",
+			input:   `1714566896`,
+			wantErr: true,
+		},
+		{
+			name:    "garbage",
+			input:   `"yesterday"`,
+			wantErr: true,
+		},
+	}
+
+	appConfig = loadConfig()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ft FlexibleTime
+			err := json.Unmarshal([]byte(test.input), &ft)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", ft.ToTime())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !ft.ToTime().Equal(test.want) {
+				t.Errorf("got %v, want %v", ft.ToTime(), test.want)
+			}
+			if !ft.ToTime().IsZero() && ft.ToTime().Location() != reportLocation() {
+				t.Errorf("got location %v, want the reporting timezone", ft.ToTime().Location())
+			}
+		})
+	}
+}
+
+func TestFlexibleTimeRoundTrip(t *testing.T) {
+	for _, attack := range generateAttacks(1, 50, time.Now()) {
+		data, err := json.Marshal(attack)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded Attack
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("could not unmarshal %s: %v", data, err)
+		}
+		if !decoded.AttackTimestamp.ToTime().Equal(attack.AttackTimestamp.ToTime()) {
+			t.Errorf("got %v, want %v", decoded.AttackTimestamp.ToTime(), attack.AttackTimestamp.ToTime())
+		}
+	}
+
+	data, err := json.Marshal(FlexibleTime{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "null" {
+		t.Errorf("zero time marshaled to %s, want null", data)
+	}
+}
+
+// legacyAttacksQuery selects the attacks of a database that was migrated to the latest version.
+const legacyAttacksQuery = `SELECT "timestamp", "source_ip", "destination_ip", "username", "password", "attack_type", "evidence" FROM "attacks"`
+
+func TestMigrationsApplyFromZero(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	appConfig = loadConfig()
+	appConfig.BackupBeforeMigration = false
+
+	all := migrations
+	t.Cleanup(func() { migrations = all })
+
+	database, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "attacks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	// Attacks written by the first version of the proxy, before the dictionaries existed.
+	legacy := generateAttacks(2, 200, time.Now())
+	expected := make(map[string]bool)
+
+	for i, migration := range all {
+		migrations = all[:i+1]
+		if err := runMigrations(database); err != nil {
+			t.Fatalf("migration to version %d failed: %v", migration.Version, err)
+		}
+
+		var version int
+		if err := database.QueryRow("PRAGMA user_version;").Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		if version != migration.Version {
+			t.Fatalf("user_version is %d after migration %d", version, migration.Version)
+		}
+
+		var integrity string
+		if err := database.QueryRow("PRAGMA integrity_check;").Scan(&integrity); err != nil {
+			t.Fatal(err)
+		}
+		if integrity != "ok" {
+			t.Fatalf("integrity check after migration %d: %s", migration.Version, integrity)
+		}
+
+		if migration.Version != 1 {
+			continue
+		}
+		for j, attack := range legacy {
+			// Old versions stored the evidence untrimmed.
+			evidence := attack.Evidence
+			if j%3 == 0 {
+				evidence = " " + evidence + "\r\n"
+			}
+			_, err := database.Exec(`INSERT INTO attacks (source_ip, destination_ip, username, password, attack_timestamp, evidence, attack_type)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`, attack.SourceIP, attack.DestinationIP, attack.Username, attack.Password,
+				attack.AttackTimestamp.ToTime().UnixMilli(), evidence, attack.AttackType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected[attackKey(attack.AttackTimestamp.ToTime().UnixMilli(), attack.SourceIP, attack.DestinationIP,
+				attack.Username, attack.Password, attack.AttackType, attack.Evidence)] = true
+		}
+
+		// Duplicates and incomplete rows are removed by later migrations.
+		_, err := database.Exec(`INSERT INTO attacks (source_ip, destination_ip, username, password, attack_timestamp, evidence, attack_type)
+			SELECT source_ip, destination_ip, username, password, attack_timestamp, evidence, attack_type FROM attacks LIMIT 10`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = database.Exec(`INSERT INTO attacks (source_ip, destination_ip, username, password, attack_timestamp, evidence, attack_type)
+			VALUES ('192.0.2.1', '203.0.113.10', NULL, 'secret', 0, 'SSH-2.0-Go', 'SSH_BRUTEFORCE')`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := database.Query(legacyAttacksQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	migrated := make(map[string]bool)
+	for rows.Next() {
+		var timestamp int64
+		var sourceIP, destinationIP, username, password, attackType, evidence string
+		if err := rows.Scan(&timestamp, &sourceIP, &destinationIP, &username, &password, &attackType, &evidence); err != nil {
+			t.Fatal(err)
+		}
+		key := attackKey(timestamp, sourceIP, destinationIP, username, password, attackType, evidence)
+		if migrated[key] {
+			t.Errorf("duplicate attack after migration: %s", key)
+		}
+		migrated[key] = true
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for key := range expected {
+		if !migrated[key] {
+			t.Errorf("attack lost in migration: %s", key)
+		}
+	}
+	for key := range migrated {
+		if !expected[key] {
+			t.Errorf("unexpected attack after migration: %s", key)
+		}
+	}
+
+	assertRollups(t, database)
+
+	// A second run finds nothing to do.
+	if err := runMigrations(database); err != nil {
+		t.Fatalf("second run of the migrations failed: %v", err)
+	}
+}
+
+// rollupQueries are the rollup tables and the queries that compute them from the attacks.
+var rollupQueries = map[string][2]string{
+	"_rollup_sources": {
+		`SELECT "source_ip", "attacks", "first_seen", "last_seen" FROM "_rollup_sources"`,
+		`SELECT "source_ip", COUNT(1), MIN("timestamp"), MAX("timestamp") FROM "_attacks" GROUP BY 1`,
+	},
+	"_rollup_credentials": {
+		`SELECT "username", "password", "attacks", "sources", "first_seen", "last_seen" FROM "_rollup_credentials"`,
+		`SELECT "username", "password", COUNT(1), COUNT(DISTINCT "source_ip"), MIN("timestamp"), MAX("timestamp") FROM "_attacks" GROUP BY 1, 2`,
+	},
+	"_rollup_source_credentials": {
+		`SELECT "source_ip", "username", "password", "attacks", "first_seen", "last_seen" FROM "_rollup_source_credentials"`,
+		`SELECT "source_ip", "username", "password", COUNT(1), MIN("timestamp"), MAX("timestamp") FROM "_attacks" GROUP BY 1, 2, 3`,
+	},
+	"_rollup_minutes": {
+		`SELECT "minute", "attacks" FROM "_rollup_minutes"`,
+		`SELECT "timestamp" / 60000 * 60, COUNT(1) FROM "_attacks" GROUP BY 1`,
+	},
+	"_rollup_hours": {
+		`SELECT "hour", "offset", "attacks" FROM "_rollup_hours"`,
+		`SELECT ("timestamp" / 1000 + "offset") / 3600 * 3600 - "offset", "offset", COUNT(1) FROM (
+			SELECT "timestamp", (SELECT "offset" FROM "_report_timezone" WHERE "since" <= "timestamp" ORDER BY "since" DESC LIMIT 1) AS "offset"
+			FROM "_attacks"
+		) GROUP BY 1, 2`,
+	},
+	"_rollup_days": {
+		`SELECT "date", "attacks" FROM "_rollup_days"`,
+		`SELECT strftime('%F', "timestamp" / 1000 + "offset", 'unixepoch'), COUNT(1) FROM (
+			SELECT "timestamp", (SELECT "offset" FROM "_report_timezone" WHERE "since" <= "timestamp" ORDER BY "since" DESC LIMIT 1) AS "offset"
+			FROM "_attacks"
+		) GROUP BY 1`,
+	},
+}
+
+// assertRollups checks that every rollup table holds exactly the aggregates of the attacks.
+func assertRollups(t *testing.T, database *sql.DB) {
+	t.Helper()
+
+	for table, queries := range rollupQueries {
+		var differences int
+		err := database.QueryRow(fmt.Sprintf(`SELECT COUNT(1) FROM (
+			SELECT * FROM (%[1]s EXCEPT %[2]s)
+			UNION ALL
+			SELECT * FROM (%[2]s EXCEPT %[1]s)
+		)`, queries[0], queries[1])).Scan(&differences)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if differences > 0 {
+			t.Errorf("%s differs from the attacks in %d rows", table, differences)
+		}
+	}
+}
+
+func TestRollupsFollowInserts(t *testing.T) {
+	setupTest(t)
+
+	// Out of order timestamps and duplicates, in batches and one by one.
+	attacks := generateAttacks(6, 500, time.Now())
+	ingestQueue.Close()
+	ingestQueue = newIngestQueue(512, 8, OverflowBlock, "")
+	for _, attack := range attacks[50:] {
+		stored := *attack
+		ingestQueue.Enqueue(&stored)
+	}
+	flushIngestQueue()
+	saveAttacks(t, attacks[:50])
+	for _, attack := range attacks[:100] {
+		duplicate := *attack
+		if err := saveAttackToDB(&duplicate); !errors.Is(err, ErrDuplicateAttack) {
+			t.Fatalf("saving a duplicate returned %v", err)
+		}
+	}
+
+	compareRows(t, queryRows(t, `SELECT COUNT(1) FROM "_attacks"`), [][]string{{"500"}})
+	assertRollups(t, db)
+}
+
+func TestSaveAttackDeduplicates(t *testing.T) {
+	setupTest(t)
+
+	attack := generateAttacks(3, 1, time.Now())[0]
+	saveAttacks(t, []*Attack{attack})
+
+	duplicate := *attack
+	if err := saveAttackToDB(&duplicate); !errors.Is(err, ErrDuplicateAttack) {
+		t.Fatalf("saving the same attack again returned %v, want ErrDuplicateAttack", err)
+	}
+
+	// Normalization makes these the same attack.
+	padded := *attack
+	padded.Evidence = "  " + attack.Evidence + "\n"
+	if err := saveAttackToDB(&padded); !errors.Is(err, ErrDuplicateAttack) {
+		t.Fatalf("saving the attack with padded evidence returned %v, want ErrDuplicateAttack", err)
+	}
+
+	// Every field is part of the identity of an attack.
+	variants := []func(*Attack){
+		func(a *Attack) { a.SourceIP = "192.0.2.200" },
+		func(a *Attack) { a.DestinationIP = "192.0.2.201" },
+		func(a *Attack) { a.Username = a.Username + "x" },
+		func(a *Attack) { a.Password = a.Password + "x" },
+		func(a *Attack) { a.AttackType = "SSH_OTHER" },
+		func(a *Attack) { a.Evidence = "SSH-2.0-variant" },
+		func(a *Attack) { a.AttackTimestamp = FlexibleTime(a.AttackTimestamp.ToTime().Add(time.Millisecond)) },
+	}
+	for i, vary := range variants {
+		variant := *attack
+		vary(&variant)
+		if err := saveAttackToDB(&variant); err != nil {
+			t.Errorf("variant %d: %v", i, err)
+		}
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM "attacks"`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if want := 1 + len(variants); count != want {
+		t.Errorf("got %d attacks, want %d", count, want)
+	}
+}
+
+func TestSaveAttackRollsBackFailedAttack(t *testing.T) {
+	setupTest(t)
+
+	// The password hook fails after the source IP, destination IP and username of the attack are inserted.
+	hook := attackWriter.passwords.onInsert
+	attackWriter.passwords.onInsert = func(tx *batchTx, id int64, value string) error {
+		if value == "fail" {
+			return errors.New("hook failed")
+		}
+		return hook(tx, id, value)
+	}
+
+	attacks := generateAttacks(4, 20, time.Now())
+	failing := *attacks[0]
+	failing.SourceIP = "192.0.2.99"
+	failing.Username = "failing-user"
+	failing.Password = "fail"
+
+	// Written concurrently, the failing attack shares its batch with others.
+	var wg sync.WaitGroup
+	errs := make([]error, len(attacks)+1)
+	for i, attack := range append([]*Attack{&failing}, attacks...) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stored := *attack
+			errs[i] = saveAttackToDB(&stored)
+		}()
+	}
+	wg.Wait()
+
+	if errs[0] == nil {
+		t.Fatalf("the failing attack was saved")
+	}
+	for i, err := range errs[1:] {
+		if err != nil {
+			t.Errorf("attack %d: %v", i, err)
+		}
+	}
+
+	compareRows(t, queryRows(t, `SELECT
+			(SELECT COUNT(*) FROM "_dict_source_ips" WHERE "value" = '192.0.2.99'),
+			(SELECT COUNT(*) FROM "_dict_usernames" WHERE "value" = 'failing-user'),
+			(SELECT COUNT(*) FROM "_username_features" JOIN "_dict_usernames" ON "_username_features"."id" = "_dict_usernames"."id"
+				WHERE "_dict_usernames"."value" = 'failing-user'),
+			(SELECT COUNT(*) FROM "_attacks")`), [][]string{{"0", "0", "0", fmt.Sprint(len(attacks))}})
+	if _, ok := attackWriter.sourceIPs.cache["192.0.2.99"]; ok {
+		t.Errorf("the source IP of the failing attack is cached")
+	}
+
+	// Without the cached ID of a rolled back row, the attack is saved with the row inserted anew.
+	attackWriter.passwords.onInsert = hook
+	saveAttacks(t, []*Attack{&failing})
+	compareRows(t, queryRows(t, `SELECT "source_ip", "username", "password" FROM "attacks" WHERE "source_ip" = '192.0.2.99'`),
+		[][]string{{"192.0.2.99", "failing-user", "fail"}})
+}
+
+func TestSaveAttackSkipsTestMode(t *testing.T) {
+	setupTest(t)
+
+	attack := generateAttacks(4, 1, time.Now())[0]
+	attack.TestMode = true
+	if err := saveAttackToDB(attack); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM "attacks"`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("test mode attack was saved")
+	}
+}
+
+// queryRows returns the rows of a query as strings. NULL is returned as "NULL".
+func queryRows(t *testing.T, query string) [][]string {
+	t.Helper()
+
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result [][]string
+	for rows.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			t.Fatal(err)
+		}
+
+		row := make([]string, len(columns))
+		for i, value := range values {
+			switch value := value.(type) {
+			case nil:
+				row[i] = "NULL"
+			case []byte:
+				row[i] = string(value)
+			default:
+				row[i] = fmt.Sprint(value)
+			}
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func compareRows(t *testing.T, got, want [][]string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Errorf("got %d rows, want %d", len(got), len(want))
+	}
+	for i := range min(len(got), len(want)) {
+		if strings.Join(got[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("row %d: got %q, want %q", i, got[i], want[i])
+			return
+		}
+	}
+}
+
+func TestViews(t *testing.T) {
+	setupTest(t)
+
+	now := time.Now()
+	attacks := generateAttacks(5, 2000, now)
+	saveAttacks(t, attacks)
+
+	for _, test := range viewTests(attacks, now) {
+		t.Run(test.view, func(t *testing.T) {
+			got := queryRows(t, fmt.Sprintf(`SELECT * FROM "%s"`, test.view))
+			if test.normalize != nil {
+				for _, row := range got {
+					test.normalize(row)
+				}
+			}
+			compareRows(t, got, test.want)
+		})
+	}
+}
+
+func TestViewsCoverEveryView(t *testing.T) {
+	setupTest(t)
+
+	tested := map[string]bool{"attacks": true, "view_quarantine": true, "view_sensors": true, "view_anomalies": true,
+		"view_wordlist_families": true, "view_wordlist_family_sources": true, "view_wordlist_family_credentials": true,
+		"view_username_categories": true, "view_password_categories": true, "report_credential_categories_last_30_days": true,
+		"view_ssh_clients": true, "view_ssh_client_software": true, "view_ssh_client_algorithms": true}
+	for _, test := range viewTests(nil, time.Now()) {
+		tested[test.view] = true
+	}
+
+	for _, row := range queryRows(t, `SELECT "name" FROM "sqlite_master" WHERE "type" = 'view' ORDER BY "name"`) {
+		if !tested[row[0]] {
+			t.Errorf("view %s has no test", row[0])
+		}
+	}
+}
+
+func TestQuarantineView(t *testing.T) {
+	setupTest(t)
+
+	attacks := generateAttacks(6, 3, time.Now())
+	attacks[0].SourceIP = "not an ip"
+	attacks[1].AttackTimestamp = FlexibleTime(time.Now().Add(48 * time.Hour))
+	attacks[2].AttackType = ""
+
+	for _, attack := range attacks {
+		if err := saveAttackToDB(attack); !errors.Is(err, ErrQuarantined) {
+			t.Fatalf("got %v, want a quarantined attack", err)
+		}
+	}
+
+	got := queryRows(t, `SELECT "reason", "source_ip" FROM "view_quarantine"`)
+	want := [][]string{
+		{"attack_type is missing", attacks[2].SourceIP},
+		{"attack_timestamp is more than 1h0m0s in the future", attacks[1].SourceIP},
+		{"source_ip is not an IP address", "not an ip"},
+	}
+	compareRows(t, got, want)
+}
+
+func TestSensorsView(t *testing.T) {
+	setupTest(t)
+
+	monitor := newSensorMonitor(time.Hour)
+	monitor.Seen(SensorKindDestinationIP, "203.0.113.10")
+	monitor.Seen(SensorKindClient, "10.0.0.2")
+	monitor.Seen(SensorKindClient, "10.0.0.1")
+	if err := monitor.flush(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var want [][]string
+	for _, sensor := range monitor.Snapshot() {
+		want = append(want, []string{string(sensor.Kind), sensor.Name,
+			sensor.FirstSeen.In(reportLocation()).Format(time.DateTime),
+			sensor.LastSeen.In(reportLocation()).Format(time.DateTime), "0"})
+	}
+	sort.Slice(want, func(i, j int) bool {
+		return want[i][0]+want[i][1] < want[j][0]+want[j][1]
+	})
+
+	compareRows(t, queryRows(t, `SELECT * FROM "view_sensors"`), want)
+}
+
+func TestSensorSilentAndRecoveredAlerts(t *testing.T) {
+	setupTest(t)
+	server, received := newWebhookReceiver(t, http.StatusOK)
+	n := startNotifier(t, &NotifyConfig{Webhooks: []WebhookConfig{{Name: "ops", URL: server.URL}}})
+
+	monitor := newSensorMonitor(time.Hour)
+	monitor.Seen(SensorKindClient, "10.0.0.1")
+	now := time.Now()
+	if silenced := monitor.check(now.Add(30 * time.Minute)); len(silenced) != 0 {
+		t.Fatalf("got %+v silent within the threshold", silenced)
+	}
+	if silenced := monitor.check(now.Add(2 * time.Hour)); len(silenced) != 1 || !monitor.Snapshot()[0].Silent {
+		t.Fatalf("got %+v silent past the threshold, want the sensor", silenced)
+	}
+	// A silent sensor is only reported once.
+	if silenced := monitor.check(now.Add(3 * time.Hour)); len(silenced) != 0 {
+		t.Errorf("got %+v silent again", silenced)
+	}
+	monitor.Seen(SensorKindClient, "10.0.0.1")
+	if monitor.Snapshot()[0].Silent {
+		t.Error("the sensor is still silent after it was seen")
+	}
+
+	events := receivedEvents(t, n, received)
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want silent and recovered", len(events))
+	}
+	if events[0].Event != "sensor_silent" || events[0].Key != "client:10.0.0.1" || events[0].Type != RuleTypeSensorLiveness ||
+		events[0].Text != "Sensor client 10.0.0.1 has been silent for 2h0m0s." {
+		t.Errorf("got %+v, want the silent event", events[0])
+	}
+	if events[1].Event != "sensor_recovered" || events[1].Key != "client:10.0.0.1" || events[1].Text != "Sensor client 10.0.0.1 recovered." {
+		t.Errorf("got %+v, want the recovered event", events[1])
+	}
+}
+
+func TestSensorFlushKeepsFailedChanges(t *testing.T) {
+	setupTest(t)
+
+	if _, err := db.Exec(`CREATE TRIGGER "fail_sensors" BEFORE INSERT ON "_sensors"
+		BEGIN SELECT RAISE(ABORT, 'disk full'); END`); err != nil {
+		t.Fatal(err)
+	}
+	monitor := newSensorMonitor(time.Hour)
+	monitor.Seen(SensorKindClient, "10.0.0.1")
+	if err := monitor.flush(db); err == nil {
+		t.Fatal("got no error for the failed write")
+	}
+
+	// The sensor was not seen again, the next flush still writes it.
+	if _, err := db.Exec(`DROP TRIGGER "fail_sensors"`); err != nil {
+		t.Fatal(err)
+	}
+	if err := monitor.flush(db); err != nil {
+		t.Fatal(err)
+	}
+	sensor := monitor.Snapshot()[0]
+	compareRows(t, queryRows(t, `SELECT "kind", "name", "last_seen" FROM "_sensors"`),
+		[][]string{{"client", "10.0.0.1", fmt.Sprint(sensor.LastSeen.UnixMilli())}})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metricKind string
+
+const (
+	metricKindCounter metricKind = "counter"
+	metricKindGauge   metricKind = "gauge"
+)
+
+// Metric is a family of values with the same name, distinguished by their label values.
+// It is exported in the Prometheus text format on /_proxy/metrics.
+type Metric struct {
+	name       string
+	help       string
+	kind       metricKind
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]*metricValue
+	// valueFunc is used for gauges that are computed on every scrape.
+	valueFunc func() float64
+}
+
+type metricValue struct {
+	labelValues []string
+	value       float64
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []*Metric
+)
+
+func registerMetric(metric *Metric) *Metric {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	metric.values = make(map[string]*metricValue)
+	metrics = append(metrics, metric)
+	return metric
+}
+
+func newCounter(name, help string, labelNames ...string) *Metric {
+	return registerMetric(&Metric{name: name, help: help, kind: metricKindCounter, labelNames: labelNames})
+}
+
+func newGauge(name, help string, labelNames ...string) *Metric {
+	return registerMetric(&Metric{name: name, help: help, kind: metricKindGauge, labelNames: labelNames})
+}
+
+func newGaugeFunc(name, help string, valueFunc func() float64) *Metric {
+	return registerMetric(&Metric{name: name, help: help, kind: metricKindGauge, valueFunc: valueFunc})
+}
+
+func (m *Metric) value(labelValues []string) *metricValue {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\x00")
+	value, ok := m.values[key]
+	if !ok {
+		value = &metricValue{labelValues: append([]string(nil), labelValues...)}
+		m.values[key] = value
+	}
+	return value
+}
+
+// Add adds delta to the value with the given label values.
+func (m *Metric) Add(delta float64, labelValues ...string) {
+	m.mu.Lock()
+	m.value(labelValues).value += delta
+	m.mu.Unlock()
+}
+
+// Inc increments the value with the given label values by one.
+func (m *Metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Set sets the value with the given label values.
+func (m *Metric) Set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	m.value(labelValues).value = value
+	m.mu.Unlock()
+}
+
+// Get returns the value with the given label values.
+func (m *Metric) Get(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.value(labelValues).value
+}
+
+func escapeLabelValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return strings.ReplaceAll(s, `"`, `\"`)
+}
+
+// writeMetrics writes every registered metric in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	metricsMu.Lock()
+	registered := append([]*Metric(nil), metrics...)
+	metricsMu.Unlock()
+
+	for _, m := range registered {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+		if m.valueFunc != nil {
+			fmt.Fprintf(w, "%s %s\n", m.name, strconv.FormatFloat(m.valueFunc(), 'g', -1, 64))
+			continue
+		}
+
+		m.mu.Lock()
+		keys := make([]string, 0, len(m.values))
+		for key := range m.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			value := m.values[key]
+
+			labels := ""
+			if len(m.labelNames) > 0 {
+				pairs := make([]string, len(m.labelNames))
+				for i, name := range m.labelNames {
+					pairs[i] = fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(value.labelValues[i]))
+				}
+				labels = "{" + strings.Join(pairs, ",") + "}"
+			}
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, strconv.FormatFloat(value.value, 'g', -1, 64))
+		}
+		m.mu.Unlock()
+	}
+}
+
+// handleMetrics exports all metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
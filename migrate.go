@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:        "migrate",
+		Usage:       "migrate status | up | down VERSION",
+		Description: "Show the applied migrations and schema drift, apply pending migrations or roll back to a version.",
+		Run:         runMigrateCommand,
+	})
+}
+
+// normalizeSQL collapses whitespace, so that reindenting a migration does not change its checksum.
+func normalizeSQL(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Checksum identifies the SQL of the migration. It is recorded when the migration is applied.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(normalizeSQL(m.SQL)))
+	return hex.EncodeToString(sum[:])
+}
+
+// AppliedMigration is a row of the "_schema_migrations" table.
+type AppliedMigration struct {
+	Version  int
+	Checksum string
+	// Applied is nil for migrations applied before checksums were recorded.
+	Applied *time.Time
+}
+
+func createSchemaMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "_schema_migrations" (
+			"version"	INTEGER NOT NULL,
+			"checksum"	TEXT NOT NULL,
+			"applied"	INTEGER,
+			PRIMARY KEY("version")
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("could not create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+// recordUntrackedMigrations records the checksums of migrations that were applied before checksums existed.
+// Their SQL cannot be verified anymore, the current checksum is assumed.
+func recordUntrackedMigrations(db *sql.DB, currentVersion int) error {
+	for _, migration := range migrations {
+		if migration.Version > currentVersion {
+			break
+		}
+		result, err := db.Exec(`INSERT OR IGNORE INTO "_schema_migrations" ("version", "checksum", "applied") VALUES (?, ?, NULL)`,
+			migration.Version, migration.Checksum())
+		if err != nil {
+			return fmt.Errorf("could not record migration %d: %w", migration.Version, err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			log.Printf("Recorded checksum of migration %d, which was applied before checksums were recorded.", migration.Version)
+		}
+	}
+	return nil
+}
+
+func loadAppliedMigrations(db *sql.DB) (map[int]*AppliedMigration, error) {
+	var exists int
+	err := db.QueryRow(`SELECT COUNT(*) FROM "sqlite_master" WHERE "type" = 'table' AND "name" = '_schema_migrations'`).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up schema_migrations table: %w", err)
+	}
+	applied := make(map[int]*AppliedMigration)
+	if exists == 0 {
+		return applied, nil
+	}
+
+	rows, err := db.Query(`SELECT "version", "checksum", "applied" FROM "_schema_migrations"`)
+	if err != nil {
+		return nil, fmt.Errorf("could not query schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var migration AppliedMigration
+		var appliedAt sql.NullInt64
+		if err := rows.Scan(&migration.Version, &migration.Checksum, &appliedAt); err != nil {
+			return nil, fmt.Errorf("could not scan schema_migrations: %w", err)
+		}
+		if appliedAt.Valid {
+			t := time.UnixMilli(appliedAt.Int64)
+			migration.Applied = &t
+		}
+		applied[migration.Version] = &migration
+	}
+	return applied, rows.Err()
+}
+
+func userVersion(db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version;").Scan(&version); err != nil {
+		return 0, fmt.Errorf("could not get user_version: %w", err)
+	}
+	return version, nil
+}
+
+// applyMigration runs the migration and records it in one transaction.
+func applyMigration(db *sql.DB, migration Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction for migration to version %d: %w", migration.Version, err)
+	}
+
+	if _, err := tx.Exec(migration.SQL); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not execute migration to version %d: %w", migration.Version, err)
+	}
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO "_schema_migrations" ("version", "checksum", "applied") VALUES (?, ?, ?)`,
+		migration.Version, migration.Checksum(), time.Now().UnixMilli())
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not record migration %d: %w", migration.Version, err)
+	}
+
+	// Update user_version
+	setUserVersionSQL := fmt.Sprintf("PRAGMA user_version = %d;", migration.Version)
+	if _, err := tx.Exec(setUserVersionSQL); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not set user_version to %d: %w", migration.Version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction for migration to version %d: %w", migration.Version, err)
+	}
+	return nil
+}
+
+// revertMigration runs the down SQL of the migration and sets user_version to the previous version.
+func revertMigration(db *sql.DB, migration Migration, previousVersion int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction to revert migration %d: %w", migration.Version, err)
+	}
+
+	if _, err := tx.Exec(migration.Down); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not revert migration %d: %w", migration.Version, err)
+	}
+	if _, err := tx.Exec(`DELETE FROM "_schema_migrations" WHERE "version" = ?`, migration.Version); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not remove record of migration %d: %w", migration.Version, err)
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", previousVersion)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not set user_version to %d: %w", previousVersion, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit revert of migration %d: %w", migration.Version, err)
+	}
+	return nil
+}
+
+// migrateDown reverts every applied migration newer than the target version, newest first.
+// Nothing is reverted unless all of them have down SQL.
+func migrateDown(db *sql.DB, target int) error {
+	current, err := userVersion(db)
+	if err != nil {
+		return err
+	}
+	if target >= current {
+		return fmt.Errorf("database is at version %d, nothing to revert to version %d", current, target)
+	}
+	if current > migrations[len(migrations)-1].Version {
+		return fmt.Errorf("database version %d is newer than this build", current)
+	}
+
+	var revert []Migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if migration.Version <= target {
+			break
+		}
+		if migration.Version > current {
+			continue
+		}
+		if migration.Down == "" {
+			return fmt.Errorf("migration %d has no down migration", migration.Version)
+		}
+		revert = append(revert, migration)
+	}
+
+	for i, migration := range revert {
+		previous := target
+		if i+1 < len(revert) {
+			previous = revert[i+1].Version
+		}
+		log.Printf("Reverting database migration %d...", migration.Version)
+		if err := revertMigration(db, migration, previous); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaObject is a table, index, view or trigger of the database schema.
+type SchemaObject struct {
+	Type string
+	Name string
+	SQL  string
+}
+
+func loadSchema(db *sql.DB) (map[string]SchemaObject, error) {
+	rows, err := db.Query(`SELECT "type", "name", COALESCE("sql", '') FROM "sqlite_master" WHERE "name" NOT LIKE 'sqlite\_%' ESCAPE '\'`)
+	if err != nil {
+		return nil, fmt.Errorf("could not query schema: %w", err)
+	}
+	defer rows.Close()
+
+	schema := make(map[string]SchemaObject)
+	for rows.Next() {
+		var object SchemaObject
+		if err := rows.Scan(&object.Type, &object.Name, &object.SQL); err != nil {
+			return nil, fmt.Errorf("could not scan schema: %w", err)
+		}
+		object.SQL = normalizeSQL(object.SQL)
+		schema[object.Type+" "+object.Name] = object
+	}
+	return schema, rows.Err()
+}
+
+// expectedSchema applies the migrations up to the version to an empty in-memory database and returns its schema.
+func expectedSchema(version int) (map[string]SchemaObject, error) {
+	memory, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, fmt.Errorf("could not open in-memory database: %w", err)
+	}
+	defer memory.Close()
+	// Every connection to :memory: is a database of its own.
+	memory.SetMaxOpenConns(1)
+
+	if err := createSchemaMigrationsTable(memory); err != nil {
+		return nil, err
+	}
+	for _, migration := range migrations {
+		if migration.Version > version {
+			break
+		}
+		if err := applyMigration(memory, migration); err != nil {
+			return nil, err
+		}
+	}
+	return loadSchema(memory)
+}
+
+// schemaDrift compares the schema of the database with the schema the applied migrations create.
+func schemaDrift(db *sql.DB, version int) ([]string, error) {
+	live, err := loadSchema(db)
+	if err != nil {
+		return nil, err
+	}
+	expected, err := expectedSchema(version)
+	if err != nil {
+		return nil, fmt.Errorf("could not build expected schema: %w", err)
+	}
+
+	var drift []string
+	for key, object := range expected {
+		liveObject, ok := live[key]
+		if !ok {
+			drift = append(drift, fmt.Sprintf("%s %q is missing", object.Type, object.Name))
+		} else if liveObject.SQL != object.SQL {
+			drift = append(drift, fmt.Sprintf("%s %q differs from its migration", object.Type, object.Name))
+		}
+	}
+	for key, object := range live {
+		if _, ok := expected[key]; !ok {
+			drift = append(drift, fmt.Sprintf("%s %q is not created by any migration", object.Type, object.Name))
+		}
+	}
+	sort.Strings(drift)
+	return drift, nil
+}
+
+// verifySchema checks that the applied migrations are the ones of this build and that the schema was not changed.
+func verifySchema(db *sql.DB) error {
+	version, err := userVersion(db)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].Version
+	if version > latest {
+		return fmt.Errorf("database version %d is newer than the latest migration %d of this build", version, latest)
+	}
+
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	known := make(map[int]bool)
+	for _, migration := range migrations {
+		known[migration.Version] = true
+		if migration.Version > version {
+			continue
+		}
+		record, ok := applied[migration.Version]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("migration %d is not recorded", migration.Version))
+		} else if record.Checksum != migration.Checksum() {
+			problems = append(problems, fmt.Sprintf("migration %d was changed after it was applied (checksum %.12s, recorded %.12s)",
+				migration.Version, migration.Checksum(), record.Checksum))
+		}
+	}
+	for v := range applied {
+		if !known[v] || v > version {
+			problems = append(problems, fmt.Sprintf("migration %d is recorded, but not part of this build", v))
+		}
+	}
+	sort.Strings(problems)
+
+	drift, err := schemaDrift(db, version)
+	if err != nil {
+		return err
+	}
+	problems = append(problems, drift...)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("schema of version %d does not match the migrations: %s", version, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// openDB opens the database without migrating it.
+func openDB(dbFilepath string) error {
+	if _, err := os.Stat(dbFilepath); err != nil {
+		return fmt.Errorf("could not open database: %w", err)
+	}
+
+	var err error
+	db, err = sql.Open("sqlite3", dbFilepath+dbOptions)
+	if err != nil {
+		return fmt.Errorf("could not open database: %w", err)
+	}
+	return nil
+}
+
+func printMigrationStatus() error {
+	version, err := userVersion(db)
+	if err != nil {
+		return err
+	}
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Database version: %d, latest migration: %d\n\n", version, migrations[len(migrations)-1].Version)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tSTATE\tAPPLIED\tCHECKSUM\tDOWN")
+	for _, migration := range migrations {
+		state := "pending"
+		appliedAt := "-"
+		if migration.Version <= version {
+			state = "applied"
+			if record, ok := applied[migration.Version]; !ok {
+				state = "not recorded"
+			} else {
+				if record.Checksum != migration.Checksum() {
+					state = "changed"
+				}
+				appliedAt = "unknown"
+				if record.Applied != nil {
+					appliedAt = record.Applied.Format("2006-01-02 15:04:05")
+				}
+			}
+		}
+		down := "no"
+		if migration.Down != "" {
+			down = "yes"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%.12s\t%s\n", migration.Version, state, appliedAt, migration.Checksum(), down)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := verifySchema(db); err != nil {
+		fmt.Printf("\nSchema: %v\n", err)
+		return errors.New("the database schema does not match the migrations")
+	}
+	fmt.Println("\nSchema: ok")
+	return nil
+}
+
+func runMigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate status | up | down VERSION")
+	}
+
+	if err := openDB(appConfig.DatabasePath); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "status":
+		return printMigrationStatus()
+
+	case "up":
+		if err := runMigrations(db); err != nil {
+			return err
+		}
+		return verifySchema(db)
+
+	case "down":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: migrate down VERSION")
+		}
+		target, err := strconv.Atoi(args[1])
+		if err != nil || target < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		if appConfig.BackupBeforeMigration {
+			current, err := userVersion(db)
+			if err != nil {
+				return err
+			}
+			if _, err := createBackup(db, BackupPreMigration, fmt.Sprintf("v%d", current)); err != nil {
+				return fmt.Errorf("could not back up database before reverting migrations: %w", err)
+			}
+		}
+		if err := migrateDown(db, target); err != nil {
+			return err
+		}
+		log.Printf("Database reverted to version %d. Run a build of that version against it.", target)
+		return nil
+	}
+
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMigrationChecksumIgnoresWhitespace(t *testing.T) {
+	a := Migration{Version: 1, SQL: "CREATE TABLE \"a\" (\n\t\"id\"\tINTEGER\n);"}
+	b := Migration{Version: 1, SQL: `  CREATE TABLE "a" ( "id" INTEGER );  `}
+	c := Migration{Version: 1, SQL: `CREATE TABLE "a" ("id" TEXT);`}
+
+	if a.Checksum() != b.Checksum() {
+		t.Errorf("checksum changed with whitespace: %s != %s", a.Checksum(), b.Checksum())
+	}
+	if a.Checksum() == c.Checksum() {
+		t.Errorf("checksum did not change with the SQL")
+	}
+}
+
+func TestMigrationsAreVerified(t *testing.T) {
+	setupTest(t)
+
+	if err := verifySchema(db); err != nil {
+		t.Fatalf("fresh database does not match the migrations: %v", err)
+	}
+
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, migration := range migrations {
+		record, ok := applied[migration.Version]
+		if !ok {
+			t.Fatalf("migration %d is not recorded", migration.Version)
+		}
+		if record.Checksum != migration.Checksum() || record.Applied == nil {
+			t.Errorf("migration %d is recorded as %+v", migration.Version, record)
+		}
+	}
+}
+
+func TestMigrationsRecordUntrackedVersions(t *testing.T) {
+	setupTest(t)
+
+	// Databases migrated before checksums existed only have a user_version.
+	if _, err := db.Exec(`DROP TABLE "_schema_migrations"`); err != nil {
+		t.Fatal(err)
+	}
+	if err := runMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySchema(db); err != nil {
+		t.Fatalf("schema does not match after recording the migrations: %v", err)
+	}
+
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("%d migrations are recorded, want %d", len(applied), len(migrations))
+	}
+	for _, record := range applied {
+		if record.Applied != nil {
+			t.Errorf("migration %d has an application time, want none", record.Version)
+		}
+	}
+}
+
+func TestVerifySchemaDetectsDrift(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{"extra index", `CREATE INDEX "manual" ON "_sensors" ("last_seen")`, `index "manual" is not created by any migration`},
+		{"missing view", `DROP VIEW "view_usernames"`, `view "view_usernames" is missing`},
+		{"changed view", `DROP VIEW "view_quarantine"; CREATE VIEW "view_quarantine" AS SELECT * FROM "_quarantine"`,
+			`view "view_quarantine" differs from its migration`},
+		{"forked migration", `INSERT INTO "_schema_migrations" ("version", "checksum") VALUES (1000, 'fork')`,
+			`migration 1000 is recorded, but not part of this build`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+
+			if _, err := db.Exec(test.sql); err != nil {
+				t.Fatal(err)
+			}
+			err := verifySchema(db)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifySchemaDetectsChangedMigrations(t *testing.T) {
+	setupTest(t)
+
+	all := migrations
+	t.Cleanup(func() { migrations = all })
+	migrations = append([]Migration(nil), all...)
+	last := &migrations[len(migrations)-1]
+	last.SQL += "\n-- Changed after it was applied.\n"
+
+	err := verifySchema(db)
+	want := fmt.Sprintf("migration %d was changed after it was applied", last.Version)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	setupTest(t)
+	latest := migrations[len(migrations)-1].Version
+
+	// Migration 6 moves the attacks into the dictionaries and cannot be reverted.
+	if err := migrateDown(db, 5); err == nil || !strings.Contains(err.Error(), "migration 6 has no down migration") {
+		t.Fatalf("got error %v, want migration 6 to block the revert", err)
+	}
+	if version, _ := userVersion(db); version != latest {
+		t.Fatalf("a failed revert changed the version to %d", version)
+	}
+
+	if err := migrateDown(db, 6); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := userVersion(db); version != 6 {
+		t.Fatalf("user_version is %d after reverting to 6", version)
+	}
+	if err := verifySchema(db); err != nil {
+		t.Fatalf("reverted schema does not match migration 6: %v", err)
+	}
+
+	if err := runMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := userVersion(db); version != latest {
+		t.Fatalf("user_version is %d after migrating up again", version)
+	}
+	if err := verifySchema(db); err != nil {
+		t.Fatalf("schema does not match after migrating up again: %v", err)
+	}
+}
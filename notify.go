@@ -0,0 +1,476 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSONDuration is a time.Duration that is written as a Go duration string ("5m", "1h30m") in JSON.
+// Plain numbers are interpreted as seconds.
+type JSONDuration time.Duration
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *JSONDuration) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), "\"")
+	if s == "null" || s == "" {
+		return nil
+	}
+
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		*d = JSONDuration(seconds * float64(time.Second))
+		return nil
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("failed to parse duration %q: %w", s, err)
+	}
+	*d = JSONDuration(duration)
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d JSONDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type RuleType string
+
+// These are the supported notification rule types.
+const (
+	// RuleTypeSourceRate fires when a single source IP exceeds Threshold attempts within Window. Evaluated on ingest.
+	RuleTypeSourceRate RuleType = "source_rate"
+	// RuleTypeNewCredential fires when a username/password pair is seen for the first time. Evaluated on ingest.
+	RuleTypeNewCredential RuleType = "new_credential"
+	// RuleTypeHourlySpike fires when the attacks of the last hour exceed Factor times the hourly average
+	// of the 7 days before and at least Threshold attacks. Evaluated every Interval.
+	RuleTypeHourlySpike RuleType = "hourly_spike"
+	// RuleTypeSensorLiveness routes the alerts of the sensor liveness monitoring.
+	RuleTypeSensorLiveness RuleType = "sensor_liveness"
+	// RuleTypeAnomaly routes the alerts of the anomaly detection on the hourly attack volume.
+	RuleTypeAnomaly RuleType = "anomaly"
+)
+
+type NotifyRule struct {
+	Name string   `json:"name"`
+	Type RuleType `json:"type"`
+	// Webhooks are the names of the webhooks to notify. Empty means every webhook.
+	Webhooks  []string     `json:"webhooks"`
+	Threshold int          `json:"threshold"`
+	Window    JSONDuration `json:"window"`
+	Factor    float64      `json:"factor"`
+	Interval  JSONDuration `json:"interval"`
+	// Dedup suppresses repeated alerts with the same rule and key within this duration.
+	Dedup JSONDuration `json:"dedup"`
+
+	lastRun time.Time
+}
+
+type NotifyConfig struct {
+	Webhooks []WebhookConfig `json:"webhooks"`
+	Rules    []NotifyRule    `json:"rules"`
+}
+
+// NotifyEvent is the data that is sent to the webhooks and available in webhook templates.
+type NotifyEvent struct {
+	Rule   string         `json:"rule"`
+	Type   RuleType       `json:"type"`
+	Event  string         `json:"event"`
+	Key    string         `json:"key"`
+	Text   string         `json:"text"`
+	Time   time.Time      `json:"time"`
+	Fields map[string]any `json:"fields,omitempty"`
+}
+
+type sourceRateWindow struct {
+	start time.Time
+	count int
+}
+
+// Notifier evaluates the notification rules and delivers the resulting events to the webhooks.
+type Notifier struct {
+	webhooks     []*Webhook
+	webhooksName map[string]*Webhook
+	rules        []*NotifyRule
+	// retention is how long source rate windows and dedup entries have to be kept.
+	retention time.Duration
+
+	mu          sync.Mutex
+	lastSent    map[string]time.Time
+	sourceRates map[string]*sourceRateWindow
+
+	events chan NotifyEvent
+}
+
+var notifier *Notifier
+
+// loadNotifyConfig reads the notification config from a JSON file.
+func loadNotifyConfig(path string) (*NotifyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read notify config: %w", err)
+	}
+
+	var config NotifyConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("could not parse notify config: %w", err)
+	}
+	return &config, nil
+}
+
+func newNotifier(config *NotifyConfig) (*Notifier, error) {
+	n := &Notifier{
+		webhooksName: make(map[string]*Webhook),
+		lastSent:     make(map[string]time.Time),
+		sourceRates:  make(map[string]*sourceRateWindow),
+		events:       make(chan NotifyEvent, 256),
+	}
+
+	for _, webhookConfig := range config.Webhooks {
+		if _, ok := n.webhooksName[webhookConfig.Name]; ok {
+			return nil, fmt.Errorf("duplicate webhook name %q", webhookConfig.Name)
+		}
+		hook, err := newWebhook(webhookConfig)
+		if err != nil {
+			return nil, err
+		}
+		n.webhooks = append(n.webhooks, hook)
+		n.webhooksName[hook.Name] = hook
+	}
+
+	for i := range config.Rules {
+		rule := config.Rules[i]
+		if rule.Name == "" {
+			rule.Name = string(rule.Type)
+		}
+
+		for _, name := range rule.Webhooks {
+			if _, ok := n.webhooksName[name]; !ok {
+				return nil, fmt.Errorf("rule %q references unknown webhook %q", rule.Name, name)
+			}
+		}
+
+		switch rule.Type {
+		case RuleTypeSourceRate:
+			if rule.Threshold <= 0 {
+				return nil, fmt.Errorf("rule %q needs a positive threshold", rule.Name)
+			}
+			if rule.Window <= 0 {
+				rule.Window = JSONDuration(time.Minute)
+			}
+			if rule.Dedup == 0 {
+				rule.Dedup = JSONDuration(time.Hour)
+			}
+		case RuleTypeNewCredential:
+		case RuleTypeHourlySpike:
+			if rule.Factor <= 0 {
+				rule.Factor = 3
+			}
+			if rule.Interval <= 0 {
+				rule.Interval = JSONDuration(5 * time.Minute)
+			}
+			if rule.Dedup == 0 {
+				rule.Dedup = JSONDuration(time.Hour)
+			}
+		case RuleTypeSensorLiveness, RuleTypeAnomaly:
+		default:
+			return nil, fmt.Errorf("rule %q has unknown type %q", rule.Name, rule.Type)
+		}
+
+		n.rules = append(n.rules, &rule)
+		n.retention = max(n.retention, time.Duration(rule.Window), time.Duration(rule.Dedup))
+	}
+
+	return n, nil
+}
+
+// rulesOfType returns every configured rule of the given type.
+func (n *Notifier) rulesOfType(ruleType RuleType) []*NotifyRule {
+	var rules []*NotifyRule
+	for _, rule := range n.rules {
+		if rule.Type == ruleType {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Notify queues the event for delivery without blocking the caller.
+// Events are dropped if the queue is full.
+func (n *Notifier) Notify(event NotifyEvent) {
+	if n == nil || len(n.webhooks) == 0 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	select {
+	case n.events <- event:
+	default:
+		log.Printf("[ERROR] Notification queue is full, dropping %s event %q.\n", event.Rule, event.Key)
+	}
+}
+
+// notifyRule sends the event for a rule, unless the same rule and key fired within the dedup window.
+func (n *Notifier) notifyRule(rule *NotifyRule, event NotifyEvent) {
+	event.Rule = rule.Name
+	event.Type = rule.Type
+
+	if rule.Dedup > 0 {
+		dedupKey := rule.Name + "\x00" + event.Key
+		now := time.Now()
+
+		n.mu.Lock()
+		last, ok := n.lastSent[dedupKey]
+		if ok && now.Sub(last) < time.Duration(rule.Dedup) {
+			n.mu.Unlock()
+			return
+		}
+		n.lastSent[dedupKey] = now
+		n.mu.Unlock()
+	}
+
+	n.Notify(event)
+}
+
+// deliver sends the queued events to the webhooks of their rule.
+func (n *Notifier) deliver() {
+	for event := range n.events {
+		var rule *NotifyRule
+		for _, r := range n.rules {
+			if r.Name == event.Rule {
+				rule = r
+				break
+			}
+		}
+
+		targets := n.webhooks
+		if rule != nil && len(rule.Webhooks) > 0 {
+			targets = nil
+			for _, name := range rule.Webhooks {
+				targets = append(targets, n.webhooksName[name])
+			}
+		}
+
+		for _, hook := range targets {
+			if !hook.limiter.Allow() {
+				log.Printf("[ERROR] Rate limit of webhook %q exceeded, dropping %s event %q.\n", hook.Name, event.Rule, event.Key)
+				continue
+			}
+			if err := hook.Send(event); err != nil {
+				log.Printf("[ERROR] Failed to send %s event to webhook %q: %v\n", event.Rule, hook.Name, err)
+			}
+		}
+	}
+}
+
+// OnAttack evaluates the ingest rules for a newly stored attack.
+func (n *Notifier) OnAttack(attack *Attack) {
+	if n == nil {
+		return
+	}
+
+	now := time.Now()
+
+	for _, rule := range n.rulesOfType(RuleTypeSourceRate) {
+		key := rule.Name + "\x00" + attack.SourceIP
+
+		n.mu.Lock()
+		window, ok := n.sourceRates[key]
+		if !ok || now.Sub(window.start) >= time.Duration(rule.Window) {
+			window = &sourceRateWindow{start: now}
+			n.sourceRates[key] = window
+		}
+		window.count++
+		count := window.count
+		n.mu.Unlock()
+
+		if count == rule.Threshold+1 {
+			n.notifyRule(rule, NotifyEvent{
+				Event: "source_rate_exceeded",
+				Key:   attack.SourceIP,
+				Text: fmt.Sprintf("Source %s made more than %d attempts within %s.",
+					attack.SourceIP, rule.Threshold, time.Duration(rule.Window)),
+				Fields: map[string]any{
+					"source_ip":      attack.SourceIP,
+					"destination_ip": attack.DestinationIP,
+					"count":          count,
+					"threshold":      rule.Threshold,
+					"window":         time.Duration(rule.Window).String(),
+				},
+			})
+		}
+	}
+
+	if !attack.firstCredentialUse {
+		return
+	}
+	// The webhooks are outside, they get the credentials the redaction policy hands out.
+	username := appConfig.Redaction.username(attack.Username)
+	password := appConfig.Redaction.password(attack.Password)
+	for _, rule := range n.rulesOfType(RuleTypeNewCredential) {
+		n.notifyRule(rule, NotifyEvent{
+			Event: "new_credential",
+			Key:   username + ":" + password,
+			Text: fmt.Sprintf("New credential pair %q / %q first seen from %s.",
+				username, password, attack.SourceIP),
+			Fields: map[string]any{
+				"username":       username,
+				"password":       password,
+				"source_ip":      attack.SourceIP,
+				"destination_ip": attack.DestinationIP,
+			},
+		})
+	}
+}
+
+// OnSensor routes a sensor liveness alert to the webhooks.
+func (n *Notifier) OnSensor(event string, sensor Sensor, now time.Time) {
+	if n == nil {
+		return
+	}
+
+	silentFor := now.Sub(sensor.LastSeen).Round(time.Second)
+	text := fmt.Sprintf("Sensor %s %s has been silent for %s.", sensor.Kind, sensor.Name, silentFor)
+	if event == "sensor_recovered" {
+		text = fmt.Sprintf("Sensor %s %s recovered.", sensor.Kind, sensor.Name)
+	}
+
+	notifyEvent := NotifyEvent{
+		Event: event,
+		Key:   string(sensor.Kind) + ":" + sensor.Name,
+		Text:  text,
+		Time:  now,
+		Fields: map[string]any{
+			"kind":           sensor.Kind,
+			"sensor":         sensor.Name,
+			"last_seen":      sensor.LastSeen,
+			"silent_seconds": int64(silentFor / time.Second),
+		},
+	}
+
+	rules := n.rulesOfType(RuleTypeSensorLiveness)
+	if len(rules) == 0 {
+		notifyEvent.Rule = string(RuleTypeSensorLiveness)
+		notifyEvent.Type = RuleTypeSensorLiveness
+		n.Notify(notifyEvent)
+		return
+	}
+	for _, rule := range rules {
+		n.notifyRule(rule, notifyEvent)
+	}
+}
+
+// OnAnomaly routes an anomaly of the hourly attack volume to the webhooks.
+func (n *Notifier) OnAnomaly(anomaly Anomaly) {
+	if n == nil {
+		return
+	}
+
+	event := "anomaly_spike"
+	if anomaly.Score < 0 {
+		event = "anomaly_drop"
+	}
+	notifyEvent := NotifyEvent{
+		Event: event,
+		Key:   string(anomaly.Scope) + ":" + anomaly.Key + ":" + strconv.FormatInt(anomaly.Hour.UnixMilli(), 10),
+		Text:  anomaly.Text(),
+		Time:  anomaly.Detected,
+		Fields: map[string]any{
+			"scope":    anomaly.Scope,
+			"key":      anomaly.Key,
+			"hour":     anomaly.Hour,
+			"attacks":  anomaly.Attacks,
+			"baseline": anomaly.Baseline,
+			"mad":      anomaly.MAD,
+			"score":    anomaly.Score,
+		},
+	}
+
+	rules := n.rulesOfType(RuleTypeAnomaly)
+	if len(rules) == 0 {
+		notifyEvent.Rule = string(RuleTypeAnomaly)
+		notifyEvent.Type = RuleTypeAnomaly
+		n.Notify(notifyEvent)
+		return
+	}
+	for _, rule := range rules {
+		n.notifyRule(rule, notifyEvent)
+	}
+}
+
+// checkHourlySpike compares the attacks of the last hour against the hourly average of the 7 days before.
+func (n *Notifier) checkHourlySpike(db *sql.DB, rule *NotifyRule, now time.Time) error {
+	hourAgo := now.Add(-time.Hour).UnixMilli()
+	weekAgo := now.Add(-time.Hour - 7*24*time.Hour).UnixMilli()
+
+	var current, baseline int
+	err := db.QueryRow(`SELECT
+			(SELECT COUNT(*) FROM "_attacks" WHERE "timestamp" >= ?),
+			(SELECT COUNT(*) FROM "_attacks" WHERE "timestamp" >= ? AND "timestamp" < ?)`,
+		hourAgo, weekAgo, hourAgo).Scan(&current, &baseline)
+	if err != nil {
+		return fmt.Errorf("could not count attacks: %w", err)
+	}
+
+	average := float64(baseline) / (7 * 24)
+	if current < rule.Threshold || float64(current) <= rule.Factor*average {
+		return nil
+	}
+
+	n.notifyRule(rule, NotifyEvent{
+		Event: "hourly_spike",
+		Key:   "hourly_spike",
+		Text: fmt.Sprintf("%d attacks within the last hour, the 7-day hourly average is %.1f.",
+			current, average),
+		Fields: map[string]any{
+			"count":    current,
+			"baseline": average,
+			"factor":   rule.Factor,
+		},
+	})
+	return nil
+}
+
+// run delivers the queued events and evaluates the scheduled rules.
+func (n *Notifier) run(db *sql.DB) {
+	go n.deliver()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, rule := range n.rules {
+			if rule.Type != RuleTypeHourlySpike || now.Sub(rule.lastRun) < time.Duration(rule.Interval) {
+				continue
+			}
+			rule.lastRun = now
+
+			if err := n.checkHourlySpike(db, rule, now); err != nil {
+				log.Printf("[ERROR] Failed to evaluate rule %q: %v\n", rule.Name, err)
+			}
+		}
+
+		// Forget expired source rate windows and dedup entries.
+		n.mu.Lock()
+		for key, window := range n.sourceRates {
+			if now.Sub(window.start) > n.retention {
+				delete(n.sourceRates, key)
+			}
+		}
+		for key, sent := range n.lastSent {
+			if now.Sub(sent) > n.retention {
+				delete(n.lastSent, key)
+			}
+		}
+		n.mu.Unlock()
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startNotifier delivers the events of the notifier and installs it for the ingest until the test ends.
+func startNotifier(t *testing.T, config *NotifyConfig) *Notifier {
+	t.Helper()
+
+	n, err := newNotifier(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go n.deliver()
+	notifier = n
+	t.Cleanup(func() {
+		notifier = nil
+		close(n.events)
+	})
+	return n
+}
+
+// receivedEvents returns the events a webhook received up to the marker event.
+// The events are delivered in order, so the marker comes after everything that was notified before it.
+func receivedEvents(t *testing.T, n *Notifier, received <-chan webhookRequest) []NotifyEvent {
+	t.Helper()
+
+	n.Notify(NotifyEvent{Rule: "marker"})
+	var events []NotifyEvent
+	for {
+		var event NotifyEvent
+		if err := json.Unmarshal(nextWebhook(t, received).Body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Rule == "marker" {
+			return events
+		}
+		events = append(events, event)
+	}
+}
+
+func TestLoadNotifyConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.json")
+	err := os.WriteFile(path, []byte(`{
+		"webhooks": [
+			{"name": "ops", "url": "http://127.0.0.1/ops", "format": "slack"},
+			{"name": "chat", "url": "http://127.0.0.1/chat", "format": "matrix", "token": "secret", "rate_limit_per_minute": 5}
+		],
+		"rules": [
+			{"name": "bruteforce", "type": "source_rate", "threshold": 10, "window": "5m", "webhooks": ["ops"]},
+			{"type": "hourly_spike", "threshold": 100, "window": 90, "dedup": "-1s"},
+			{"type": "new_credential"}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadNotifyConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := newNotifier(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(n.webhooks) != 2 || n.webhooksName["chat"].RateLimitPerMinute != 5 || n.webhooksName["ops"].Format != WebhookFormatSlack {
+		t.Errorf("got webhooks %+v", n.webhooks)
+	}
+	want := []NotifyRule{
+		{Name: "bruteforce", Type: RuleTypeSourceRate, Webhooks: []string{"ops"}, Threshold: 10,
+			Window: JSONDuration(5 * time.Minute), Dedup: JSONDuration(time.Hour)},
+		{Name: "hourly_spike", Type: RuleTypeHourlySpike, Threshold: 100, Window: JSONDuration(90 * time.Second),
+			Factor: 3, Interval: JSONDuration(5 * time.Minute), Dedup: JSONDuration(-time.Second)},
+		{Name: "new_credential", Type: RuleTypeNewCredential},
+	}
+	if len(n.rules) != len(want) {
+		t.Fatalf("got %d rules, want %d", len(n.rules), len(want))
+	}
+	for i, rule := range n.rules {
+		got, _ := json.Marshal(rule)
+		expected, _ := json.Marshal(want[i])
+		if string(got) != string(expected) {
+			t.Errorf("rule %d: got %s, want %s", i, got, expected)
+		}
+	}
+	if n.retention != time.Hour {
+		t.Errorf("got retention %s, want 1h", n.retention)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"rules": [{"type": "source_rate", "window": "5 minutes"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadNotifyConfig(path); err == nil || !strings.Contains(err.Error(), `failed to parse duration "5 minutes"`) {
+		t.Errorf("got %v, want the invalid duration rejected", err)
+	}
+	if _, err := loadNotifyConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("got no error for a missing file")
+	}
+}
+
+func TestNewNotifierRejectsInvalidConfig(t *testing.T) {
+	hook := WebhookConfig{Name: "ops", URL: "http://127.0.0.1/ops"}
+	tests := []struct {
+		config NotifyConfig
+		err    string
+	}{
+		{NotifyConfig{Webhooks: []WebhookConfig{hook, hook}}, `duplicate webhook name "ops"`},
+		{NotifyConfig{Webhooks: []WebhookConfig{{Name: "ops"}}}, `webhook "ops" has no url`},
+		{NotifyConfig{Rules: []NotifyRule{{Type: RuleTypeNewCredential, Webhooks: []string{"chat"}}}},
+			`rule "new_credential" references unknown webhook "chat"`},
+		{NotifyConfig{Rules: []NotifyRule{{Name: "bruteforce", Type: RuleTypeSourceRate}}}, `rule "bruteforce" needs a positive threshold`},
+		{NotifyConfig{Rules: []NotifyRule{{Name: "other", Type: "port_scan"}}}, `rule "other" has unknown type "port_scan"`},
+	}
+	for _, test := range tests {
+		if _, err := newNotifier(&test.config); err == nil || err.Error() != test.err {
+			t.Errorf("got error %v, want %q", err, test.err)
+		}
+	}
+}
+
+func TestNotifierSourceRate(t *testing.T) {
+	setupTest(t)
+	server, received := newWebhookReceiver(t, http.StatusOK)
+	n := startNotifier(t, &NotifyConfig{
+		Webhooks: []WebhookConfig{{Name: "ops", URL: server.URL}},
+		Rules:    []NotifyRule{{Name: "bruteforce", Type: RuleTypeSourceRate, Threshold: 3, Window: JSONDuration(time.Hour)}},
+	})
+
+	// Only the attempt that exceeds the threshold fires, further attempts are within the dedup window.
+	attacks := generateAttacks(1, 6, time.Now())
+	for _, attack := range attacks {
+		attack.SourceIP = "198.51.100.1"
+		ingestAttack(attack, time.Now())
+	}
+	other := generateAttacks(2, 1, time.Now())[0]
+	other.SourceIP = "198.51.100.2"
+	ingestAttack(other, time.Now())
+
+	events := receivedEvents(t, n, received)
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	event := events[0]
+	if event.Rule != "bruteforce" || event.Type != RuleTypeSourceRate || event.Event != "source_rate_exceeded" || event.Key != "198.51.100.1" ||
+		event.Text != "Source 198.51.100.1 made more than 3 attempts within 1h0m0s." || event.Fields["count"] != float64(4) {
+		t.Errorf("got %+v", event)
+	}
+
+	// A new window counts from zero, but the dedup window still suppresses the alert.
+	n.mu.Lock()
+	n.sourceRates["bruteforce\x00198.51.100.1"].start = time.Now().Add(-2 * time.Hour)
+	n.mu.Unlock()
+	for _, attack := range generateAttacks(3, 4, time.Now()) {
+		attack.SourceIP = "198.51.100.1"
+		ingestAttack(attack, time.Now())
+	}
+	if events := receivedEvents(t, n, received); len(events) != 0 {
+		t.Errorf("got %d events within the dedup window, want none", len(events))
+	}
+}
+
+func TestNotifierNewCredential(t *testing.T) {
+	setupTest(t)
+	appConfig.Redaction = RedactNone
+	server, received := newWebhookReceiver(t, http.StatusOK)
+	n := startNotifier(t, &NotifyConfig{
+		Webhooks: []WebhookConfig{{Name: "ops", URL: server.URL}},
+		Rules:    []NotifyRule{{Type: RuleTypeNewCredential}},
+	})
+
+	attacks := generateAttacks(1, 3, time.Now())
+	for _, attack := range attacks {
+		attack.Username = "deploy"
+		attack.Password = "hunter2"
+	}
+	attacks[2].Password = "hunter3"
+	for _, attack := range attacks {
+		ingestAttack(attack, time.Now())
+	}
+
+	events := receivedEvents(t, n, received)
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want one per new credential pair", len(events))
+	}
+	for i, key := range []string{"deploy:hunter2", "deploy:hunter3"} {
+		if events[i].Rule != "new_credential" || events[i].Key != key || events[i].Fields["username"] != "deploy" {
+			t.Errorf("got %+v, want a new credential event for %s", events[i], key)
+		}
+	}
+}
+
+func TestNotifierNewCredentialInOneBatch(t *testing.T) {
+	setupTest(t)
+	appConfig.Redaction = RedactNone
+	server, received := newWebhookReceiver(t, http.StatusOK)
+	n := startNotifier(t, &NotifyConfig{
+		Webhooks: []WebhookConfig{{Name: "ops", URL: server.URL}},
+		Rules:    []NotifyRule{{Type: RuleTypeNewCredential, Dedup: JSONDuration(-1)}},
+	})
+
+	// Committed in one transaction, only the first attack is the first use of the pair.
+	attacks := generateAttacks(1, 3, time.Now())
+	batch := make([]attackWrite, len(attacks))
+	for i, attack := range attacks {
+		attack.Username = "deploy"
+		attack.Password = "hunter2"
+		batch[i] = attackWrite{attack: attack}
+	}
+	results := make([]error, len(batch))
+	if err := attackWriter.commitBatch(batch, results); err != nil {
+		t.Fatal(err)
+	}
+	for i, attack := range attacks {
+		if results[i] != nil {
+			t.Fatalf("attack %d: %v", i, results[i])
+		}
+		n.OnAttack(attack)
+	}
+
+	events := receivedEvents(t, n, received)
+	if len(events) != 1 || events[0].Key != "deploy:hunter2" || events[0].Fields["source_ip"] != attacks[0].SourceIP {
+		t.Errorf("got %+v, want one event for the first attack", events)
+	}
+}
+
+func TestNotifierRedactsCredentials(t *testing.T) {
+	setupTest(t)
+	server, received := newWebhookReceiver(t, http.StatusOK)
+	startNotifier(t, &NotifyConfig{
+		Webhooks: []WebhookConfig{{Name: "ops", URL: server.URL}},
+		Rules:    []NotifyRule{{Type: RuleTypeNewCredential}},
+	})
+
+	tests := []struct {
+		policy   RedactionPolicy
+		username string
+	}{
+		{RedactPasswords, "deploy"},
+		{RedactAll, redacted},
+	}
+	for i, test := range tests {
+		appConfig.Redaction = test.policy
+		attack := generateAttacks(int64(i+1), 1, time.Now())[0]
+		attack.Username = "deploy"
+		attack.Password = fmt.Sprintf("hunter%d", i)
+		ingestAttack(attack, time.Now())
+
+		body := nextWebhook(t, received).Body
+		if strings.Contains(string(body), attack.Password) || test.policy == RedactAll && strings.Contains(string(body), "deploy") {
+			t.Errorf("%s: the webhook got %s", test.policy, body)
+		}
+		var event NotifyEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Fields["username"] != test.username || event.Fields["password"] != redacted {
+			t.Errorf("%s: got the fields %v", test.policy, event.Fields)
+		}
+	}
+}
+
+func TestNotifierDedupAndRouting(t *testing.T) {
+	setupTest(t)
+	opsServer, opsReceived := newWebhookReceiver(t, http.StatusOK)
+	chatServer, chatReceived := newWebhookReceiver(t, http.StatusOK)
+	n := startNotifier(t, &NotifyConfig{
+		Webhooks: []WebhookConfig{{Name: "ops", URL: opsServer.URL}, {Name: "chat", URL: chatServer.URL}},
+		Rules: []NotifyRule{
+			{Name: "spike", Type: RuleTypeHourlySpike, Webhooks: []string{"chat"}},
+			{Name: "every", Type: RuleTypeHourlySpike, Webhooks: []string{"ops"}, Dedup: JSONDuration(-1)},
+		},
+	})
+	spike, every := n.rules[0], n.rules[1]
+
+	n.notifyRule(spike, NotifyEvent{Key: "a"})
+	n.notifyRule(spike, NotifyEvent{Key: "a"})
+	n.notifyRule(spike, NotifyEvent{Key: "b"})
+	n.notifyRule(every, NotifyEvent{Key: "a"})
+	n.notifyRule(every, NotifyEvent{Key: "a"})
+
+	// Each rule goes to its own webhook only, the marker to both.
+	chatEvents := receivedEvents(t, n, chatReceived)
+	if len(chatEvents) != 2 || chatEvents[0].Key != "a" || chatEvents[1].Key != "b" {
+		t.Errorf("got %+v, want a and b once each", chatEvents)
+	}
+	opsEvents := receivedEvents(t, n, opsReceived)
+	if len(opsEvents) != 2 || opsEvents[0].Rule != "every" || opsEvents[1].Rule != "every" {
+		t.Errorf("got %+v, want both events of the rule without dedup", opsEvents)
+	}
+	// The marker for ops also reached chat.
+	var marker NotifyEvent
+	if err := json.Unmarshal(nextWebhook(t, chatReceived).Body, &marker); err != nil || marker.Rule != "marker" {
+		t.Errorf("got %+v, %v, want the marker for ops", marker, err)
+	}
+
+	// Once the dedup window is over the key fires again.
+	n.mu.Lock()
+	n.lastSent["spike\x00a"] = time.Now().Add(-2 * time.Hour)
+	n.mu.Unlock()
+	n.notifyRule(spike, NotifyEvent{Key: "a"})
+	if events := receivedEvents(t, n, chatReceived); len(events) != 1 || events[0].Key != "a" {
+		t.Errorf("got %+v, want a after the dedup window", events)
+	}
+}
+
+func TestNotifierHourlySpike(t *testing.T) {
+	setupTest(t)
+	server, received := newWebhookReceiver(t, http.StatusOK)
+	n := startNotifier(t, &NotifyConfig{
+		Webhooks: []WebhookConfig{{Name: "ops", URL: server.URL}},
+		Rules:    []NotifyRule{{Type: RuleTypeHourlySpike, Threshold: 5}},
+	})
+	rule := n.rules[0]
+	now := time.Now()
+
+	// 168 attacks in the week before are an average of one per hour, the factor is 3.
+	var attacks []*Attack
+	for i, attack := range generateAttacks(1, 168+4, now) {
+		if i < 168 {
+			attack.AttackTimestamp = FlexibleTime(now.Add(-2*time.Hour - time.Duration(i)*time.Hour).Truncate(time.Millisecond))
+		} else {
+			attack.AttackTimestamp = FlexibleTime(now.Add(-time.Duration(i-167) * time.Minute).Truncate(time.Millisecond))
+		}
+		attacks = append(attacks, attack)
+	}
+	saveAttacks(t, attacks)
+
+	// Four attacks are below the threshold, seven are more than three times the average.
+	if err := n.checkHourlySpike(db, rule, now); err != nil {
+		t.Fatal(err)
+	}
+	more := generateAttacks(2, 3, now)
+	for i, attack := range more {
+		attack.AttackTimestamp = FlexibleTime(now.Add(-time.Duration(10+i) * time.Minute).Truncate(time.Millisecond))
+	}
+	saveAttacks(t, more)
+	if err := n.checkHourlySpike(db, rule, now); err != nil {
+		t.Fatal(err)
+	}
+
+	events := receivedEvents(t, n, received)
+	if len(events) != 1 || events[0].Event != "hourly_spike" || events[0].Fields["count"] != float64(7) ||
+		events[0].Text != "7 attacks within the last hour, the 7-day hourly average is 1.0." {
+		t.Errorf("got %+v, want one spike of 7 attacks", events)
+	}
+}
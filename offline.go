@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var metricOfflineResponses = newCounter("netwatch_proxy_offline_responses_total",
+	"Requests answered by the offline collector.", "endpoint", "status")
+
+// localResponse builds a JSON response of the proxy itself, shaped like a response of the collector.
+func localResponse(statusCode int, body any) *http.Response {
+	data, err := json.Marshal(body)
+	if err != nil {
+		// The bodies are built from maps of strings, so this cannot happen.
+		panic(err)
+	}
+
+	return &http.Response{
+		StatusCode: statusCode,
+		Header: http.Header{
+			"Content-Length": []string{strconv.Itoa(len(data))},
+			"Server":         []string{"SSH-AttackPod-Proxy/1.0"},
+			"Date":           []string{time.Now().UTC().Format(http.TimeFormat)},
+			"Content-Type":   []string{"application/json"},
+		},
+		Body: io.NopCloser(bytes.NewReader(data)),
+	}
+}
+
+// mockAddAttackResponse is the success response of the collector for /add_attack.
+func mockAddAttackResponse() *http.Response {
+	return localResponse(http.StatusOK, map[string]string{"status": "success"})
+}
+
+// offlineResponse answers a request as the collector would, so the pods work without any network access.
+// Every KnownEndpoints value is implemented, other paths are answered with 404.
+func offlineResponse(r *http.Request) *http.Response {
+	resp := offlineEndpointResponse(r)
+	metricOfflineResponses.Inc(endpointLabel(r.URL.Path), strconv.Itoa(resp.StatusCode))
+	return resp
+}
+
+func offlineEndpointResponse(r *http.Request) *http.Response {
+	switch KnownEndpoints(r.URL.Path) {
+	case EndpointAddAttack:
+		if r.Method != http.MethodPost {
+			return offlineMethodNotAllowed(http.MethodPost)
+		}
+		return mockAddAttackResponse()
+
+	case EndpointCheckIP:
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			return offlineMethodNotAllowed(http.MethodGet, http.MethodPost)
+		}
+		// The collector reports the address the pod connects from, which is the pod itself here.
+		return localResponse(http.StatusOK, map[string]string{"status": "success", "ip": clientIP(r)})
+	}
+
+	return localResponse(http.StatusNotFound, map[string]string{"status": "error", "message": "unknown endpoint"})
+}
+
+func offlineMethodNotAllowed(methods ...string) *http.Response {
+	resp := localResponse(http.StatusMethodNotAllowed, map[string]string{"status": "error", "message": "method not allowed"})
+	for _, method := range methods {
+		resp.Header.Add("Allow", method)
+	}
+	return resp
+}
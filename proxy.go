@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// proxyTransport is shared by all forwarded requests, so connections to the collector are kept alive and reused.
+var proxyTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   32,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+	ResponseHeaderTimeout: 60 * time.Second,
+}
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// cappedBuffer keeps the first limit bytes written to it and counts the rest.
+type cappedBuffer struct {
+	limit int
+	buf   bytes.Buffer
+	total int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if room := b.limit - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// bodyRecorder passes a request body through to the collector and copies what was read to the writers.
+// The transport may still read the body after the response arrived, so every access is locked.
+type bodyRecorder struct {
+	mu      sync.Mutex
+	body    io.Reader
+	writers []io.Writer
+	err     error
+}
+
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, err := b.body.Read(p)
+	for _, w := range b.writers {
+		w.Write(p[:n])
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// Close does not close the request body, so that the rest of the body can still be drained
+// after the collector answered early. The server closes the request body itself.
+func (b *bodyRecorder) Close() error {
+	return nil
+}
+
+// drain reads the rest of the body and returns the first read error.
+func (b *bodyRecorder) drain() error {
+	io.Copy(io.Discard, b)
+	return b.readErr()
+}
+
+func (b *bodyRecorder) readErr() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// snapshot returns the captured part of the debug buffer and the number of bytes read so far.
+func (b *bodyRecorder) snapshot(debug *cappedBuffer) ([]byte, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(debug.buf.Bytes()), debug.total
+}
+
+func logDebugHeaders(name string, header http.Header) {
+	headerCount := 0
+	for _, values := range header {
+		headerCount += len(values)
+	}
+
+	log.Printf("[DEBUG] %s Headers (%d):\n", name, headerCount)
+	for key, values := range header {
+		for _, value := range values {
+			log.Printf("[DEBUG] - %s: %s\n", key, value)
+		}
+	}
+}
+
+func logDebugBody(name string, captured []byte, total int64) {
+	log.Printf("[DEBUG] %s Body (%d bytes):\n", name, total)
+	if total == 0 {
+		log.Println("[DEBUG] <empty body>")
+		return
+	}
+	log.Printf("[DEBUG] %s\n", string(captured))
+	if omitted := total - int64(len(captured)); omitted > 0 {
+		log.Printf("[DEBUG] <%d more bytes not logged>\n", omitted)
+	}
+}
+
+func rejectBodyTooLarge(w http.ResponseWriter, r *http.Request) {
+	metricRejectedRequests.Inc(endpointLabel(r.URL.Path), rejectReasonBodyTooLarge)
+	log.Printf("[WARN] Rejected %s %s from %s: body exceeds %d bytes.\n", r.Method, r.URL.Path, clientIP(r), appConfig.MaxBodyBytes)
+	http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+}
+
+// handleProxyRequest forwards the request to the collector.
+func handleProxyRequest(w http.ResponseWriter, r *http.Request) {
+	proxyRequest(w, r, appConfig.Collector)
+}
+
+// proxyRequest manually forwards the request to the upstream, modifying the headers only as configured.
+// Both bodies are streamed, only /add_attack bodies are kept in memory to be parsed.
+func proxyRequest(w http.ResponseWriter, r *http.Request, upstream *Upstream) {
+	if !admitRequest(w, r) {
+		return
+	}
+
+	if appConfig.MaxBodyBytes > 0 {
+		if r.ContentLength > appConfig.MaxBodyBytes {
+			rejectBodyTooLarge(w, r)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, appConfig.MaxBodyBytes)
+	}
+
+	if r.URL.Path == string(EndpointAddAttack) || r.URL.Path == string(EndpointCheckIP) {
+		sensorMonitor.Seen(SensorKindClient, clientIP(r))
+	}
+
+	isAttack := r.Method == http.MethodPost && r.URL.Path == string(EndpointAddAttack)
+
+	requestBody := &bodyRecorder{body: r.Body}
+	var attackBody bytes.Buffer
+	if isAttack {
+		requestBody.writers = append(requestBody.writers, &attackBody)
+	}
+	requestLog := &cappedBuffer{limit: appConfig.DebugLogMaxBytes}
+	responseLog := &cappedBuffer{limit: appConfig.DebugLogMaxBytes}
+	responseCopy := &cappedBuffer{limit: maxCachedResponseBytes}
+	cacheResponse := false
+	if appConfig.DebugLog {
+		requestBody.writers = append(requestBody.writers, requestLog)
+	}
+
+	// Construct the full destination URL.
+	host := r.Host
+	r.URL.Scheme = upstream.URL.Scheme
+	r.URL.Host = upstream.URL.Host
+	r.Host = upstream.URL.Host
+	targetURL := upstream.URL.ResolveReference(r.URL)
+
+	// Create a new request to be forwarded.
+	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL.String(), nil)
+	if err != nil {
+		log.Printf("[ERROR] Failed to create proxy request: %v\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if r.ContentLength != 0 {
+		proxyReq.Body = requestBody
+		proxyReq.ContentLength = r.ContentLength
+	}
+
+	proxyReq.Header = proxyRequestHeader(r, host, upstream)
+	proxyReq.Host = upstream.URL.Host
+
+	if appConfig.LogRequests {
+		log.Printf("[INFO] Forwarding request: %s %s to %s\n", r.Method, r.URL.Path, targetURL.String())
+	}
+	if appConfig.DebugLog {
+		logDebugHeaders("Request", proxyReq.Header)
+	}
+
+	var resp *http.Response
+	if appConfig.OfflineCollector {
+		if appConfig.LogRequests {
+			log.Printf("[INFO] Answering %s %s as offline collector.\n", r.Method, r.URL.Path)
+		}
+		resp = offlineResponse(r)
+	} else if appConfig.DoNotSubmitAttacks && r.URL.Path == string(EndpointAddAttack) {
+		if appConfig.LogRequests {
+			log.Printf("[INFO] Skipping submission of attack data due to configuration and returning mockup response.")
+		}
+		resp = mockAddAttackResponse()
+	} else if permit, allowed := upstreamBreaker.Allow(); !allowed {
+		if appConfig.LogRequests {
+			log.Printf("[INFO] Circuit breaker for %s is open, answering %s %s locally.\n", targetURL.Host, r.Method, r.URL.Path)
+		}
+		if resp = fallbackResponse(r); resp == nil {
+			err = errCircuitOpen
+		}
+	} else {
+		started := time.Now()
+		resp, err = proxyTransport.RoundTrip(proxyReq)
+
+		if requestBody.readErr() != nil || r.Context().Err() != nil {
+			// The request failed on the side of the client, which says nothing about the upstream.
+			upstreamBreaker.Release(permit)
+		} else {
+			upstreamBreaker.Record(permit, err != nil || resp.StatusCode >= 500, time.Since(started))
+		}
+		if err == nil && r.URL.Path == string(EndpointCheckIP) && resp.StatusCode < 300 {
+			cacheResponse = true
+		}
+	}
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+
+	// The collector may answer before it read the whole body, but the attack is parsed from all of it.
+	if isAttack {
+		requestBody.drain()
+	}
+	if readErr := requestBody.readErr(); readErr != nil {
+		if isBodyTooLarge(readErr) {
+			rejectBodyTooLarge(w, r)
+			return
+		}
+
+		log.Printf("[ERROR] Failed to read request body: %v\n", readErr)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// The attack is saved even if the collector is unavailable.
+	if isAttack {
+		var attack Attack
+		err := json.Unmarshal(attackBody.Bytes(), &attack)
+		if err == nil {
+			sensorMonitor.Seen(SensorKindDestinationIP, attack.DestinationIP)
+		}
+
+		if err != nil {
+			log.Printf("[ERROR] Failed to unmarshal attack data: %v\n", err)
+			if errDeadLetter := saveDeadLetter(r, attackBody.Bytes(), err); errDeadLetter != nil {
+				log.Printf("[ERROR] Failed to save dead letter: %v\n", errDeadLetter)
+			}
+		} else {
+			ingestQueue.Enqueue(&attack)
+		}
+	}
+
+	if errors.Is(err, errCircuitOpen) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(appConfig.BreakerOpenDuration.Seconds())))
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to forward request to %s: %v\n", targetURL, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	if appConfig.LogRequests {
+		log.Printf("[INFO] Received response: %d from %s\n", resp.StatusCode, targetURL.String())
+	}
+	if appConfig.DebugLog {
+		logDebugHeaders("Response", resp.Header)
+	}
+
+	// --- Copy the response back to the original client ---
+	for key, values := range proxyResponseHeader(resp) {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var responseWriters []io.Writer
+	if appConfig.DebugLog {
+		responseWriters = append(responseWriters, responseLog)
+	}
+	if cacheResponse {
+		responseWriters = append(responseWriters, responseCopy)
+	}
+	_, err = io.Copy(w, io.TeeReader(resp.Body, io.MultiWriter(responseWriters...)))
+	if err != nil {
+		log.Printf("[ERROR] Failed to copy response body: %v\n", err)
+	} else if cacheResponse && responseCopy.total <= maxCachedResponseBytes {
+		checkIPCache.Store(r, resp, responseCopy.buf.Bytes())
+	}
+
+	if appConfig.DebugLog {
+		captured, total := requestBody.snapshot(requestLog)
+		logDebugBody("Request", captured, total)
+		logDebugBody("Response", responseLog.buf.Bytes(), responseLog.total)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func doRequest(t *testing.T, method, url string, header http.Header, body []byte) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, respBody
+}
+
+func attackJSON(t *testing.T, attack *Attack) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(attack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func countRequests(requests []collectedRequest, path string) int {
+	count := 0
+	for _, r := range requests {
+		if strings.HasPrefix(r.URI, path) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestProxyForwardsRequests(t *testing.T) {
+	setupTest(t)
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+	collectorHost := strings.TrimPrefix(collector.URL, "http://")
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	tests := []struct {
+		method string
+		uri    string
+		body   []byte
+	}{
+		{http.MethodGet, "/check_ip?ip=198.51.100.7&verbose=1", nil},
+		{http.MethodPost, "/check_ip", []byte(`{"ip":"198.51.100.7"}`)},
+		{http.MethodPut, "/some/other/path?a=1&a=2", large},
+		{http.MethodDelete, "/some/other/path", nil},
+	}
+
+	for i, test := range tests {
+		header := http.Header{"X-Custom": {"value one", "value two"}, "Authorization": {"Bearer secret"}}
+		doRequest(t, test.method, proxyURL+test.uri, header, test.body)
+
+		requests := collector.Requests()
+		if len(requests) != i+1 {
+			t.Fatalf("%s %s: collector received %d requests, want %d", test.method, test.uri, len(requests), i+1)
+		}
+		got := requests[i]
+		if got.Method != test.method || got.URI != test.uri {
+			t.Errorf("collector received %s %s, want %s %s", got.Method, got.URI, test.method, test.uri)
+		}
+		if got.Host != collectorHost {
+			t.Errorf("%s %s: collector received host %q, want %q", test.method, test.uri, got.Host, collectorHost)
+		}
+		if !bytes.Equal(got.Body, test.body) {
+			t.Errorf("%s %s: collector received a body of %d bytes, want %d", test.method, test.uri, len(got.Body), len(test.body))
+		}
+		if v := got.Header.Values("X-Custom"); len(v) != 2 || v[0] != "value one" || v[1] != "value two" {
+			t.Errorf("%s %s: collector received X-Custom %q", test.method, test.uri, v)
+		}
+		if v := got.Header.Get("Authorization"); v != "Bearer secret" {
+			t.Errorf("%s %s: collector received Authorization %q", test.method, test.uri, v)
+		}
+	}
+}
+
+func TestProxyPassesResponsesThrough(t *testing.T) {
+	setupTest(t)
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+
+	body := bytes.Repeat([]byte("teapot "), 20000)
+	collector.setHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Collector", "yes")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write(body)
+	})
+
+	resp, got := doRequest(t, http.MethodGet, proxyURL+"/check_ip", nil, nil)
+	if resp.StatusCode != http.StatusTeapot {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusTeapot)
+	}
+	if v := resp.Header.Get("X-Collector"); v != "yes" {
+		t.Errorf("got X-Collector %q, want %q", v, "yes")
+	}
+	if v := resp.Header.Values("Set-Cookie"); len(v) != 2 {
+		t.Errorf("got Set-Cookie %q, want both cookies", v)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("got a body of %d bytes, want %d", len(got), len(body))
+	}
+}
+
+func TestProxyHeaderModes(t *testing.T) {
+	for _, mode := range []HeaderMode{HeaderModeStandard, HeaderModeMinimal} {
+		t.Run(string(mode), func(t *testing.T) {
+			setupTest(t)
+			appConfig.HeaderMode = mode
+			collector := newFakeCollector(t)
+			proxyURL := startProxy(t, collector)
+
+			collector.setHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Connection", "X-Upstream-Hop")
+				w.Header().Set("X-Upstream-Hop", "1")
+				w.Header().Set("Proxy-Authenticate", "Basic")
+			})
+
+			header := http.Header{
+				"Connection":          {"X-Client-Hop"},
+				"X-Client-Hop":        {"1"},
+				"Proxy-Authorization": {"Basic c2VjcmV0"},
+				"X-End-To-End":        {"1"},
+			}
+			resp, _ := doRequest(t, http.MethodGet, proxyURL+"/check_ip", header, nil)
+			got := collector.Requests()[0].Header
+
+			stripped := mode == HeaderModeStandard
+			for _, key := range []string{"X-Client-Hop", "Proxy-Authorization"} {
+				if (got.Get(key) == "") != stripped {
+					t.Errorf("collector received %s %q", key, got.Get(key))
+				}
+			}
+			for _, key := range []string{"X-Upstream-Hop", "Proxy-Authenticate"} {
+				if (resp.Header.Get(key) == "") != stripped {
+					t.Errorf("client received %s %q", key, resp.Header.Get(key))
+				}
+			}
+			if got.Get("X-End-To-End") != "1" {
+				t.Errorf("collector did not receive the end-to-end header")
+			}
+		})
+	}
+}
+
+func TestProxyForwardedHeadersPerUpstream(t *testing.T) {
+	setupTest(t)
+
+	// The first upstream is told the client address by X-Forwarded-For, the second by Forwarded and X-Forwarded-Proto.
+	upstreams := []struct {
+		collector *fakeCollector
+		headers   []ForwardedHeader
+		want      map[string]string
+	}{
+		{newFakeCollector(t), []ForwardedHeader{ForwardedHeaderFor}, map[string]string{
+			"X-Forwarded-For": "198.51.100.7, 127.0.0.1",
+		}},
+		{newFakeCollector(t), []ForwardedHeader{ForwardedHeaderForwarded, ForwardedHeaderProto}, map[string]string{
+			"Forwarded":         "for=127.0.0.1;proto=http;host=\"pods.example\"",
+			"X-Forwarded-Proto": "http",
+		}},
+	}
+	for i, test := range upstreams {
+		upstreamURL, err := url.Parse(test.collector.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstream := &Upstream{URL: upstreamURL, ForwardedHeaders: test.headers}
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxyRequest(w, r, upstream)
+		}))
+		t.Cleanup(proxy.Close)
+
+		request, err := http.NewRequest(http.MethodGet, proxy.URL+"/check_ip", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Host = "pods.example"
+		request.Header.Set("X-Forwarded-For", "198.51.100.7")
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		got := test.collector.Requests()[0].Header
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+			want, ok := test.want[name]
+			if !ok && name == "X-Forwarded-For" {
+				// The header of the client passes through unchanged.
+				want = "198.51.100.7"
+			}
+			if got.Get(name) != want {
+				t.Errorf("upstream %d received %s %q, want %q", i+1, name, got.Get(name), want)
+			}
+		}
+	}
+}
+
+func TestProxyStoresAttacks(t *testing.T) {
+	setupTest(t)
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+
+	now := time.Now()
+	attacks := generateAttacks(1, 20, now)
+	for _, attack := range attacks {
+		body := attackJSON(t, attack)
+		resp, got := doRequest(t, http.MethodPost, proxyURL+"/add_attack", nil, body)
+		if resp.StatusCode != http.StatusOK || string(got) != `{"status":"success"}` {
+			t.Fatalf("got %d %s, want the response of the collector", resp.StatusCode, got)
+		}
+
+		requests := collector.Requests()
+		if forwarded := requests[len(requests)-1].Body; !bytes.Equal(forwarded, body) {
+			t.Fatalf("collector received %s, want %s", forwarded, body)
+		}
+	}
+	flushIngestQueue()
+
+	if count := countRequests(collector.Requests(), "/add_attack"); count != len(attacks) {
+		t.Errorf("collector received %d attacks, want %d", count, len(attacks))
+	}
+	assertStoredAttacks(t, attacks)
+}
+
+func TestProxyDoNotSubmitAttacks(t *testing.T) {
+	setupTest(t)
+	appConfig.DoNotSubmitAttacks = true
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+
+	attacks := generateAttacks(2, 5, time.Now())
+	for _, attack := range attacks {
+		resp, got := doRequest(t, http.MethodPost, proxyURL+"/add_attack", nil, attackJSON(t, attack))
+		if resp.StatusCode != http.StatusOK || string(got) != `{"status":"success"}` {
+			t.Fatalf("got %d %s, want the mockup response", resp.StatusCode, got)
+		}
+	}
+	resp, _ := doRequest(t, http.MethodGet, proxyURL+"/check_ip", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/check_ip got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	flushIngestQueue()
+
+	requests := collector.Requests()
+	if count := countRequests(requests, "/add_attack"); count != 0 {
+		t.Errorf("collector received %d attacks, want none", count)
+	}
+	if count := countRequests(requests, "/check_ip"); count != 1 {
+		t.Errorf("collector received %d /check_ip requests, want 1", count)
+	}
+	assertStoredAttacks(t, attacks)
+}
+
+func TestProxyDuplicateAttacks(t *testing.T) {
+	setupTest(t)
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+
+	attacks := generateAttacks(3, 1, time.Now())
+	body := attackJSON(t, attacks[0])
+	for i := 0; i < 3; i++ {
+		doRequest(t, http.MethodPost, proxyURL+"/add_attack", nil, body)
+	}
+	flushIngestQueue()
+
+	if count := countRequests(collector.Requests(), "/add_attack"); count != 3 {
+		t.Errorf("collector received %d attacks, want every duplicate forwarded", count)
+	}
+	assertStoredAttacks(t, attacks)
+}
+
+func TestProxyKeepsInvalidAttacksAsDeadLetters(t *testing.T) {
+	setupTest(t)
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+
+	body := []byte(`{"source_ip": "198.51.100.7", "username": `)
+	header := http.Header{"Authorization": {"Bearer pod-secret"}, "User-Agent": {"attackpod/1.0"}}
+	resp, _ := doRequest(t, http.MethodPost, proxyURL+"/add_attack", header, body)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want the status of the collector", resp.StatusCode)
+	}
+	flushIngestQueue()
+
+	compareRows(t, queryRows(t, `SELECT "method", "path", "body" FROM "_dead_letters"`),
+		[][]string{{http.MethodPost, "/add_attack", string(body)}})
+	compareRows(t, queryRows(t, `SELECT COUNT(*) FROM "attacks"`), [][]string{{"0"}})
+
+	// The token of the pod is not kept.
+	letter, err := loadDeadLetter(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if letter.Headers.Get("Authorization") != redacted || letter.Headers.Get("User-Agent") != "attackpod/1.0" {
+		t.Errorf("got headers %v, want the authorization redacted", letter.Headers)
+	}
+	if rows := queryRows(t, `SELECT "headers" FROM "_dead_letters"`); strings.Contains(rows[0][0], "pod-secret") {
+		t.Errorf("the stored headers contain the token: %s", rows[0][0])
+	}
+}
+
+func TestDeadLettersListDoesNotMigrate(t *testing.T) {
+	setupTest(t)
+	req := httptest.NewRequest(http.MethodPost, "/add_attack", nil)
+	if err := saveDeadLetter(req, []byte(`{"source_ip": `), errors.New("unexpected end of JSON input")); err != nil {
+		t.Fatal(err)
+	}
+
+	assertDoesNotMigrate(t, "dead-letters list", func() error { return runDeadLettersCommand([]string{"list", "-all"}) })
+	assertDoesNotMigrate(t, "dead-letters show", func() error { return runDeadLettersCommand([]string{"show", "1"}) })
+}
+
+func TestProxyCollectorUnavailable(t *testing.T) {
+	setupTest(t)
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+	collector.Close()
+
+	attacks := generateAttacks(4, 1, time.Now())
+	resp, _ := doRequest(t, http.MethodPost, proxyURL+"/add_attack", nil, attackJSON(t, attacks[0]))
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+	flushIngestQueue()
+
+	// The attack is stored even though it could not be forwarded.
+	assertStoredAttacks(t, attacks)
+}
+
+func TestProxyOfflineCollector(t *testing.T) {
+	setupTest(t)
+	appConfig.OfflineCollector = true
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+
+	attacks := generateAttacks(5, 1, time.Now())
+	resp, got := doRequest(t, http.MethodPost, proxyURL+"/add_attack", nil, attackJSON(t, attacks[0]))
+	if resp.StatusCode != http.StatusOK || string(got) != `{"status":"success"}` {
+		t.Errorf("/add_attack got %d %s, want the mockup response", resp.StatusCode, got)
+	}
+	resp, got = doRequest(t, http.MethodGet, proxyURL+"/check_ip", nil, nil)
+	var checkIP struct {
+		Status string `json:"status"`
+		IP     string `json:"ip"`
+	}
+	if err := json.Unmarshal(got, &checkIP); err != nil || resp.StatusCode != http.StatusOK || checkIP.IP != "127.0.0.1" {
+		t.Errorf("/check_ip got %d %s, want the IP of the client", resp.StatusCode, got)
+	}
+	resp, _ = doRequest(t, http.MethodGet, proxyURL+"/unknown", nil, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/unknown got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	flushIngestQueue()
+
+	if requests := collector.Requests(); len(requests) != 0 {
+		t.Errorf("collector received %d requests, want none", len(requests))
+	}
+	assertStoredAttacks(t, attacks)
+}
+
+// assertStoredAttacks checks that exactly the attacks are stored.
+func assertStoredAttacks(t *testing.T, attacks []*Attack) {
+	t.Helper()
+
+	stored, err := storedAttacks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, attack := range attacks {
+		key := attackKey(attack.AttackTimestamp.ToTime().UnixMilli(), attack.SourceIP, attack.DestinationIP,
+			attack.Username, attack.Password, attack.AttackType, attack.Evidence)
+		if !stored[key] {
+			t.Errorf("attack %s is not stored", key)
+		}
+	}
+	if len(stored) != len(attacks) {
+		t.Errorf("%d attacks are stored, want %d", len(stored), len(attacks))
+	}
+}
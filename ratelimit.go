@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	metricRequests = newCounter("netwatch_proxy_requests_total",
+		"Requests received by the proxy.", "endpoint")
+	metricRejectedRequests = newCounter("netwatch_proxy_rejected_requests_total",
+		"Requests rejected by the proxy before forwarding.", "endpoint", "reason")
+)
+
+// Reasons for rejected requests.
+const (
+	rejectReasonForbidden    = "forbidden"
+	rejectReasonRateLimited  = "rate_limited"
+	rejectReasonBodyTooLarge = "body_too_large"
+)
+
+// endpointLabel maps the request path to a metric label without unbounded cardinality.
+func endpointLabel(path string) string {
+	switch KnownEndpoints(path) {
+	case EndpointCheckIP, EndpointAddAttack:
+		return path
+	}
+	return "other"
+}
+
+// parseCIDRs parses a comma separated list of CIDRs or single IP addresses.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", part)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", part, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// clientAllowed reports whether the client IP is inside one of the allowed networks.
+// An empty list allows every client.
+func clientAllowed(networks []*net.IPNet, ip string) bool {
+	if len(networks) == 0 {
+		return true
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+type clientBucket struct {
+	bucket   *tokenBucket
+	lastSeen time.Time
+	// rejected counts the rejections since the last log line for this client.
+	rejected int
+	lastLog  time.Time
+}
+
+// ClientRateLimiter keeps a token bucket per client IP.
+type ClientRateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*clientBucket
+}
+
+var clientRateLimiter *ClientRateLimiter
+
+func newClientRateLimiter(rate float64, burst int) *ClientRateLimiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &ClientRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clients: make(map[string]*clientBucket),
+	}
+}
+
+// Allow reports whether the client may send another request.
+// The second return value is true if the rejection should be logged,
+// so that a flooding client does not flood the log as well.
+func (l *ClientRateLimiter) Allow(ip string) (allowed bool, logRejection bool, rejected int) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientBucket{bucket: newTokenBucket(l.rate, l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+
+	if client.bucket.allowAt(now) {
+		return true, false, 0
+	}
+
+	client.rejected++
+	if now.Sub(client.lastLog) < time.Minute {
+		return false, false, client.rejected
+	}
+
+	rejected = client.rejected
+	client.rejected = 0
+	client.lastLog = now
+	return false, true, rejected
+}
+
+// RetryAfter returns the number of seconds until the next token is available.
+func (l *ClientRateLimiter) RetryAfter() int {
+	return int(math.Max(1, math.Ceil(1/l.rate)))
+}
+
+// cleanup forgets clients that have been idle for a while.
+func (l *ClientRateLimiter) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		l.mu.Lock()
+		for ip, client := range l.clients {
+			if now.Sub(client.lastSeen) > 10*time.Minute {
+				delete(l.clients, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// admitRequest applies the client allowlist and the rate limit.
+// It writes the error response and returns false if the request is rejected.
+func admitRequest(w http.ResponseWriter, r *http.Request) bool {
+	endpoint := endpointLabel(r.URL.Path)
+	ip := clientIP(r)
+	metricRequests.Inc(endpoint)
+
+	if r.Method == http.MethodPost && r.URL.Path == string(EndpointAddAttack) &&
+		!clientAllowed(appConfig.AllowedClients, ip) {
+		metricRejectedRequests.Inc(endpoint, rejectReasonForbidden)
+		log.Printf("[WARN] Rejected %s %s from %s: client is not allowed to submit attacks.\n", r.Method, r.URL.Path, ip)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	if clientRateLimiter != nil {
+		allowed, logRejection, rejected := clientRateLimiter.Allow(ip)
+		if !allowed {
+			metricRejectedRequests.Inc(endpoint, rejectReasonRateLimited)
+			if logRejection {
+				log.Printf("[WARN] Rejected %d request(s) from %s: rate limit exceeded.\n", rejected, ip)
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(clientRateLimiter.RetryAfter()))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return false
+		}
+	}
+
+	return true
+}
+
+// isBodyTooLarge reports whether the error was caused by http.MaxBytesReader.
+func isBodyTooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
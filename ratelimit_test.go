@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientAllowed(t *testing.T) {
+	networks, err := parseCIDRs(" 198.51.100.0/24, 203.0.113.7,2001:db8::/32,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"198.51.100.1", true},
+		{"198.51.101.1", false},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"::ffff:203.0.113.7", true},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"not an ip", false},
+	}
+	for _, test := range tests {
+		if got := clientAllowed(networks, test.ip); got != test.want {
+			t.Errorf("clientAllowed(%q) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+	if !clientAllowed(nil, "198.51.101.1") {
+		t.Error("an empty allowlist rejected a client")
+	}
+
+	for _, invalid := range []string{"198.51.100.0/33", "198.51.100", "example.com"} {
+		if _, err := parseCIDRs(invalid); err == nil {
+			t.Errorf("parseCIDRs(%q): got no error", invalid)
+		}
+	}
+}
+
+func TestProxyRejectsDisallowedClients(t *testing.T) {
+	setupTest(t)
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+
+	networks, err := parseCIDRs("198.51.100.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig.AllowedClients = networks
+
+	attack := generateAttacks(1, 1, time.Now())[0]
+	resp, _ := doRequest(t, http.MethodPost, proxyURL+"/add_attack", nil, attackJSON(t, attack))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d, want 403", resp.StatusCode)
+	}
+	// The allowlist is about submitting attacks, other requests are forwarded.
+	if resp, _ := doRequest(t, http.MethodGet, proxyURL+"/check_ip", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d for /check_ip, want 200", resp.StatusCode)
+	}
+	requests := collector.Requests()
+	if countRequests(requests, "/add_attack") != 0 || countRequests(requests, "/check_ip") != 1 {
+		t.Errorf("got %+v at the collector, want only /check_ip", requests)
+	}
+	flushIngestQueue()
+	if saved := countAttacks(t, db); saved != 0 {
+		t.Errorf("got %d saved attacks, want none", saved)
+	}
+
+	// The test client connects from loopback.
+	networks, err = parseCIDRs("198.51.100.0/24,127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig.AllowedClients = networks
+	if resp, _ := doRequest(t, http.MethodPost, proxyURL+"/add_attack", nil, attackJSON(t, attack)); resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d for an allowed client, want 200", resp.StatusCode)
+	}
+	flushIngestQueue()
+	assertStoredAttacks(t, []*Attack{attack})
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	setupTest(t)
+	if appConfig.RateLimit != 0 {
+		t.Errorf("got a default rate limit of %v, want it disabled", appConfig.RateLimit)
+	}
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+	clientRateLimiter = newClientRateLimiter(0.5, 3)
+	t.Cleanup(func() { clientRateLimiter = nil })
+
+	// The burst is forwarded, then the client has to wait for the next token.
+	for i := range 3 {
+		if resp, _ := doRequest(t, http.MethodGet, proxyURL+"/check_ip", nil, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d of the burst: got status %d, want 200", i+1, resp.StatusCode)
+		}
+	}
+	resp, _ := doRequest(t, http.MethodGet, proxyURL+"/check_ip", nil, nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" {
+		t.Errorf("got status %d with Retry-After %q, want 429 with Retry-After 2", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if got := len(collector.Requests()); got != 3 {
+		t.Errorf("got %d requests at the collector, want 3", got)
+	}
+
+	// Other clients have their own bucket.
+	if allowed, _, _ := clientRateLimiter.Allow("198.51.100.1"); !allowed {
+		t.Error("another client was rate limited")
+	}
+}
+
+func TestClientRateLimiterLogsRejectionsOnce(t *testing.T) {
+	limiter := newClientRateLimiter(0.001, 1)
+	if allowed, _, _ := limiter.Allow("198.51.100.1"); !allowed {
+		t.Fatal("the first request was not allowed")
+	}
+
+	// The first rejection is logged, the following ones are counted for the next log line a minute later.
+	if allowed, logRejection, rejected := limiter.Allow("198.51.100.1"); allowed || !logRejection || rejected != 1 {
+		t.Errorf("got %v, %v, %d, want the first rejection logged", allowed, logRejection, rejected)
+	}
+	for range 3 {
+		if allowed, logRejection, _ := limiter.Allow("198.51.100.1"); allowed || logRejection {
+			t.Errorf("got %v, %v, want a silent rejection", allowed, logRejection)
+		}
+	}
+	limiter.clients["198.51.100.1"].lastLog = time.Now().Add(-time.Minute)
+	if allowed, logRejection, rejected := limiter.Allow("198.51.100.1"); allowed || !logRejection || rejected != 4 {
+		t.Errorf("got %v, %v, %d, want the 4 rejections since the last line logged", allowed, logRejection, rejected)
+	}
+
+	if limiter := newClientRateLimiter(2.5, 0); limiter.burst != 3 || limiter.RetryAfter() != 1 {
+		t.Errorf("got burst %v and Retry-After %d, want 3 and 1", limiter.burst, limiter.RetryAfter())
+	}
+}
+
+func TestProxyRejectsLargeBodies(t *testing.T) {
+	setupTest(t)
+	collector := newFakeCollector(t)
+	proxyURL := startProxy(t, collector)
+	appConfig.MaxBodyBytes = 1024
+
+	attacks := generateAttacks(1, 3, time.Now())
+	attacks[0].Evidence = strings.Repeat("x", 2048)
+	attacks[1].Evidence = strings.Repeat("y", 2048)
+
+	// A declared length above the limit is rejected before anything is forwarded.
+	resp, _ := doRequest(t, http.MethodPost, proxyURL+"/add_attack", nil, attackJSON(t, attacks[0]))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want 413", resp.StatusCode)
+	}
+	if got := len(collector.Requests()); got != 0 {
+		t.Errorf("got %d requests at the collector, want none", got)
+	}
+
+	// Without a declared length the body is cut off at the limit.
+	req, err := http.NewRequest(http.MethodPost, proxyURL+"/add_attack", io.MultiReader(bytes.NewReader(attackJSON(t, attacks[1]))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunked, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunked.Body.Close()
+	if chunked.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d for a chunked body, want 413", chunked.StatusCode)
+	}
+
+	if resp, _ := doRequest(t, http.MethodPost, proxyURL+"/add_attack", nil, attackJSON(t, attacks[2])); resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d within the limit, want 200", resp.StatusCode)
+	}
+	flushIngestQueue()
+	if saved := countAttacks(t, db); saved != 1 {
+		t.Errorf("got %d saved attacks, want only the one within the limit", saved)
+	}
+	assertStoredAttacks(t, attacks[2:])
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// RedactionPolicy decides which credentials the proxy hands out, the stored credentials are never changed.
+// It applies to the credential export, the reports, the digests, the wordlist families and the notifications.
+type RedactionPolicy string
+
+const (
+	// RedactNone hands out usernames and passwords.
+	RedactNone RedactionPolicy = "none"
+	// RedactPasswords withholds passwords, only usernames are handed out.
+	RedactPasswords RedactionPolicy = "passwords"
+	// RedactAll withholds usernames and passwords.
+	RedactAll RedactionPolicy = "all"
+)
+
+func parseRedactionPolicy(s string) (RedactionPolicy, error) {
+	switch policy := RedactionPolicy(s); policy {
+	case RedactNone, RedactPasswords, RedactAll:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown redaction policy %q, expected none, passwords or all", s)
+}
+
+// ErrRedacted is returned for an export the redaction policy does not allow.
+var ErrRedacted = errors.New("withheld by the redaction policy")
+
+// redacted replaces a withheld value.
+const redacted = "[redacted]"
+
+// withholdsPasswords reports whether passwords are withheld.
+func (p RedactionPolicy) withholdsPasswords() bool {
+	return p == RedactPasswords || p == RedactAll
+}
+
+// withholdsUsernames reports whether usernames are withheld.
+func (p RedactionPolicy) withholdsUsernames() bool {
+	return p == RedactAll
+}
+
+// password returns the password, or the placeholder if passwords are withheld.
+func (p RedactionPolicy) password(value string) string {
+	if p.withholdsPasswords() {
+		return redacted
+	}
+	return value
+}
+
+// username returns the username, or the placeholder if usernames are withheld.
+func (p RedactionPolicy) username(value string) string {
+	if p.withholdsUsernames() {
+		return redacted
+	}
+	return value
+}
+
+// withholds reports whether the column holds credentials the policy withholds.
+// The quarantine and the dead letters keep the attacks as the pods sent them, passwords included.
+func (p RedactionPolicy) withholds(table, column string) bool {
+	switch table {
+	case "_dict_passwords":
+		return column == "value" && p.withholdsPasswords()
+	case "_dict_usernames":
+		return column == "value" && p.withholdsUsernames()
+	case "_quarantine":
+		return column == "data" && p.withholdsPasswords()
+	case "_dead_letters":
+		return (column == "body" || column == "headers") && p.withholdsPasswords()
+	}
+	return false
+}
+
+// redactedConn returns a connection on which the columns the policy withholds read as NULL.
+// SQLite asks the authorizer for every column a statement reads, also through views, so no query can get around it.
+// Closing the connection removes the authorizer before the connection goes back to the pool.
+func redactedConn(ctx context.Context, db *sql.DB, policy RedactionPolicy) (*redactionConn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get connection: %w", err)
+	}
+
+	err = conn.Raw(func(driverConn any) error {
+		sqliteConn, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected database driver %T", driverConn)
+		}
+		sqliteConn.RegisterAuthorizer(func(action int, table, column, _ string) int {
+			if action == sqlite3.SQLITE_READ && policy.withholds(table, column) {
+				return sqlite3.SQLITE_IGNORE
+			}
+			return sqlite3.SQLITE_OK
+		})
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &redactionConn{conn}, nil
+}
+
+// redactionConn is a connection with the authorizer of a redaction policy.
+type redactionConn struct {
+	*sql.Conn
+}
+
+func (c *redactionConn) Close() error {
+	c.Raw(func(driverConn any) error {
+		driverConn.(*sqlite3.SQLiteConn).RegisterAuthorizer(nil)
+		return nil
+	})
+	return c.Conn.Close()
+}
+
+// requireAdminToken lets the request through if it carries the admin token as a bearer token.
+// Without a configured token the endpoint is disabled, it shares the listener with the pods.
+func requireAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	if appConfig.AdminToken == "" {
+		http.Error(w, "Forbidden: set NETWATCH_PROXY_ADMIN_TOKEN to enable this endpoint", http.StatusForbidden)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(appConfig.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ssh_attackpod_proxy"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
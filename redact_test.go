@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRedactionDefaultsToPasswords(t *testing.T) {
+	t.Setenv("NETWATCH_PROXY_REDACTION", "")
+	os.Unsetenv("NETWATCH_PROXY_REDACTION")
+	if got := loadConfig().Redaction; got != RedactPasswords {
+		t.Errorf("got redaction %q, want passwords", got)
+	}
+}
+
+func TestReportRedaction(t *testing.T) {
+	setupTest(t)
+	saveCredentialCorpus(t, time.Now())
+
+	reports := []*Report{
+		{Name: "passwords", SQL: `SELECT "value" FROM "_dict_passwords" WHERE "value" = '123456'`},
+		{Name: "attacks", SQL: `SELECT "username", "password" FROM "attacks" WHERE "password" = '123456' LIMIT 1`},
+		{Name: "fingerprints", SQL: `SELECT "username", "password" FROM "view_credential_fingerprints" WHERE "username" = 'admin'`},
+	}
+	tests := []struct {
+		policy RedactionPolicy
+		want   [][]any
+	}{
+		{RedactNone, [][]any{{"123456"}, {"root", "123456"}, {"admin", "admin"}}},
+		// Withheld values read as NULL, also in the conditions, so nothing can be matched against them.
+		{RedactPasswords, [][]any{nil, nil, {"admin", nil}}},
+		{RedactAll, [][]any{nil, nil, nil}},
+	}
+	for _, test := range tests {
+		appConfig.Redaction = test.policy
+		for i, report := range reports {
+			result, err := runReport(db, report, nil, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []any
+			if len(result.Rows) > 0 {
+				got = result.Rows[0]
+			}
+			if len(got) != len(test.want[i]) || (len(got) > 0 && fmt.Sprint(got) != fmt.Sprint(test.want[i])) {
+				t.Errorf("%s with %s: got %v, want %v", report.Name, test.policy, got, test.want[i])
+			}
+		}
+	}
+
+	// The connection goes back to the pool without the authorizer.
+	var password string
+	if err := db.QueryRow(`SELECT "value" FROM "_dict_passwords" WHERE "value" = '123456'`).Scan(&password); err != nil {
+		t.Errorf("got %v, want the password readable outside of reports", err)
+	}
+}
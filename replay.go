@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:        "replay",
+		Usage:       "replay [-db PATH] [-speed N] CAPTURE...",
+		Description: "Replay captured traffic through a proxy with a stub upstream and diff the responses and stored attacks.",
+		Run:         runReplayCommand,
+	})
+}
+
+// loadCapture reads the records of the capture files, ordered by time.
+func loadCapture(paths []string) ([]*CaptureRecord, error) {
+	var records []*CaptureRecord
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not open capture file: %w", err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			var record CaptureRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("invalid record in %s, line %d: %w", path, line, err)
+			}
+			records = append(records, &record)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read capture file %s: %w", path, err)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
+
+// stubUpstream answers forwarded requests with the recorded responses, in the recorded order.
+type stubUpstream struct {
+	mu        sync.Mutex
+	responses map[string][]*CaptureRecord
+	last      map[string]*CaptureRecord
+}
+
+func newStubUpstream(records []*CaptureRecord) *stubUpstream {
+	stub := &stubUpstream{
+		responses: make(map[string][]*CaptureRecord),
+		last:      make(map[string]*CaptureRecord),
+	}
+	for _, record := range records {
+		key := record.Method + " " + record.URI
+		stub.responses[key] = append(stub.responses[key], record)
+	}
+	return stub
+}
+
+func (s *stubUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+
+	key := r.Method + " " + r.URL.RequestURI()
+	s.mu.Lock()
+	record := s.last[key]
+	if queue := s.responses[key]; len(queue) > 0 {
+		record = queue[0]
+		s.responses[key] = queue[1:]
+		s.last[key] = record
+	}
+	s.mu.Unlock()
+
+	if record == nil {
+		http.Error(w, "no recorded response for "+key, http.StatusBadGateway)
+		return
+	}
+
+	for key, values := range record.ResponseHeader {
+		if key == "Content-Length" {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(record.StatusCode)
+	w.Write(record.ResponseBody)
+}
+
+// serveLocal serves the handler on a random local port and returns its base URL.
+func serveLocal(handler http.Handler) (*url.URL, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+
+	return &url.URL{Scheme: "http", Host: listener.Addr().String()}, func() { server.Close() }, nil
+}
+
+// equalBodies compares two bodies, JSON bodies by their compacted form.
+// A truncated recorded body only has to be a prefix of the actual body.
+func equalBodies(recorded, actual []byte, truncated bool) bool {
+	if truncated {
+		return bytes.HasPrefix(actual, recorded)
+	}
+
+	var recordedJSON, actualJSON bytes.Buffer
+	if json.Compact(&recordedJSON, recorded) == nil && json.Compact(&actualJSON, actual) == nil {
+		return bytes.Equal(recordedJSON.Bytes(), actualJSON.Bytes())
+	}
+	return bytes.Equal(recorded, actual)
+}
+
+func attackKey(timestamp int64, sourceIP, destinationIP, username, password, attackType, evidence string) string {
+	return fmt.Sprintf("%s %s -> %s %q:%q %s %q", time.UnixMilli(timestamp).UTC().Format(time.RFC3339Nano),
+		sourceIP, destinationIP, username, password, attackType, evidence)
+}
+
+// expectedAttacks returns the attacks that the proxy should have stored for the recorded /add_attack requests.
+func expectedAttacks(records []*CaptureRecord) map[string]bool {
+	expected := make(map[string]bool)
+	for _, record := range records {
+		if record.Method != http.MethodPost || record.URI != string(EndpointAddAttack) || record.RequestBodyTruncated {
+			continue
+		}
+
+		var attack Attack
+		if err := json.Unmarshal(record.RequestBody, &attack); err != nil || attack.TestMode {
+			continue
+		}
+		if err := normalizeAttack(&attack, time.Now()); err != nil {
+			continue
+		}
+		expected[attackKey(attack.AttackTimestamp.ToTime().UnixMilli(), attack.SourceIP, attack.DestinationIP,
+			attack.Username, attack.Password, attack.AttackType, attack.Evidence)] = true
+	}
+	return expected
+}
+
+func storedAttacks() (map[string]bool, error) {
+	rows, err := db.Query(`SELECT "timestamp", "source_ip", "destination_ip", "username", "password", "attack_type", "evidence" FROM "attacks"`)
+	if err != nil {
+		return nil, fmt.Errorf("could not query attacks: %w", err)
+	}
+	defer rows.Close()
+
+	stored := make(map[string]bool)
+	for rows.Next() {
+		var timestamp int64
+		var sourceIP, destinationIP, username, password, attackType, evidence string
+		if err := rows.Scan(&timestamp, &sourceIP, &destinationIP, &username, &password, &attackType, &evidence); err != nil {
+			return nil, fmt.Errorf("could not scan attack: %w", err)
+		}
+		stored[attackKey(timestamp, sourceIP, destinationIP, username, password, attackType, evidence)] = true
+	}
+	return stored, rows.Err()
+}
+
+// replayRecord sends the recorded request to the proxy and returns the differences to the recorded response.
+func replayRecord(client *http.Client, proxyURL *url.URL, record *CaptureRecord) ([]string, error) {
+	request, err := http.NewRequest(record.Method, proxyURL.String()+record.URI, bytes.NewReader(record.RequestBody))
+	if err != nil {
+		return nil, err
+	}
+	request.Header = record.RequestHeader.Clone()
+	removeHopByHopHeaders(request.Header)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+	if response.StatusCode != record.StatusCode {
+		diffs = append(diffs, fmt.Sprintf("status %d, recorded %d", response.StatusCode, record.StatusCode))
+	}
+	if !equalBodies(record.ResponseBody, body, record.ResponseBodyTruncated) {
+		diffs = append(diffs, fmt.Sprintf("body %s, recorded %s", logSafe(truncateText(string(body), 200)),
+			logSafe(truncateText(string(record.ResponseBody), 200))))
+	}
+	return diffs, nil
+}
+
+func runReplayCommand(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	dbPath := flags.String("db", "", "empty database the replayed attacks are stored in, a temporary database by default")
+	speed := flags.Float64("speed", 0, "replay with the recorded timing, divided by this factor; 0 replays as fast as possible")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: replay [-db PATH] [-speed N] CAPTURE...")
+	}
+	records, err := loadCapture(flags.Args())
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("the capture contains no records")
+	}
+
+	if *dbPath == "" {
+		dir, err := os.MkdirTemp("", "netwatch-replay-")
+		if err != nil {
+			return fmt.Errorf("could not create temporary directory: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		*dbPath = filepath.Join(dir, "attacks.db")
+	}
+
+	upstreamURL, closeUpstream, err := serveLocal(newStubUpstream(records))
+	if err != nil {
+		return fmt.Errorf("could not start stub upstream: %w", err)
+	}
+	defer closeUpstream()
+
+	// The replay always forwards to the stub. Captures are historic and replayed from localhost,
+	// so timestamp checks and the client allowlist do not apply.
+	appConfig.Collector.URL = upstreamURL
+	appConfig.OfflineCollector = false
+	appConfig.DoNotSubmitAttacks = false
+	appConfig.AllowedClients = nil
+	appConfig.MaxTimestampSkew = 0
+	appConfig.MaxAttackAge = 0
+	appConfig.LogRequests = false
+	appConfig.DebugLog = false
+
+	initDB(*dbPath)
+	defer closeDB()
+	ingestQueue = newIngestQueue(appConfig.IngestQueueSize, appConfig.IngestWorkers, OverflowBlock, "")
+
+	proxyURL, closeProxy, err := serveLocal(http.HandlerFunc(handleProxyRequest))
+	if err != nil {
+		ingestQueue.Close()
+		return fmt.Errorf("could not start proxy: %w", err)
+	}
+	defer closeProxy()
+
+	client := &http.Client{
+		Timeout: appConfig.UpstreamTimeout + 10*time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start := time.Now()
+	differences := 0
+	for i, record := range records {
+		if *speed > 0 {
+			offset := time.Duration(float64(record.Time.Sub(records[0].Time)) / *speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+
+		diffs, err := replayRecord(client, proxyURL, record)
+		if err != nil {
+			diffs = []string{err.Error()}
+		}
+		for _, diff := range diffs {
+			fmt.Printf("#%d %s %s: %s\n", i+1, record.Method, logSafe(record.URI), diff)
+		}
+		if len(diffs) > 0 {
+			differences++
+		}
+	}
+
+	// Wait until every replayed attack is saved.
+	ingestQueue.Close()
+
+	stored, err := storedAttacks()
+	if err != nil {
+		return err
+	}
+	expected := expectedAttacks(records)
+
+	var missing, unexpected []string
+	for key := range expected {
+		if !stored[key] {
+			missing = append(missing, key)
+		}
+	}
+	for key := range stored {
+		if !expected[key] {
+			unexpected = append(unexpected, key)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+	for _, key := range missing {
+		fmt.Printf("- missing attack %s\n", logSafe(key))
+	}
+	for _, key := range unexpected {
+		fmt.Printf("+ unexpected attack %s\n", logSafe(key))
+	}
+
+	fmt.Printf("Replayed %d requests: %d responses differ, %d of %d attacks missing, %d unexpected.\n",
+		len(records), differences, len(missing), len(expected), len(unexpected))
+	if differences > 0 || len(missing) > 0 || len(unexpected) > 0 {
+		return errors.New("the replay differs from the capture")
+	}
+	return nil
+}
@@ -0,0 +1,686 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:        "stats",
+		Usage:       "stats [REPORT [NAME=VALUE...]]",
+		Description: "Print every built-in and user-defined report, or one report with the given parameters.",
+		Run:         runStatsCommand,
+	})
+}
+
+// User-defined reports are read from the reports directory, one report per file, named after the file.
+//
+// A .sql file holds a single SELECT. The comments before it describe the report and declare its parameters:
+//
+//	-- Top usernames of a source.
+//	-- @param window duration 7d How far back to look.
+//	-- @param limit int 20
+//	-- @param source string "198.51.100.1"
+//	SELECT "username", COUNT(*) AS "count" FROM "attacks"
+//	WHERE "source_ip" = :source AND "timestamp" >= :window
+//	GROUP BY "username" ORDER BY "count" DESC LIMIT :limit
+//
+// A .yaml or .yml file holds the same as a mapping with description, params and sql:
+//
+//	description: Top usernames of a source.
+//	params:
+//	  - name: window
+//	    type: duration
+//	    default: 7d
+//	    description: How far back to look.
+//	  - name: limit
+//	    type: int
+//	    default: 20
+//	  - name: source
+//	    type: string
+//	    default: "198.51.100.1"
+//	sql: |
+//	  SELECT "username", COUNT(*) AS "count" FROM "attacks"
+//	  WHERE "source_ip" = :source AND "timestamp" >= :window
+//	  GROUP BY "username" ORDER BY "count" DESC LIMIT :limit
+//
+// Only the block style of YAML is supported, see parseYAML.
+// A .json file holds the same as an object with "description", "params" and "sql".
+// The parameters are bound by name, a duration is bound as the Unix time in milliseconds the duration before now.
+// A report file is parsed and validated again only when its modification time or size changes.
+
+// ReportParamType is the type of a report parameter.
+type ReportParamType string
+
+const (
+	ReportParamDuration ReportParamType = "duration"
+	ReportParamInt      ReportParamType = "int"
+	ReportParamString   ReportParamType = "string"
+)
+
+// ReportParam is a named parameter of a report. Every parameter has a default, so every report can run without arguments.
+type ReportParam struct {
+	Name        string          `json:"name"`
+	Type        ReportParamType `json:"type"`
+	Default     string          `json:"default"`
+	Description string          `json:"description,omitempty"`
+}
+
+// Report is a query whose result can be fetched from the API and printed by the stats command.
+type Report struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Params      []ReportParam `json:"params"`
+	SQL         string        `json:"sql"`
+	// Builtin reports are the report views created by the migrations.
+	Builtin bool `json:"builtin"`
+}
+
+// ReportResult is the result of running a report.
+type ReportResult struct {
+	Report  string            `json:"report"`
+	Params  map[string]string `json:"params"`
+	Columns []string          `json:"columns"`
+	Rows    [][]any           `json:"rows"`
+}
+
+// ErrReportParam is returned for parameters a report does not have and values that do not fit their type.
+var ErrReportParam = errors.New("invalid report parameter")
+
+// reportTimeout limits how long a single report may run.
+const reportTimeout = 30 * time.Second
+
+var (
+	reportNamePattern  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	reportParamPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// parseReportDuration parses a Go duration or a number of days like 7d.
+func parseReportDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("%q is not a duration like 24h or 7d", s)
+	}
+	return duration, nil
+}
+
+// bind converts the value of the parameter into the value the query gets.
+func (p ReportParam) bind(value string, now time.Time) (any, error) {
+	switch p.Type {
+	case ReportParamDuration:
+		duration, err := parseReportDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", p.Name, err)
+		}
+		return now.Add(-duration).UnixMilli(), nil
+	case ReportParamInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s: %q is not an integer", p.Name, value)
+		}
+		return n, nil
+	case ReportParamString:
+		return value, nil
+	}
+	return nil, fmt.Errorf("parameter %s has the unknown type %q, expected duration, int or string", p.Name, p.Type)
+}
+
+// checkReadOnlySQL checks that the query is a single SELECT statement, optionally with a WITH clause.
+// Strings, quoted identifiers and comments are skipped, so a semicolon in them does not count as a second statement.
+func checkReadOnlySQL(query string) error {
+	var keyword strings.Builder
+	keywordDone := false
+	ended := false
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return fmt.Errorf("the query has an unterminated comment")
+			}
+			i += end + 3
+			continue
+		case unicode.IsSpace(rune(c)):
+			if keyword.Len() > 0 {
+				keywordDone = true
+			}
+			continue
+		}
+
+		if ended {
+			return fmt.Errorf("the query has more than one statement")
+		}
+		if c == ';' {
+			ended = true
+			continue
+		}
+		if !keywordDone {
+			if unicode.IsLetter(rune(c)) {
+				keyword.WriteByte(c)
+				continue
+			}
+			keywordDone = true
+		}
+
+		if closing, ok := map[byte]byte{'\'': '\'', '"': '"', '`': '`', '[': ']'}[c]; ok {
+			end := strings.IndexByte(query[i+1:], closing)
+			if end < 0 {
+				return fmt.Errorf("the query has an unterminated string or identifier")
+			}
+			i += end + 1
+		}
+	}
+
+	switch strings.ToUpper(keyword.String()) {
+	case "SELECT", "WITH":
+		return nil
+	case "":
+		return fmt.Errorf("the query is empty")
+	}
+	return fmt.Errorf("only SELECT statements are allowed, not %s", strings.ToUpper(keyword.String()))
+}
+
+// validateReport checks the parameters of the report and lets SQLite confirm that its query does not write.
+func validateReport(db *sql.DB, report *Report) error {
+	if !reportNamePattern.MatchString(report.Name) {
+		return fmt.Errorf("report name %q may only contain letters, digits, _ and -", report.Name)
+	}
+	if err := checkReadOnlySQL(report.SQL); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, param := range report.Params {
+		if !reportParamPattern.MatchString(param.Name) {
+			return fmt.Errorf("parameter name %q is not an identifier", param.Name)
+		}
+		if seen[param.Name] {
+			return fmt.Errorf("parameter %s is declared twice", param.Name)
+		}
+		seen[param.Name] = true
+		if _, err := param.bind(param.Default, time.Now()); err != nil {
+			return fmt.Errorf("default of %w", err)
+		}
+	}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return fmt.Errorf("could not get connection: %w", err)
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		sqliteConn, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected database driver %T", driverConn)
+		}
+		stmt, err := sqliteConn.Prepare(report.SQL)
+		if err != nil {
+			return fmt.Errorf("invalid query: %w", err)
+		}
+		defer stmt.Close()
+
+		if !stmt.(*sqlite3.SQLiteStmt).Readonly() {
+			return fmt.Errorf("the query writes to the database")
+		}
+		return nil
+	})
+}
+
+// parseSQLReport reads a report from a .sql file. The leading comments are its description and parameters.
+func parseSQLReport(name, data string) (*Report, error) {
+	report := &Report{Name: name, SQL: strings.TrimSpace(data)}
+
+	var description []string
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		comment, ok := strings.CutPrefix(line, "--")
+		if !ok {
+			break
+		}
+		comment = strings.TrimSpace(comment)
+
+		declaration, ok := strings.CutPrefix(comment, "@param")
+		if !ok {
+			description = append(description, comment)
+			continue
+		}
+		param, err := parseReportParam(declaration)
+		if err != nil {
+			return nil, err
+		}
+		report.Params = append(report.Params, param)
+	}
+	report.Description = strings.Join(description, " ")
+	return report, nil
+}
+
+// parseReportParam parses "NAME TYPE DEFAULT [DESCRIPTION]". A default with spaces or an empty default is quoted.
+func parseReportParam(declaration string) (ReportParam, error) {
+	fields := strings.Fields(declaration)
+	if len(fields) < 3 {
+		return ReportParam{}, fmt.Errorf("@param needs a name, a type and a default: %q", strings.TrimSpace(declaration))
+	}
+	param := ReportParam{Name: fields[0], Type: ReportParamType(fields[1])}
+
+	rest := strings.TrimSpace(declaration)
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, fields[0]))
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, fields[1]))
+	if strings.HasPrefix(rest, `"`) {
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return ReportParam{}, fmt.Errorf("default of parameter %s is not a valid quoted string", param.Name)
+		}
+		param.Default, _ = strconv.Unquote(quoted)
+		rest = rest[len(quoted):]
+	} else {
+		param.Default, rest, _ = strings.Cut(rest, " ")
+	}
+	param.Description = strings.TrimSpace(rest)
+	return param, nil
+}
+
+func parseJSONReport(name string, data []byte) (*Report, error) {
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("could not parse report: %w", err)
+	}
+	report.Name = name
+	report.Builtin = false
+	return &report, nil
+}
+
+// parseYAMLReport reads a report from a .yaml file. Its mapping has the fields of a .json report.
+func parseYAMLReport(name string, data []byte) (*Report, error) {
+	value, err := parseYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse report: %w", err)
+	}
+	if _, ok := value.(map[string]any); !ok {
+		return nil, fmt.Errorf("could not parse report: expected a mapping with description, params and sql")
+	}
+	converted, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse report: %w", err)
+	}
+	return parseJSONReport(name, converted)
+}
+
+// builtinReports are the report views of the migrations. Their windows and limits are fixed.
+func builtinReports(db *sql.DB) ([]*Report, error) {
+	rows, err := db.Query(`SELECT "name" FROM "sqlite_master" WHERE "type" = 'view' AND "name" LIKE 'report\_%' ESCAPE '\' ORDER BY "name"`)
+	if err != nil {
+		return nil, fmt.Errorf("could not list report views: %w", err)
+	}
+	defer rows.Close()
+
+	var reports []*Report
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("could not scan report view: %w", err)
+		}
+		reports = append(reports, &Report{
+			Name:        name,
+			Description: "Built-in report of the view " + name + ".",
+			Params:      []ReportParam{},
+			SQL:         fmt.Sprintf(`SELECT * FROM "%s"`, name),
+			Builtin:     true,
+		})
+	}
+	return reports, rows.Err()
+}
+
+// loadReports returns the built-in reports and the valid reports of the directory, sorted by name.
+// Reports that cannot be loaded are skipped and returned as errors, a missing directory has no reports.
+func loadReports(db *sql.DB, dir string) ([]*Report, []error) {
+	reports, err := builtinReports(db)
+	if err != nil {
+		return nil, []error{err}
+	}
+	names := make(map[string]bool)
+	for _, report := range reports {
+		names[report.Name] = true
+	}
+
+	var entries []os.DirEntry
+	if dir != "" {
+		entries, err = os.ReadDir(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return reports, []error{fmt.Errorf("could not list reports: %w", err)}
+		}
+	}
+
+	reportFilesMu.Lock()
+	defer reportFilesMu.Unlock()
+
+	var errs []error
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".sql" && ext != ".json" && ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ext)
+		path := filepath.Join(dir, entry.Name())
+		seen[path] = true
+
+		report, err := loadReportFile(db, path, name, ext)
+		if err == nil && names[name] {
+			err = fmt.Errorf("a report named %s already exists", name)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", entry.Name(), err))
+			continue
+		}
+		names[name] = true
+		reports = append(reports, report)
+	}
+	for path := range reportFiles {
+		if filepath.Dir(path) == filepath.Clean(dir) && !seen[path] {
+			delete(reportFiles, path)
+		}
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	return reports, errs
+}
+
+// reportFile is a report file as it was parsed and validated.
+type reportFile struct {
+	modTime time.Time
+	size    int64
+	report  *Report
+	err     error
+}
+
+// reportFiles caches the report files by path, so that the API does not parse and prepare every report on every request.
+var (
+	reportFilesMu sync.Mutex
+	reportFiles   = make(map[string]*reportFile)
+)
+
+// loadReportFile returns the report of the file, from the cache unless the file changed. reportFilesMu must be held.
+func loadReportFile(db *sql.DB, path, name, ext string) (*Report, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if cached := reportFiles[path]; cached != nil && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.report, cached.err
+	}
+
+	report, err := parseReportFile(db, path, name, ext)
+	reportFiles[path] = &reportFile{modTime: info.ModTime(), size: info.Size(), report: report, err: err}
+	return report, err
+}
+
+func parseReportFile(db *sql.DB, path, name, ext string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var report *Report
+	switch ext {
+	case ".sql":
+		report, err = parseSQLReport(name, string(data))
+	case ".yaml", ".yml":
+		report, err = parseYAMLReport(name, data)
+	default:
+		report, err = parseJSONReport(name, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := validateReport(db, report); err != nil {
+		return nil, err
+	}
+	if report.Params == nil {
+		report.Params = []ReportParam{}
+	}
+	return report, nil
+}
+
+func findReport(reports []*Report, name string) *Report {
+	for _, report := range reports {
+		if report.Name == name {
+			return report
+		}
+	}
+	return nil
+}
+
+// runReport runs the report with the given parameters, all others keep their defaults.
+// The credentials the redaction policy withholds read as NULL.
+func runReport(db *sql.DB, report *Report, values map[string]string, now time.Time) (*ReportResult, error) {
+	result := &ReportResult{Report: report.Name, Params: make(map[string]string), Rows: [][]any{}}
+
+	declared := make(map[string]bool)
+	var args []any
+	for _, param := range report.Params {
+		declared[param.Name] = true
+		value, ok := values[param.Name]
+		if !ok {
+			value = param.Default
+		}
+		bound, err := param.bind(value, now)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrReportParam, err)
+		}
+		result.Params[param.Name] = value
+		args = append(args, sql.Named(param.Name, bound))
+	}
+	for name := range values {
+		if !declared[name] {
+			return nil, fmt.Errorf("%w: report %s has no parameter %s", ErrReportParam, report.Name, name)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+
+	conn, err := redactedConn(ctx, db, appConfig.Redaction)
+	if err != nil {
+		return nil, fmt.Errorf("could not run report %s: %w", report.Name, err)
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, report.SQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not run report %s: %w", report.Name, err)
+	}
+	defer rows.Close()
+
+	if result.Columns, err = rows.Columns(); err != nil {
+		return nil, fmt.Errorf("could not read columns of report %s: %w", report.Name, err)
+	}
+	for rows.Next() {
+		row := make([]any, len(result.Columns))
+		pointers := make([]any, len(row))
+		for i := range row {
+			pointers[i] = &row[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("could not scan row of report %s: %w", report.Name, err)
+		}
+		for i, value := range row {
+			if b, ok := value.([]byte); ok {
+				row[i] = string(b)
+			}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not run report %s: %w", report.Name, err)
+	}
+	return result, nil
+}
+
+// handleReports lists the reports and why reports of the directory could not be loaded.
+func handleReports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdminToken(w, r) {
+		return
+	}
+
+	reports, errs := loadReports(db, appConfig.ReportsDir)
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"reports": reports,
+		"errors":  messages,
+	})
+}
+
+// handleReport runs the report named by the path. The query parameters set the report parameters.
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdminToken(w, r) {
+		return
+	}
+
+	reports, _ := loadReports(db, appConfig.ReportsDir)
+	report := findReport(reports, strings.TrimPrefix(r.URL.Path, "/_proxy/reports/"))
+	if report == nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	values := make(map[string]string)
+	for name, value := range r.URL.Query() {
+		values[name] = value[len(value)-1]
+	}
+
+	result, err := runReport(db, report, values, time.Now())
+	if errors.Is(err, ErrReportParam) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] %v\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// printReport prints the result as a table below the name and the description of the report.
+func printReport(report *Report, result *ReportResult) {
+	fmt.Printf("%s\n", report.Name)
+	if report.Description != "" {
+		fmt.Printf("%s\n", report.Description)
+	}
+	var params []string
+	for _, param := range report.Params {
+		params = append(params, param.Name+"="+result.Params[param.Name])
+	}
+	if len(params) > 0 {
+		fmt.Printf("Parameters: %s\n", strings.Join(params, " "))
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(result.Columns, "\t")))
+	for _, row := range result.Rows {
+		cells := make([]string, len(row))
+		for i, value := range row {
+			if value != nil {
+				cells[i] = fmt.Sprint(value)
+			}
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+	w.Flush()
+	if len(result.Rows) == 0 {
+		fmt.Println("No rows.")
+	}
+	fmt.Println()
+}
+
+func runStatsCommand(args []string) error {
+	if err := openDB(appConfig.DatabasePath); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	reports, errs := loadReports(db, appConfig.ReportsDir)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "[WARN] Skipped report %v\n", err)
+	}
+
+	if len(args) == 0 {
+		for _, report := range reports {
+			result, err := runReport(db, report, nil, time.Now())
+			if err != nil {
+				return err
+			}
+			printReport(report, result)
+		}
+		return nil
+	}
+
+	report := findReport(reports, args[0])
+	if report == nil {
+		return fmt.Errorf("unknown report %q", args[0])
+	}
+	values := make(map[string]string)
+	for _, arg := range args[1:] {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("parameter %q is not NAME=VALUE", arg)
+		}
+		values[name] = value
+	}
+
+	result, err := runReport(db, report, values, time.Now())
+	if err != nil {
+		return err
+	}
+	printReport(report, result)
+	return nil
+}
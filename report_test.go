@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckReadOnlySQL(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`SELECT 1`, ""},
+		{`select * from "attacks";`, ""},
+		{"-- A comment; with a semicolon.\nSELECT 1; -- And a trailing comment.\n", ""},
+		{`/* ; */ WITH "x" AS (SELECT 1) SELECT * FROM "x"`, ""},
+		{`SELECT 'a;b', "c;d", [e;f], ` + "`g;h`", ""},
+		{`SELECT 'it''s'`, ""},
+		{`SELECT 1; DELETE FROM "_attacks"`, "more than one statement"},
+		{`SELECT 1;;`, "more than one statement"},
+		{`DELETE FROM "_attacks"`, "not DELETE"},
+		{`PRAGMA user_version`, "not PRAGMA"},
+		{`ATTACH 'other.db' AS "other"`, "not ATTACH"},
+		{"-- Only a comment.", "empty"},
+		{`SELECT 'unterminated`, "unterminated"},
+		{`SELECT 1 /* unterminated`, "unterminated"},
+	}
+
+	for _, test := range tests {
+		err := checkReadOnlySQL(test.query)
+		if test.want == "" && err != nil {
+			t.Errorf("%q: unexpected error %v", test.query, err)
+		}
+		if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("%q: got error %v, want %q", test.query, err, test.want)
+		}
+	}
+}
+
+func TestParseSQLReport(t *testing.T) {
+	report, err := parseSQLReport("top_usernames", `
+-- Top usernames of a source.
+-- Only counts attacks within the window.
+-- @param window duration 7d How far back to look.
+-- @param limit int 20
+-- @param source string "198.51.100.1 " The source IP.
+-- @param note string ""
+SELECT 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Description != "Top usernames of a source. Only counts attacks within the window." {
+		t.Errorf("got description %q", report.Description)
+	}
+	want := []ReportParam{
+		{Name: "window", Type: ReportParamDuration, Default: "7d", Description: "How far back to look."},
+		{Name: "limit", Type: ReportParamInt, Default: "20"},
+		{Name: "source", Type: ReportParamString, Default: "198.51.100.1 ", Description: "The source IP."},
+		{Name: "note", Type: ReportParamString, Default: ""},
+	}
+	if len(report.Params) != len(want) {
+		t.Fatalf("got params %+v, want %+v", report.Params, want)
+	}
+	for i := range want {
+		if report.Params[i] != want[i] {
+			t.Errorf("param %d: got %+v, want %+v", i, report.Params[i], want[i])
+		}
+	}
+
+	if _, err := parseSQLReport("broken", "-- @param window duration\nSELECT 1"); err == nil {
+		t.Error("a parameter without a default was accepted")
+	}
+}
+
+func TestParseReportDuration(t *testing.T) {
+	tests := map[string]time.Duration{"90d": 90 * 24 * time.Hour, "24h": 24 * time.Hour, "1h30m": 90 * time.Minute, "0d": 0}
+	for s, want := range tests {
+		if got, err := parseReportDuration(s); err != nil || got != want {
+			t.Errorf("parseReportDuration(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "d", "-1d", "-1h", "week"} {
+		if _, err := parseReportDuration(s); err == nil {
+			t.Errorf("parseReportDuration(%q) did not fail", s)
+		}
+	}
+}
+
+// writeReports writes the files into a reports directory and configures it.
+func writeReports(t *testing.T, files map[string]string) {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "reports")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appConfig.ReportsDir = dir
+}
+
+const sourceUsernamesReport = `-- Usernames a source tried.
+-- @param window duration 7d
+-- @param limit int 3
+-- @param source string "198.51.0.1"
+SELECT "username", COUNT(*) AS "count"
+FROM "attacks"
+WHERE "source_ip" = :source AND "timestamp" >= :window
+GROUP BY "username"
+ORDER BY "count" DESC, "username" ASC
+LIMIT :limit;
+`
+
+func TestLoadReports(t *testing.T) {
+	setupTest(t)
+	writeReports(t, map[string]string{
+		"source_usernames.sql":              sourceUsernamesReport,
+		"daily.json":                        `{"description": "Attacks per day.", "sql": "SELECT * FROM \"view_daily_attacks\""}`,
+		"notes.txt":                         "not a report",
+		"delete.sql":                        `DELETE FROM "_attacks"`,
+		"cte_delete.sql":                    `WITH "x" AS (SELECT 1) DELETE FROM "_attacks"`,
+		"two.sql":                           `SELECT 1; SELECT 2`,
+		"unknown_table.sql":                 `SELECT * FROM "nothing"`,
+		"bad_default.sql":                   "-- @param limit int many\nSELECT :limit",
+		"report_top_logins_last_7_days.sql": `SELECT 1`,
+		"broken.json":                       `{"sql": `,
+		"weekly.yaml":                       "description: Attacks per week.\nsql: >-\n  SELECT *\n  FROM \"view_daily_attacks\"\n",
+		"broken.yml":                        "sql: [SELECT 1]\n",
+	})
+
+	reports, errs := loadReports(db, appConfig.ReportsDir)
+
+	var names []string
+	for _, report := range reports {
+		names = append(names, report.Name)
+	}
+	want := []string{
+		"daily",
+		"report_credential_categories_last_30_days",
+		"report_daily_attacks_last_90_days",
+		"report_hourly_attacks_last_7_days",
+		"report_new_credential_fingerprints_last_7_days",
+		"report_top_attackers_last_24_hours",
+		"report_top_logins_last_7_days",
+		"report_top_passwords_last_7_days",
+		"report_top_usernames_last_7_days",
+		"source_usernames",
+		"weekly",
+	}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("got reports %v, want %v", names, want)
+	}
+
+	wantErrs := map[string]string{
+		"delete.sql":                        "not DELETE",
+		"cte_delete.sql":                    "writes to the database",
+		"two.sql":                           "more than one statement",
+		"unknown_table.sql":                 "no such table",
+		"bad_default.sql":                   "not an integer",
+		"report_top_logins_last_7_days.sql": "already exists",
+		"broken.json":                       "could not parse",
+		"broken.yml":                        "could not parse",
+	}
+	for _, err := range errs {
+		file, _, _ := strings.Cut(err.Error(), ":")
+		if want, ok := wantErrs[file]; !ok || !strings.Contains(err.Error(), want) {
+			t.Errorf("unexpected error %v", err)
+		}
+		delete(wantErrs, file)
+	}
+	for file, want := range wantErrs {
+		t.Errorf("%s was loaded, want an error with %q", file, want)
+	}
+}
+
+const sourceUsernamesYAMLReport = `# The same as sourceUsernamesReport.
+description: Top usernames of a source.
+params:
+  - name: source
+    type: string
+    default: "198.51.100.1"
+    description: The source IP.
+  - name: window
+    type: duration
+    default: 7d
+  - name: limit
+    type: int
+    default: 5 # at most
+sql: |
+  SELECT "username", COUNT(*) AS "count"
+  FROM "attacks"
+  WHERE "source_ip" = :source AND "timestamp" >= :window
+`
+
+func TestParseYAMLReport(t *testing.T) {
+	report, err := parseYAMLReport("source_usernames", []byte(sourceUsernamesYAMLReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Report{
+		Name:        "source_usernames",
+		Description: "Top usernames of a source.",
+		Params: []ReportParam{
+			{Name: "source", Type: ReportParamString, Default: "198.51.100.1", Description: "The source IP."},
+			{Name: "window", Type: ReportParamDuration, Default: "7d"},
+			{Name: "limit", Type: ReportParamInt, Default: "5"},
+		},
+		SQL: "SELECT \"username\", COUNT(*) AS \"count\"\nFROM \"attacks\"\nWHERE \"source_ip\" = :source AND \"timestamp\" >= :window\n",
+	}
+	if fmt.Sprintf("%+v", report) != fmt.Sprintf("%+v", want) {
+		t.Errorf("got %+v, want %+v", report, want)
+	}
+
+	for _, data := range []string{
+		"- sql: SELECT 1\n",
+		"sql: SELECT 1\nsql: SELECT 2\n",
+		"sql: SELECT 1\n  limit: 1\n",
+		"params: [{name: limit}]\n",
+		"sql: 'SELECT 1\n",
+	} {
+		if _, err := parseYAMLReport("broken", []byte(data)); err == nil {
+			t.Errorf("%q: got no error", data)
+		}
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		data string
+		want any
+	}{
+		{"", map[string]any{}},
+		{"---\na: 1\n...\n", map[string]any{"a": "1"}},
+		{"a: 'it''s' # comment\nb: \"x\\ty\"\nc: http://example.com/#x\n", map[string]any{"a": "it's", "b": "x\ty", "c": "http://example.com/#x"}},
+		{"a:\n- 1\n-\n  - 2\n- b: 3\n  c: []\n", map[string]any{"a": []any{"1", []any{"2"}, map[string]any{"b": "3", "c": []any{}}}}},
+		{"a: |\n  x\n    y\n\nb: x", map[string]any{"a": "x\n  y\n", "b": "x"}},
+		{"a: >\n  x\n  y\n\n  z\n\n\nb: |-\n  x\n\n", map[string]any{"a": "x y\nz\n", "b": "x"}},
+		{"a: |+\n  x\n\nb:\n", map[string]any{"a": "x\n\n", "b": ""}},
+	}
+	for _, test := range tests {
+		got, err := parseYAML(test.data)
+		if err != nil {
+			t.Errorf("%q: %v", test.data, err)
+			continue
+		}
+		if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", test.want) {
+			t.Errorf("%q: got %#v, want %#v", test.data, got, test.want)
+		}
+	}
+}
+
+func TestLoadReportsCachesFiles(t *testing.T) {
+	setupTest(t)
+	writeReports(t, map[string]string{"source_usernames.yaml": sourceUsernamesYAMLReport})
+	path := filepath.Join(appConfig.ReportsDir, "source_usernames.yaml")
+
+	load := func() *Report {
+		t.Helper()
+		reports, errs := loadReports(db, appConfig.ReportsDir)
+		if len(errs) > 0 {
+			t.Fatal(errs)
+		}
+		return findReport(reports, "source_usernames")
+	}
+
+	first := load()
+	if first == nil || load() != first {
+		t.Fatalf("got the report parsed again, want it from the cache")
+	}
+
+	if err := os.WriteFile(path, []byte(strings.Replace(sourceUsernamesYAMLReport, "default: 5", "default: 10", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed := load(); changed == first || changed.Params[2].Default != "10" {
+		t.Errorf("got %+v, want the changed report", changed)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if load() != nil {
+		t.Errorf("got the removed report")
+	}
+	if _, ok := reportFiles[path]; ok {
+		t.Errorf("the removed report is still cached")
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	setupTest(t)
+	writeReports(t, map[string]string{"source_usernames.sql": sourceUsernamesReport})
+
+	now := time.Now()
+	attacks := generateAttacks(11, 3000, now)
+	saveAttacks(t, attacks)
+
+	reports, errs := loadReports(db, appConfig.ReportsDir)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	report := findReport(reports, "source_usernames")
+
+	for _, params := range []map[string]string{
+		nil,
+		{"window": "30d", "limit": "100", "source": "198.51.0.7"},
+		{"window": "48h", "source": "198.51.1.2"},
+	} {
+		result, err := runReport(db, report, params, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values := map[string]string{"window": "7d", "limit": "3", "source": "198.51.0.1"}
+		for name, value := range params {
+			values[name] = value
+		}
+		window, _ := parseReportDuration(values["window"])
+		source := values["source"]
+		var matching []*Attack
+		for _, attack := range since(attacks, now.Add(-window)) {
+			if attack.SourceIP == source {
+				matching = append(matching, attack)
+			}
+		}
+		limit := map[string]int{"3": 3, "100": 100}[values["limit"]]
+		want := countRows(groupAttacks(matching, field(username)), byCountDesc, limit)
+
+		var got [][]string
+		for _, row := range result.Rows {
+			got = append(got, []string{row[0].(string), fmt.Sprint(row[1])})
+		}
+		compareRows(t, got, want)
+		if len(result.Params) != 3 || result.Params["source"] != source {
+			t.Errorf("got params %v", result.Params)
+		}
+	}
+
+	if _, err := runReport(db, report, map[string]string{"limit": "all"}, now); err == nil {
+		t.Error("an invalid parameter value was accepted")
+	}
+	if _, err := runReport(db, report, map[string]string{"user": "root"}, now); err == nil {
+		t.Error("an unknown parameter was accepted")
+	}
+}
+
+func TestReportsAPI(t *testing.T) {
+	setupTest(t)
+	writeReports(t, map[string]string{
+		"source_usernames.sql": sourceUsernamesReport,
+		"delete.sql":           `DELETE FROM "_attacks"`,
+	})
+	saveAttacks(t, generateAttacks(12, 200, time.Now()))
+	appConfig.AdminToken = "secret"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_proxy/reports", handleReports)
+	mux.HandleFunc("/_proxy/reports/", handleReport)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	get := func(path string, want int, body any) {
+		t.Helper()
+		resp, respBody := doRequest(t, http.MethodGet, server.URL+path, http.Header{"Authorization": {"Bearer secret"}}, nil)
+		if resp.StatusCode != want {
+			t.Fatalf("GET %s: got status %d, want %d", path, resp.StatusCode, want)
+		}
+		if body != nil {
+			if err := json.Unmarshal(respBody, body); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The reports show attack data, they need the admin token like the credentials.
+	for _, path := range []string{"/_proxy/reports", "/_proxy/reports/report_top_usernames_last_7_days"} {
+		if resp, _ := doRequest(t, http.MethodGet, server.URL+path, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("GET %s without the admin token: got status %d, want 401", path, resp.StatusCode)
+		}
+	}
+
+	var list struct {
+		Reports []Report `json:"reports"`
+		Errors  []string `json:"errors"`
+	}
+	get("/_proxy/reports", http.StatusOK, &list)
+	if len(list.Reports) != 9 || len(list.Errors) != 1 || !strings.HasPrefix(list.Errors[0], "delete.sql") {
+		t.Errorf("got %d reports and errors %v", len(list.Reports), list.Errors)
+	}
+
+	var result ReportResult
+	get("/_proxy/reports/source_usernames?window=120d&limit=2&source=198.51.0.3", http.StatusOK, &result)
+	if strings.Join(result.Columns, ",") != "username,count" || len(result.Rows) > 2 || result.Params["window"] != "120d" {
+		t.Errorf("got %+v", result)
+	}
+
+	var builtin ReportResult
+	get("/_proxy/reports/report_top_usernames_last_7_days", http.StatusOK, &builtin)
+	if strings.Join(builtin.Columns, ",") != "username,count" {
+		t.Errorf("got columns %v", builtin.Columns)
+	}
+
+	get("/_proxy/reports/source_usernames?limit=many", http.StatusBadRequest, nil)
+	get("/_proxy/reports/source_usernames?user=root", http.StatusBadRequest, nil)
+	get("/_proxy/reports/delete", http.StatusNotFound, nil)
+	get("/_proxy/reports/missing", http.StatusNotFound, nil)
+}
+
+func TestReadOnlyCommandsDoNotMigrate(t *testing.T) {
+	setupTest(t)
+	saveAttacks(t, generateAttacks(1, 20, time.Now().Add(-2*time.Hour)))
+	appConfig.AnomalyThreshold = 3
+	appConfig.DigestConfigPath = filepath.Join(t.TempDir(), "digests.json")
+	if err := os.WriteFile(appConfig.DigestConfigPath, []byte(`{"digests": [{"period": "daily", "dir": "/tmp"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	assertDoesNotMigrate(t, "stats", func() error { return runStatsCommand(nil) })
+	assertDoesNotMigrate(t, "credentials", func() error { return runCredentialsCommand([]string{"usernames"}) })
+	assertDoesNotMigrate(t, "wordlists", func() error { return runWordlistsCommand(nil) })
+	assertDoesNotMigrate(t, "anomalies", func() error { return runAnomaliesCommand([]string{"3"}) })
+	assertDoesNotMigrate(t, "digest", func() error { return runDigestCommand([]string{"daily", "markdown"}) })
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type SensorKind string
+
+// A sensor is identified either by the client address that talks to the proxy
+// or by the destination_ip the attack pod reports in its attacks.
+const (
+	SensorKindClient        SensorKind = "client"
+	SensorKindDestinationIP SensorKind = "destination_ip"
+)
+
+type Sensor struct {
+	Kind      SensorKind `json:"kind"`
+	Name      string     `json:"name"`
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  time.Time  `json:"last_seen"`
+	Silent    bool       `json:"silent"`
+
+	dirty bool
+}
+
+type sensorKey struct {
+	kind SensorKind
+	name string
+}
+
+// SensorMonitor keeps track of the last time every known sensor was seen
+// and raises an alert once a sensor has been silent for longer than the threshold.
+type SensorMonitor struct {
+	mu        sync.Mutex
+	sensors   map[sensorKey]*Sensor
+	threshold time.Duration
+}
+
+var sensorMonitor *SensorMonitor
+
+func newSensorMonitor(threshold time.Duration) *SensorMonitor {
+	return &SensorMonitor{
+		sensors:   make(map[sensorKey]*Sensor),
+		threshold: threshold,
+	}
+}
+
+// load restores the known sensors from the database so that a sensor which went silent
+// while the proxy was down is still noticed after a restart.
+func (m *SensorMonitor) load(db *sql.DB) error {
+	rows, err := db.Query(`SELECT "kind", "name", "first_seen", "last_seen", "silent" FROM "_sensors"`)
+	if err != nil {
+		return fmt.Errorf("could not query sensors: %w", err)
+	}
+	defer rows.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for rows.Next() {
+		var sensor Sensor
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&sensor.Kind, &sensor.Name, &firstSeen, &lastSeen, &sensor.Silent); err != nil {
+			return fmt.Errorf("could not scan sensor: %w", err)
+		}
+		sensor.FirstSeen = time.UnixMilli(firstSeen)
+		sensor.LastSeen = time.UnixMilli(lastSeen)
+		m.sensors[sensorKey{sensor.Kind, sensor.Name}] = &sensor
+	}
+	return rows.Err()
+}
+
+// Seen marks the sensor as alive. A sensor that was silent before is reported as recovered.
+func (m *SensorMonitor) Seen(kind SensorKind, name string) {
+	if m == nil || name == "" {
+		return
+	}
+
+	now := time.Now()
+
+	m.mu.Lock()
+	sensor, ok := m.sensors[sensorKey{kind, name}]
+	if !ok {
+		sensor = &Sensor{Kind: kind, Name: name, FirstSeen: now}
+		m.sensors[sensorKey{kind, name}] = sensor
+		log.Printf("[INFO] New sensor %s %s seen.\n", kind, name)
+	}
+	sensor.LastSeen = now
+	sensor.dirty = true
+
+	recovered := sensor.Silent
+	sensor.Silent = false
+	snapshot := *sensor
+	m.mu.Unlock()
+
+	if recovered {
+		log.Printf("[INFO] Sensor %s %s recovered.\n", kind, name)
+		notifier.OnSensor("sensor_recovered", snapshot, now)
+	}
+}
+
+// Snapshot returns a copy of all known sensors, sorted by kind and name.
+func (m *SensorMonitor) Snapshot() []Sensor {
+	m.mu.Lock()
+	sensors := make([]Sensor, 0, len(m.sensors))
+	for _, sensor := range m.sensors {
+		sensors = append(sensors, *sensor)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(sensors, func(i, j int) bool {
+		if sensors[i].Kind != sensors[j].Kind {
+			return sensors[i].Kind < sensors[j].Kind
+		}
+		return sensors[i].Name < sensors[j].Name
+	})
+	return sensors
+}
+
+// check marks every sensor that exceeded the silence threshold as silent,
+// alerts about the sensors that just went silent and returns them.
+func (m *SensorMonitor) check(now time.Time) []Sensor {
+	m.mu.Lock()
+	var silenced []Sensor
+	for _, sensor := range m.sensors {
+		if !sensor.Silent && now.Sub(sensor.LastSeen) > m.threshold {
+			sensor.Silent = true
+			sensor.dirty = true
+			silenced = append(silenced, *sensor)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, sensor := range silenced {
+		log.Printf("[WARN] Sensor %s %s has been silent since %s.\n",
+			sensor.Kind, sensor.Name, sensor.LastSeen.Format(time.RFC3339))
+		notifier.OnSensor("sensor_silent", sensor, now)
+	}
+	return silenced
+}
+
+// flush writes every changed sensor back to the database.
+// Sensors that could not be written stay changed, so the next flush tries again.
+func (m *SensorMonitor) flush(db *sql.DB) error {
+	m.mu.Lock()
+	var changed []Sensor
+	for _, sensor := range m.sensors {
+		if sensor.dirty {
+			changed = append(changed, *sensor)
+			sensor.dirty = false
+		}
+	}
+	m.mu.Unlock()
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	if err := saveSensors(db, changed); err != nil {
+		m.mu.Lock()
+		for _, sensor := range changed {
+			m.sensors[sensorKey{sensor.Kind, sensor.Name}].dirty = true
+		}
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// saveSensors writes the sensors to the database in one transaction.
+func saveSensors(db *sql.DB, changed []Sensor) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+
+	for _, sensor := range changed {
+		_, err := tx.Exec(`INSERT INTO "_sensors" ("kind", "name", "first_seen", "last_seen", "silent")
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT ("kind", "name") DO UPDATE SET
+				"last_seen" = excluded."last_seen",
+				"silent" = excluded."silent"`,
+			sensor.Kind, sensor.Name, sensor.FirstSeen.UnixMilli(), sensor.LastSeen.UnixMilli(), sensor.Silent)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not save sensor %s %s: %w", sensor.Kind, sensor.Name, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+	return nil
+}
+
+// run periodically checks for silent sensors and persists the last seen times.
+func (m *SensorMonitor) run(db *sql.DB) {
+	interval := m.threshold / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		m.check(now)
+		if err := m.flush(db); err != nil {
+			log.Printf("[ERROR] Failed to save sensors to DB: %v\n", err)
+		}
+	}
+}
+
+// handleSensors returns the last seen times of all known sensors as JSON.
+func handleSensors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sensors := []Sensor{}
+	if sensorMonitor != nil {
+		sensors = sensorMonitor.Snapshot()
+	}
+	for i := range sensors {
+		sensors[i].FirstSeen = sensors[i].FirstSeen.In(reportLocation())
+		sensors[i].LastSeen = sensors[i].LastSeen.In(reportLocation())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"silence_threshold_seconds": int64(appConfig.SensorSilenceThreshold / time.Second),
+		"sensors":                   sensors,
+	})
+}
+
+// clientIP returns the IP address of the client that sent the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Write path tuning.
+const (
+	// attackBatchWindow is how long the writer waits for more attacks before it commits a batch.
+	attackBatchWindow = 5 * time.Millisecond
+	// maxAttackBatchSize is the maximum number of attacks committed in one transaction.
+	maxAttackBatchSize = 512
+	// maxDictionaryCacheEntries limits the cached IDs per dictionary. The cache is cleared when it is full.
+	maxDictionaryCacheEntries = 100_000
+)
+
+var (
+	metricDBBatches = newCounter("netwatch_proxy_db_batches_total",
+		"Transactions committed by the attack writer.")
+	metricDBAttacks = newCounter("netwatch_proxy_db_attacks_total",
+		"Attacks processed by the attack writer.", "result")
+)
+
+var errAttackWriterClosed = errors.New("attack writer is closed")
+
+// dictionary maps the values of one _dict_* table to their IDs.
+type dictionary struct {
+	table      string
+	cache      map[string]int64
+	selectStmt *sql.Stmt
+	insertStmt *sql.Stmt
+	// onInsert is called in the transaction for every value the dictionary inserts.
+	onInsert func(tx *batchTx, id int64, value string) error
+}
+
+func newDictionary(db *sql.DB, table string) (*dictionary, error) {
+	selectStmt, err := db.Prepare(fmt.Sprintf(`SELECT "id" FROM "%s" WHERE "value" = ?`, table))
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare select for %s: %w", table, err)
+	}
+	insertStmt, err := db.Prepare(fmt.Sprintf(`INSERT INTO "%s" ("value") VALUES (?)`, table))
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare insert for %s: %w", table, err)
+	}
+
+	return &dictionary{
+		table:      table,
+		cache:      make(map[string]int64),
+		selectStmt: selectStmt,
+		insertStmt: insertStmt,
+	}, nil
+}
+
+// batchTx is the transaction of one batch together with its transaction bound statements.
+type batchTx struct {
+	*sql.Tx
+	stmts map[*sql.Stmt]*sql.Stmt
+}
+
+// stmt returns the prepared statement bound to the transaction.
+func (tx *batchTx) stmt(stmt *sql.Stmt) *sql.Stmt {
+	txStmt, ok := tx.stmts[stmt]
+	if !ok {
+		txStmt = tx.Stmt(stmt)
+		tx.stmts[stmt] = txStmt
+	}
+	return txStmt
+}
+
+// pendingIDs are the IDs a dictionary looked up or created in the transaction, they are only cached after the commit.
+// The IDs of the attack being inserted are kept apart, so that they can be dropped if its savepoint is rolled back.
+type pendingIDs struct {
+	batch  map[string]int64
+	attack map[string]int64
+}
+
+func newPendingIDs() *pendingIDs {
+	return &pendingIDs{batch: make(map[string]int64), attack: make(map[string]int64)}
+}
+
+func (p *pendingIDs) get(value string) (int64, bool) {
+	if id, ok := p.attack[value]; ok {
+		return id, true
+	}
+	id, ok := p.batch[value]
+	return id, ok
+}
+
+// release keeps the IDs of the attack for the rest of the batch.
+func (p *pendingIDs) release() {
+	for value, id := range p.attack {
+		p.batch[value] = id
+	}
+	clear(p.attack)
+}
+
+// rollback drops the IDs of the attack, the rows they refer to were rolled back.
+func (p *pendingIDs) rollback() {
+	clear(p.attack)
+}
+
+// id returns the ID of the value and inserts it if it is unknown.
+// IDs found or created in the transaction are collected in pending and only cached after the commit.
+func (d *dictionary) id(tx *batchTx, value string, pending *pendingIDs) (int64, error) {
+	if id, ok := d.cache[value]; ok {
+		return id, nil
+	}
+	if id, ok := pending.get(value); ok {
+		return id, nil
+	}
+
+	var id int64
+	err := tx.stmt(d.selectStmt).QueryRow(value).Scan(&id)
+	if err == nil {
+		pending.attack[value] = id
+		return id, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("could not look up %s: %w", d.table, err)
+	}
+
+	result, err := tx.stmt(d.insertStmt).Exec(value)
+	if err != nil {
+		return 0, fmt.Errorf("could not insert into %s: %w", d.table, err)
+	}
+	id, err = result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("could not get id of %s: %w", d.table, err)
+	}
+	if d.onInsert != nil {
+		if err := d.onInsert(tx, id, value); err != nil {
+			return 0, err
+		}
+	}
+	pending.attack[value] = id
+	return id, nil
+}
+
+func (d *dictionary) commit(pending map[string]int64) {
+	if len(d.cache)+len(pending) > maxDictionaryCacheEntries {
+		d.cache = make(map[string]int64)
+	}
+	for value, id := range pending {
+		d.cache[value] = id
+	}
+}
+
+type attackWrite struct {
+	attack *Attack
+	result chan error
+}
+
+// AttackWriter is the single goroutine that writes attacks to the database.
+// Attacks that arrive within attackBatchWindow of each other are committed in one transaction.
+type AttackWriter struct {
+	db       *sql.DB
+	requests chan attackWrite
+	done     chan struct{}
+
+	// closeMu guards closed, so that no attack is sent to the closed request channel.
+	closeMu sync.RWMutex
+	closed  bool
+
+	sourceIPs      *dictionary
+	destinationIPs *dictionary
+	usernames      *dictionary
+	passwords      *dictionary
+	attackTypes    *dictionary
+	evidences      *dictionary
+
+	insertStmt     *sql.Stmt
+	credentialStmt *sql.Stmt
+}
+
+var attackWriter *AttackWriter
+
+func newAttackWriter(db *sql.DB) (*AttackWriter, error) {
+	w := &AttackWriter{
+		db:       db,
+		requests: make(chan attackWrite, maxAttackBatchSize),
+		done:     make(chan struct{}),
+	}
+
+	var err error
+	if w.sourceIPs, err = newDictionary(db, "_dict_source_ips"); err != nil {
+		return nil, err
+	}
+	if w.destinationIPs, err = newDictionary(db, "_dict_destination_ips"); err != nil {
+		return nil, err
+	}
+	if w.usernames, err = newDictionary(db, "_dict_usernames"); err != nil {
+		return nil, err
+	}
+	if w.passwords, err = newDictionary(db, "_dict_passwords"); err != nil {
+		return nil, err
+	}
+	if w.attackTypes, err = newDictionary(db, "_dict_attack_types"); err != nil {
+		return nil, err
+	}
+	if w.evidences, err = newDictionary(db, "_dict_evidences"); err != nil {
+		return nil, err
+	}
+
+	// New usernames and passwords are classified and new evidences parsed in the transaction that stores them.
+	if w.usernames.onInsert, err = usernameClassifier.hook(db); err != nil {
+		return nil, err
+	}
+	if w.passwords.onInsert, err = passwordClassifier.hook(db); err != nil {
+		return nil, err
+	}
+	if w.evidences.onInsert, err = evidenceClassifier.hook(db); err != nil {
+		return nil, err
+	}
+
+	// The unique index idx_attacks_unique turns duplicates into ignored inserts.
+	w.insertStmt, err = db.Prepare(`INSERT OR IGNORE INTO "_attacks"
+		("timestamp", "source_ip", "destination_ip", "username", "password", "attack_type", "evidence")
+		VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare attack insert: %w", err)
+	}
+	w.credentialStmt, err = db.Prepare(`SELECT "attacks" FROM "_rollup_credentials" WHERE "username" = ? AND "password" = ?`)
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare credential lookup: %w", err)
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Write queues the attack and waits until it is committed.
+func (w *AttackWriter) Write(attack *Attack) error {
+	result := make(chan error, 1)
+
+	w.closeMu.RLock()
+	if w.closed {
+		w.closeMu.RUnlock()
+		return errAttackWriterClosed
+	}
+	w.requests <- attackWrite{attack: attack, result: result}
+	w.closeMu.RUnlock()
+
+	return <-result
+}
+
+// Close stops the writer after all queued attacks are written.
+func (w *AttackWriter) Close() {
+	w.closeMu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.requests)
+	}
+	w.closeMu.Unlock()
+
+	<-w.done
+}
+
+func (w *AttackWriter) run() {
+	defer close(w.done)
+
+	batch := make([]attackWrite, 0, maxAttackBatchSize)
+	for request := range w.requests {
+		batch = append(batch[:0], request)
+
+		timer := time.NewTimer(attackBatchWindow)
+	collect:
+		for len(batch) < maxAttackBatchSize {
+			select {
+			case request, ok := <-w.requests:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, request)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		w.writeBatch(batch)
+	}
+}
+
+func (w *AttackWriter) writeBatch(batch []attackWrite) {
+	results := make([]error, len(batch))
+	err := w.commitBatch(batch, results)
+
+	metricDBBatches.Inc()
+	for i, request := range batch {
+		if err != nil {
+			results[i] = err
+		}
+
+		switch {
+		case results[i] == nil:
+			metricDBAttacks.Inc("saved")
+		case errors.Is(results[i], ErrDuplicateAttack):
+			metricDBAttacks.Inc("duplicate")
+		default:
+			metricDBAttacks.Inc("error")
+		}
+		request.result <- results[i]
+	}
+}
+
+func (w *AttackWriter) commitBatch(batch []attackWrite, results []error) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	sqlTx, err := w.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	tx := &batchTx{Tx: sqlTx, stmts: make(map[*sql.Stmt]*sql.Stmt)}
+
+	pending := map[*dictionary]*pendingIDs{
+		w.sourceIPs:      newPendingIDs(),
+		w.destinationIPs: newPendingIDs(),
+		w.usernames:      newPendingIDs(),
+		w.passwords:      newPendingIDs(),
+		w.attackTypes:    newPendingIDs(),
+		w.evidences:      newPendingIDs(),
+	}
+
+	for i, request := range batch {
+		results[i] = w.insertAtomically(tx, request.attack, pending)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	for dict, ids := range pending {
+		dict.commit(ids.batch)
+	}
+	return nil
+}
+
+// insertAtomically inserts the attack within a savepoint. If the insert fails, the dictionary values, features and
+// metadata it already wrote are rolled back, so that the attack does not leave rows behind while it is dead-lettered.
+func (w *AttackWriter) insertAtomically(tx *batchTx, attack *Attack, pending map[*dictionary]*pendingIDs) error {
+	if _, err := tx.Exec(`SAVEPOINT "attack"`); err != nil {
+		return fmt.Errorf("could not create savepoint: %w", err)
+	}
+
+	err := w.insert(tx, attack, pending)
+	if err != nil && !errors.Is(err, ErrDuplicateAttack) {
+		for _, ids := range pending {
+			ids.rollback()
+		}
+		if _, errRollback := tx.Exec(`ROLLBACK TO SAVEPOINT "attack"`); errRollback != nil {
+			return fmt.Errorf("%w, could not roll back to savepoint: %w", err, errRollback)
+		}
+	} else {
+		for _, ids := range pending {
+			ids.release()
+		}
+	}
+
+	if _, errRelease := tx.Exec(`RELEASE SAVEPOINT "attack"`); errRelease != nil && err == nil {
+		return fmt.Errorf("could not release savepoint: %w", errRelease)
+	}
+	return err
+}
+
+func (w *AttackWriter) insert(tx *batchTx, attack *Attack, pending map[*dictionary]*pendingIDs) error {
+	var ids [6]int64
+	for i, field := range []struct {
+		dict  *dictionary
+		value string
+	}{
+		{w.sourceIPs, attack.SourceIP},
+		{w.destinationIPs, attack.DestinationIP},
+		{w.usernames, attack.Username},
+		{w.passwords, attack.Password},
+		{w.attackTypes, attack.AttackType},
+		{w.evidences, attack.Evidence},
+	} {
+		id, err := field.dict.id(tx, field.value, pending[field.dict])
+		if err != nil {
+			return err
+		}
+		ids[i] = id
+	}
+
+	result, err := tx.stmt(w.insertStmt).Exec(attack.AttackTimestamp.ToTime().UnixMilli(),
+		ids[0], ids[1], ids[2], ids[3], ids[4], ids[5])
+	if err != nil {
+		return fmt.Errorf("could not execute insert statement: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not get affected rows: %w", err)
+	}
+	if affected == 0 {
+		return ErrDuplicateAttack
+	}
+
+	// The rollup trigger counted the attack in this transaction, so a count of one is the first use of the pair,
+	// also when the next attack of the batch uses it again.
+	var uses int64
+	if err := tx.stmt(w.credentialStmt).QueryRow(ids[2], ids[3]).Scan(&uses); err != nil {
+		return fmt.Errorf("could not look up credential rollup: %w", err)
+	}
+	attack.firstCredentialUse = uses == 1
+	return nil
+}
+
+// closeDB flushes the attack writer and closes the database.
+func closeDB() {
+	if attackWriter != nil {
+		attackWriter.Close()
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("[ERROR] Failed to close database: %v\n", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchmarkAttack generates the n-th attack of a brute force run:
+// a few hundred sources trying usernames and passwords from a shared list.
+func benchmarkAttack(n int64, start time.Time) *Attack {
+	return &Attack{
+		SourceIP:        fmt.Sprintf("198.51.%d.%d", (n/256)%4, n%256),
+		DestinationIP:   "203.0.113.10",
+		Username:        fmt.Sprintf("user%d", n%64),
+		Password:        fmt.Sprintf("password%d", n%1024),
+		AttackTimestamp: FlexibleTime(start.Add(time.Duration(n) * time.Millisecond)),
+		Evidence:        "SSH-2.0-libssh_0.9.6",
+		AttackType:      "SSH_BRUTEFORCE",
+	}
+}
+
+func setupBenchmarkConfig(b *testing.B) {
+	b.Helper()
+
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(output) })
+
+	appConfig = &Config{
+		MaxTimestampSkew: time.Hour,
+		MaxAttackAge:     720 * time.Hour,
+		MaxEvidenceBytes: 16384,
+	}
+}
+
+// BenchmarkSaveAttack measures the batched writer with concurrent handlers.
+func BenchmarkSaveAttack(b *testing.B) {
+	setupBenchmarkConfig(b)
+	initDB(filepath.Join(b.TempDir(), "attacks.db"))
+	b.Cleanup(closeDB)
+
+	start := time.Now().Add(-time.Hour)
+	var n atomic.Int64
+
+	// Simulate the concurrent requests of several attack pods.
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := saveAttackToDB(benchmarkAttack(n.Add(1), start)); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+// BenchmarkSaveAttackLegacy measures the write path before the writer was introduced:
+// one transaction per attack with un-prepared subselects and the default rollback journal.
+func BenchmarkSaveAttackLegacy(b *testing.B) {
+	setupBenchmarkConfig(b)
+
+	legacyDB, err := sql.Open("sqlite3", filepath.Join(b.TempDir(), "attacks.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { legacyDB.Close() })
+	if err := runMigrations(legacyDB); err != nil {
+		b.Fatal(err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	var n atomic.Int64
+
+	// Simulate the concurrent requests of several attack pods.
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := legacySaveAttack(legacyDB, benchmarkAttack(n.Add(1), start)); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func legacySaveAttack(db *sql.DB, attack *Attack) error {
+	timestamp := attack.AttackTimestamp.ToTime().UnixMilli()
+	evidence := strings.TrimSpace(attack.Evidence)
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var count int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM _attacks WHERE
+		timestamp = ? AND
+		source_ip = (SELECT id FROM _dict_source_ips WHERE value = ?) AND
+		destination_ip = (SELECT id FROM _dict_destination_ips WHERE value = ?) AND
+		username = (SELECT id FROM _dict_usernames WHERE value = ?) AND
+		password = (SELECT id FROM _dict_passwords WHERE value = ?) AND
+		attack_type = (SELECT id FROM _dict_attack_types WHERE value = ?) AND
+		evidence = (SELECT id FROM _dict_evidences WHERE value = ?)`,
+		timestamp, attack.SourceIP, attack.DestinationIP, attack.Username, attack.Password,
+		attack.AttackType, evidence).Scan(&count)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count > 0 {
+		tx.Rollback()
+		return ErrDuplicateAttack
+	}
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO _dict_source_ips (value) VALUES (?);
+		INSERT OR IGNORE INTO _dict_destination_ips (value) VALUES (?);
+		INSERT OR IGNORE INTO _dict_usernames (value) VALUES (?);
+		INSERT OR IGNORE INTO _dict_passwords (value) VALUES (?);
+		INSERT OR IGNORE INTO _dict_attack_types (value) VALUES (?);
+		INSERT OR IGNORE INTO _dict_evidences (value) VALUES (?);`,
+		attack.SourceIP, attack.DestinationIP, attack.Username, attack.Password, attack.AttackType, evidence)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO _attacks (timestamp, source_ip, destination_ip, username, password, attack_type, evidence)
+		VALUES (?,
+			(SELECT id FROM _dict_source_ips WHERE value = ?),
+			(SELECT id FROM _dict_destination_ips WHERE value = ?),
+			(SELECT id FROM _dict_usernames WHERE value = ?),
+			(SELECT id FROM _dict_passwords WHERE value = ?),
+			(SELECT id FROM _dict_attack_types WHERE value = ?),
+			(SELECT id FROM _dict_evidences WHERE value = ?))`,
+		timestamp, attack.SourceIP, attack.DestinationIP, attack.Username, attack.Password, attack.AttackType, evidence)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"time"
+)
+
+// NaiveTimestampPolicy decides how attack timestamps without a timezone are interpreted.
+// The attack pod sends Python's datetime.isoformat(), which has no timezone.
+type NaiveTimestampPolicy string
+
+const (
+	// NaiveUTC reads naive timestamps as UTC, which is what the attack pod container runs in.
+	NaiveUTC NaiveTimestampPolicy = "utc"
+	// NaiveReport reads naive timestamps in the reporting timezone.
+	NaiveReport NaiveTimestampPolicy = "report"
+	// NaiveLocal reads naive timestamps in the timezone of the proxy process.
+	NaiveLocal NaiveTimestampPolicy = "local"
+	// NaiveReject refuses naive timestamps, the attacks end up as dead letters.
+	NaiveReject NaiveTimestampPolicy = "reject"
+)
+
+func parseNaiveTimestampPolicy(s string) (NaiveTimestampPolicy, error) {
+	switch policy := NaiveTimestampPolicy(s); policy {
+	case NaiveUTC, NaiveReport, NaiveLocal, NaiveReject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown naive timestamp policy %q, expected utc, report, local or reject", s)
+}
+
+// reportLocation is the timezone the views and the API report times in.
+// It is UTC until the configuration is loaded.
+func reportLocation() *time.Location {
+	if appConfig == nil || appConfig.Timezone == nil {
+		return time.UTC
+	}
+	return appConfig.Timezone
+}
+
+// naiveTimestampLocation returns the timezone of timestamps without one, or an error if they are refused.
+func naiveTimestampLocation() (*time.Location, error) {
+	policy := NaiveUTC
+	if appConfig != nil && appConfig.NaiveTimestamps != "" {
+		policy = appConfig.NaiveTimestamps
+	}
+
+	switch policy {
+	case NaiveReport:
+		return reportLocation(), nil
+	case NaiveLocal:
+		return time.Local, nil
+	case NaiveReject:
+		return nil, fmt.Errorf("timestamps without a timezone are not accepted")
+	}
+	return time.UTC, nil
+}
+
+// TimezoneOffset is a period in which the reporting timezone has the same offset to UTC.
+// The views look up the offset of a timestamp in the "_report_timezone" table,
+// because SQLite only knows UTC and the timezone of the process.
+type TimezoneOffset struct {
+	// Since is the Unix time in milliseconds the offset starts at.
+	Since int64
+	// Offset is the number of seconds east of UTC.
+	Offset int
+	// Abbreviation is the name of the zone during the period, like CET or CEST.
+	Abbreviation string
+}
+
+// The offsets are computed until the end of this year, the last offset stays in effect after it.
+const timezoneOffsetsUntilYear = 2100
+
+// timezoneOffsets lists the offsets of the timezone since 1970.
+// The first period starts at the smallest timestamp, so every timestamp has an offset.
+func timezoneOffsets(loc *time.Location) []TimezoneOffset {
+	end := time.Date(timezoneOffsetsUntilYear, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var offsets []TimezoneOffset
+	for t := time.Unix(0, 0).In(loc); t.Before(end); {
+		abbreviation, offset := t.Zone()
+		since := t.UnixMilli()
+		if len(offsets) == 0 {
+			since = math.MinInt64
+		}
+		// Some transitions only change the abbreviation or the DST flag, the views only need the offset.
+		if len(offsets) == 0 || offsets[len(offsets)-1].Offset != offset {
+			offsets = append(offsets, TimezoneOffset{Since: since, Offset: offset, Abbreviation: abbreviation})
+		}
+
+		_, next := t.ZoneBounds()
+		if next.IsZero() {
+			break
+		}
+		// The bounds Go derives from the rules of a zone after its last transition do not always advance.
+		if !next.After(t) {
+			next = t.Add(24 * time.Hour)
+		}
+		t = next
+	}
+	return offsets
+}
+
+// formatUTCOffset formats an offset in seconds like +02:00, which SQLite understands as a timezone suffix.
+func formatUTCOffset(offset int) string {
+	sign := '+'
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	return fmt.Sprintf("%c%02d:%02d", sign, offset/3600, offset%3600/60)
+}
+
+// syncReportTimezone fills "_report_timezone" with the offsets of the timezone, unless it already holds them.
+func syncReportTimezone(db *sql.DB, loc *time.Location) error {
+	offsets := timezoneOffsets(loc)
+
+	rows, err := db.Query(`SELECT "since", "offset", "abbreviation", "zone" FROM "_report_timezone" ORDER BY "since"`)
+	if err != nil {
+		return fmt.Errorf("could not read reporting timezone: %w", err)
+	}
+	var stored []TimezoneOffset
+	var zone string
+	for rows.Next() {
+		var offset TimezoneOffset
+		if err := rows.Scan(&offset.Since, &offset.Offset, &offset.Abbreviation, &zone); err != nil {
+			rows.Close()
+			return fmt.Errorf("could not scan timezone offset: %w", err)
+		}
+		stored = append(stored, offset)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not read reporting timezone: %w", err)
+	}
+	// The offsets also change when the timezone database is updated.
+	if zone == loc.String() && slices.Equal(stored, offsets) {
+		return nil
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM "_report_timezone"`); err != nil {
+		return fmt.Errorf("could not clear reporting timezone: %w", err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO "_report_timezone" ("since", "offset", "utc_offset", "abbreviation", "zone") VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, offset := range offsets {
+		if _, err := stmt.Exec(offset.Since, offset.Offset, formatUTCOffset(offset.Offset), offset.Abbreviation, loc.String()); err != nil {
+			return fmt.Errorf("could not insert timezone offset: %w", err)
+		}
+	}
+	if err := rebuildLocalRollups(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit reporting timezone: %w", err)
+	}
+
+	if zone != "" && zone != loc.String() {
+		log.Printf("[INFO] Changed the reporting timezone from %s to %s.\n", zone, loc)
+	} else {
+		log.Printf("[INFO] Reporting times in %s.\n", loc)
+	}
+	return nil
+}
+
+// rebuildLocalRollups sums the hours and days of the reporting timezone up from the minutes again.
+func rebuildLocalRollups(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		DELETE FROM "_rollup_hours";
+		DELETE FROM "_rollup_days";
+
+		INSERT INTO "_rollup_hours" ("hour", "offset", "attacks")
+		SELECT ("minute" + "offset") / 3600 * 3600 - "offset", "offset", SUM("attacks")
+		FROM (
+			SELECT "minute", "attacks", (
+				SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_rollup_minutes"."minute" * 1000 ORDER BY "since" DESC LIMIT 1
+			) AS "offset"
+			FROM "_rollup_minutes"
+		)
+		GROUP BY 1, 2;
+
+		INSERT INTO "_rollup_days" ("date", "attacks")
+		SELECT strftime('%F', "minute" + "offset", 'unixepoch'), SUM("attacks")
+		FROM (
+			SELECT "minute", "attacks", (
+				SELECT "offset" FROM "_report_timezone" WHERE "since" <= "_rollup_minutes"."minute" * 1000 ORDER BY "since" DESC LIMIT 1
+			) AS "offset"
+			FROM "_rollup_minutes"
+		)
+		GROUP BY 1;`)
+	if err != nil {
+		return fmt.Errorf("could not rebuild the hourly and daily rollups: %w", err)
+	}
+	return nil
+}
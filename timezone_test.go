@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("timezone database is not available: %v", err)
+	}
+	return loc
+}
+
+func TestTimezoneOffsets(t *testing.T) {
+	if offsets := timezoneOffsets(time.UTC); len(offsets) != 1 || offsets[0] != (TimezoneOffset{math.MinInt64, 0, "UTC"}) {
+		t.Errorf("got %+v for UTC, want a single offset", offsets)
+	}
+
+	offsets := timezoneOffsets(loadLocation(t, "America/New_York"))
+	if offsets[0].Since != math.MinInt64 {
+		t.Errorf("first offset starts at %d, want the smallest timestamp", offsets[0].Since)
+	}
+	want := map[time.Time]TimezoneOffset{
+		time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC):  {Offset: -4 * 3600, Abbreviation: "EDT"},
+		time.Date(2026, 11, 1, 6, 0, 0, 0, time.UTC): {Offset: -5 * 3600, Abbreviation: "EST"},
+	}
+	for _, offset := range offsets {
+		since := time.UnixMilli(offset.Since).UTC()
+		if expected, ok := want[since]; ok {
+			if offset.Offset != expected.Offset || offset.Abbreviation != expected.Abbreviation {
+				t.Errorf("offset at %s is %+v, want %+v", since, offset, expected)
+			}
+			delete(want, since)
+		}
+	}
+	for since := range want {
+		t.Errorf("no offset starts at %s", since)
+	}
+}
+
+func TestFormatUTCOffset(t *testing.T) {
+	tests := map[int]string{0: "+00:00", 7200: "+02:00", -18000: "-05:00", 19800: "+05:30", -9000: "-02:30"}
+	for offset, want := range tests {
+		if got := formatUTCOffset(offset); got != want {
+			t.Errorf("formatUTCOffset(%d) = %q, want %q", offset, got, want)
+		}
+	}
+}
+
+func TestNaiveTimestampPolicies(t *testing.T) {
+	appConfig = loadConfig()
+	appConfig.Timezone = loadLocation(t, "Europe/Berlin")
+
+	const naive = `"2024-05-01T12:34:56"`
+	tests := []struct {
+		policy NaiveTimestampPolicy
+		want   time.Time
+	}{
+		{NaiveUTC, time.Date(2024, 5, 1, 12, 34, 56, 0, time.UTC)},
+		{NaiveReport, time.Date(2024, 5, 1, 10, 34, 56, 0, time.UTC)},
+		{NaiveLocal, time.Date(2024, 5, 1, 12, 34, 56, 0, time.Local)},
+		{NaiveReject, time.Time{}},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			appConfig.NaiveTimestamps = test.policy
+
+			var ft FlexibleTime
+			err := json.Unmarshal([]byte(naive), &ft)
+			if test.want.IsZero() {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", ft.ToTime())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ft.ToTime().Equal(test.want) {
+				t.Errorf("got %v, want %v", ft.ToTime(), test.want)
+			}
+			if ft.ToTime().Location() != appConfig.Timezone {
+				t.Errorf("got location %v, want the reporting timezone", ft.ToTime().Location())
+			}
+		})
+	}
+
+	// Timestamps with a timezone are never affected.
+	var ft FlexibleTime
+	if err := json.Unmarshal([]byte(`"2024-05-01T12:34:56Z"`), &ft); err != nil {
+		t.Fatal(err)
+	}
+	if !ft.ToTime().Equal(time.Date(2024, 5, 1, 12, 34, 56, 0, time.UTC)) {
+		t.Errorf("got %v for a timestamp with a timezone", ft.ToTime())
+	}
+
+	if _, err := parseNaiveTimestampPolicy("server"); err == nil {
+		t.Error("unknown policy was accepted")
+	}
+}
+
+// setReportTimezone switches the reporting timezone of the test database.
+func setReportTimezone(t *testing.T, loc *time.Location) {
+	t.Helper()
+
+	appConfig.Timezone = loc
+	if err := syncReportTimezone(db, loc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestViewsInReportTimezone(t *testing.T) {
+	for _, name := range []string{"Australia/Sydney", "Asia/Kolkata", "America/St_Johns"} {
+		t.Run(name, func(t *testing.T) {
+			setupTest(t)
+			setReportTimezone(t, loadLocation(t, name))
+
+			now := time.Now()
+			attacks := generateAttacks(7, 500, now)
+			saveAttacks(t, attacks)
+
+			for _, test := range viewTests(attacks, now) {
+				got := queryRows(t, fmt.Sprintf(`SELECT * FROM "%s"`, test.view))
+				if test.normalize != nil {
+					for _, row := range got {
+						test.normalize(row)
+					}
+				}
+				t.Run(test.view, func(t *testing.T) { compareRows(t, got, test.want) })
+			}
+		})
+	}
+}
+
+func TestViewsAcrossDaylightSavingTime(t *testing.T) {
+	setupTest(t)
+	setReportTimezone(t, loadLocation(t, "America/New_York"))
+
+	attack := func(timestamp string) *Attack {
+		at, err := time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Attack{SourceIP: "198.51.100.1", DestinationIP: "203.0.113.10", Username: "root", Password: timestamp,
+			AttackTimestamp: FlexibleTime(at), AttackType: "SSH_BRUTEFORCE"}
+	}
+	saveAttacks(t, []*Attack{
+		// The clocks go forward from 02:00 to 03:00 on 2025-03-09.
+		attack("2025-03-09T06:30:00Z"),
+		attack("2025-03-09T07:30:00Z"),
+		// The clocks go back from 02:00 to 01:00 on 2025-11-02, 01:30 happens twice.
+		attack("2025-11-02T05:30:00Z"),
+		attack("2025-11-02T06:30:00Z"),
+		attack("2025-11-02T06:31:00Z"),
+		// Midnight in New York is 05:00 in UTC.
+		attack("2025-11-03T04:59:00Z"),
+		attack("2025-11-03T05:00:00Z"),
+	})
+
+	compareRows(t, queryRows(t, `SELECT "date", "hour_of_day", "minute_of_hour", "count", "utc_offset" FROM "view_attacks_by_time"`), [][]string{
+		{"2025-03-09", "01", "30", "1", "-05:00"},
+		{"2025-03-09", "03", "30", "1", "-04:00"},
+		{"2025-11-02", "01", "30", "1", "-04:00"},
+		{"2025-11-02", "01", "30", "1", "-05:00"},
+		{"2025-11-02", "01", "31", "1", "-05:00"},
+		{"2025-11-02", "23", "59", "1", "-05:00"},
+		{"2025-11-03", "00", "00", "1", "-05:00"},
+	})
+	compareRows(t, queryRows(t, `SELECT * FROM "view_daily_attacks"`), [][]string{
+		{"2025-11-03", "1"},
+		{"2025-11-02", "4"},
+		{"2025-03-09", "2"},
+	})
+	compareRows(t, queryRows(t, `SELECT "time" FROM "view_log" LIMIT 4`), [][]string{
+		{"2025-11-03 00:00:00"},
+		{"2025-11-02 23:59:00"},
+		{"2025-11-02 01:31:00"},
+		{"2025-11-02 01:30:00"},
+	})
+}
+
+func TestSyncReportTimezone(t *testing.T) {
+	setupTest(t)
+
+	berlin := loadLocation(t, "Europe/Berlin")
+	setReportTimezone(t, berlin)
+	var zone string
+	var offsets int
+	if err := db.QueryRow(`SELECT MIN("zone"), COUNT(*) FROM "_report_timezone"`).Scan(&zone, &offsets); err != nil {
+		t.Fatal(err)
+	}
+	if zone != "Europe/Berlin" || offsets != len(timezoneOffsets(berlin)) {
+		t.Errorf("got %d offsets of %s, want %d of Europe/Berlin", offsets, zone, len(timezoneOffsets(berlin)))
+	}
+
+	// The hours and days are rolled up in the new timezone.
+	saveAttacks(t, generateAttacks(3, 200, time.Now()))
+	for _, loc := range []*time.Location{loadLocation(t, "Asia/Kolkata"), time.UTC} {
+		setReportTimezone(t, loc)
+		assertRollups(t, db)
+	}
+	compareRows(t, queryRows(t, `SELECT "since", "offset", "utc_offset", "zone" FROM "_report_timezone"`), [][]string{
+		{fmt.Sprint(int64(math.MinInt64)), "0", "+00:00", "UTC"},
+	})
+	if err := verifySchema(db); err != nil {
+		t.Errorf("the offsets changed the schema: %v", err)
+	}
+}
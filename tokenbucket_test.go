@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(2, 3)
+	now := bucket.lastFill
+
+	// A full bucket allows a burst, then nothing until it refilled.
+	for i := range 3 {
+		if !bucket.allowAt(now) {
+			t.Fatalf("request %d of the burst was not allowed", i+1)
+		}
+	}
+	if bucket.allowAt(now) {
+		t.Fatal("the empty bucket allowed a request")
+	}
+
+	// Two tokens per second, so half a second refills one.
+	now = now.Add(250 * time.Millisecond)
+	if bucket.allowAt(now) {
+		t.Error("a quarter token allowed a request")
+	}
+	now = now.Add(250 * time.Millisecond)
+	if !bucket.allowAt(now) {
+		t.Error("the refilled token was not allowed")
+	}
+
+	// Refilling stops at the burst size.
+	now = now.Add(time.Hour)
+	allowed := 0
+	for bucket.allowAt(now) {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Errorf("got %d requests allowed after an hour, want the burst of 3", allowed)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits for the free text fields of an attack.
+const (
+	maxCredentialBytes = 1024
+	maxAttackTypeBytes = 128
+)
+
+var ErrQuarantined = errors.New("attack quarantined")
+
+// ValidationError describes why an attack was rejected.
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrQuarantined
+}
+
+// normalizeIP parses an IPv4 or IPv6 address and returns its canonical form.
+// IPv4-mapped IPv6 addresses are converted to plain IPv4.
+func normalizeIP(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", fmt.Errorf("is empty")
+	}
+
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return "", fmt.Errorf("is not an IP address")
+	}
+	if addr.Zone() != "" {
+		return "", fmt.Errorf("has an IPv6 zone")
+	}
+	return addr.Unmap().String(), nil
+}
+
+// sanitizeText makes attacker controlled text safe to store.
+// Invalid UTF-8 and NUL bytes are replaced with U+FFFD, every other character is kept as is.
+func sanitizeText(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	return strings.ReplaceAll(s, "\x00", "\uFFFD")
+}
+
+// truncateText cuts s to at most maxBytes without splitting a UTF-8 sequence.
+func truncateText(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	s = s[:maxBytes]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// logSafe escapes control and non-printable characters so attacker controlled text cannot forge log lines.
+func logSafe(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x80 && !unicode.IsPrint(r):
+			fmt.Fprintf(&b, `\x%02x`, r)
+		case !unicode.IsPrint(r) && r != ' ':
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// normalizeAttack validates the attack and brings it into its canonical form for storage.
+// The timestamp is checked against now, the time the attack was received.
+// A *ValidationError is returned if the attack has to be quarantined.
+func normalizeAttack(attack *Attack, now time.Time) error {
+	sourceIP, err := normalizeIP(attack.SourceIP)
+	if err != nil {
+		return &ValidationError{Reason: "source_ip " + err.Error()}
+	}
+	destinationIP, err := normalizeIP(attack.DestinationIP)
+	if err != nil {
+		return &ValidationError{Reason: "destination_ip " + err.Error()}
+	}
+
+	timestamp := attack.AttackTimestamp.ToTime()
+	if timestamp.IsZero() {
+		return &ValidationError{Reason: "attack_timestamp is missing"}
+	}
+	if appConfig.MaxTimestampSkew > 0 && timestamp.After(now.Add(appConfig.MaxTimestampSkew)) {
+		return &ValidationError{Reason: fmt.Sprintf("attack_timestamp is more than %s in the future", appConfig.MaxTimestampSkew)}
+	}
+	if appConfig.MaxAttackAge > 0 && timestamp.Before(now.Add(-appConfig.MaxAttackAge)) {
+		return &ValidationError{Reason: fmt.Sprintf("attack_timestamp is more than %s in the past", appConfig.MaxAttackAge)}
+	}
+
+	username := sanitizeText(attack.Username)
+	password := sanitizeText(attack.Password)
+	if len(username) > maxCredentialBytes {
+		return &ValidationError{Reason: fmt.Sprintf("username is longer than %d bytes", maxCredentialBytes)}
+	}
+	if len(password) > maxCredentialBytes {
+		return &ValidationError{Reason: fmt.Sprintf("password is longer than %d bytes", maxCredentialBytes)}
+	}
+
+	attackType := strings.TrimSpace(sanitizeText(attack.AttackType))
+	if attackType == "" {
+		return &ValidationError{Reason: "attack_type is missing"}
+	}
+	if len(attackType) > maxAttackTypeBytes {
+		return &ValidationError{Reason: fmt.Sprintf("attack_type is longer than %d bytes", maxAttackTypeBytes)}
+	}
+
+	evidence := strings.TrimSpace(sanitizeText(attack.Evidence))
+	if appConfig.MaxEvidenceBytes > 0 {
+		evidence = truncateText(evidence, appConfig.MaxEvidenceBytes)
+	}
+
+	attack.SourceIP = sourceIP
+	attack.DestinationIP = destinationIP
+	attack.Username = username
+	attack.Password = password
+	attack.AttackType = attackType
+	attack.Evidence = evidence
+	return nil
+}
+
+// quarantineAttack stores a rejected attack together with the reason.
+func quarantineAttack(attack *Attack, reason string) error {
+	data, err := json.Marshal(attack)
+	if err != nil {
+		return fmt.Errorf("could not marshal attack: %w", err)
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	_, err = db.Exec(`INSERT INTO "_quarantine" ("received", "reason", "source_ip", "data") VALUES (?, ?, ?, ?)`,
+		time.Now().UnixMilli(), reason, attack.SourceIP, string(data))
+	if err != nil {
+		return fmt.Errorf("could not insert into quarantine: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  string
+	}{
+		{"198.51.100.1", "198.51.100.1", ""},
+		{" 198.51.100.1\n", "198.51.100.1", ""},
+		{"::ffff:198.51.100.1", "198.51.100.1", ""},
+		{"2001:DB8:0:0::1", "2001:db8::1", ""},
+		{"[2001:db8::1]", "2001:db8::1", ""},
+		{"", "", "is empty"},
+		{"   ", "", "is empty"},
+		{"198.51.100.256", "", "is not an IP address"},
+		{"198.51.100.1:22", "", "is not an IP address"},
+		{"example.com", "", "is not an IP address"},
+		{"fe80::1%eth0", "", "has an IPv6 zone"},
+	}
+	for _, test := range tests {
+		got, err := normalizeIP(test.in)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("normalizeIP(%q): got error %v, want %q", test.in, err, test.err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("normalizeIP(%q) = %q, %v, want %q", test.in, got, err, test.want)
+		}
+	}
+}
+
+func TestSanitizeText(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"root", "root"},
+		{"", ""},
+		{"pass\x00word", "pass�word"},
+		{"bad\xff\xfeutf8", "bad�utf8"},
+		{"tab\tnew\nline\x1b[31m", "tab\tnew\nline\x1b[31m"},
+		{"pässwörd 🔑", "pässwörd 🔑"},
+	}
+	for _, test := range tests {
+		if got := sanitizeText(test.in); got != test.want {
+			t.Errorf("sanitizeText(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeAttack(t *testing.T) {
+	setupTest(t)
+	appConfig.MaxTimestampSkew = time.Hour
+	appConfig.MaxAttackAge = 30 * 24 * time.Hour
+	appConfig.MaxEvidenceBytes = 16
+
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	valid := func() *Attack {
+		return &Attack{
+			SourceIP:        "::ffff:198.51.100.1",
+			DestinationIP:   " 203.0.113.10 ",
+			Username:        "ro\x00ot",
+			Password:        "123456",
+			AttackTimestamp: FlexibleTime(now.Add(-time.Minute)),
+			Evidence:        "  SSH-2.0-libssh_0.9.6 and more  ",
+			AttackType:      " SSH_BRUTEFORCE ",
+		}
+	}
+
+	attack := valid()
+	if err := normalizeAttack(attack, now); err != nil {
+		t.Fatal(err)
+	}
+	want := Attack{
+		SourceIP:        "198.51.100.1",
+		DestinationIP:   "203.0.113.10",
+		Username:        "ro�ot",
+		Password:        "123456",
+		AttackTimestamp: FlexibleTime(now.Add(-time.Minute)),
+		Evidence:        "SSH-2.0-libssh_0",
+		AttackType:      "SSH_BRUTEFORCE",
+	}
+	if *attack != want {
+		t.Errorf("got %+v, want %+v", *attack, want)
+	}
+
+	tests := []struct {
+		vary   func(*Attack)
+		reason string
+	}{
+		{func(a *Attack) { a.SourceIP = "" }, "source_ip is empty"},
+		{func(a *Attack) { a.DestinationIP = "pod-1" }, "destination_ip is not an IP address"},
+		{func(a *Attack) { a.AttackTimestamp = FlexibleTime{} }, "attack_timestamp is missing"},
+		{func(a *Attack) { a.AttackTimestamp = FlexibleTime(now.Add(2 * time.Hour)) }, "attack_timestamp is more than 1h0m0s in the future"},
+		{func(a *Attack) { a.AttackTimestamp = FlexibleTime(now.AddDate(0, 0, -31)) }, "attack_timestamp is more than 720h0m0s in the past"},
+		{func(a *Attack) { a.Username = strings.Repeat("u", maxCredentialBytes+1) }, "username is longer than 1024 bytes"},
+		{func(a *Attack) { a.Password = strings.Repeat("p", maxCredentialBytes+1) }, "password is longer than 1024 bytes"},
+		{func(a *Attack) { a.AttackType = " \t" }, "attack_type is missing"},
+		{func(a *Attack) { a.AttackType = strings.Repeat("t", maxAttackTypeBytes+1) }, "attack_type is longer than 128 bytes"},
+	}
+	for _, test := range tests {
+		attack := valid()
+		test.vary(attack)
+		err := normalizeAttack(attack, now)
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) || validationErr.Reason != test.reason || !errors.Is(err, ErrQuarantined) {
+			t.Errorf("got %v, want %q", err, test.reason)
+		}
+	}
+}
+
+func TestReplayOldDeadLetter(t *testing.T) {
+	setupTest(t)
+	appConfig.MaxAttackAge = 30 * 24 * time.Hour
+
+	// The attack was fresh when the letter was received 40 days ago.
+	received := time.Now().AddDate(0, 0, -40)
+	attack := generateAttacks(5, 1, received)[0]
+	attack.AttackTimestamp = FlexibleTime(received.Add(-time.Minute))
+	letter := &DeadLetter{ID: 1, Received: received, Body: attackJSON(t, attack)}
+
+	result, err := replayDeadLetter(letter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "saved" {
+		t.Errorf("got %q, want the old attack saved", result)
+	}
+
+	// Received now, the same attack is too old.
+	old := *attack
+	old.SourceIP = "198.51.100.200"
+	if err := saveAttackToDB(&old); !errors.Is(err, ErrQuarantined) {
+		t.Errorf("got %v, want the attack quarantined", err)
+	}
+}
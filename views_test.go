@@ -0,0 +1,324 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type viewTest struct {
+	view string
+	want [][]string
+	// normalize makes columns with an unspecified order comparable.
+	normalize func(row []string)
+}
+
+// group is the aggregation of the attacks that share a key.
+type group struct {
+	key         []string
+	count       int
+	usernames   map[string]bool
+	passwords   map[string]bool
+	logins      map[string]bool
+	sources     map[string]bool
+	first, last string
+}
+
+// groupAttacks groups the attacks by the key function, skipping attacks for which it returns nil.
+func groupAttacks(attacks []*Attack, key func(*Attack) []string) []*group {
+	groups := make(map[string]*group)
+	for _, attack := range attacks {
+		k := key(attack)
+		if k == nil {
+			continue
+		}
+
+		id := strings.Join(k, "\x00")
+		g, ok := groups[id]
+		if !ok {
+			g = &group{
+				key:       k,
+				usernames: make(map[string]bool),
+				passwords: make(map[string]bool),
+				logins:    make(map[string]bool),
+				sources:   make(map[string]bool),
+			}
+			groups[id] = g
+		}
+
+		seen := localDateTime(attack)
+		if g.count == 0 || seen < g.first {
+			g.first = seen
+		}
+		if g.count == 0 || seen > g.last {
+			g.last = seen
+		}
+		g.count++
+		g.usernames[attack.Username] = true
+		g.passwords[attack.Password] = true
+		g.logins[attack.Username+" <-| username @ password |-> "+attack.Password] = true
+		g.sources[attack.SourceIP] = true
+	}
+
+	result := make([]*group, 0, len(groups))
+	for _, g := range groups {
+		result = append(result, g)
+	}
+	return result
+}
+
+// localTime converts the timestamp like the views do: whole seconds in the reporting timezone.
+func localTime(attack *Attack) time.Time {
+	return time.Unix(attack.AttackTimestamp.ToTime().UnixMilli()/1000, 0).In(reportLocation())
+}
+
+// utcOffset is the offset of the reporting timezone at the time, as the views show it.
+func utcOffset(t time.Time) string {
+	_, offset := t.Zone()
+	return formatUTCOffset(offset)
+}
+
+func localDate(attack *Attack) string {
+	return localTime(attack).Format(time.DateOnly)
+}
+
+func localDateTime(attack *Attack) string {
+	return localTime(attack).Format(time.DateTime)
+}
+
+// weekOfYear is the week number of strftime's %W: weeks start on Monday, days before the first Monday are week 0.
+func weekOfYear(t time.Time) int {
+	weekday := (int(t.Weekday()) + 6) % 7
+	return (t.YearDay() - 1 + 7 - weekday) / 7
+}
+
+func since(attacks []*Attack, from time.Time) []*Attack {
+	var result []*Attack
+	for _, attack := range attacks {
+		if !attack.AttackTimestamp.ToTime().Before(from) {
+			result = append(result, attack)
+		}
+	}
+	return result
+}
+
+// countRows returns the key columns and the count of each group, ordered by less.
+func countRows(groups []*group, less func(a, b *group) bool, limit int) [][]string {
+	sort.Slice(groups, func(i, j int) bool { return less(groups[i], groups[j]) })
+	if limit > 0 && len(groups) > limit {
+		groups = groups[:limit]
+	}
+
+	rows := make([][]string, 0, len(groups))
+	for _, g := range groups {
+		rows = append(rows, append(append([]string{}, g.key...), strconv.Itoa(g.count)))
+	}
+	return rows
+}
+
+// byCountDesc orders by count descending, then by the key columns ascending.
+func byCountDesc(a, b *group) bool {
+	if a.count != b.count {
+		return a.count > b.count
+	}
+	return keyLess(a.key, b.key)
+}
+
+func keyLess(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// byDateDescCountDesc orders by the date in the first key column descending, then by count and the other columns.
+func byDateDescCountDesc(a, b *group) bool {
+	if a.key[0] != b.key[0] {
+		return a.key[0] > b.key[0]
+	}
+	return byCountDesc(a, b)
+}
+
+func field(get func(*Attack) string) func(*Attack) []string {
+	return func(attack *Attack) []string { return []string{get(attack)} }
+}
+
+func daily(get func(*Attack) string) func(*Attack) []string {
+	return func(attack *Attack) []string { return []string{localDate(attack), get(attack)} }
+}
+
+func username(attack *Attack) string { return attack.Username }
+func password(attack *Attack) string { return attack.Password }
+func sourceIP(attack *Attack) string { return attack.SourceIP }
+func login(attack *Attack) []string  { return []string{attack.Username, attack.Password} }
+
+// viewTests computes the expected rows of every view from the generated attacks.
+func viewTests(attacks []*Attack, now time.Time) []viewTest {
+	day := 24 * time.Hour
+	lastDay := since(attacks, now.Add(-day))
+	lastWeek := since(attacks, now.Add(-7*day))
+
+	tests := []viewTest{
+		{view: "view_usernames", want: countRows(groupAttacks(attacks, field(username)), byCountDesc, 0)},
+		{view: "view_passwords", want: countRows(groupAttacks(attacks, field(password)), byCountDesc, 0)},
+		{view: "view_source_ips", want: countRows(groupAttacks(attacks, field(sourceIP)), byCountDesc, 0)},
+		{view: "view_logins", want: countRows(groupAttacks(attacks, login), byCountDesc, 0)},
+		{view: "view_daily_attacks", want: countRows(groupAttacks(attacks, field(localDate)), func(a, b *group) bool {
+			return a.key[0] > b.key[0]
+		}, 0)},
+		{view: "view_daily_usernames", want: countRows(groupAttacks(attacks, daily(username)), byDateDescCountDesc, 0)},
+		{view: "view_daily_passwords", want: countRows(groupAttacks(attacks, daily(password)), byDateDescCountDesc, 0)},
+		{view: "view_daily_source_ips", want: countRows(groupAttacks(attacks, daily(sourceIP)), byDateDescCountDesc, 0)},
+		{view: "report_top_attackers_last_24_hours", want: countRows(groupAttacks(lastDay, field(sourceIP)), byCountDesc, 20)},
+		{view: "report_top_usernames_last_7_days", want: countRows(groupAttacks(lastWeek, field(username)), byCountDesc, 20)},
+		{view: "report_top_passwords_last_7_days", want: countRows(groupAttacks(lastWeek, field(password)), byCountDesc, 20)},
+		{view: "report_top_logins_last_7_days", want: countRows(groupAttacks(lastWeek, login), byCountDesc, 20)},
+	}
+
+	// view_log lists every attack, newest first.
+	sorted := append([]*Attack(nil), attacks...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].AttackTimestamp.ToTime().After(sorted[j].AttackTimestamp.ToTime())
+	})
+	var log [][]string
+	for _, attack := range sorted {
+		log = append(log, []string{localDateTime(attack), attack.SourceIP, attack.Username, attack.Password})
+	}
+	tests = append(tests, viewTest{view: "view_log", want: log})
+
+	// view_attacks_by_time counts per minute and offset, in the order the minutes happened.
+	byMinute := groupAttacks(attacks, func(attack *Attack) []string {
+		t := localTime(attack)
+		return []string{t.Format(time.DateOnly), t.Format("01"), strconv.Itoa(weekOfYear(t)), strconv.Itoa(int(t.Weekday())),
+			t.Format("02"), t.Format("15"), t.Format("04"), utcOffset(t)}
+	})
+	for _, g := range byMinute {
+		if len(g.key[2]) == 1 {
+			g.key[2] = "0" + g.key[2]
+		}
+	}
+	happened := func(date, clock, offset string) time.Time {
+		t, _ := time.Parse("2006-01-02 15:04:05-07:00", date+" "+clock+offset)
+		return t
+	}
+	minuteRows := countRows(byMinute, func(a, b *group) bool {
+		return happened(a.key[0], a.key[5]+":"+a.key[6]+":00", a.key[7]).Before(happened(b.key[0], b.key[5]+":"+b.key[6]+":00", b.key[7]))
+	}, 0)
+	for _, row := range minuteRows {
+		// The offset comes after the count.
+		row[7], row[8] = row[8], row[7]
+	}
+	tests = append(tests, viewTest{view: "view_attacks_by_time", want: minuteRows})
+
+	// report_hourly_attacks_last_7_days sums the hours since the same hour 7 days ago.
+	fromHour := now.Add(-7 * day).In(reportLocation()).Format("2006-01-02 15:00:00")
+	hourly := groupAttacks(attacks, func(attack *Attack) []string {
+		t := localTime(attack)
+		hour := t.Format("2006-01-02 15:00:00")
+		if hour < fromHour {
+			return nil
+		}
+		return []string{hour, utcOffset(t)}
+	})
+	sort.Slice(hourly, func(i, j int) bool {
+		return happened(hourly[i].key[0][:10], hourly[i].key[0][11:], hourly[i].key[1]).Before(
+			happened(hourly[j].key[0][:10], hourly[j].key[0][11:], hourly[j].key[1]))
+	})
+	var hourlyRows [][]string
+	for _, g := range hourly {
+		from, _ := time.Parse(time.DateTime, g.key[0])
+		hourlyRows = append(hourlyRows, []string{g.key[0], from.Add(time.Hour).Format(time.DateTime), strconv.Itoa(g.count), g.key[1]})
+	}
+	tests = append(tests, viewTest{view: "report_hourly_attacks_last_7_days", want: hourlyRows})
+
+	// report_daily_attacks_last_90_days sums the days since the same day 90 days ago.
+	fromDay := now.Add(-90 * day).In(reportLocation()).Format("2006-01-02 00:00:00")
+	dailyGroups := groupAttacks(attacks, func(attack *Attack) []string {
+		date := localDate(attack) + " 00:00:00"
+		if date < fromDay {
+			return nil
+		}
+		return []string{date}
+	})
+	sort.Slice(dailyGroups, func(i, j int) bool { return dailyGroups[i].key[0] < dailyGroups[j].key[0] })
+	var dailyRows [][]string
+	for _, g := range dailyGroups {
+		from, _ := time.Parse(time.DateTime, g.key[0])
+		dailyRows = append(dailyRows, []string{g.key[0], from.AddDate(0, 0, 1).Format(time.DateTime), strconv.Itoa(g.count)})
+	}
+	tests = append(tests, viewTest{view: "report_daily_attacks_last_90_days", want: dailyRows})
+
+	// view_attack_patterns_by_source
+	sources := groupAttacks(attacks, field(sourceIP))
+	sort.Slice(sources, func(i, j int) bool { return byCountDesc(sources[i], sources[j]) })
+	var patterns [][]string
+	for _, g := range sources {
+		patterns = append(patterns, []string{g.key[0], strconv.Itoa(g.count), strconv.Itoa(len(g.usernames)),
+			strconv.Itoa(len(g.passwords)), strconv.Itoa(len(g.logins)), g.first, g.last})
+	}
+	tests = append(tests, viewTest{view: "view_attack_patterns_by_source", want: patterns})
+
+	// view_attack_spread_by_username
+	spread := groupAttacks(attacks, field(username))
+	sort.Slice(spread, func(i, j int) bool {
+		a, b := spread[i], spread[j]
+		if a.count != b.count {
+			return a.count > b.count
+		}
+		if len(a.sources) != len(b.sources) {
+			return len(a.sources) > len(b.sources)
+		}
+		return a.key[0] < b.key[0]
+	})
+	var spreadRows [][]string
+	for _, g := range spread {
+		spreadRows = append(spreadRows, []string{g.key[0], strconv.Itoa(g.count), strconv.Itoa(len(g.sources))})
+	}
+	tests = append(tests, viewTest{view: "view_attack_spread_by_username", want: spreadRows})
+
+	// view_credential_fingerprints and the report of new fingerprints.
+	fingerprints := groupAttacks(attacks, login)
+	sort.Slice(fingerprints, func(i, j int) bool {
+		a, b := fingerprints[i], fingerprints[j]
+		if len(a.sources) != len(b.sources) {
+			return len(a.sources) < len(b.sources)
+		}
+		if a.count != b.count {
+			return a.count > b.count
+		}
+		if a.last != b.last {
+			return a.last > b.last
+		}
+		return keyLess(a.key, b.key)
+	})
+	fromWeek := now.Add(-7 * day).In(reportLocation()).Format(time.DateTime)
+	var fingerprintRows, newFingerprintRows [][]string
+	for _, g := range fingerprints {
+		sources := make([]string, 0, len(g.sources))
+		for source := range g.sources {
+			sources = append(sources, source)
+		}
+		sort.Strings(sources)
+
+		row := []string{g.key[0], g.key[1], strconv.Itoa(g.count), strconv.Itoa(len(g.sources)), g.first, g.last,
+			strings.Join(sources, ",")}
+		fingerprintRows = append(fingerprintRows, row)
+		if len(g.sources) == 1 && g.first >= fromWeek {
+			newFingerprintRows = append(newFingerprintRows, row)
+		}
+	}
+	sortSources := func(row []string) {
+		sources := strings.Split(row[6], ",")
+		sort.Strings(sources)
+		row[6] = strings.Join(sources, ",")
+	}
+	tests = append(tests,
+		viewTest{view: "view_credential_fingerprints", want: fingerprintRows, normalize: sortSources},
+		viewTest{view: "report_new_credential_fingerprints_last_7_days", want: newFingerprintRows, normalize: sortSources},
+	)
+
+	return tests
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// webhookClient is shared by all outgoing webhook notifications.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+type WebhookFormat string
+
+// These are the supported payload formats for outgoing webhooks.
+const (
+	// WebhookFormatGeneric posts the whole event as JSON.
+	WebhookFormatGeneric WebhookFormat = "generic"
+	// WebhookFormatSlack posts a Slack compatible incoming webhook message. Mattermost and Discord (/slack) accept it as well.
+	WebhookFormatSlack WebhookFormat = "slack"
+	// WebhookFormatMatrix sends an m.text message via the Matrix client-server API.
+	// The URL has to point to .../rooms/{roomId}/send/m.room.message, the transaction ID is appended.
+	WebhookFormatMatrix WebhookFormat = "matrix"
+)
+
+type WebhookConfig struct {
+	Name   string        `json:"name"`
+	URL    string        `json:"url"`
+	Format WebhookFormat `json:"format"`
+	// Token is sent as a bearer token. It is required for Matrix.
+	Token string `json:"token"`
+	// Template is an optional text/template that renders the JSON body from a NotifyEvent.
+	Template string `json:"template"`
+	// RateLimitPerMinute limits the number of messages sent to this webhook. Zero means 30.
+	RateLimitPerMinute int `json:"rate_limit_per_minute"`
+}
+
+type Webhook struct {
+	WebhookConfig
+
+	template *template.Template
+	limiter  *tokenBucket
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func newWebhook(config WebhookConfig) (*Webhook, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("webhook %q has no url", config.Name)
+	}
+
+	switch config.Format {
+	case "":
+		config.Format = WebhookFormatGeneric
+	case WebhookFormatGeneric, WebhookFormatSlack:
+	case WebhookFormatMatrix:
+		if config.Token == "" {
+			return nil, fmt.Errorf("matrix webhook %q needs a token", config.Name)
+		}
+	default:
+		return nil, fmt.Errorf("webhook %q has unknown format %q", config.Name, config.Format)
+	}
+
+	if config.RateLimitPerMinute <= 0 {
+		config.RateLimitPerMinute = 30
+	}
+
+	hook := &Webhook{
+		WebhookConfig: config,
+		limiter:       newTokenBucket(float64(config.RateLimitPerMinute)/60, float64(config.RateLimitPerMinute)),
+	}
+
+	if config.Template != "" {
+		tmpl, err := template.New(config.Name).Funcs(webhookTemplateFuncs).Parse(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse template of webhook %q: %w", config.Name, err)
+		}
+		hook.template = tmpl
+	}
+
+	return hook, nil
+}
+
+// body renders the request body for the event.
+func (h *Webhook) body(event NotifyEvent) ([]byte, error) {
+	if h.template != nil {
+		var buf bytes.Buffer
+		if err := h.template.Execute(&buf, event); err != nil {
+			return nil, fmt.Errorf("could not execute template: %w", err)
+		}
+		if !json.Valid(buf.Bytes()) {
+			return nil, fmt.Errorf("template did not render valid JSON")
+		}
+		return buf.Bytes(), nil
+	}
+
+	switch h.Format {
+	case WebhookFormatSlack:
+		return json.Marshal(map[string]string{"text": event.Text})
+	case WebhookFormatMatrix:
+		return json.Marshal(map[string]string{"msgtype": "m.text", "body": event.Text})
+	default:
+		return json.Marshal(event)
+	}
+}
+
+// Send delivers the event to the webhook.
+func (h *Webhook) Send(event NotifyEvent) error {
+	body, err := h.body(event)
+	if err != nil {
+		return err
+	}
+
+	method := http.MethodPost
+	target := h.URL
+	if h.Format == WebhookFormatMatrix {
+		method = http.MethodPut
+		target = strings.TrimSuffix(target, "/") + "/" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	return sendWebhook(method, target, h.Token, body)
+}
+
+// sendWebhook sends the JSON body to the given URL.
+// Any non-2xx response is treated as an error.
+func sendWebhook(method, webhookURL, token string, body []byte) error {
+	req, err := http.NewRequest(method, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SSH-AttackPod-Proxy/1.0")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
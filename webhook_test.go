@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// newWebhookReceiver starts a server that answers webhooks with the given status and passes on what it received.
+func newWebhookReceiver(t *testing.T, status int) (*httptest.Server, <-chan webhookRequest) {
+	t.Helper()
+
+	received := make(chan webhookRequest, 64)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- webhookRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+// nextWebhook returns the next request the receiver got.
+func nextWebhook(t *testing.T, received <-chan webhookRequest) webhookRequest {
+	t.Helper()
+
+	select {
+	case req := <-received:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was not called")
+	}
+	return webhookRequest{}
+}
+
+func TestNewWebhook(t *testing.T) {
+	hook, err := newWebhook(WebhookConfig{Name: "ops", URL: "http://127.0.0.1/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hook.Format != WebhookFormatGeneric || hook.RateLimitPerMinute != 30 || hook.limiter.burst != 30 {
+		t.Errorf("got format %q and %d messages per minute, want generic and 30", hook.Format, hook.RateLimitPerMinute)
+	}
+
+	tests := []struct {
+		config WebhookConfig
+		err    string
+	}{
+		{WebhookConfig{Name: "ops"}, `webhook "ops" has no url`},
+		{WebhookConfig{Name: "ops", URL: "http://127.0.0.1", Format: "teams"}, `webhook "ops" has unknown format "teams"`},
+		{WebhookConfig{Name: "ops", URL: "http://127.0.0.1", Format: WebhookFormatMatrix}, `matrix webhook "ops" needs a token`},
+		{WebhookConfig{Name: "ops", URL: "http://127.0.0.1", Template: "{{.Text"}, `could not parse template of webhook "ops"`},
+	}
+	for _, test := range tests {
+		if _, err := newWebhook(test.config); err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("newWebhook(%+v): got error %v, want %q", test.config, err, test.err)
+		}
+	}
+}
+
+func TestWebhookFormats(t *testing.T) {
+	server, received := newWebhookReceiver(t, http.StatusOK)
+	event := NotifyEvent{
+		Rule:   "bruteforce",
+		Type:   RuleTypeSourceRate,
+		Event:  "source_rate_exceeded",
+		Key:    "198.51.100.1",
+		Text:   `Source 198.51.100.1 made more than 10 "attempts".`,
+		Time:   time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC),
+		Fields: map[string]any{"count": 11},
+	}
+
+	tests := []struct {
+		config WebhookConfig
+		method string
+		path   string
+		body   string
+	}{
+		{
+			WebhookConfig{URL: server.URL + "/generic"},
+			http.MethodPost, "/generic",
+			`{"rule":"bruteforce","type":"source_rate","event":"source_rate_exceeded","key":"198.51.100.1",` +
+				`"text":"Source 198.51.100.1 made more than 10 \"attempts\".","time":"2025-03-10T12:00:00Z","fields":{"count":11}}`,
+		},
+		{
+			WebhookConfig{URL: server.URL + "/slack", Format: WebhookFormatSlack},
+			http.MethodPost, "/slack",
+			`{"text":"Source 198.51.100.1 made more than 10 \"attempts\"."}`,
+		},
+		{
+			WebhookConfig{URL: server.URL + "/rooms/!room:example.org/send/m.room.message/", Format: WebhookFormatMatrix, Token: "matrix-token"},
+			http.MethodPut, "/rooms/!room:example.org/send/m.room.message/",
+			`{"body":"Source 198.51.100.1 made more than 10 \"attempts\".","msgtype":"m.text"}`,
+		},
+		{
+			WebhookConfig{URL: server.URL + "/template", Template: `{"summary":{{json .Text}},"ip":"{{.Key}}","count":{{index .Fields "count"}}}`},
+			http.MethodPost, "/template",
+			`{"summary":"Source 198.51.100.1 made more than 10 \"attempts\".","ip":"198.51.100.1","count":11}`,
+		},
+	}
+	for _, test := range tests {
+		test.config.Name = string(test.config.Format)
+		hook, err := newWebhook(test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hook.Send(event); err != nil {
+			t.Fatalf("%s: %v", test.path, err)
+		}
+
+		req := nextWebhook(t, received)
+		if req.Method != test.method || !strings.HasPrefix(req.Path, test.path) || string(req.Body) != test.body {
+			t.Errorf("got %s %s %s, want %s %s %s", req.Method, req.Path, req.Body, test.method, test.path, test.body)
+		}
+		if req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: got Content-Type %q, want application/json", test.path, req.Header.Get("Content-Type"))
+		}
+
+		if test.config.Format != WebhookFormatMatrix {
+			if req.Header.Get("Authorization") != "" {
+				t.Errorf("%s: got Authorization %q, want none", test.path, req.Header.Get("Authorization"))
+			}
+			continue
+		}
+		// Matrix needs the token and a new transaction ID for every message.
+		if req.Header.Get("Authorization") != "Bearer matrix-token" {
+			t.Errorf("got Authorization %q, want the matrix token", req.Header.Get("Authorization"))
+		}
+		if transaction := strings.TrimPrefix(req.Path, test.path); transaction == "" || strings.Contains(transaction, "/") {
+			t.Errorf("got path %s, want a transaction ID after %s", req.Path, test.path)
+		}
+		if err := hook.Send(event); err != nil {
+			t.Fatal(err)
+		}
+		if next := nextWebhook(t, received); next.Path == req.Path {
+			t.Errorf("got the transaction ID of the last message again: %s", next.Path)
+		}
+	}
+}
+
+func TestWebhookErrors(t *testing.T) {
+	event := NotifyEvent{Key: "198.51.100.1", Text: "text"}
+
+	hook, err := newWebhook(WebhookConfig{Name: "broken", URL: "http://127.0.0.1/", Template: `{"text": {{.Text}}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.Send(event); err == nil || err.Error() != "template did not render valid JSON" {
+		t.Errorf("got %v, want the invalid JSON rejected", err)
+	}
+
+	server, received := newWebhookReceiver(t, http.StatusBadGateway)
+	hook, err = newWebhook(WebhookConfig{Name: "down", URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.Send(event); err == nil || err.Error() != "webhook returned status 502" {
+		t.Errorf("got %v, want the status reported", err)
+	}
+	var sent NotifyEvent
+	if err := json.Unmarshal(nextWebhook(t, received).Body, &sent); err != nil || sent.Key != event.Key {
+		t.Errorf("got %+v, %v, want the event", sent, err)
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:        "wordlists",
+		Usage:       "wordlists [rebuild|FAMILY]",
+		Description: "List the wordlist families, rebuild them first, or show the sources and credentials of a family.",
+		Run:         runWordlistsCommand,
+	})
+}
+
+const (
+	// minHashSize is the number of hash functions of a MinHash signature.
+	minHashSize = 126
+	// The signatures are split into bands of rows, sources whose signatures agree in a band are compared.
+	// With 3 rows, two sources with a similarity of 0.5 share a band with a probability of 99.6%, at 0.2 of 28%.
+	minHashRows  = 3
+	minHashBands = minHashSize / minHashRows
+	// wordlistRepresentatives is the number of credentials stored per family.
+	wordlistRepresentatives = 20
+)
+
+var metricWordlistFamilies = newGauge("netwatch_proxy_wordlist_families",
+	"Wordlist families found by the last rebuild.")
+
+// wordlistCredential is a username and password pair by their dictionary ids.
+type wordlistCredential struct {
+	username int64
+	password int64
+}
+
+func compareWordlistCredentials(a, b wordlistCredential) int {
+	if a.username != b.username {
+		return cmp.Compare(a.username, b.username)
+	}
+	return cmp.Compare(a.password, b.password)
+}
+
+// wordlistSource is a source with the set of credentials it tried, sorted by username and password.
+type wordlistSource struct {
+	sourceIP    int64
+	credentials []wordlistCredential
+	attacks     int
+	firstSeen   int64
+	lastSeen    int64
+}
+
+// WordlistFamily is a group of sources that try credentials from the same wordlist.
+type WordlistFamily struct {
+	ID          int64
+	Sources     int
+	Credentials int
+	Attacks     int
+	Similarity  float64
+	FirstSeen   time.Time
+	LastSeen    time.Time
+}
+
+// loadWordlistSources returns the sources that tried at least minCredentials distinct credentials.
+func loadWordlistSources(db *sql.DB, minCredentials int) ([]*wordlistSource, error) {
+	rows, err := db.Query(`SELECT "source_ip", "username", "password", "attacks", "first_seen", "last_seen"
+		FROM "_rollup_source_credentials"
+		ORDER BY "source_ip", "username", "password"`)
+	if err != nil {
+		return nil, fmt.Errorf("could not query source credentials: %w", err)
+	}
+	defer rows.Close()
+
+	var sources []*wordlistSource
+	var source *wordlistSource
+	keep := func() {
+		if source != nil && len(source.credentials) >= minCredentials {
+			sources = append(sources, source)
+		}
+	}
+	for rows.Next() {
+		var sourceIP, username, password, firstSeen, lastSeen int64
+		var attacks int
+		if err := rows.Scan(&sourceIP, &username, &password, &attacks, &firstSeen, &lastSeen); err != nil {
+			return nil, fmt.Errorf("could not scan source credential: %w", err)
+		}
+		if source == nil || source.sourceIP != sourceIP {
+			keep()
+			source = &wordlistSource{sourceIP: sourceIP, firstSeen: firstSeen, lastSeen: lastSeen}
+		}
+		source.credentials = append(source.credentials, wordlistCredential{username, password})
+		source.attacks += attacks
+		source.firstSeen = min(source.firstSeen, firstSeen)
+		source.lastSeen = max(source.lastSeen, lastSeen)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read source credentials: %w", err)
+	}
+	keep()
+	return sources, nil
+}
+
+// mix64 is the finalizer of SplitMix64, which spreads every bit of the input over the output.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// minHash returns the MinHash signature of the credentials. The share of equal positions in the signatures
+// of two sets estimates the Jaccard similarity of the sets.
+func minHash(credentials []wordlistCredential) [minHashSize]uint64 {
+	var signature [minHashSize]uint64
+	for i := range signature {
+		signature[i] = math.MaxUint64
+	}
+	for _, credential := range credentials {
+		hash := mix64(mix64(uint64(credential.username)) ^ uint64(credential.password))
+		for i := range signature {
+			signature[i] = min(signature[i], mix64(hash^mix64(uint64(i)+1)))
+		}
+	}
+	return signature
+}
+
+// jaccard returns the size of the intersection of the sorted sets divided by the size of their union.
+func jaccard(a, b []wordlistCredential) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch c := compareWordlistCredentials(a[i], b[j]); {
+		case c == 0:
+			shared++
+			i++
+			j++
+		case c < 0:
+			i++
+		default:
+			j++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// wordlistCluster is a group of sources found by clusterWordlistSources.
+type wordlistCluster struct {
+	sources []*wordlistSource
+	// similarity is the average similarity of every pair of sources in the cluster.
+	similarity float64
+}
+
+// clusterWordlistSources groups sources whose credential sets are at least as similar as the threshold.
+// Only sources that share a band of their MinHash signatures are candidates for a group,
+// which avoids comparing every source with every other one.
+// The most similar candidates are grouped first, and two groups are only joined if every source of one
+// is similar enough to every source of the other, so sources are never grouped through the sources in between.
+func clusterWordlistSources(sources []*wordlistSource, threshold float64) []wordlistCluster {
+	signatures := make([][minHashSize]uint64, len(sources))
+	for i, source := range sources {
+		signatures[i] = minHash(source.credentials)
+	}
+
+	type bandKey struct {
+		band int
+		hash [minHashRows]uint64
+	}
+	buckets := make(map[bandKey][]int)
+	for i := range sources {
+		for band := range minHashBands {
+			key := bandKey{band: band}
+			copy(key.hash[:], signatures[i][band*minHashRows:])
+			buckets[key] = append(buckets[key], i)
+		}
+	}
+
+	type candidate struct {
+		a, b       int
+		similarity float64
+	}
+	type pair struct{ a, b int }
+	compared := make(map[pair]bool)
+	var candidates []candidate
+	for _, bucket := range buckets {
+		for x := 0; x < len(bucket); x++ {
+			for y := x + 1; y < len(bucket); y++ {
+				p := pair{bucket[x], bucket[y]}
+				if compared[p] {
+					continue
+				}
+				compared[p] = true
+
+				if similarity := jaccard(sources[p.a].credentials, sources[p.b].credentials); similarity >= threshold {
+					candidates = append(candidates, candidate{p.a, p.b, similarity})
+				}
+			}
+		}
+	}
+	slices.SortFunc(candidates, func(x, y candidate) int {
+		if x.similarity != y.similarity {
+			return cmp.Compare(y.similarity, x.similarity)
+		}
+		if x.a != y.a {
+			return x.a - y.a
+		}
+		return x.b - y.b
+	})
+
+	// Every source starts as a group of its own, a group is kept under the index of one of its sources.
+	group := make([]int, len(sources))
+	members := make([][]int, len(sources))
+	similaritySum := make([]float64, len(sources))
+	pairs := make([]int, len(sources))
+	for i := range sources {
+		group[i] = i
+		members[i] = []int{i}
+	}
+	for _, c := range candidates {
+		a, b := group[c.a], group[c.b]
+		if a == b {
+			continue
+		}
+
+		sum, similar := 0.0, true
+		for _, x := range members[a] {
+			for _, y := range members[b] {
+				similarity := jaccard(sources[x].credentials, sources[y].credentials)
+				if similarity < threshold {
+					similar = false
+					break
+				}
+				sum += similarity
+			}
+			if !similar {
+				break
+			}
+		}
+		if !similar {
+			continue
+		}
+
+		if len(members[a]) < len(members[b]) {
+			a, b = b, a
+		}
+		for _, y := range members[b] {
+			group[y] = a
+		}
+		similaritySum[a] += similaritySum[b] + sum
+		pairs[a] += pairs[b] + len(members[a])*len(members[b])
+		members[a] = append(members[a], members[b]...)
+		members[b] = nil
+	}
+
+	var clusters []wordlistCluster
+	for i, indexes := range members {
+		if len(indexes) < 2 {
+			continue
+		}
+		slices.Sort(indexes)
+		cluster := wordlistCluster{similarity: similaritySum[i] / float64(pairs[i])}
+		for _, index := range indexes {
+			cluster.sources = append(cluster.sources, sources[index])
+		}
+		clusters = append(clusters, cluster)
+	}
+	// The biggest clusters pick their family ids first.
+	slices.SortFunc(clusters, func(a, b wordlistCluster) int {
+		if len(a.sources) != len(b.sources) {
+			return len(b.sources) - len(a.sources)
+		}
+		return int(a.sources[0].sourceIP - b.sources[0].sourceIP)
+	})
+	return clusters
+}
+
+// representativeCredentials returns the credentials tried by most sources of the cluster and how many tried them.
+func representativeCredentials(cluster wordlistCluster, limit int) ([]wordlistCredential, []int, int) {
+	counts := make(map[wordlistCredential]int)
+	for _, source := range cluster.sources {
+		for _, credential := range source.credentials {
+			counts[credential]++
+		}
+	}
+	credentials := make([]wordlistCredential, 0, len(counts))
+	for credential := range counts {
+		credentials = append(credentials, credential)
+	}
+	slices.SortFunc(credentials, func(a, b wordlistCredential) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+		return compareWordlistCredentials(a, b)
+	})
+
+	distinct := len(credentials)
+	credentials = credentials[:min(limit, len(credentials))]
+	sources := make([]int, len(credentials))
+	for i, credential := range credentials {
+		sources[i] = counts[credential]
+	}
+	return credentials, sources, distinct
+}
+
+// rebuildWordlistFamilies clusters the sources by their credentials and replaces the stored families.
+// A cluster takes over the id of the previous family it shares the most sources with.
+func rebuildWordlistFamilies(db *sql.DB, now time.Time) (int, error) {
+	sources, err := loadWordlistSources(db, appConfig.WordlistMinCredentials)
+	if err != nil {
+		return 0, err
+	}
+	clusters := clusterWordlistSources(sources, appConfig.WordlistSimilarity)
+
+	previous := make(map[int64]int64)
+	rows, err := db.Query(`SELECT "source_ip", "family" FROM "_wordlist_family_sources"`)
+	if err != nil {
+		return 0, fmt.Errorf("could not query previous wordlist families: %w", err)
+	}
+	for rows.Next() {
+		var sourceIP, family int64
+		if err := rows.Scan(&sourceIP, &family); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("could not scan previous wordlist family: %w", err)
+		}
+		previous[sourceIP] = family
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("could not read previous wordlist families: %w", err)
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"_wordlist_family_credentials", "_wordlist_family_sources", "_wordlist_families"} {
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM "%s"`, table)); err != nil {
+			return 0, fmt.Errorf("could not clear %s: %w", table, err)
+		}
+	}
+
+	insertFamily, err := tx.Prepare(`INSERT INTO "_wordlist_families" ("id", "sources", "credentials", "attacks", "similarity", "first_seen", "last_seen", "updated")
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer insertFamily.Close()
+	insertSource, err := tx.Prepare(`INSERT INTO "_wordlist_family_sources" ("family", "source_ip", "credentials", "attacks", "first_seen", "last_seen")
+		VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer insertSource.Close()
+	insertCredential, err := tx.Prepare(`INSERT INTO "_wordlist_family_credentials" ("family", "rank", "username", "password", "sources")
+		VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer insertCredential.Close()
+
+	taken := make(map[int64]bool)
+	for _, cluster := range clusters {
+		overlap := make(map[int64]int)
+		attacks := 0
+		firstSeen, lastSeen := int64(math.MaxInt64), int64(math.MinInt64)
+		for _, source := range cluster.sources {
+			if family, ok := previous[source.sourceIP]; ok && !taken[family] {
+				overlap[family]++
+			}
+			attacks += source.attacks
+			firstSeen = min(firstSeen, source.firstSeen)
+			lastSeen = max(lastSeen, source.lastSeen)
+		}
+		// A new family gets the next id, which AUTOINCREMENT never hands out twice.
+		var id sql.NullInt64
+		var best int
+		for family, n := range overlap {
+			if n > best || n == best && family < id.Int64 {
+				id, best = sql.NullInt64{Int64: family, Valid: true}, n
+			}
+		}
+		if id.Valid {
+			taken[id.Int64] = true
+		}
+
+		credentials, users, distinct := representativeCredentials(cluster, wordlistRepresentatives)
+		result, err := insertFamily.Exec(id, len(cluster.sources), distinct, attacks, cluster.similarity, firstSeen, lastSeen, now.UnixMilli())
+		if err != nil {
+			return 0, fmt.Errorf("could not insert wordlist family: %w", err)
+		}
+		family, err := result.LastInsertId()
+		if err != nil {
+			return 0, fmt.Errorf("could not get wordlist family id: %w", err)
+		}
+
+		for _, source := range cluster.sources {
+			if _, err := insertSource.Exec(family, source.sourceIP, len(source.credentials), source.attacks, source.firstSeen, source.lastSeen); err != nil {
+				return 0, fmt.Errorf("could not insert wordlist family source: %w", err)
+			}
+		}
+		for i, credential := range credentials {
+			if _, err := insertCredential.Exec(family, i+1, credential.username, credential.password, users[i]); err != nil {
+				return 0, fmt.Errorf("could not insert wordlist family credential: %w", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not commit wordlist families: %w", err)
+	}
+	metricWordlistFamilies.Set(float64(len(clusters)))
+	return len(clusters), nil
+}
+
+// runWordlistSchedule rebuilds the wordlist families right away and then every interval.
+func runWordlistSchedule(db *sql.DB, interval time.Duration) {
+	for {
+		start := time.Now()
+		families, err := rebuildWordlistFamilies(db, start)
+		if err != nil {
+			log.Printf("[ERROR] Failed to rebuild wordlist families: %v\n", err)
+		} else {
+			log.Printf("[INFO] Found %d wordlist families in %s.\n", families, time.Since(start).Round(time.Millisecond))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// listWordlistFamilies returns the stored families, the most recently active first.
+func listWordlistFamilies(db *sql.DB) ([]WordlistFamily, error) {
+	rows, err := db.Query(`SELECT "id", "sources", "credentials", "attacks", "similarity", "first_seen", "last_seen"
+		FROM "_wordlist_families"
+		ORDER BY "last_seen" DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("could not query wordlist families: %w", err)
+	}
+	defer rows.Close()
+
+	var families []WordlistFamily
+	for rows.Next() {
+		var family WordlistFamily
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&family.ID, &family.Sources, &family.Credentials, &family.Attacks, &family.Similarity, &firstSeen, &lastSeen); err != nil {
+			return nil, fmt.Errorf("could not scan wordlist family: %w", err)
+		}
+		family.FirstSeen = time.UnixMilli(firstSeen).In(reportLocation())
+		family.LastSeen = time.UnixMilli(lastSeen).In(reportLocation())
+		families = append(families, family)
+	}
+	return families, rows.Err()
+}
+
+func printWordlistFamilies(families []WordlistFamily) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FAMILY\tSOURCES\tCREDENTIALS\tATTACKS\tSIMILARITY\tFIRST SEEN\tLAST SEEN")
+	for _, family := range families {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%.2f\t%s\t%s\n", family.ID, family.Sources, family.Credentials, family.Attacks,
+			family.Similarity, family.FirstSeen.Format(time.DateTime), family.LastSeen.Format(time.DateTime))
+	}
+	w.Flush()
+	fmt.Printf("%d wordlist families.\n", len(families))
+}
+
+// printWordlistFamily prints the sources and the representative credentials of a family.
+// The credentials the redaction policy withholds are replaced.
+func printWordlistFamily(db *sql.DB, family int64) error {
+	rows, err := db.Query(`SELECT "source_ip", "credentials", "attacks", "first_seen", "last_seen"
+		FROM "view_wordlist_family_sources"
+		WHERE "family" = ?`, family)
+	if err != nil {
+		return fmt.Errorf("could not query wordlist family: %w", err)
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE IP\tCREDENTIALS\tATTACKS\tFIRST SEEN\tLAST SEEN")
+	sources := 0
+	for rows.Next() {
+		var sourceIP, firstSeen, lastSeen string
+		var credentials, attacks int
+		if err := rows.Scan(&sourceIP, &credentials, &attacks, &firstSeen, &lastSeen); err != nil {
+			return fmt.Errorf("could not scan wordlist family source: %w", err)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", logSafe(sourceIP), credentials, attacks, firstSeen, lastSeen)
+		sources++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not read wordlist family: %w", err)
+	}
+	if sources == 0 {
+		return fmt.Errorf("unknown wordlist family %d", family)
+	}
+	w.Flush()
+	fmt.Println()
+
+	rows, err = db.Query(`SELECT "rank", "username", "password", "sources"
+		FROM "view_wordlist_family_credentials"
+		WHERE "family" = ?`, family)
+	if err != nil {
+		return fmt.Errorf("could not query wordlist family credentials: %w", err)
+	}
+	defer rows.Close()
+
+	fmt.Fprintln(w, "RANK\tUSERNAME\tPASSWORD\tSOURCES")
+	for rows.Next() {
+		var rank, users int
+		var username, password string
+		if err := rows.Scan(&rank, &username, &password, &users); err != nil {
+			return fmt.Errorf("could not scan wordlist family credential: %w", err)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\n", rank, logSafe(appConfig.Redaction.username(username)), logSafe(appConfig.Redaction.password(password)), users)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not read wordlist family credentials: %w", err)
+	}
+	w.Flush()
+	return nil
+}
+
+func runWordlistsCommand(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: wordlists [rebuild|FAMILY]")
+	}
+
+	if err := openDB(appConfig.DatabasePath); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if len(args) == 1 && args[0] != "rebuild" {
+		family, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a wordlist family", args[0])
+		}
+		return printWordlistFamily(db, family)
+	}
+	if len(args) == 1 {
+		if _, err := rebuildWordlistFamilies(db, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	families, err := listWordlistFamilies(db)
+	if err != nil {
+		return err
+	}
+	printWordlistFamilies(families)
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// credentialSet returns the credentials of the given password ids, tried with the username id 1.
+func credentialSet(passwords ...int64) []wordlistCredential {
+	credentials := make([]wordlistCredential, len(passwords))
+	for i, password := range passwords {
+		credentials[i] = wordlistCredential{username: 1, password: password}
+	}
+	return credentials
+}
+
+func TestJaccard(t *testing.T) {
+	tests := []struct {
+		a, b []wordlistCredential
+		want float64
+	}{
+		{credentialSet(1, 2, 3), credentialSet(1, 2, 3), 1},
+		{credentialSet(1, 2, 3), credentialSet(4, 5), 0},
+		{credentialSet(1, 2, 3, 4), credentialSet(3, 4, 5, 6), 2.0 / 6},
+		{nil, credentialSet(1), 0},
+		{nil, nil, 0},
+		// Ids above 32 bits are different credentials.
+		{[]wordlistCredential{{1 << 32, 1}}, []wordlistCredential{{0, 1}}, 0},
+		{[]wordlistCredential{{1, 1 << 32}}, []wordlistCredential{{1, 0}}, 0},
+		{[]wordlistCredential{{1, 2}, {2, 1}}, []wordlistCredential{{2, 1}}, 0.5},
+	}
+	for _, test := range tests {
+		if got := jaccard(test.a, test.b); got != test.want {
+			t.Errorf("jaccard(%v, %v) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestClusterWordlistSourcesDoesNotChain(t *testing.T) {
+	sources := []*wordlistSource{
+		{sourceIP: 1, credentials: credentialSet(1, 2, 3, 4, 5, 6)},
+		{sourceIP: 2, credentials: credentialSet(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12)},
+		{sourceIP: 3, credentials: credentialSet(7, 8, 9, 10, 11, 12)},
+		{sourceIP: 4, credentials: credentialSet(1, 2, 3, 4, 5, 6, 7)},
+	}
+
+	// The second source is as similar to the first as to the third, but those have nothing in common.
+	clusters := clusterWordlistSources(sources, 0.5)
+	if len(clusters) != 1 {
+		t.Fatalf("got %d clusters, want 1", len(clusters))
+	}
+	var got []int64
+	for _, source := range clusters[0].sources {
+		got = append(got, source.sourceIP)
+	}
+	if fmt.Sprint(got) != "[1 2 4]" {
+		t.Errorf("got the sources %v, want [1 2 4]", got)
+	}
+	// The average of all three pairs, 6/7, 7/12 and 6/12.
+	if want := (6.0/7 + 7.0/12 + 6.0/12) / 3; math.Abs(clusters[0].similarity-want) > 1e-9 {
+		t.Errorf("got a similarity of %v, want %v", clusters[0].similarity, want)
+	}
+}
+
+func TestMinHashEstimatesJaccard(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for range 20 {
+		var a, b []wordlistCredential
+		for i := int64(1); i <= 200; i++ {
+			credential := wordlistCredential{username: i / 20, password: i}
+			switch rng.Intn(3) {
+			case 0:
+				a = append(a, credential)
+			case 1:
+				b = append(b, credential)
+			default:
+				a = append(a, credential)
+				b = append(b, credential)
+			}
+		}
+
+		signatureA, signatureB := minHash(a), minHash(b)
+		equal := 0
+		for i := range signatureA {
+			if signatureA[i] == signatureB[i] {
+				equal++
+			}
+		}
+		estimate := float64(equal) / minHashSize
+		if want := jaccard(a, b); math.Abs(estimate-want) > 0.15 {
+			t.Errorf("MinHash estimates %.2f, the Jaccard similarity is %.2f", estimate, want)
+		}
+	}
+}
+
+// wordlist returns n credentials of a wordlist with the given name.
+func wordlist(name string, n int) [][2]string {
+	credentials := make([][2]string, n)
+	for i := range credentials {
+		credentials[i] = [2]string{fmt.Sprintf("%s-user%d", name, i%4), fmt.Sprintf("%s-password%d", name, i)}
+	}
+	return credentials
+}
+
+// credentialAttacks returns an attack of the source for every credential, a minute apart from start on.
+func credentialAttacks(source string, credentials [][2]string, start time.Time) []*Attack {
+	attacks := make([]*Attack, len(credentials))
+	for i, credential := range credentials {
+		attacks[i] = newAttack(source, credential[0], credential[1], start.Add(time.Duration(i)*time.Minute))
+	}
+	return attacks
+}
+
+// saveWordlistAttacks saves two botnets with a wordlist each and sources that try a few common credentials.
+// The four sources of the first botnet each try most of its wordlist in a different order,
+// the three of the second try all of its wordlist and a credential of their own.
+func saveWordlistAttacks(t *testing.T, start time.Time) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(7))
+
+	first := wordlist("first", 30)
+	for i := range 4 {
+		tried := make([][2]string, len(first))
+		copy(tried, first)
+		rng.Shuffle(len(tried), func(a, b int) { tried[a], tried[b] = tried[b], tried[a] })
+		saveAttacks(t, credentialAttacks(fmt.Sprintf("198.51.100.%d", 10+i), tried[:24], start.Add(time.Duration(i)*time.Hour)))
+	}
+
+	for i := range 3 {
+		tried := append(wordlist("second", 20), [2]string{"root", "own" + strconv.Itoa(i)})
+		saveAttacks(t, credentialAttacks(fmt.Sprintf("198.51.100.%d", 20+i), tried, start.Add(time.Duration(i)*time.Hour)))
+	}
+
+	common := [][2]string{{"root", "123456"}, {"root", "root"}, {"admin", "admin"}, {"pi", "raspberry"}, {"ubuntu", "ubuntu"},
+		{"test", "test"}, {"oracle", "oracle"}, {"git", "git"}, {"user", "user"}, {"root", "password"}}
+	for i := range 5 {
+		tried := make([][2]string, len(common))
+		copy(tried, common)
+		rng.Shuffle(len(tried), func(a, b int) { tried[a], tried[b] = tried[b], tried[a] })
+		saveAttacks(t, credentialAttacks(fmt.Sprintf("198.51.100.%d", 30+i), tried[:5], start.Add(time.Duration(i)*time.Hour)))
+	}
+
+	// Too few credentials to tell anything about the wordlist.
+	saveAttacks(t, credentialAttacks("198.51.100.40", first[:3], start))
+}
+
+// familySources returns the source IPs of every stored family.
+func familySources(t *testing.T) map[string][]string {
+	t.Helper()
+
+	families := make(map[string][]string)
+	for _, row := range queryRows(t, `SELECT "family", "source_ip" FROM "view_wordlist_family_sources" ORDER BY "family", "source_ip"`) {
+		families[row[0]] = append(families[row[0]], row[1])
+	}
+	return families
+}
+
+func TestRebuildWordlistFamilies(t *testing.T) {
+	setupTest(t)
+	start := time.Now().Add(-72 * time.Hour).Truncate(time.Minute)
+	saveWordlistAttacks(t, start)
+
+	families, err := rebuildWordlistFamilies(db, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if families != 2 {
+		t.Errorf("got %d families, want 2", families)
+	}
+	want := map[string][]string{
+		"1": {"198.51.100.10", "198.51.100.11", "198.51.100.12", "198.51.100.13"},
+		"2": {"198.51.100.20", "198.51.100.21", "198.51.100.22"},
+	}
+	if got := familySources(t); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got families %v, want %v", got, want)
+	}
+
+	// The second botnet moves to new addresses and grows bigger than the first, it keeps its family.
+	for i := range 2 {
+		saveAttacks(t, credentialAttacks(fmt.Sprintf("198.51.100.%d", 50+i), wordlist("second", 20), start.Add(24*time.Hour)))
+	}
+	// A third botnet shows up.
+	for i := range 2 {
+		saveAttacks(t, credentialAttacks(fmt.Sprintf("198.51.100.%d", 60+i), wordlist("third", 10), start.Add(48*time.Hour)))
+	}
+	if _, err := rebuildWordlistFamilies(db, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	want["2"] = append(want["2"], "198.51.100.50", "198.51.100.51")
+	want["3"] = []string{"198.51.100.60", "198.51.100.61"}
+	if got := familySources(t); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got families %v, want %v", got, want)
+	}
+	if got := metricWordlistFamilies.Get(); got != 3 {
+		t.Errorf("got %v families in the metric, want 3", got)
+	}
+
+	// A stricter similarity splits the first botnet, whose sources only share most of the wordlist.
+	appConfig.WordlistSimilarity = 0.9
+	if _, err := rebuildWordlistFamilies(db, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	got := familySources(t)
+	if len(got) != 2 || fmt.Sprint(got["2"]) != fmt.Sprint(want["2"]) || fmt.Sprint(got["3"]) != fmt.Sprint(want["3"]) {
+		t.Errorf("got families %v with a similarity of 0.9, want the second and third", got)
+	}
+}
+
+func TestWordlistViews(t *testing.T) {
+	setupTest(t)
+	start := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	for i := range 2 {
+		saveAttacks(t, credentialAttacks(fmt.Sprintf("198.51.100.%d", 1+i), wordlist("only", 6), start.Add(time.Duration(i)*time.Hour)))
+	}
+	if _, err := rebuildWordlistFamilies(db, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	compareRows(t, queryRows(t, `SELECT * FROM "view_wordlist_families"`), [][]string{
+		{"1", "2", "6", "12", "1", "2025-03-10 12:00:00", "2025-03-10 13:05:00",
+			"only-user0 / only-password0, only-user0 / only-password4, only-user1 / only-password1, only-user1 / only-password5, only-user2 / only-password2"},
+	})
+	compareRows(t, queryRows(t, `SELECT * FROM "view_wordlist_family_sources"`), [][]string{
+		{"1", "198.51.100.1", "6", "6", "2025-03-10 12:00:00", "2025-03-10 12:05:00"},
+		{"1", "198.51.100.2", "6", "6", "2025-03-10 13:00:00", "2025-03-10 13:05:00"},
+	})
+	compareRows(t, queryRows(t, `SELECT * FROM "view_wordlist_family_credentials" WHERE "rank" IN (1, 6)`), [][]string{
+		{"1", "1", "only-user0", "only-password0", "2"},
+		{"1", "6", "only-user3", "only-password3", "2"},
+	})
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML the report files use into maps, slices and strings:
+// block mappings and sequences by indentation, plain, single- and double-quoted scalars,
+// literal (|) and folded (>) block scalars with their chomping indicators, empty [] and {}, and # comments.
+// Anchors, tags, multiple documents and other flow collections are not supported.
+// Every scalar is a string, so `default: 20` and `default: "20"` are the same.
+func parseYAML(data string) (any, error) {
+	p := &yamlParser{lines: strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")}
+	if p.next() && strings.TrimSpace(p.peek()) == "---" {
+		p.pos++
+	}
+	if !p.next() {
+		return map[string]any{}, nil
+	}
+	value, err := p.node(p.indent())
+	if err != nil {
+		return nil, err
+	}
+	if p.next() {
+		return nil, p.errorf("unexpected content")
+	}
+	return value, nil
+}
+
+type yamlParser struct {
+	lines []string
+	pos   int
+}
+
+func (p *yamlParser) peek() string {
+	if p.pos < len(p.lines) {
+		return p.lines[p.pos]
+	}
+	return ""
+}
+
+// next skips blank and comment lines and reports whether a line is left.
+func (p *yamlParser) next() bool {
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := strings.TrimSpace(p.lines[p.pos])
+		if line != "" && !strings.HasPrefix(line, "#") && line != "..." {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *yamlParser) indent() int {
+	line := p.peek()
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// content is the current line without its indentation.
+func (p *yamlParser) content() string {
+	return strings.TrimLeft(p.peek(), " ")
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// node parses the mapping or sequence at the current line, which is indented by indent.
+func (p *yamlParser) node(indent int) (any, error) {
+	if strings.HasPrefix(p.content(), "\t") {
+		return nil, p.errorf("tabs are not allowed for indentation")
+	}
+	if isYAMLSequenceItem(p.content()) {
+		return p.sequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(p.content()); ok {
+		return p.mapping(indent)
+	}
+	return nil, p.errorf("expected a mapping or a sequence")
+}
+
+func isYAMLSequenceItem(content string) bool {
+	return content == "-" || strings.HasPrefix(content, "- ")
+}
+
+// splitYAMLKey splits "key: value" and "key:". A colon is only a separator if a space or the end of the line follows it.
+func splitYAMLKey(content string) (string, string, bool) {
+	if strings.HasPrefix(content, `"`) || strings.HasPrefix(content, "'") {
+		return "", "", false
+	}
+	for i := 0; i < len(content); i++ {
+		if content[i] == '#' && i > 0 && content[i-1] == ' ' {
+			return "", "", false
+		}
+		if content[i] == ':' && (i+1 == len(content) || content[i+1] == ' ') {
+			return strings.TrimSpace(content[:i]), strings.TrimSpace(content[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+	mapping := make(map[string]any)
+	for p.next() && p.indent() == indent && !isYAMLSequenceItem(p.content()) {
+		key, rest, ok := splitYAMLKey(p.content())
+		if !ok {
+			return nil, p.errorf("expected key: value")
+		}
+		if _, ok := mapping[key]; ok {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		value, err := p.value(indent, rest, true)
+		if err != nil {
+			return nil, err
+		}
+		mapping[key] = value
+	}
+	if p.next() && p.indent() > indent {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return mapping, nil
+}
+
+func (p *yamlParser) sequence(indent int) ([]any, error) {
+	sequence := []any{}
+	for p.next() && p.indent() == indent && isYAMLSequenceItem(p.content()) {
+		rest := strings.TrimSpace(strings.TrimPrefix(p.content(), "-"))
+		if _, _, ok := splitYAMLKey(rest); ok {
+			// The item is a mapping that starts on the line of the dash, continue as if the dash were a space.
+			itemIndent := indent + len(p.content()) - len(strings.TrimLeft(strings.TrimPrefix(p.content(), "-"), " "))
+			p.lines[p.pos] = strings.Repeat(" ", itemIndent) + rest
+			item, err := p.mapping(itemIndent)
+			if err != nil {
+				return nil, err
+			}
+			sequence = append(sequence, item)
+			continue
+		}
+		item, err := p.value(indent, rest, false)
+		if err != nil {
+			return nil, err
+		}
+		sequence = append(sequence, item)
+	}
+	if p.next() && p.indent() > indent {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return sequence, nil
+}
+
+// value parses what follows a key or a dash on the current line, and the nested lines below it.
+// A mapping value may be a sequence on the indentation of its key.
+func (p *yamlParser) value(indent int, rest string, inMapping bool) (any, error) {
+	switch {
+	case strings.HasPrefix(rest, "|") || strings.HasPrefix(rest, ">"):
+		return p.blockScalar(indent, rest)
+	case rest != "" && !strings.HasPrefix(rest, "#"):
+		value, err := parseYAMLScalar(rest)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		p.pos++
+		return value, nil
+	}
+
+	p.pos++
+	if !p.next() {
+		return "", nil
+	}
+	if p.indent() > indent || (inMapping && p.indent() == indent && isYAMLSequenceItem(p.content())) {
+		return p.node(p.indent())
+	}
+	return "", nil
+}
+
+// blockScalar reads the lines indented below the header, like | or >-, as one string.
+func (p *yamlParser) blockScalar(indent int, header string) (string, error) {
+	if i := strings.Index(header, " #"); i >= 0 {
+		header = header[:i]
+	}
+	header = strings.TrimSpace(header)
+	folded := header[0] == '>'
+	chomping := header[1:]
+	if chomping != "" && chomping != "-" && chomping != "+" {
+		return "", p.errorf("unsupported block scalar header %q", header)
+	}
+	p.pos++
+
+	var lines []string
+	blockIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		lineIndent := len(line) - len(strings.TrimLeft(line, " "))
+		if lineIndent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = lineIndent
+		}
+		if lineIndent < blockIndent {
+			return "", p.errorf("block scalar is less indented than its first line")
+		}
+		lines = append(lines, line[blockIndent:])
+	}
+
+	trailing := 0
+	for trailing < len(lines) && lines[len(lines)-1-trailing] == "" {
+		trailing++
+	}
+	lines = lines[:len(lines)-trailing]
+	if len(lines) == 0 {
+		return "", nil
+	}
+
+	var text string
+	if folded {
+		var b strings.Builder
+		for i, line := range lines {
+			// A blank line is a line break, a break between lines is a space unless one of them is more indented.
+			switch {
+			case i == 0, lines[i-1] == "" && line != "":
+			case line == "" || strings.HasPrefix(line, " ") || strings.HasPrefix(lines[i-1], " "):
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(' ')
+			}
+			b.WriteString(line)
+		}
+		text = b.String()
+	} else {
+		text = strings.Join(lines, "\n")
+	}
+
+	switch chomping {
+	case "-":
+		return text, nil
+	case "+":
+		return text + strings.Repeat("\n", trailing+1), nil
+	}
+	return text + "\n", nil
+}
+
+// parseYAMLScalar parses a scalar on a single line.
+func parseYAMLScalar(s string) (any, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid double-quoted string %s", s)
+		}
+		if err := checkYAMLComment(s[len(quoted):]); err != nil {
+			return nil, err
+		}
+		return strconv.Unquote(quoted)
+	case strings.HasPrefix(s, "'"):
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				b.WriteByte(s[i])
+				continue
+			}
+			if i+1 < len(s) && s[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+				continue
+			}
+			if err := checkYAMLComment(s[i+1:]); err != nil {
+				return nil, err
+			}
+			return b.String(), nil
+		}
+		return nil, fmt.Errorf("unterminated single-quoted string %s", s)
+	}
+
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimSpace(s)
+	switch s {
+	case "":
+		return "", nil
+	case "[]":
+		return []any{}, nil
+	case "{}":
+		return map[string]any{}, nil
+	}
+	if strings.ContainsAny(s[:1], "[{&*!%@`") {
+		return nil, fmt.Errorf("unsupported value %s, quote it", s)
+	}
+	return s, nil
+}
+
+// checkYAMLComment checks that only a comment follows a quoted string.
+func checkYAMLComment(rest string) error {
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected %s after the quoted string", rest)
+	}
+	return nil
+}